@@ -0,0 +1,203 @@
+package main
+
+/*
+This file serves the readings over a small REST API when apiListen is set in the config, so local dashboards and
+scripts can query the stations without touching Google Sheets. The newest apiHistorySize readings of every station
+are kept in memory, and the endpoints return them as JSON in the same shape as the webhook bodies:
+  - /api/current returns the newest reading of every station.
+  - /api/history returns the readings held since a time, oldest first. since is an RFC 3339 time, a dateutc in
+    milliseconds, or a duration back from now such as 6h, and defaults to every reading held.
+
+Both endpoints take a station parameter, the MAC Address or name of a station, to return only that station's
+readings. The readings held are those passed to writeRows, whether or not they were written to the outputs, and are
+lost when the program stops.
+*/
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	APIHISTORYSIZE = 2016 //Readings of each station held by default, a week of 5 minute readings
+)
+
+var (
+	recentMutex    sync.Mutex
+	recentReadings = make(map[string]*readingRing) //Readings held for the API, by station MAC Address
+)
+
+/*
+readingRing is a struct that holds the newest readings of a station in a fixed-size ring buffer. start is the index of
+the oldest reading once the buffer is full.
+*/
+type readingRing struct {
+	station  Station
+	readings []DeviceData
+	start    int
+}
+
+/*
+Adds a reading to the ring, replacing the oldest reading once the ring is full. The ring holds at least one reading
+whatever apiHistorySize is.
+*/
+func (ring *readingRing) add(data DeviceData) {
+	if len(ring.readings) < max(config.HistorySize, 1) {
+		ring.readings = append(ring.readings, data)
+		return
+	}
+	ring.readings[ring.start] = data
+	ring.start = (ring.start + 1) % len(ring.readings)
+}
+
+/*
+Returns the readings of the ring after the given dateutc, oldest first.
+*/
+func (ring *readingRing) since(dateUTC int64) []DeviceData {
+	var readings []DeviceData
+	for i := range ring.readings {
+		if data := ring.readings[(ring.start+i)%len(ring.readings)]; data.DateUTC > dateUTC {
+			readings = append(readings, data)
+		}
+	}
+	return readings
+}
+
+/*
+Returns the newest reading of the ring, reporting false if the ring is empty.
+*/
+func (ring *readingRing) newest() (DeviceData, bool) {
+	if len(ring.readings) == 0 {
+		return DeviceData{}, false
+	}
+	return ring.readings[(ring.start+len(ring.readings)-1)%len(ring.readings)], true
+}
+
+/*
+Holds a station's readings for the API, skipping any that are not newer than the newest reading held so the ring stays
+in time order. The readings must be sorted oldest first. Returns the readings that were added.
+*/
+func trackRecent(station Station, readings []DeviceData) []DeviceData {
+	if config.APIListen == "" {
+		return nil
+	}
+	recentMutex.Lock()
+	defer recentMutex.Unlock()
+	ring, exists := recentReadings[station.MacAddress]
+	if !exists {
+		ring = &readingRing{station: station}
+		recentReadings[station.MacAddress] = ring
+	}
+	var added []DeviceData
+	for _, data := range readings {
+		if newest, held := ring.newest(); held && data.DateUTC <= newest.DateUTC {
+			continue
+		}
+		ring.add(data)
+		added = append(added, data)
+	}
+	return added
+}
+
+/*
+Registers the REST API endpoints on a server's handlers.
+*/
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/current", serveCurrent)
+	mux.HandleFunc("GET /api/history", serveHistory)
+	mux.HandleFunc("GET /ws", serveLive)
+}
+
+/*
+Writes the newest reading of every station, or of the requested station, ordered by station.
+*/
+func serveCurrent(w http.ResponseWriter, r *http.Request) {
+	body := []webhookReading{}
+	for _, ring := range requestedRings(r) {
+		if data, exists := ring.newest(); exists {
+			body = append(body, webhookBody(ring.station, data))
+		}
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+/*
+Writes the readings held since the requested time for every station, or for the requested station, ordered by station
+and then by time.
+*/
+func serveHistory(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	body := []webhookReading{}
+	for _, ring := range requestedRings(r) {
+		for _, data := range ring.since(since) {
+			body = append(body, webhookBody(ring.station, data))
+		}
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+/*
+Returns a copy of the rings of every station, or of the station named by the request's station parameter, ordered by
+station MAC Address. Copies are returned so the readings can be encoded without holding the lock.
+*/
+func requestedRings(r *http.Request) []readingRing {
+	requested := r.URL.Query().Get("station")
+	recentMutex.Lock()
+	defer recentMutex.Unlock()
+	var rings []readingRing
+	for _, ring := range recentReadings {
+		if requested != "" && !strings.EqualFold(ring.station.MacAddress, requested) &&
+			ring.station.displayName() != requested {
+			continue
+		}
+		rings = append(rings, readingRing{station: ring.station, readings: append([]DeviceData(nil), ring.readings...),
+			start: ring.start})
+	}
+	sort.Slice(rings, func(i, j int) bool {
+		return rings[i].station.MacAddress < rings[j].station.MacAddress
+	})
+	return rings
+}
+
+/*
+Parses the since parameter of a history request into a dateutc: an RFC 3339 time, a dateutc in milliseconds, or a
+duration back from now. An empty parameter returns 0, the start of every reading held.
+*/
+func parseSince(since string) (int64, error) {
+	if since == "" {
+		return 0, nil
+	}
+	if dateUTC, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return dateUTC, nil
+	}
+	if at, err := time.Parse(time.RFC3339, since); err == nil {
+		return at.UnixMilli(), nil
+	}
+	if ago, err := time.ParseDuration(since); err == nil && ago >= 0 {
+		return time.Now().Add(-ago).UnixMilli(), nil
+	}
+	return 0, errors.New("since must be an RFC 3339 time, a dateutc in milliseconds, or a duration such as 6h")
+}
+
+/*
+Writes a response body as JSON with the given status. Any origin may read the response, so dashboards served from
+elsewhere on the network can call the API.
+*/
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Debug("Unable to write the API response", "err", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+/*
+This file implements failover to a secondary Ambient Weather API Key. When the API rejects the primary key, because it
+was revoked (401/403) or is being rate limited (429), the request is sent again with the secondary key set as
+secondaryApiKey in the config and a warning is logged. The secondary key stays in use for an hour before the primary
+is tried again, so a revoked key doesn't cost a failed request on every poll.
+*/
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	FAILOVERPERIOD = time.Hour
+)
+
+var (
+	failoverMutex sync.Mutex
+	failoverUntil time.Time //The secondary API Key is used until this time
+)
+
+/*
+Returns the API Key requests should currently be made with, the secondary key for an hour after the primary key was
+rejected and the primary key otherwise.
+*/
+func activeAPIKey() string {
+	failoverMutex.Lock()
+	defer failoverMutex.Unlock()
+	if config.SecondaryAPIKey != "" && time.Now().Before(failoverUntil) {
+		return config.SecondaryAPIKey
+	}
+	return config.APIKey
+}
+
+/*
+Reports whether a response status means the API Key was rejected rather than the request failing.
+*/
+func isKeyRejected(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden ||
+		statusCode == http.StatusTooManyRequests
+}
+
+/*
+Returns the given request URL with the primary API Key replaced by the secondary key and switches to the secondary key
+for the next hour. Reports false if no secondary key is configured or the request didn't use the primary key.
+*/
+func failoverURL(completeURL string, statusCode int) (string, bool) {
+	if config.SecondaryAPIKey == "" {
+		return "", false
+	}
+	parsed, err := url.Parse(completeURL)
+	if err != nil {
+		return "", false
+	}
+	query := parsed.Query()
+	if query.Get("apiKey") != config.APIKey {
+		return "", false
+	}
+	query.Set("apiKey", config.SecondaryAPIKey)
+	parsed.RawQuery = query.Encode()
+
+	failoverMutex.Lock()
+	failoverUntil = time.Now().Add(FAILOVERPERIOD)
+	failoverMutex.Unlock()
+
+	slog.Warn("Primary API Key rejected with status " + strconv.Itoa(statusCode) +
+		", failing over to the secondary API Key for " + FAILOVERPERIOD.String())
+	return parsed.String(), true
+}
@@ -0,0 +1,91 @@
+package main
+
+/*
+This file computes the US EPA Air Quality Index from the particulate readings of the outdoor PM2.5 sensor, the indoor
+PM2.5 sensor, and the AQIN indoor air quality monitor. The AQI of the outdoor sensor is added as the aqiPM25 and
+aqiPM25_24h fields, since the API only reports the concentration, and the AQI fields of the indoor sensors are filled
+in from their concentrations when the station doesn't report them. Values use the breakpoints of the EPA's 2024 PM2.5
+standard.
+*/
+import (
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"math"
+)
+
+/*
+aqiBreakpoint is a struct that holds one category of the AQI scale: the range of concentrations in µg/m³ and the range
+of index values it maps to.
+*/
+type aqiBreakpoint struct {
+	concentrationLow  float64
+	concentrationHigh float64
+	indexLow          float64
+	indexHigh         float64
+}
+
+/*
+aqiSource is a struct that holds the AQI field computed from a concentration field, along with the breakpoints of the
+pollutant and the number of decimal places the EPA truncates its concentration to.
+*/
+type aqiSource struct {
+	index         string
+	concentration string
+	breakpoints   []aqiBreakpoint
+	decimals      int
+}
+
+var (
+	pm25Breakpoints = []aqiBreakpoint{
+		{0, 9.0, 0, 50}, {9.1, 35.4, 51, 100}, {35.5, 55.4, 101, 150}, {55.5, 125.4, 151, 200},
+		{125.5, 225.4, 201, 300}, {225.5, 325.4, 301, 500},
+	}
+	pm10Breakpoints = []aqiBreakpoint{
+		{0, 54, 0, 50}, {55, 154, 51, 100}, {155, 254, 101, 150}, {255, 354, 151, 200}, {355, 424, 201, 300},
+		{425, 604, 301, 500},
+	}
+	aqiSources = []aqiSource{
+		{"aqiPM25", "pm25", pm25Breakpoints, 1},
+		{"aqiPM25_24h", "pm25_24h", pm25Breakpoints, 1},
+		{"aqi_pm25_in", "pm25_in", pm25Breakpoints, 1},
+		{"aqi_pm25_in_24h", "pm25_in_24h", pm25Breakpoints, 1},
+		{"aqi_pm25_aqin", "pm25_in_aqin", pm25Breakpoints, 1},
+		{"aqi_pm25_24h_aqin", "pm25_in_24h_aqin", pm25Breakpoints, 1},
+		{"aqi_pm10_aqin", "pm10_in_aqin", pm10Breakpoints, 0},
+		{"aqi_pm10_24h_aqin", "pm10_in_24h_aqin", pm10Breakpoints, 0},
+	}
+)
+
+/*
+Returns the record with the AQI of every particulate reading it holds added. AQI values the station reported itself
+are kept.
+*/
+func withAirQuality(data DeviceData) DeviceData {
+	for _, source := range aqiSources {
+		value, exists := data.Fields[source.concentration]
+		if !exists {
+			continue
+		}
+		concentration, ok := ambient.ToFloat(value)
+		if !ok {
+			continue
+		}
+		setDerived(&data, source.index, usAQI(concentration, source.breakpoints, source.decimals), nil)
+	}
+	return data
+}
+
+/*
+Returns the AQI for a concentration in µg/m³, truncated to the given number of decimal places as the EPA specifies,
+by interpolating linearly within its category. Concentrations beyond the last category are reported as 500.
+*/
+func usAQI(concentration float64, breakpoints []aqiBreakpoint, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	concentration = math.Trunc(math.Max(0, concentration)*scale) / scale
+	for _, category := range breakpoints {
+		if concentration <= category.concentrationHigh {
+			return math.Round(category.indexLow + (category.indexHigh-category.indexLow)*
+				(concentration-category.concentrationLow)/(category.concentrationHigh-category.concentrationLow))
+		}
+	}
+	return 500
+}
@@ -0,0 +1,91 @@
+package main
+
+/*
+This file sends alerts that can't wait for someone to look at the sheet or the logs. When alertUrl is configured each
+alert is POSTed to it as a JSON object with the event, station, message, and time, which works with ntfy, Home
+Assistant webhooks, and most chat webhook relays. Alerts are sent in the background with a few quick retries so a slow
+endpoint never delays the poll that raised them.
+*/
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ALERTATTEMPTS = 3
+)
+
+var (
+	alertClient = &http.Client{Transport: sharedTransport, Timeout: 10 * time.Second}
+)
+
+/*
+alert is a struct that holds the JSON body POSTed to the alert URL.
+*/
+type alert struct {
+	Event   string    `json:"event"`
+	Station string    `json:"station"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+/*
+Sends an alert for the station to the configured alert URL in the background. Does nothing if no alert URL is
+configured, the event is always logged by the caller.
+*/
+func sendAlert(ctx context.Context, event string, station Station, message string, observed time.Time) {
+	if config.AlertURL == "" {
+		return
+	}
+	body, err := json.Marshal(alert{Event: event, Station: station.displayName(), Message: message, Time: observed})
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to encode alert", "event", event, "err", err)
+		return
+	}
+
+	go func() {
+		for attempt := 1; attempt <= ALERTATTEMPTS; attempt++ {
+			err = postAlert(context.WithoutCancel(ctx), body)
+			if err == nil {
+				return
+			}
+			slog.WarnContext(ctx, "Unable to send alert, attempt "+strconv.Itoa(attempt), "event", event, "err", err)
+			time.Sleep(time.Duration(attempt) * 5 * time.Second)
+		}
+		slog.ErrorContext(ctx, "Giving up on sending alert", "event", event, "station", station.displayName())
+	}()
+}
+
+/*
+POSTs an encoded alert to the alert URL and returns an error if the request fails or isn't accepted.
+*/
+func postAlert(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.AlertURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			return
+		}
+	}(resp.Body)
+	if resp.StatusCode >= 300 {
+		return errors.New("alert URL answered " + resp.Status)
+	}
+	return nil
+}
@@ -2,51 +2,134 @@ package main
 
 /*
 The AmbientWeatherAPI program provides a way to interact with the Ambient Weather API by making HTTP requests to
-retrieve data from specific weather stations. The program handles the construction and execution of said API
-requests, manages retries in case of errors, and logs the process for monitoring and debugging purposes.
+retrieve data from specific weather stations. The requests are built and decoded by the ambient package, and the
+program handles their execution, manages retries in case of errors, and logs the process for monitoring and debugging
+purposes.
 */
 import (
+	"context"
+	"errors"
+	"github.com/ryanwlin/GoAmbient/ambient"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
 	"strconv"
 	"time"
 )
 
 const (
-	URLBASE = "https://api.ambientweather.net/v1/devices/"
+	BACKOFFBASE      = 5 * time.Second
+	BACKOFFMAX       = 2 * time.Minute
+	RATELIMITBACKOFF = 30 * time.Second //First wait after a 429, the API is asking for fewer requests
+	GATEWAYBACKOFF   = 2 * time.Second  //First wait after a 502, 503, or 504, which usually pass within seconds
+
+	QUERYHISTORY  = "history"  //Query each station's device endpoint for every reading since the last one written
+	QUERYLASTDATA = "lastData" //Take each station's most recent reading from one call to the device list
+)
+
+/*
+The record and device types of the ambient package, used throughout the program under their own names.
+*/
+type (
+	DeviceData = ambient.DeviceData
+	Device     = ambient.Device
 )
 
 var (
-	completeURL string
+	maxRetryTime = 2 * time.Minute //Total time a request and its retries may take
 )
 
 /*
-The createURL function creates an HTTP URL to make API requests to the Ambient Weather API with the given API Key,
-App Key, and MAC Address for a station.
+Returns an ambient.Client for the given API Key that sends every request through executeRequest, so calls made with
+it get the program's retries, rate limiting, caching, key failover, and circuit breaker, and connects to the realtime
+API with the shared dialer and the program's request headers.
 */
-func createURL(macAddress string, apiKey string, appKey string) {
-	completeURL = URLBASE + macAddress + "?apiKey=" + apiKey + "&applicationKey=" +
-		appKey + "&limit=1&end_date=1723481785"
-	slog.Info("URL Created: " + completeURL)
-	return
+func ambientClientFor(apiKey string) *ambient.Client {
+	return &ambient.Client{
+		APIKey:         apiKey,
+		ApplicationKey: config.ApplicationKey,
+		Dialer:         realtimeDialer,
+		Header:         requestHeaders(),
+		Fetch: func(ctx context.Context, url string) (string, error) {
+			slog.InfoContext(ctx, "Requesting "+redact(url))
+			body := executeRequest(ctx, url, 0)
+			if body == "" {
+				return "", errors.New("API request resulted in empty values")
+			}
+			return body, nil
+		},
+	}
+}
+
+/*
+Retrieves the list of devices on the account of the configured API Key through the /v1/devices endpoint, including
+each device's name, MAC Address, location, and last reported data.
+*/
+func listDevices(ctx context.Context) ([]Device, error) {
+	return ambientClientFor(activeAPIKey()).ListDevices(ctx)
 }
 
 /*
 Executes the request to retrieve data for a given weather station, includes retry logic to manage errors and
 http statuses.
-- Sends an HTTP GET request to the specified `completeURL`.
+- On the first run, returns immediately if the circuit breaker is open, limits the request and all of its retries to
+the configured retry time, and reports the final outcome to the circuit breaker.
+- Waits for the shared rate limiter so the request stays within the API's per key limits.
+- Sends an HTTP GET request to the specified `completeURL` with the shared client and the given context, identifying
+the program with its User-Agent and any configured request headers.
 - If an error occurs during the request, it retries using the `retryAPICall` function.
 - Logs the HTTP response status for debugging purposes.
-- If the response status code is not 200 (OK), it retries using the `retryAPICall` function.
+- If the response status code is 304 (Not Modified), it returns the cached body of the previous response.
+- If the API Key was rejected and a secondary key is configured, it sends the request again with the secondary key.
+- If the response status code is 401 (Unauthorized) or 403 (Forbidden), it gives up immediately, since retrying with
+the same keys can't succeed.
+- If the response status code is not 200 (OK), it retries using `retryAPICall`, waiting longer after a 429 and only
+briefly after a 502, 503, or 504, and honoring Retry-After on 429 and 503.
 - Reads and processes the response body:
   - If an error occurs while reading the body, it retries using `retryAPICall`.
-  - Logs the response body and trims any unwanted characters before returning the processed data.
+  - Logs the response body, records it to the archive if enabled, and returns it for the ambient package to decode.
+
+The shared client times out hung connections, and the context aborts the request when the program shuts down.
 */
-func executeRequest(runs int) string {
-	resp, err := http.Get(completeURL)
+func executeRequest(ctx context.Context, completeURL string, runs int) (result string) {
+	if runs == 0 {
+		if !ambientBreaker.allow() {
+			slog.DebugContext(ctx, "Circuit breaker open, skipping API request")
+			return ""
+		}
+		parent := ctx
+		defer func() {
+			if parent.Err() == nil { //Requests cut short by shutdown say nothing about the API
+				ambientBreaker.record(result != "")
+			}
+		}()
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRetryTime)
+		defer cancel()
+	}
+
+	if !waitForRateLimit(ctx, completeURL) {
+		return ""
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, completeURL, nil)
 	if err != nil {
-		return retryAPICall(runs, "Error occurred when trying to execute API request: "+err.Error())
+		slog.ErrorContext(ctx, "Unable to create API request: "+err.Error())
+		return ""
+	}
+	applyRequestHeaders(req)
+	applyCacheHeaders(req, completeURL)
+
+	resp, err := ambientClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			slog.ErrorContext(ctx, "API request stopped: "+ctx.Err().Error())
+			return ""
+		}
+		return retryAPICall(ctx, completeURL, runs, 0,
+			"Error occurred when trying to execute API request: "+err.Error())
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
@@ -55,39 +138,119 @@ func executeRequest(runs int) string {
 		}
 	}(resp.Body)
 
-	slog.Info("Response Status:", "resp", resp.Status)
+	slog.InfoContext(ctx, "Response Status:", "resp", resp.Status)
+	if resp.StatusCode == http.StatusNotModified {
+		if body, exists := cachedBody(completeURL); exists {
+			slog.InfoContext(ctx, "Response not modified since the previous request, using cached response")
+			return body
+		}
+	}
+	if isKeyRejected(resp.StatusCode) {
+		if secondaryURL, ok := failoverURL(completeURL, resp.StatusCode); ok {
+			return executeRequest(ctx, secondaryURL, max(runs, 1)) //Continues with the remaining retries
+		}
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		slog.ErrorContext(ctx, "API Key or Application Key rejected with status "+strconv.Itoa(resp.StatusCode)+
+			", check your keys in "+configFile+". Not retrying")
+		return ""
+	}
 	if resp.StatusCode != http.StatusOK {
-		return retryAPICall(runs, "Error: Received error status code "+strconv.Itoa(resp.StatusCode))
+		wait := statusBackoff(resp.StatusCode, runs, parseRetryAfter(resp.Header.Get("Retry-After")))
+		return retryAPICall(ctx, completeURL, runs, wait,
+			"Error: Received error status code "+strconv.Itoa(resp.StatusCode))
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return retryAPICall(runs, "Error occurred when trying read response: "+err.Error())
+		return retryAPICall(ctx, completeURL, runs, 0, "Error occurred when trying read response: "+err.Error())
 	}
 
-	slog.Info(string(body))
-
-	data := string(body)
-	trimData := data[2 : len(data)-2]
+	slog.InfoContext(ctx, string(body))
+	storeResponse(completeURL, resp.Header, string(body))
+	recordResponse(completeURL, string(body))
 
-	return trimData
+	return string(body)
 }
 
 /*
 Handles Errors from the execute request, takes the error, number of runs performed, and a message.
 If runs of the function reach or exceed 3 runs, then an error is logged, otherwise a warning is logged. Both the
-warning and error log the error message and a message about the function. The program will wait based on the number of
-runs starting from a 10-second wait to a 30-second wait. If an error is logged, the program returns a empty string
+warning and error log the error message and a message about the function. The program waits with exponential backoff
+and jitter, or for the given wait when the response status calls for its own (see statusBackoff). If the wait would
+run past the retry time for this request, an error is logged. If an error is logged, or the context is cancelled during
+the wait, the program returns a empty string
 */
-func retryAPICall(runs int, info string) string {
+func retryAPICall(ctx context.Context, completeURL string, runs int, statusWait time.Duration, info string) string {
 	if runs < 3 {
-		wait := 10 * runs
-		slog.Warn("Warning #" + strconv.Itoa(runs) + ". Error: " + info + " retrying after " +
-			strconv.Itoa(wait) + " second wait.")
-		time.Sleep(time.Duration(wait) * time.Second)
-		return executeRequest(runs + 1)
+		wait := backoff(BACKOFFBASE, runs)
+		if statusWait > 0 {
+			wait = statusWait
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			slog.ErrorContext(ctx, "Retry time exhausted: "+info+" returning back to caller method")
+			return ""
+		}
+
+		slog.WarnContext(ctx, "Warning #"+strconv.Itoa(runs)+". Error: "+info+" retrying after "+
+			wait.Round(time.Second).String()+" wait.")
+		if !sleepContext(ctx, wait) {
+			return ""
+		}
+		return executeRequest(ctx, completeURL, runs+1)
 	} else {
-		slog.Error("Error after 3 attempts: " + info + " returning back to caller method")
+		slog.ErrorContext(ctx, "Error after 3 attempts: "+info+" returning back to caller method")
 		return ""
 	}
 }
+
+/*
+Returns the wait before retry number runs+1 after the given error status. A 429 backs off from 30 seconds, or longer
+if the server asked for it, since retrying sooner only extends the rate limiting. A 502, 503, or 504 is usually a
+momentary gateway problem and is retried after 2 seconds, unless a 503 says how long to wait. Returns 0 for every
+other status so the default backoff is used.
+*/
+func statusBackoff(statusCode int, runs int, retryAfter time.Duration) time.Duration {
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return max(retryAfter, backoff(RATELIMITBACKOFF, runs))
+	case http.StatusServiceUnavailable:
+		if retryAfter > 0 {
+			return retryAfter
+		}
+		return backoff(GATEWAYBACKOFF, runs)
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return backoff(GATEWAYBACKOFF, runs)
+	}
+	return 0
+}
+
+/*
+Returns the wait before retry number runs+1: an exponential backoff starting at the given base and doubling each run
+up to 2 minutes, with jitter so that several clients failing together don't retry in lockstep. The wait is between
+half and all of the backoff.
+*/
+func backoff(base time.Duration, runs int) time.Duration {
+	wait := base << runs
+	if wait > BACKOFFMAX || wait <= 0 {
+		wait = BACKOFFMAX
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+/*
+Parses a Retry-After header, which is either a number of seconds or an HTTP date, into the duration to wait. Returns
+0 if the header is missing or can't be parsed.
+*/
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -0,0 +1,233 @@
+package main
+
+/*
+This file implements the backfill subcommand, which pulls historical data for every configured station from the Ambient
+Weather API and writes it into the sheets. The API returns at most 288 records per request, newest first, so the history
+is walked backwards one page at a time with end_date until the start of the requested range is reached. The records are
+then sorted into timestamp order and written in bulk. The same history walk heals the gap left when the program was
+down, from the last row in the sheet up to now, every time the program starts.
+*/
+import (
+	"context"
+	"errors"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	DATEFORMAT = "2006-01-02"
+)
+
+var (
+	backfillFrom = ""
+	backfillTo   = ""
+)
+
+/*
+Runs the backfill for every configured station between the given dates and returns the exit code for the program, 0
+if every station was backfilled and 1 otherwise. Both dates are inclusive and in the configured timezone, an empty
+end date means today.
+*/
+func runBackfill(ctx context.Context, fromDate string, toDate string) int {
+	from, to, err := parseDateRange(fromDate, toDate)
+	if err != nil {
+		slog.Error("Invalid backfill range", "err", err)
+		return 1
+	}
+
+	if !initialize(ctx) {
+		return 1
+	}
+
+	exitCode := 0
+	for _, station := range config.Stations {
+		ctx := withCorrelationID(ctx)
+		slog.InfoContext(ctx, "Backfilling station", "station", station.displayName(), "from", from, "to", to)
+		readings, err := fetchHistory(ctx, station, from, to)
+		readings = validReadings(ctx, station, readings)
+		if err != nil {
+			slog.ErrorContext(ctx, "Backfill incomplete, writing the records retrieved so far",
+				"station", station.displayName(), "err", err)
+			exitCode = 1
+		}
+		if len(readings) == 0 {
+			slog.WarnContext(ctx, "No records found to backfill", "station", station.displayName())
+			continue
+		}
+
+		if !writeRows(ctx, station, readings) {
+			slog.ErrorContext(ctx, "Backfilled records were not all persisted", "station", station.displayName())
+			exitCode = 1
+			continue
+		}
+		slog.InfoContext(ctx, "Backfilled "+strconv.Itoa(len(readings))+" records", "station", station.displayName())
+	}
+	if !flushSinks(context.WithoutCancel(ctx)) {
+		exitCode = 1
+	}
+	return exitCode
+}
+
+/*
+Finds the last reading stored in the sheet, or recorded in the state file if that is newer, for each of the given
+stations and, if the station has reported since then beyond the next poll, fetches the missing interval from the
+history API and writes it before normal polling resumes. The last stored reading also seeds the readings already
+written, so nothing in the sheet is written again.
+*/
+func healGaps(ctx context.Context, stations []Station) {
+	for _, station := range stations {
+		ctx := withCorrelationID(ctx)
+		last, exists := lastSheetReading(station)
+		if stored, known := stateLastWritten(station.MacAddress); known && (!exists || stored > last) {
+			last, exists = stored, true
+		}
+		if !exists {
+			slog.Info("No stored readings found, skipping gap detection", "station", station.displayName())
+			continue
+		}
+		lastObservedMutex.Lock()
+		lastObserved[station.MacAddress] = max(lastObserved[station.MacAddress], last)
+		lastObservedMutex.Unlock()
+
+		since := time.UnixMilli(last)
+		if time.Since(since) < 10*time.Minute {
+			continue
+		}
+		slog.WarnContext(ctx, "Gap detected since the last stored reading, backfilling",
+			"station", station.displayName(), "lastStored", since)
+
+		readings, err := fetchHistory(ctx, station, since.Add(time.Millisecond), time.Now())
+		if err != nil {
+			slog.ErrorContext(ctx, "Gap backfill incomplete, writing the records retrieved so far",
+				"station", station.displayName(), "err", err)
+		}
+		readings = validReadings(ctx, station, readings)
+		if len(readings) == 0 {
+			continue
+		}
+		readings = newReadings(ctx, station, readings)
+		if len(readings) == 0 {
+			continue
+		}
+		if !writeRows(ctx, station, readings) {
+			slog.ErrorContext(ctx, "Gap was not filled, retrying it on the next poll", "station", station.displayName())
+			continue
+		}
+		markPersisted(station, readings)
+		slog.InfoContext(ctx, "Filled gap with "+strconv.Itoa(len(readings))+" records",
+			"station", station.displayName())
+	}
+	saveState()
+}
+
+/*
+Returns the dateutc of the last reading stored for a station, read from the dateutc column of the current period's
+sheet or, early in the period, the previous period's. Reports false if dateutc is not mapped to a column or no reading
+is found.
+*/
+func lastSheetReading(station Station) (int64, bool) {
+	sensor, exists := allSensors["dateutc"]
+	if !exists || service == nil {
+		return 0, false
+	}
+
+	now := time.Now().In(location)
+	for _, period := range []time.Time{now, previousPeriod(now)} {
+		name := sheetTitle(station, period)
+		ctx, exists := yearlyContext(context.Background(), period.Year(), false)
+		if !exists {
+			continue
+		}
+		resp, err := service.Spreadsheets.Values.Get(spreadsheetFor(ctx), quoteSheetName(name)+"!"+sensor.ID+":"+
+			sensor.ID).ValueRenderOption("UNFORMATTED_VALUE").Do()
+		if err != nil {
+			slog.Debug("Unable to read stored readings", "sheet", name, "err", err)
+			continue
+		}
+		for i := len(resp.Values) - 1; i >= 0; i-- {
+			if len(resp.Values[i]) == 0 {
+				continue
+			}
+			if dateUTC, ok := ambient.ToFloat(resp.Values[i][0]); ok && dateUTC > 0 {
+				return int64(dateUTC), true
+			}
+		}
+	}
+	return 0, false
+}
+
+/*
+Parses the start and end dates of a range given as YYYY-MM-DD. The returned end time is midnight after the end date
+so that the whole end day is included.
+*/
+func parseDateRange(fromDate string, toDate string) (time.Time, time.Time, error) {
+	if fromDate == "" {
+		return time.Time{}, time.Time{}, errors.New("-from is required")
+	}
+	from, err := time.ParseInLocation(DATEFORMAT, fromDate, location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	to := time.Now().In(location)
+	if toDate != "" {
+		to, err = time.ParseInLocation(DATEFORMAT, toDate, location)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	to = time.Date(to.Year(), to.Month(), to.Day()+1, 0, 0, 0, 0, location)
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("-from must not be after -to")
+	}
+	return from, to, nil
+}
+
+/*
+Retrieves every record a station reported from the start time up to (but not including) the end time, sorted oldest
+first, through the paginated History iterator of the ambient package, with executeRequest keeping the requests within
+the API's rate limit. The records retrieved so far are returned along with an error if a page can't be retrieved.
+*/
+func fetchHistory(ctx context.Context, station Station, from time.Time, to time.Time) ([]DeviceData, error) {
+	var readings []DeviceData
+	for data, err := range ambientClientFor(activeAPIKey()).History(ctx, station.MacAddress, from, to) {
+		if err != nil {
+			return sortByTime(readings), err
+		}
+		readings = append(readings, data)
+	}
+	slog.Info("Retrieved history", "station", station.displayName(), "records", len(readings))
+	return sortByTime(readings), nil
+}
+
+/*
+Sorts DeviceData records by their observation time, oldest first.
+*/
+func sortByTime(readings []DeviceData) []DeviceData {
+	sort.Slice(readings, func(i, j int) bool {
+		return readings[i].DateUTC < readings[j].DateUTC
+	})
+	return readings
+}
+
+/*
+Sorts DeviceData records by their observation time, oldest first, keeping only the last of records with the same
+dateutc, such as a reading both queued for an output and fetched again for it.
+*/
+func uniqueByTime(readings []DeviceData) []DeviceData {
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readings[i].DateUTC < readings[j].DateUTC
+	})
+	unique := readings[:0]
+	for i, data := range readings {
+		if i+1 < len(readings) && readings[i+1].DateUTC == data.DateUTC {
+			continue
+		}
+		unique = append(unique, data)
+	}
+	return unique
+}
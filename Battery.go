@@ -0,0 +1,85 @@
+package main
+
+/*
+This file monitors the battery indicators a station reports for itself and each of its sensors. The state of every
+battery is tracked between readings, and a battery_low event is logged when one goes low so the battery can be
+replaced before the sensor drops out and leaves a gap in the data, and a battery_ok event once it has been replaced.
+Most indicators report 1 for OK and 0 for low, the lightning and leak detectors report the opposite.
+*/
+import (
+	"context"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+var (
+	batteryMutex sync.Mutex
+	batteryLow   = make(map[string]map[string]bool) //Battery state of each indicator for each station MAC Address
+
+	invertedBatteries = map[string]bool{"batt_lightning": true} //Indicators that report 1 for low
+	batterySensors    = buildBatterySensors()
+)
+
+/*
+Builds the list of battery indicator fields, including every sensor of the numbered battery series.
+*/
+func buildBatterySensors() []string {
+	names := []string{"battout", "battin", "batt_co2", "batt_25", "batt_lightning", "batt_cellgateway"}
+
+	var data DeviceData
+	for _, series := range ambient.NumberedSensors {
+		switch series.Prefix {
+		case "batt", "battsm", "batleak":
+			for i := range series.Values(&data) {
+				names = append(names, series.Name(i+1))
+				if series.Prefix == "batleak" {
+					invertedBatteries[series.Name(i+1)] = true
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Checks the battery indicators of a station's readings, oldest first, and logs a battery_low event for every battery
+that goes low and a battery_ok event for every low battery that reports OK again. A battery that is already low the
+first time it is seen is reported as well.
+*/
+func trackBatteries(ctx context.Context, station Station, readings []DeviceData) {
+	batteryMutex.Lock()
+	defer batteryMutex.Unlock()
+
+	states, exists := batteryLow[station.MacAddress]
+	if !exists {
+		states = make(map[string]bool)
+		batteryLow[station.MacAddress] = states
+	}
+
+	for _, data := range readings {
+		for _, name := range batterySensors {
+			value, ok := ambient.ToFloat(data.Fields[name])
+			if !ok {
+				continue
+			}
+			low := value == 0
+			if invertedBatteries[name] {
+				low = value == 1
+			}
+
+			wasLow, seen := states[name]
+			states[name] = low
+			switch {
+			case low && !wasLow:
+				slog.WarnContext(ctx, "Battery is low, replace it to avoid losing data", "event", "battery_low",
+					"station", station.displayName(), "battery", name, "time", data.Time())
+			case !low && wasLow && seen:
+				slog.InfoContext(ctx, "Battery is OK again", "event", "battery_ok",
+					"station", station.displayName(), "battery", name, "time", data.Time())
+			}
+		}
+	}
+}
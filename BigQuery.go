@@ -0,0 +1,237 @@
+package main
+
+/*
+This file streams the readings into a BigQuery table when bigqueryDataset is set in the config, for long-term analytics.
+The table, bigqueryTable in the dataset of bigqueryProject, is created if it doesn't exist, partitioned by the day of
+dateutc, with the station's MAC Address and name, dateutc as a TIMESTAMP, and a FLOAT column for every sensor in the
+headers mapping. Columns for sensors added to the mapping later are added to the table the next time they are written.
+Values are written in their configured units, and each row's insert ID is the station and dateutc, so BigQuery drops
+rows written again on a best effort basis. The credentials are the same as for the Sheets API, with the BigQuery scope
+added, so an OAuth token saved before BigQuery was enabled must be deleted to grant it.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	BIGQUERYBATCH = 500 //Rows per streaming insert
+)
+
+var (
+	bigqueryService *bigquery.Service = nil
+	bigqueryColumns                   = make(map[string]bool) //Columns the table is known to have
+	bigqueryMutex   sync.Mutex
+	bigqueryInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+/*
+Streams the readings of a station into the BigQuery table, connecting and creating or extending the table first if
+needed. Returns an error unless every reading was inserted, and nil when no bigqueryDataset is configured. Rows
+BigQuery rejects are skipped, and the first rejection is returned once the other batches are inserted.
+*/
+func writeBigQuery(ctx context.Context, station Station, readings []DeviceData) error {
+	if config.BigQueryDataset == "" || len(readings) == 0 {
+		return nil
+	}
+	bigqueryMutex.Lock()
+	defer bigqueryMutex.Unlock()
+
+	if bigqueryService == nil {
+		client, err := getSheetsClient(googleContext(ctx))
+		if err == nil {
+			bigqueryService, err = bigquery.NewService(ctx, option.WithHTTPClient(client))
+		}
+		if err != nil {
+			return fmt.Errorf("unable to retrieve BigQuery client: %w", err)
+		}
+	}
+	if err := ensureBigQueryTable(ctx); err != nil {
+		return fmt.Errorf("unable to prepare the BigQuery table %s: %w", config.BigQueryTable, err)
+	}
+
+	var rejected error //First batch with rows BigQuery rejected, the other batches are still inserted
+	for start := 0; start < len(readings); start += BIGQUERYBATCH {
+		end := min(start+BIGQUERYBATCH, len(readings))
+		if err := insertBigQuery(ctx, station, readings[start:end]); err != nil {
+			err = fmt.Errorf("unable to insert the readings into the BigQuery table %s: %w", config.BigQueryTable, err)
+			if !isRejected(err) {
+				return err
+			} else if rejected == nil {
+				rejected = err
+			}
+		}
+	}
+	slog.InfoContext(ctx, "Inserted "+strconv.Itoa(len(readings))+" readings into BigQuery", "table",
+		config.BigQueryTable, "station", station.displayName())
+	return rejected
+}
+
+/*
+Creates the table if it doesn't exist, or adds columns for the mapped sensors the table doesn't have yet.
+*/
+func ensureBigQueryTable(ctx context.Context) error {
+	schema := bigquerySchema()
+	missing := false
+	for _, field := range schema.Fields {
+		missing = missing || !bigqueryColumns[field.Name]
+	}
+	if !missing {
+		return nil
+	}
+
+	table, err := bigqueryService.Tables.Get(config.BigQueryProject, config.BigQueryDataset, config.BigQueryTable).
+		Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		slog.InfoContext(ctx, "Creating the BigQuery table", "table", config.BigQueryTable)
+		table, err = bigqueryService.Tables.Insert(config.BigQueryProject, config.BigQueryDataset, &bigquery.Table{
+			TableReference: &bigquery.TableReference{ProjectId: config.BigQueryProject,
+				DatasetId: config.BigQueryDataset, TableId: config.BigQueryTable},
+			Schema:           schema,
+			TimePartitioning: &bigquery.TimePartitioning{Type: "DAY", Field: "dateutc"},
+		}).Context(ctx).Do()
+	}
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	var fields []*bigquery.TableFieldSchema
+	if table.Schema != nil {
+		fields = table.Schema.Fields
+	}
+	for _, field := range fields {
+		existing[field.Name] = true
+	}
+	var added []string
+	for _, field := range schema.Fields {
+		if !existing[field.Name] {
+			fields = append(fields, field)
+			added = append(added, field.Name)
+		}
+	}
+	if len(added) > 0 {
+		slog.InfoContext(ctx, "Adding columns to the BigQuery table", "table", config.BigQueryTable,
+			"columns", strings.Join(added, ", "))
+		_, err = bigqueryService.Tables.Patch(config.BigQueryProject, config.BigQueryDataset, config.BigQueryTable,
+			&bigquery.Table{Schema: &bigquery.TableSchema{Fields: fields}}).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+	}
+	for _, field := range fields {
+		bigqueryColumns[field.Name] = true
+	}
+	return nil
+}
+
+/*
+Returns the schema of the table: the station, its name, and dateutc, followed by a FLOAT column for every mapped
+sensor in order of the sensor names.
+*/
+func bigquerySchema() *bigquery.TableSchema {
+	fields := []*bigquery.TableFieldSchema{
+		{Name: "station", Type: "STRING", Mode: "REQUIRED", Description: "MAC Address of the station"},
+		{Name: "station_name", Type: "STRING", Mode: "NULLABLE"},
+		{Name: "dateutc", Type: "TIMESTAMP", Mode: "REQUIRED", Description: "Time the station observed the reading"},
+	}
+	names := make([]string, 0, len(allSensors))
+	for name := range allSensors {
+		if name != "date" && name != "dateutc" && !undiscoveredFields[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields = append(fields, &bigquery.TableFieldSchema{Name: bigqueryColumn(name), Type: "FLOAT",
+			Mode: "NULLABLE", Description: headerText(name, allSensors[name].Description)})
+	}
+	return &bigquery.TableSchema{Fields: fields}
+}
+
+/*
+Streams the rows of readings into the table and returns an error naming the first row BigQuery rejected. Invalid
+rows are skipped so the valid ones are still inserted, and reported as rejected for good. Any other row error is
+returned as is, so the batch is sent again, the insert IDs keeping the rows that did land from being duplicated.
+Values that aren't numbers, and sensors without a column, are left out.
+*/
+func insertBigQuery(ctx context.Context, station Station, readings []DeviceData) error {
+	rows := make([]*bigquery.TableDataInsertAllRequestRows, 0, len(readings))
+	for _, data := range readings {
+		if data.DateUTC <= 0 {
+			continue
+		}
+		row := map[string]bigquery.JsonValue{"station": station.MacAddress, "station_name": station.displayName(),
+			"dateutc": float64(data.DateUTC) / 1000}
+		for name, value := range data.Fields {
+			column := bigqueryColumn(name)
+			if !bigqueryColumns[column] || name == "dateutc" {
+				continue
+			}
+			switch typed := cellValue(convertField(name, value)).(type) {
+			case float64:
+				row[column] = typed
+			case bool:
+				row[column] = 0.0
+				if typed {
+					row[column] = 1.0
+				}
+			}
+		}
+		rows = append(rows, &bigquery.TableDataInsertAllRequestRows{
+			InsertId: station.MacAddress + "-" + strconv.FormatInt(data.DateUTC, 10), Json: row})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	request := &bigquery.TableDataInsertAllRequest{Rows: rows, IgnoreUnknownValues: true, SkipInvalidRows: true}
+	resp, err := bigqueryService.Tabledata.InsertAll(config.BigQueryProject, config.BigQueryDataset,
+		config.BigQueryTable, request).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return rejectStatus(apiErr.Code, err)
+	} else if err != nil {
+		return err
+	}
+	var rejected error //First row BigQuery found invalid, the other rows were inserted
+	for _, insertErr := range resp.InsertErrors {
+		for _, reason := range insertErr.Errors {
+			err := errors.New("row " + strconv.FormatInt(insertErr.Index, 10) + " was rejected: " + reason.Message)
+			if reason.Reason != "invalid" {
+				return err
+			}
+			if rejected == nil {
+				rejected = rejectedError{err: err}
+			}
+		}
+	}
+	if rejected != nil {
+		return rejected
+	}
+	return nil
+}
+
+/*
+Returns the name of a sensor's column, with the characters BigQuery doesn't allow replaced by underscores and an
+underscore added before a leading digit, e.g. _24hourrainin.
+*/
+func bigqueryColumn(name string) string {
+	column := bigqueryInvalid.ReplaceAllString(name, "_")
+	if column != "" && column[0] >= '0' && column[0] <= '9' {
+		column = "_" + column
+	}
+	return column
+}
@@ -0,0 +1,159 @@
+package main
+
+/*
+This file keeps the readings an output failed to write on disk as well as in its queue, when bufferDir is set in the
+config, so an output that is unreachable, such as the Google Sheet once errorHandler gives up on it, loses nothing
+when the program stops or crashes before it comes back. Each output with queued readings has a file of its own in
+bufferDir, e.g. sheets.jsonl, holding one queued reading per line as JSON with its station's MAC Address. The file is
+rewritten, through a temporary file, whenever the output's queue changes and removed once the queue is empty. The
+files are read when the program starts and the readings put back in their output's queue, which is written first
+the next time readings arrive, as if the program had never stopped. An empty bufferDir keeps the queues in memory.
+*/
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	BUFFERSUFFIX = ".jsonl"
+	BUFFERLINE   = 1 << 20 //Longest line read from a buffer file
+)
+
+/*
+bufferedReading is a struct that holds one line of a buffer file: the MAC Address of the station and every field of
+the reading as the API reported it.
+*/
+type bufferedReading struct {
+	MacAddress string                 `json:"macAddress"`
+	Reading    map[string]interface{} `json:"reading"`
+}
+
+/*
+Returns the path of an output's buffer file.
+*/
+func bufferPath(name string) string {
+	return filepath.Join(config.BufferDir, name+BUFFERSUFFIX)
+}
+
+/*
+Writes the readings queued for an output to its buffer file, or removes the file if nothing is queued. The caller
+must hold the queue's mutex. Failures are logged and the readings stay queued in memory.
+*/
+func saveBuffer(name string, queue *sinkQueue) {
+	if config.BufferDir == "" {
+		return
+	}
+	path := bufferPath(name)
+	if len(queue.pending) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Unable to remove the output's buffer file", "file", path, "err", err)
+		}
+		return
+	}
+	if err := os.MkdirAll(config.BufferDir, 0o755); err != nil {
+		slog.Warn("Unable to create the buffer directory", "dir", config.BufferDir, "err", err)
+		return
+	}
+
+	macAddresses := make([]string, 0, len(queue.pending))
+	for mac := range queue.pending {
+		macAddresses = append(macAddresses, mac)
+	}
+	sort.Strings(macAddresses)
+	var lines []byte
+	for _, mac := range macAddresses {
+		for _, data := range queue.pending[mac] {
+			fields := make(map[string]interface{}, len(data.Fields)+1)
+			for field, value := range data.Fields {
+				fields[field] = value
+			}
+			fields["dateutc"] = data.DateUTC
+			line, err := json.Marshal(bufferedReading{MacAddress: mac, Reading: fields})
+			if err != nil {
+				slog.Warn("Unable to encode a queued reading for the buffer", "sink", name, "err", err)
+				continue
+			}
+			lines = append(append(lines, line...), '\n')
+		}
+	}
+
+	temporary := path + ".tmp"
+	err := os.WriteFile(temporary, lines, 0o600)
+	if err == nil {
+		err = os.Rename(temporary, path)
+	}
+	if err != nil {
+		slog.Warn("Unable to write the output's buffer file", "file", path, "err", err)
+	}
+}
+
+/*
+Reads the buffer file of every output and queues its readings again, for the configured station with the same MAC
+Address, or a station with just the MAC Address if it is no longer configured. Unreadable lines are skipped.
+*/
+func loadBuffers() {
+	if config.BufferDir == "" {
+		return
+	}
+	stations := make(map[string]Station, len(config.Stations))
+	for _, station := range config.Stations {
+		stations[station.MacAddress] = station
+	}
+
+	for _, sink := range sinks {
+		path := bufferPath(sink.Name())
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			slog.Warn("Unable to read the output's buffer file", "file", path, "err", err)
+			continue
+		}
+
+		queue := queueFor(sink.Name())
+		queue.mutex.Lock()
+		loaded := 0
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), BUFFERLINE)
+		for scanner.Scan() {
+			var line struct {
+				MacAddress string          `json:"macAddress"`
+				Reading    json.RawMessage `json:"reading"`
+			}
+			var data DeviceData
+			err := json.Unmarshal(scanner.Bytes(), &line)
+			if err == nil {
+				err = json.Unmarshal(line.Reading, &data)
+			}
+			if err != nil || line.MacAddress == "" {
+				slog.Warn("Skipping unreadable line of the output's buffer file", "file", path, "err", err)
+				continue
+			}
+			station, exists := stations[line.MacAddress]
+			if !exists {
+				station = Station{MacAddress: line.MacAddress}
+			}
+			queue.stations[line.MacAddress] = station
+			queue.pending[line.MacAddress] = append(queue.pending[line.MacAddress], data)
+			loaded++
+		}
+		if err := scanner.Err(); err != nil {
+			slog.Warn("Unable to read all of the output's buffer file", "file", path, "err", err)
+		}
+		_ = file.Close()
+		for mac, pending := range queue.pending {
+			queue.pending[mac] = uniqueByTime(pending)
+		}
+		queue.mutex.Unlock()
+		if loaded > 0 {
+			slog.Info("Queued "+strconv.Itoa(loaded)+" buffered readings for output", "sink", sink.Name(),
+				"file", path)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+/*
+This file appends the readings to local CSV files when csvDir is set in the config. Each station gets one file per month
+in csvDir, named after the station and the month, e.g. Backyard-2026-07.csv, starting with the same header row as the
+sheet. The date columns hold the observation time in the configured timezone as text, so the files read the same in any
+program. Readings whose dateutc is already in a file are skipped, so restarts and backfills add no duplicate rows. Like
+the workbook, the files are written without a spreadsheetId.
+*/
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CSVMONTHFORMAT = "2006-01"
+	CSVTIMEFORMAT  = "2006-01-02 15:04:05"
+)
+
+var (
+	csvMutex sync.Mutex
+)
+
+/*
+Appends the readings of a station to the CSV files of their months, creating the directory and files if needed.
+Returns an error unless every reading is in the files, and nil when no csvDir is configured.
+*/
+func writeCSV(ctx context.Context, station Station, readings []DeviceData) error {
+	if config.CSVDir == "" || len(readings) == 0 {
+		return nil
+	}
+	csvMutex.Lock()
+	defer csvMutex.Unlock()
+
+	if err := os.MkdirAll(config.CSVDir, 0755); err != nil {
+		return fmt.Errorf("unable to create the CSV directory %s: %w", config.CSVDir, err)
+	}
+	groups := make(map[string][]DeviceData)
+	var paths []string
+	for _, data := range readings {
+		path := csvPath(station, data.Time())
+		if _, exists := groups[path]; !exists {
+			paths = append(paths, path)
+		}
+		groups[path] = append(groups[path], data)
+	}
+
+	for _, path := range paths {
+		written, err := appendCSV(path, groups[path])
+		if err != nil {
+			return fmt.Errorf("unable to append the readings to the CSV file %s: %w", path, err)
+		}
+		slog.InfoContext(ctx, "Appended "+strconv.Itoa(written)+" rows to the CSV file", "file", path)
+	}
+	return nil
+}
+
+/*
+Appends the rows of readings to a CSV file, writing the header row first if the file is new. Readings whose dateutc
+is already in the file are skipped. Returns the number of rows appended.
+*/
+func appendCSV(path string, readings []DeviceData) (int, error) {
+	written, err := csvWritten(path)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	writer := csv.NewWriter(file)
+	if written == nil {
+		err = writer.Write(csvRecord(sensorHeaders()))
+	}
+	appended := 0
+	for _, data := range readings {
+		if err != nil {
+			break
+		}
+		if data.DateUTC > 0 && written[data.DateUTC] {
+			continue
+		}
+		err = writer.Write(csvRecord(csvRow(data)))
+		appended++
+	}
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return appended, err
+}
+
+/*
+Reads the dateutc of every row in a CSV file. Returns nil if the file doesn't exist yet, and an empty index if dateutc
+isn't mapped to a column.
+*/
+func csvWritten(path string) (map[int64]bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	written := make(map[int64]bool)
+	sensor, mapped := allSensors["dateutc"]
+	if !mapped {
+		return written, nil
+	}
+	column := stringToNum(sensor.ID)
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1 //Files written before a sensor was discovered have shorter rows
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if column < len(record) {
+			if dateUTC, err := strconv.ParseInt(record[column], 10, 64); err == nil {
+				written[dateUTC] = true
+			}
+		}
+	}
+}
+
+/*
+Builds the CSV row of a reading, the sheet's row with the date columns written as text in the configured timezone.
+*/
+func csvRow(data DeviceData) []interface{} {
+	row := buildRow(data)
+	if sensor, exists := allSensors["date"]; exists && data.DateUTC > 0 {
+		if position := stringToNum(sensor.ID); position >= 0 && position < len(row) {
+			row[position] = data.Time().Format(CSVTIMEFORMAT)
+		}
+	}
+	if sensor, exists := allSensors["lightning_time"]; exists {
+		if strike, ok := data.LightningStrike(); ok {
+			if position := stringToNum(sensor.ID); position >= 0 && position < len(row) {
+				row[position] = strike.Format(CSVTIMEFORMAT)
+			}
+		}
+	}
+	return row
+}
+
+/*
+Converts a row into a CSV record, writing empty cells for missing values and numbers without exponents.
+*/
+func csvRecord(row []interface{}) []string {
+	record := make([]string, len(row))
+	for i, cell := range row {
+		switch value := cell.(type) {
+		case nil:
+		case float64:
+			record[i] = strconv.FormatFloat(value, 'f', -1, 64)
+		default:
+			record[i] = fmt.Sprint(value)
+		}
+	}
+	return record
+}
+
+/*
+Returns the path of a station's CSV file for the month of a time.
+*/
+func csvPath(station Station, observed time.Time) string {
+	name := strings.NewReplacer("/", "-", "\\", "-").Replace(station.displayName())
+	return filepath.Join(config.CSVDir, name+"-"+observed.Format(CSVMONTHFORMAT)+".csv")
+}
@@ -0,0 +1,116 @@
+package main
+
+/*
+This file adds charts to new station sheets so the readings can be seen without building charts by hand: the outdoor
+temperature over time and the rain each day. The daily rain is the largest dailyrainin of each day, since the station
+reports it as a running total that resets at midnight. The charts sit to the right of the data and cover whole columns,
+so they grow with the sheet as rows are appended. A chart is only added when the sheet has columns for its readings,
+and only when charts is set to true.
+*/
+import (
+	"google.golang.org/api/sheets/v4"
+)
+
+const (
+	CHARTWIDTH  = 800 //Pixels
+	CHARTHEIGHT = 400 //Pixels
+)
+
+/*
+chart is a struct that holds a chart added to new sheets: its title, the Sheets chart type, the sensors plotted
+against the observation date, and whether each day is plotted as the largest value of the day rather than every
+reading.
+*/
+type chart struct {
+	title     string
+	chartType string
+	sensors   []string
+	daily     bool
+}
+
+var (
+	sheetCharts = []chart{
+		{title: "Temperature", chartType: "LINE", sensors: []string{"tempf", "feelsLike", "dewPoint"}},
+		{title: "Daily Rainfall", chartType: "COLUMN", sensors: []string{"dailyrainin"}, daily: true},
+	}
+)
+
+/*
+Returns the requests that add the charts to a new sheet with the given ID and header row, stacked one above the other
+beside the last column. Sensors the sheet has no column for are left out of a chart, and a chart with none of its
+sensors, or a sheet without a date column, gets no chart.
+*/
+func chartRequests(sheetId int64, headers []interface{}) []*sheets.Request {
+	if !config.Charts {
+		return nil
+	}
+	dateColumn, exists := sensorColumn("date", headers)
+	if !exists {
+		return nil
+	}
+
+	var requests []*sheets.Request
+	for _, spec := range sheetCharts {
+		var series []*sheets.BasicChartSeries
+		for _, sensor := range spec.sensors {
+			if column, exists := sensorColumn(sensor, headers); exists {
+				data := columnData(sheetId, column)
+				if spec.daily {
+					data.AggregateType = "MAX"
+				}
+				series = append(series, &sheets.BasicChartSeries{Series: data, TargetAxis: "LEFT_AXIS"})
+			}
+		}
+		if len(series) == 0 {
+			continue
+		}
+		domain := columnData(sheetId, dateColumn)
+		if spec.daily {
+			domain.GroupRule = &sheets.ChartGroupRule{DateTimeRule: &sheets.ChartDateTimeRule{Type: "YEAR_MONTH_DAY"}}
+		}
+
+		requests = append(requests, &sheets.Request{
+			AddChart: &sheets.AddChartRequest{
+				Chart: &sheets.EmbeddedChart{
+					Spec: &sheets.ChartSpec{
+						Title: spec.title,
+						BasicChart: &sheets.BasicChartSpec{
+							ChartType:      spec.chartType,
+							LegendPosition: "BOTTOM_LEGEND",
+							HeaderCount:    1,
+							Domains:        []*sheets.BasicChartDomain{{Domain: domain}},
+							Series:         series,
+						},
+					},
+					Position: &sheets.EmbeddedObjectPosition{
+						OverlayPosition: &sheets.OverlayPosition{
+							AnchorCell: &sheets.GridCoordinate{
+								SheetId:     sheetId,
+								RowIndex:    int64(1 + len(requests)*CHARTHEIGHT/21), //Rows are 21 pixels tall
+								ColumnIndex: int64(len(headers) + 1),
+							},
+							WidthPixels:  CHARTWIDTH,
+							HeightPixels: CHARTHEIGHT,
+						},
+					},
+				},
+			},
+		})
+	}
+	return requests
+}
+
+/*
+Returns chart data covering the whole of a sheet's column, header included.
+*/
+func columnData(sheetId int64, column int) *sheets.ChartData {
+	return &sheets.ChartData{
+		SourceRange: &sheets.ChartSourceRange{
+			Sources: []*sheets.GridRange{{
+				SheetId:          sheetId,
+				StartColumnIndex: int64(column),
+				EndColumnIndex:   int64(column + 1),
+			}},
+		},
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+/*
+This file implements the circuit breaker around the Ambient Weather API. After a number of consecutive calls fail
+(each already retried by executeRequest), the circuit opens: a single error is logged and further calls return
+immediately instead of hammering an API that is down. Once the cooldown has passed, one call is let through as a probe;
+if it succeeds the circuit closes again, if it fails the circuit stays open for another cooldown.
+*/
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CIRCUITCLOSED = iota
+	CIRCUITOPEN
+	CIRCUITHALFOPEN
+)
+
+var (
+	ambientBreaker = &circuitBreaker{threshold: 5, cooldown: 5 * time.Minute}
+)
+
+/*
+circuitBreaker is a struct that tracks consecutive failures of the calls it guards and whether calls are currently
+allowed.
+*/
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	state     int
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+}
+
+/*
+Reports whether a call may be made. While the circuit is open calls are refused until the cooldown has passed, then a
+single probe call is allowed.
+*/
+func (breaker *circuitBreaker) allow() bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	switch breaker.state {
+	case CIRCUITOPEN:
+		if time.Since(breaker.openedAt) < breaker.cooldown {
+			return false
+		}
+		breaker.state = CIRCUITHALFOPEN
+		slog.Info("Probing the Ambient Weather API after circuit breaker cooldown")
+		return true
+	case CIRCUITHALFOPEN:
+		return false //A probe is already in flight
+	default:
+		return true
+	}
+}
+
+/*
+Records the outcome of a call that was allowed. A success closes the circuit, a failure counts towards the threshold
+or, for a probe, reopens the circuit for another cooldown.
+*/
+func (breaker *circuitBreaker) record(success bool) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if success {
+		if breaker.state != CIRCUITCLOSED {
+			slog.Info("Ambient Weather API recovered, circuit breaker closed")
+		}
+		breaker.state = CIRCUITCLOSED
+		breaker.failures = 0
+		return
+	}
+
+	breaker.failures++
+	switch {
+	case breaker.state == CIRCUITHALFOPEN:
+		breaker.state = CIRCUITOPEN
+		breaker.openedAt = time.Now()
+		slog.Debug("Ambient Weather API probe failed, circuit breaker remains open")
+	case breaker.failures >= breaker.threshold:
+		breaker.state = CIRCUITOPEN
+		breaker.openedAt = time.Now()
+		slog.Error("Ambient Weather API unavailable after " + strconv.Itoa(breaker.failures) +
+			" consecutive failed calls, circuit breaker open. Pausing calls and probing every " +
+			breaker.cooldown.String())
+	}
+}
+
+/*
+Reports whether the circuit is open or probing, i.e. failed calls are expected and already reported.
+*/
+func (breaker *circuitBreaker) isOpen() bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.state != CIRCUITCLOSED
+}
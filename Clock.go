@@ -0,0 +1,44 @@
+package main
+
+/*
+This file notices when the host wakes from suspend or its clock is changed, so the program catches up at once instead
+of waiting for its next scheduled call. Go's timers run on the monotonic clock, which stops while the host is
+suspended and ignores changes to the wall clock, so after a suspend the next call would come late and after a clock
+change it would come at the wrong time. The scheduler compares how far the wall clock and the monotonic clock have
+moved every CLOCKCHECK, and a difference of more than CLOCKJUMP means the host slept or the clock jumped.
+*/
+import (
+	"time"
+)
+
+const (
+	CLOCKCHECK = 30 * time.Second //How often the clocks are compared
+	CLOCKJUMP  = time.Minute      //Difference between the clocks taken as a suspend or a clock change
+)
+
+/*
+clockWatch is a struct that holds the time the clocks were last compared, with its monotonic reading.
+*/
+type clockWatch struct {
+	last time.Time
+}
+
+/*
+Returns a clockWatch that compares the clocks from now.
+*/
+func newClockWatch() *clockWatch {
+	return &clockWatch{last: time.Now()}
+}
+
+/*
+Compares how far the wall clock and the monotonic clock have moved since the last comparison, and returns the
+difference, positive when the wall clock moved further as it does over a suspend. Reports whether the difference is
+more than CLOCKJUMP.
+*/
+func (watch *clockWatch) jumped() (time.Duration, bool) {
+	now := time.Now()
+	wall := now.Round(0).Sub(watch.last.Round(0)) //Round(0) strips the monotonic reading
+	drift := wall - now.Sub(watch.last)
+	watch.last = now
+	return drift, drift > CLOCKJUMP || drift < -CLOCKJUMP
+}
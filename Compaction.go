@@ -0,0 +1,310 @@
+package main
+
+/*
+This file keeps the SQLite and PostgreSQL databases from growing without bound by compacting old readings into
+averages. With compactHourlyDays set, the readings older than that many days are averaged into one row per station,
+sensor, and hour, and with compactDailyDays set as well, the hours older than that are averaged again into one row
+per day. Each compacted row holds the average, the lowest and highest value, and the number of readings averaged, so
+long-term trends and extremes survive. Wind directions are averaged as angles, from the mean of their sines and
+cosines, so north winds either side of 0 average to north rather than south. Only numeric values are compacted, and
+dateutc and date, being times, are left out. Every row of a compacted period is deleted in the same transaction, text
+values such as battery states included, as they have no average. Hours and days are in UTC, like dateutc. The
+compacted rows are kept in their own tables:
+  - SQLite: readings_hourly and readings_daily, keyed like readings by station_id, dateutc, and sensor_id.
+  - PostgreSQL: ambient_readings_hourly and ambient_readings_daily, keyed by station, dateutc, and sensor.
+
+Compaction runs when the program starts and every hour after. The end of the periods compacted so far, the watermark,
+is stored in the database, in compaction for SQLite and ambient_readings_compaction for PostgreSQL, and readings
+older than it, such as a backfill reaching into compacted periods, are refused rather than written, as averaging them
+in would count the readings already averaged twice. The sheets are kept in full, bounded by retentionYears instead.
+*/
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+const (
+	COMPACTPERIOD      = time.Hour                                                     //How often compaction runs
+	DIRECTIONSENSORS   = "'winddir', 'windgustdir', 'winddir_avg2m', 'winddir_avg10m'" //Averaged as angles
+	UNCOMPACTEDSENSORS = "'dateutc', 'date'"                                           //Times, never averaged
+)
+
+var (
+	sqliteWatermark   int64 = 0 //dateutc before which the SQLite readings are compacted, guarded by sqliteMutex
+	postgresWatermark int64 = 0 //dateutc before which the PostgreSQL readings are compacted, guarded by postgresMutex
+)
+
+/*
+compactionStep is a struct that describes one step of compaction: the table the rows come from, the table their
+averages go to, the length of the periods they are averaged over, and the age in days of the rows it compacts.
+*/
+type compactionStep struct {
+	source string
+	target string
+	period time.Duration
+	days   int
+}
+
+/*
+Compacts the databases now and then every hour in the background until the context is cancelled, if
+compactHourlyDays is configured.
+*/
+func startCompaction(ctx context.Context) {
+	if config.CompactHourly <= 0 {
+		return
+	}
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		ticker := time.NewTicker(COMPACTPERIOD)
+		defer ticker.Stop()
+		for {
+			compact(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+/*
+Compacts every configured database.
+*/
+func compact(ctx context.Context) {
+	if config.SQLiteFile != "" {
+		compactSQLite(ctx)
+	}
+	if config.PostgresURL != "" {
+		compactPostgres(ctx)
+	}
+}
+
+/*
+Returns the steps of compaction in order, from the readings to hours and from hours to days, with the names of the
+tables of a database, whose compacted tables are named after the readings table.
+*/
+func compactionSteps(readings string) []compactionStep {
+	steps := []compactionStep{{source: readings, target: readings + "_hourly", period: time.Hour,
+		days: config.CompactHourly}}
+	if config.CompactDaily > 0 {
+		steps = append(steps, compactionStep{source: readings + "_hourly", target: readings + "_daily",
+			period: 24 * time.Hour, days: config.CompactDaily})
+	}
+	return steps
+}
+
+/*
+Returns the start of the period the compaction step's cutoff falls in, so only whole periods are compacted.
+*/
+func (step compactionStep) cutoff() time.Time {
+	return time.Now().AddDate(0, 0, -step.days).UTC().Truncate(step.period)
+}
+
+/*
+Compacts the SQLite database, each step in its own transaction.
+*/
+func compactSQLite(ctx context.Context) {
+	sqliteMutex.Lock()
+	defer sqliteMutex.Unlock()
+	if err := connectSQLite(ctx); err != nil {
+		slog.ErrorContext(ctx, "Unable to compact the SQLite database", "err", err)
+		return
+	}
+	direction := `sensor_id IN (SELECT id FROM sensors WHERE name IN (` + DIRECTIONSENSORS + `))`
+	merged := circularMean("sin(radians(value)) * samples + sin(radians(excluded.value)) * excluded.samples",
+		"cos(radians(value)) * samples + cos(radians(excluded.value)) * excluded.samples")
+	for _, step := range compactionSteps("readings") {
+		mean := "CASE WHEN " + direction + " THEN " + circularMean("sum(sin(radians(value)))",
+			"sum(cos(radians(value)))") + " ELSE avg(value) END"
+		aggregates := "min(value), max(value), count(value)"
+		if step.source != "readings" {
+			mean = "CASE WHEN " + direction + " THEN " + circularMean("sum(sin(radians(value)) * samples)",
+				"sum(cos(radians(value)) * samples)") + " ELSE sum(value * samples) / sum(samples) END"
+			aggregates = "min(min_value), max(max_value), sum(samples)"
+		}
+		bucket := step.period.Milliseconds()
+		cutoff := step.cutoff().UnixMilli()
+		statements := []string{
+			`INSERT INTO ` + step.target + ` (station_id, dateutc, sensor_id, value, min_value, max_value, samples)
+			SELECT station_id, dateutc - dateutc % ?, sensor_id, ` + mean + `, ` + aggregates + `
+			FROM ` + step.source + ` WHERE dateutc < ? AND value IS NOT NULL
+				AND sensor_id NOT IN (SELECT id FROM sensors WHERE name IN (` + UNCOMPACTEDSENSORS + `))
+			GROUP BY 1, 2, 3
+			ON CONFLICT (station_id, dateutc, sensor_id) DO UPDATE SET
+				value = CASE WHEN ` + direction + ` THEN ` + merged + `
+					ELSE (value * samples + excluded.value * excluded.samples) / (samples + excluded.samples) END,
+				min_value = min(min_value, excluded.min_value), max_value = max(max_value, excluded.max_value),
+				samples = samples + excluded.samples`,
+			`DELETE FROM ` + step.source + ` WHERE dateutc < ?`,
+		}
+		args := [][]interface{}{{bucket, cutoff}, {cutoff}}
+		if step.source == "readings" {
+			statements = append(statements, `INSERT INTO compaction (source, watermark) VALUES (?, ?)
+				ON CONFLICT (source) DO UPDATE SET watermark = max(watermark, excluded.watermark)`)
+			args = append(args, []interface{}{step.source, cutoff})
+		}
+		if err := compactTables(ctx, sqliteDB, step, statements, args); err != nil {
+			slog.ErrorContext(ctx, "Unable to compact the SQLite database", "table", step.source, "err", err)
+			return
+		}
+		if step.source == "readings" {
+			sqliteWatermark = max(sqliteWatermark, cutoff)
+		}
+	}
+}
+
+/*
+Compacts the PostgreSQL database, creating the compacted tables if they don't exist, each step in its own
+transaction.
+*/
+func compactPostgres(ctx context.Context) {
+	postgresMutex.Lock()
+	defer postgresMutex.Unlock()
+	if err := connectPostgres(ctx); err != nil {
+		slog.ErrorContext(ctx, "Unable to compact the PostgreSQL database", "err", err)
+		return
+	}
+	merged := circularMean(
+		"sin(radians(compacted.value)) * compacted.samples + sin(radians(excluded.value)) * excluded.samples",
+		"cos(radians(compacted.value)) * compacted.samples + cos(radians(excluded.value)) * excluded.samples")
+	for _, step := range compactionSteps(POSTGRESTABLE) {
+		_, err := postgresDB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+step.target+` (
+			station TEXT NOT NULL,
+			dateutc TIMESTAMPTZ NOT NULL,
+			sensor TEXT NOT NULL,
+			value DOUBLE PRECISION NOT NULL,
+			min_value DOUBLE PRECISION NOT NULL,
+			max_value DOUBLE PRECISION NOT NULL,
+			samples BIGINT NOT NULL,
+			PRIMARY KEY (station, dateutc, sensor)
+		)`)
+		if err != nil {
+			slog.ErrorContext(ctx, "Unable to create the compacted table", "table", step.target, "err", err)
+			return
+		}
+
+		unit := "hour"
+		if step.period >= 24*time.Hour {
+			unit = "day"
+		}
+		bucket := `date_trunc('` + unit + `', dateutc AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'`
+		source := `SELECT station, ` + bucket + `, sensor, CASE WHEN sensor IN (` + DIRECTIONSENSORS + `) THEN ` +
+			circularMean("sum(sin(radians(value)) * samples)", "sum(cos(radians(value)) * samples)") + `
+			ELSE sum(value * samples) / sum(samples) END, min(min_value), max(max_value), sum(samples)
+			FROM ` + step.source + ` WHERE dateutc < $1 GROUP BY 1, 2, 3`
+		if step.source == POSTGRESTABLE {
+			number := "value::text::double precision"
+			source = `SELECT station, ` + bucket + `, key, CASE WHEN key IN (` + DIRECTIONSENSORS + `) THEN ` +
+				circularMean("sum(sin(radians("+number+")))", "sum(cos(radians("+number+")))") + `
+				ELSE avg(` + number + `) END, min(` + number + `), max(` + number + `), count(*)
+				FROM ` + POSTGRESTABLE + `, jsonb_each(data) WHERE dateutc < $1 AND jsonb_typeof(value) = 'number'
+					AND key NOT IN (` + UNCOMPACTEDSENSORS + `)
+				GROUP BY 1, 2, 3`
+		}
+		statements := []string{
+			`INSERT INTO ` + step.target + ` AS compacted (station, dateutc, sensor, value, min_value, max_value,
+				samples) ` + source + `
+			ON CONFLICT (station, dateutc, sensor) DO UPDATE SET
+				value = CASE WHEN compacted.sensor IN (` + DIRECTIONSENSORS + `) THEN ` + merged + `
+					ELSE (compacted.value * compacted.samples + excluded.value * excluded.samples) /
+						(compacted.samples + excluded.samples) END,
+				min_value = LEAST(compacted.min_value, excluded.min_value),
+				max_value = GREATEST(compacted.max_value, excluded.max_value),
+				samples = compacted.samples + excluded.samples`,
+			`DELETE FROM ` + step.source + ` WHERE dateutc < $1`,
+		}
+		cutoff := step.cutoff()
+		args := [][]interface{}{{cutoff}, {cutoff}}
+		if step.source == POSTGRESTABLE {
+			statements = append(statements, `INSERT INTO `+POSTGRESTABLE+`_compaction (source, watermark)
+				VALUES ($1, $2) ON CONFLICT (source) DO UPDATE SET watermark = GREATEST(`+POSTGRESTABLE+
+				`_compaction.watermark, excluded.watermark)`)
+			args = append(args, []interface{}{step.source, cutoff})
+		}
+		if err := compactTables(ctx, postgresDB, step, statements, args); err != nil {
+			slog.ErrorContext(ctx, "Unable to compact the PostgreSQL database", "table", step.source, "err", err)
+			return
+		}
+		if step.source == POSTGRESTABLE {
+			postgresWatermark = max(postgresWatermark, cutoff.UnixMilli())
+		}
+	}
+}
+
+/*
+Runs the statements of a compaction step in a single transaction: the first averages the rows into the compacted
+table, the second removes the values averaged, and the rest tidy up and record the watermark. Logs how many rows the
+second changed.
+*/
+func compactTables(ctx context.Context, db *sql.DB, step compactionStep, statements []string,
+	args [][]interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //Does nothing once committed
+
+	var compacted int64
+	for i, statement := range statements {
+		result, err := tx.ExecContext(ctx, statement, args[i]...)
+		if err != nil {
+			return err
+		}
+		if i == 1 {
+			compacted, _ = result.RowsAffected()
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if compacted > 0 {
+		slog.InfoContext(ctx, "Compacted old rows", "from", step.source, "into", step.target, "rows", compacted,
+			"before", step.cutoff())
+	}
+	return nil
+}
+
+/*
+Returns the SQL of the mean of directions in degrees, given the SQL of the sums of their sines and cosines. atan2 of
+the negated sums is the opposite direction, between -180 and 180 degrees, so adding 180 gives the mean from 0 to 360
+without a modulo, which PostgreSQL doesn't have for floating point numbers.
+*/
+func circularMean(sines string, cosines string) string {
+	return "degrees(atan2(-(" + sines + "), -(" + cosines + "))) + 180"
+}
+
+/*
+Returns the watermark a database stored for the readings table, as dateutc, or 0 if it was never compacted. The
+query selects the watermark, given the table's name.
+*/
+func loadWatermark(ctx context.Context, db *sql.DB, query string, source string) (int64, error) {
+	var watermark sql.NullInt64
+	err := db.QueryRowContext(ctx, query, source).Scan(&watermark)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return watermark.Int64, err
+}
+
+/*
+Returns the readings at or after a watermark, logging how many older ones were refused.
+*/
+func afterWatermark(ctx context.Context, database string, watermark int64, readings []DeviceData) []DeviceData {
+	kept := make([]DeviceData, 0, len(readings))
+	for _, data := range readings {
+		if data.DateUTC >= watermark {
+			kept = append(kept, data)
+		}
+	}
+	if refused := len(readings) - len(kept); refused > 0 {
+		slog.WarnContext(ctx, "Refusing "+strconv.Itoa(refused)+" readings older than the compacted periods",
+			"database", database, "watermark", time.UnixMilli(watermark))
+	}
+	return kept
+}
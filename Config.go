@@ -0,0 +1,372 @@
+package main
+
+/*
+This file loads the program configuration. Settings are read from a JSON file (config.json by default) holding the
+Ambient Weather keys, the stations to poll, the spreadsheet to write to, and the locations of the credential and
+header files. The file may define named profiles (e.g. prod and test) that override any of these settings, selected at
+launch with --profile. When no config file exists the older comma separated secrets.txt file is read instead so
+existing deployments keep working.
+*/
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Config is a struct that holds every setting needed to run the program. Fields left empty in the config file are filled
+with the defaults from defaultConfig.
+*/
+type Config struct {
+	APIKey          string                     `json:"apiKey"`
+	ApplicationKey  string                     `json:"applicationKey"`
+	SecondaryAPIKey string                     `json:"secondaryApiKey"` //Used when the API Key is rejected
+	MacAddress      string                     `json:"macAddress"`      //Shorthand for a single station
+	Stations        []Station                  `json:"stations"`
+	SpreadsheetID   string                     `json:"spreadsheetId"`
+	YearlySheets    bool                       `json:"yearlySpreadsheets"` //A new spreadsheet every year
+	DriveFolder     string                     `json:"driveFolderId"`      //Drive folder of yearly spreadsheets
+	ShareWith       []string                   `json:"shareWith"`          //Yearly spreadsheets are shared with
+	XLSXFile        string                     `json:"xlsxFile"`           //Excel workbook also written to
+	CSVDir          string                     `json:"csvDir"`             //Monthly CSV files also written here
+	SQLiteFile      string                     `json:"sqliteFile"`         //SQLite database also written to
+	PostgresURL     string                     `json:"postgresUrl"`        //PostgreSQL database also written to
+	Timescale       bool                       `json:"timescaleDb"`        //Make the PostgreSQL table a hypertable
+	CompactHourly   int                        `json:"compactHourlyDays"`  //Average readings older than this hourly
+	CompactDaily    int                        `json:"compactDailyDays"`   //Average hours older than this daily
+	InfluxURL       string                     `json:"influxUrl"`          //InfluxDB v2 server also written to
+	InfluxOrg       string                     `json:"influxOrg"`
+	InfluxBucket    string                     `json:"influxBucket"`
+	InfluxToken     string                     `json:"influxToken"`
+	MetricsListen   string                     `json:"metricsListen"`       //Prometheus endpoint, e.g. :9101
+	APIListen       string                     `json:"apiListen"`           //REST API, e.g. :8080
+	HistorySize     int                        `json:"apiHistorySize"`      //Readings of each station the API keeps
+	HealthListen    string                     `json:"healthListen"`        //Health endpoints, e.g. :8081
+	HealthMaxAge    int                        `json:"healthMaxAgeMinutes"` //Longest time without polls to be ready
+	HeartbeatURL    string                     `json:"heartbeatUrl"`        //Pinged after every successful cycle
+	MQTTBroker      string                     `json:"mqttBroker"`          //MQTT broker, e.g. tcp://host:1883
+	MQTTUser        string                     `json:"mqttUsername"`
+	MQTTPassword    string                     `json:"mqttPassword"`
+	MQTTPrefix      string                     `json:"mqttTopicPrefix"`
+	DiscoveryPrefix string                     `json:"haDiscoveryPrefix"` //Home Assistant MQTT Discovery prefix
+	BigQueryProject string                     `json:"bigqueryProject"`
+	BigQueryDataset string                     `json:"bigqueryDataset"` //BigQuery dataset also written to
+	BigQueryTable   string                     `json:"bigqueryTable"`
+	ParquetURL      string                     `json:"parquetBucket"` //e.g. gs://bucket or s3://bucket?region=us-east-1
+	ParquetPrefix   string                     `json:"parquetPrefix"` //Prefix of the Parquet object keys
+	ParquetInterval int                        `json:"parquetFlushMinutes"`
+	GraphiteAddr    string                     `json:"graphiteAddress"` //Graphite receiver, e.g. host:2003
+	StatsDAddr      string                     `json:"statsdAddress"`   //StatsD server, e.g. host:8125
+	MetricPath      string                     `json:"metricPath"`      //Template of Graphite/StatsD paths
+	Webhooks        []string                   `json:"webhookUrls"`     //Readings are POSTed here as JSON
+	WebhookSecret   string                     `json:"webhookSecret"`   //Signs the webhook requests
+	Sinks           []string                   `json:"sinks"`           //Only these outputs are written, if set
+	SinkRoutes      []SinkRoute                `json:"sinkRoutes"`      //Sensors each output receives
+	KafkaBrokers    []string                   `json:"kafkaBrokers"`    //Kafka brokers, e.g. host:9092
+	KafkaTopic      string                     `json:"kafkaTopic"`
+	NATSURL         string                     `json:"natsUrl"`        //NATS server also published to
+	NATSSubject     string                     `json:"natsSubject"`    //Prefix of the subject of each station
+	RemoteWriteURL  string                     `json:"remoteWriteUrl"` //Prometheus remote_write endpoint
+	RemoteToken     string                     `json:"remoteWriteToken"`
+	HAURL           string                     `json:"homeAssistantUrl"`        //e.g. http://homeassistant.local:8123
+	HAToken         string                     `json:"homeAssistantToken"`      //Long-lived access token
+	ExtraSheetIDs   []string                   `json:"extraSpreadsheetIds"`     //Spreadsheets also written to
+	SheetsPerMinute int                        `json:"sheetsRequestsPerMinute"` //Sheets API requests allowed a minute
+	ValueInput      string                     `json:"valueInputOption"`        //RAW (default) or USER_ENTERED
+	CredentialsFile string                     `json:"credentialsFile"`
+	TokenFile       string                     `json:"tokenFile"`
+	HeadersFile     string                     `json:"headersFile"`
+	TemplateSheet   string                     `json:"templateSheet"`          //Sheet new sheets are copied from
+	MappingSheet    string                     `json:"mappingSheet"`           //Hidden sheet holding the column mapping
+	RainFile        string                     `json:"rainFile"`               //Ledger of daily rain totals
+	StateFile       string                     `json:"stateFile"`              //Last reading written, for restarts
+	BufferDir       string                     `json:"bufferDir"`              //Readings outputs failed to write
+	RainYearStart   int                        `json:"rainYearStartMonth"`     //Month the rain year starts in, 1-12
+	Proxy           string                     `json:"proxy"`                  //Proxy URL, else HTTPS_PROXY is used
+	RecordDir       string                     `json:"recordDir"`              //Archive of raw responses, off if empty
+	RecordDays      int                        `json:"recordDays"`             //Days of archive kept, 0 keeps all
+	RequestHeaders  map[string]string          `json:"requestHeaders"`         //Extra headers sent to the Ambient API
+	CAFile          string                     `json:"caFile"`                 //Extra CA certificates to trust, as PEM
+	TLSMinVersion   string                     `json:"tlsMinVersion"`          //1.2 (default) or 1.3
+	Units           string                     `json:"units"`                  //imperial (default) or metric
+	SensorUnits     map[string]string          `json:"sensorUnits"`            //Per sensor units, e.g. tempf: C
+	SoilProbes      map[string]string          `json:"soilProbes"`             //Soil probe names, e.g. 1: Garden bed
+	Timezone        string                     `json:"timezone"`               //IANA zone of row times, e.g. US/Central
+	SheetRotation   string                     `json:"sheetRotation"`          //yearly (default), monthly, or weekly
+	DailySummary    bool                       `json:"dailySummary"`           //Write daily highs, lows, and totals
+	SheetName       string                     `json:"sheetName"`              //Sheet name template, e.g. {{.Year}}
+	FormatRules     []FormatRule               `json:"conditionalFormats"`     //Colors for readings, e.g. tempf < 32
+	Charts          bool                       `json:"charts"`                 //Chart temperature and rain on sheets
+	RetentionYears  int                        `json:"retentionYears"`         //Archive sheets older than this
+	RetentionAction string                     `json:"retentionAction"`        //hide (default) or delete
+	ArchiveDir      string                     `json:"archiveDir"`             //CSV exports of retired sheets
+	EndOfDayStats   []DayEndStat               `json:"endOfDayStats"`          //Statistics after each day's rows
+	DiscoverSensors bool                       `json:"discoverSensors"`        //Add columns for unmapped fields
+	Summary         bool                       `json:"summary"`                //Aggregate every station on a sheet
+	Realtime        bool                       `json:"realtime"`               //Subscribe instead of polling
+	RequestTimeout  int                        `json:"requestTimeoutSeconds"`  //Limit for a single API request
+	MaxRetryTime    int                        `json:"maxRetrySeconds"`        //Limit for a request and its retries
+	QueryMode       string                     `json:"queryMode"`              //history (default) or lastData
+	Schedule        string                     `json:"schedule"`               //Cron spec the stations are polled on
+	Jitter          int                        `json:"jitterSeconds"`          //Random delay of up to this per call
+	ReadingsPerPoll int                        `json:"readingsPerPoll"`        //Records fetched by each scheduled call
+	StalePolls      int                        `json:"stalePolls"`             //Polls without new data to go stale
+	AlertURL        string                     `json:"alertUrl"`               //Alerts such as leaks are POSTed here
+	QualityAction   string                     `json:"qualityAction"`          //drop (default), flag, or off
+	SpikeLimits     map[string]float64         `json:"spikeLimits"`            //Largest change per 5 minutes by sensor
+	BreakerFailures int                        `json:"circuitBreakerFailures"` //Failed calls that open the circuit
+	BreakerCooldown int                        `json:"circuitBreakerSeconds"`  //Wait before probing an open circuit
+	Profiles        map[string]json.RawMessage `json:"profiles"`               //Settings applied with --profile
+}
+
+/*
+Station is a struct that identifies a weather station to poll by its MAC Address, with an optional name used in logs
+and sheet names.
+*/
+type Station struct {
+	Name         string `json:"name"`
+	MacAddress   string `json:"macAddress"`
+	WUID         string `json:"wundergroundId"`  //Weather Underground PWS the readings are uploaded to
+	WUKey        string `json:"wundergroundKey"` //Key of the Weather Underground PWS
+	PWSID        string `json:"pwsweatherId"`    //PWSWeather station the readings are uploaded to
+	PWSKey       string `json:"pwsweatherKey"`   //API key of the PWSWeather station
+	WindyKey     string `json:"windyKey"`        //Windy API key the readings are uploaded with
+	WindyStation int    `json:"windyStation"`    //Index of the station on the Windy account
+	Schedule     string `json:"schedule"`        //Cron spec of the station, if not the config's schedule
+}
+
+var (
+	location   = time.Local //Timezone rows are dated and sheets are split into years in
+	configFile = "config.json"
+	secretFile = "secrets.txt"
+	profile    = ""
+	config     Config
+)
+
+/*
+Returns a Config with the default spreadsheet and file locations used before the config file existed.
+*/
+func defaultConfig() Config {
+	return Config{
+		SpreadsheetID:   spreadsheetId,
+		CredentialsFile: credentialsFile,
+		TokenFile:       tokenFile,
+		HeadersFile:     headersFile,
+		RainFile:        rainFile,
+		StateFile:       "state.json",
+		BufferDir:       "buffer",
+		RainYearStart:   1,
+		SheetRotation:   ROTATIONYEARLY,
+		ValueInput:      VALUEINPUTRAW,
+		SheetsPerMinute: 60,
+		MQTTPrefix:      "goambient",
+		BigQueryTable:   "readings",
+		ParquetPrefix:   "ambient/",
+		ParquetInterval: 60,
+		KafkaTopic:      "ambient.readings",
+		NATSSubject:     "ambient.readings",
+		HistorySize:     APIHISTORYSIZE,
+		HealthMaxAge:    15,
+		DiscoveryPrefix: "homeassistant",
+		RetentionAction: RETENTIONHIDE,
+		ArchiveDir:      "archive",
+		RequestTimeout:  30,
+		MaxRetryTime:    120,
+		QueryMode:       QUERYHISTORY,
+		Schedule:        DEFAULTSCHEDULE,
+		Units:           UNITSIMPERIAL,
+		ReadingsPerPoll: 1,
+		StalePolls:      3,
+		QualityAction:   QUALITYDROP,
+		BreakerFailures: 5,
+		BreakerCooldown: 300,
+		RecordDays:      30,
+	}
+}
+
+/*
+Reads the config file at the given path and applies the named profile, if one is given. Unknown fields are rejected so
+a misspelled setting is reported instead of being silently ignored. If the file does not exist the legacy secrets.txt
+file is read for the MAC Address, API Key, and App Key.
+*/
+func loadConfig(path string, profileName string) (Config, error) {
+	loaded := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && profileName == "" {
+		slog.Info("No " + path + " found, reading keys from " + secretFile)
+		loaded, err = loadLegacySecrets(loaded)
+		return withStations(loaded), err
+	}
+	if err != nil {
+		return loaded, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	if err := decodeStrict(data, &loaded); err != nil {
+		return loaded, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+
+	if profileName != "" {
+		overrides, exists := loaded.Profiles[profileName]
+		if !exists {
+			return loaded, fmt.Errorf("profile %q is not defined in %s", profileName, path)
+		}
+		if err := decodeStrict(overrides, &loaded); err != nil {
+			return loaded, fmt.Errorf("unable to parse profile %q in %s: %w", profileName, path, err)
+		}
+		slog.Info("Using profile " + profileName)
+	}
+	loaded.Profiles = nil
+
+	return withStations(loaded), nil
+}
+
+/*
+Decodes JSON onto the given value, rejecting unknown fields. Fields not present in the JSON keep their current value,
+which is how profile settings are layered on top of the base config.
+*/
+func decodeStrict(data []byte, value any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(value)
+}
+
+/*
+Converts the single station macAddress shorthand into the Stations list so the rest of the program only deals with
+Stations.
+*/
+func withStations(loaded Config) Config {
+	if len(loaded.Stations) == 0 && loaded.MacAddress != "" {
+		loaded.Stations = []Station{{MacAddress: loaded.MacAddress}}
+	}
+	return loaded
+}
+
+/*
+Fills the MAC Address, API Key, and App Key of the given Config from the comma separated secrets.txt file.
+*/
+func loadLegacySecrets(loaded Config) (Config, error) {
+	data, err := os.ReadFile(secretFile)
+	if err != nil {
+		return loaded, fmt.Errorf("unable to read %s: %w", secretFile, err)
+	}
+
+	secret := strings.Split(strings.TrimSpace(string(data)), ",")
+	if len(secret) < 3 {
+		return loaded, fmt.Errorf("%s must contain the MAC Address, API Key, and App Key separated by commas",
+			secretFile)
+	}
+	loaded.MacAddress = strings.TrimSpace(secret[0])
+	loaded.APIKey = strings.TrimSpace(secret[1])
+	loaded.ApplicationKey = strings.TrimSpace(secret[2])
+	return loaded, nil
+}
+
+/*
+Makes the given Config the active configuration, pointing the Sheets functions at the configured spreadsheet and files
+and registering the keys as secrets so they are redacted from the logs.
+*/
+func applyConfig(loaded Config) {
+	config = loaded
+	spreadsheetId = loaded.SpreadsheetID
+	credentialsFile = loaded.CredentialsFile
+	tokenFile = loaded.TokenFile
+	headersFile = loaded.HeadersFile
+	rainFile = loaded.RainFile
+	ambientClient.Timeout = time.Duration(loaded.RequestTimeout) * time.Second
+	maxRetryTime = time.Duration(loaded.MaxRetryTime) * time.Second
+	applySheetsQuota(loaded.SheetsPerMinute)
+	if err := applyProxy(loaded.Proxy); err != nil {
+		slog.Error("Invalid proxy, using the proxy environment variables instead", "err", err)
+	}
+	if err := applyTLS(loaded.CAFile, loaded.TLSMinVersion); err != nil {
+		slog.Error("Invalid TLS settings, using the system roots and TLS 1.2 instead", "err", err)
+	}
+	location = time.Local
+	if loaded.Timezone != "" {
+		if zone, err := time.LoadLocation(loaded.Timezone); err == nil {
+			location = zone
+		} else {
+			slog.Error("Unknown timezone, using the system timezone instead", "timezone", loaded.Timezone, "err", err)
+		}
+	}
+	ambient.Location = location
+	if parsed, err := parseSheetName(loaded.SheetName); err == nil {
+		sheetNameTemplate = parsed
+	} else {
+		sheetNameTemplate = nil
+		slog.Error("Invalid sheet name template, using the default sheet names instead", "err", err)
+	}
+	if parsed, err := parseMetricPath(loaded.MetricPath); err == nil {
+		metricPathTemplate = parsed
+	} else {
+		metricPathTemplate, _ = parseMetricPath("")
+		slog.Error("Invalid metric path template, using "+METRICPATH+" instead", "err", err)
+	}
+	if parsed, err := parseCron(loaded.Schedule); err == nil {
+		pollSchedule = parsed
+	} else {
+		pollSchedule, _ = parseCron(DEFAULTSCHEDULE)
+		slog.Error("Invalid schedule, polling on "+DEFAULTSCHEDULE+" instead", "err", err)
+	}
+	if loaded.HistorySize < 1 {
+		config.HistorySize = APIHISTORYSIZE
+		if loaded.APIListen != "" {
+			slog.Error("apiHistorySize must be at least 1, keeping "+strconv.Itoa(APIHISTORYSIZE)+" readings instead",
+				"apiHistorySize", loaded.HistorySize)
+		}
+	}
+	ambientBreaker.threshold = loaded.BreakerFailures
+	ambientBreaker.cooldown = time.Duration(loaded.BreakerCooldown) * time.Second
+
+	registerSecret(loaded.APIKey)
+	registerSecret(loaded.ApplicationKey)
+	registerSecret(loaded.SecondaryAPIKey)
+	registerURLSecret(loaded.PostgresURL)
+	registerURLSecret(loaded.NATSURL)
+	registerURLSecret(loaded.RemoteWriteURL)
+	registerSecret(loaded.RemoteToken)
+	registerSecret(loaded.HAToken)
+	registerSecret(loaded.HeartbeatURL) //The URL itself identifies the check
+	registerSecret(loaded.InfluxToken)
+	registerSecret(loaded.MQTTPassword)
+	registerSecret(loaded.WebhookSecret)
+	registerSecret(loaded.AlertURL) //Chat webhook URLs carry their token in the path
+	for _, webhookURL := range loaded.Webhooks {
+		registerSecret(webhookURL)
+	}
+	for _, station := range loaded.Stations {
+		registerSecret(station.WUKey)
+		registerSecret(station.PWSKey)
+		registerSecret(station.WindyKey)
+	}
+}
+
+/*
+Reports whether any of the stations matches the condition.
+*/
+func anyStation(stations []Station, condition func(station Station) bool) bool {
+	for _, station := range stations {
+		if condition(station) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns the name of the station for logs and sheet names, falling back to the MAC Address for unnamed stations.
+*/
+func (station Station) displayName() string {
+	if station.Name != "" {
+		return station.Name
+	}
+	return station.MacAddress
+}
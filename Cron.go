@@ -0,0 +1,158 @@
+package main
+
+/*
+This file parses the schedule the stations are polled on, a cron spec set with schedule in the config, so polling can
+be aligned with the minute a station reports on instead of the 5 minute marks of the clock. The spec has the five
+standard fields, evaluated in the configured timezone:
+minute hour day-of-month month day-of-week
+Each field is *, a number, a range such as 1-5, or a list of these separated by commas, and any of them may take a
+step after a slash, such as 2-59/5, which matches every 5th value from 2 to 59. Sunday is 0 or 7. As in cron, a day
+matches if either the day of the month or the day of the week does, when both are restricted. A spec of a single
+field is the minute field, run every hour, so "2-59/5" polls 2 minutes after every 5 minute mark. The default
+schedule, DEFAULTSCHEDULE, polls on every 5 minute mark.
+*/
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULTSCHEDULE = "*/5 * * * *"
+)
+
+/*
+cronSchedule is a struct that holds a parsed cron spec as a set of bits for every field, bit n set when the value n
+matches. anyDay and anyWeekday record whether the day fields were *, which decides how the two are combined.
+*/
+type cronSchedule struct {
+	minutes    uint64
+	hours      uint64
+	days       uint64
+	months     uint64
+	weekdays   uint64
+	anyDay     bool
+	anyWeekday bool
+}
+
+/*
+cronField is a struct that holds the range of values a field of a cron spec allows.
+*/
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var (
+	cronFields = []cronField{{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12},
+		{"day of week", 0, 7}}
+	pollSchedule = cronSchedule{}
+)
+
+/*
+Parses a cron spec of five fields, or a single minute field, into a schedule.
+*/
+func parseCron(spec string) (cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 1 {
+		fields = append(fields, "*", "*", "*", "*")
+	}
+	if len(fields) != len(cronFields) {
+		return cronSchedule{}, errors.New("expected 5 fields, minute hour day-of-month month day-of-week")
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		parsed, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return cronSchedule{}, err
+		}
+		bits[i] = parsed
+	}
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1 //Sunday is both 0 and 7
+	}
+	return cronSchedule{minutes: bits[0], hours: bits[1], days: bits[2], months: bits[3], weekdays: bits[4],
+		anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}, nil
+}
+
+/*
+Parses a field of a cron spec into the bits of the values it matches.
+*/
+func parseCronField(field string, allowed cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		values, stepText, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q in the %s field", stepText, allowed.name)
+			}
+		}
+
+		low, high := allowed.min, allowed.max
+		if values != "*" {
+			first, last, ranged := strings.Cut(values, "-")
+			var err error
+			if low, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q in the %s field", first, allowed.name)
+			}
+			high = low
+			if ranged {
+				if high, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q in the %s field", last, allowed.name)
+				}
+			} else if stepped {
+				high = allowed.max //A start with a step runs to the end of the field
+			}
+		}
+		if low < allowed.min || high > allowed.max || low > high {
+			return 0, fmt.Errorf("%q is out of range in the %s field, which allows %d-%d", part, allowed.name,
+				allowed.min, allowed.max)
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+/*
+Returns the first minute after the given time that the schedule matches, in the configured timezone. Reports false if
+no minute in the next 5 years matches, as with February 30.
+*/
+func (schedule cronSchedule) next(after time.Time) (time.Time, bool) {
+	at := after.In(location).Truncate(time.Minute).Add(time.Minute)
+	limit := at.AddDate(5, 0, 0)
+	for at.Before(limit) {
+		switch {
+		case schedule.months&(1<<int(at.Month())) == 0:
+			at = time.Date(at.Year(), at.Month()+1, 1, 0, 0, 0, 0, location)
+		case !schedule.dayMatches(at):
+			at = time.Date(at.Year(), at.Month(), at.Day()+1, 0, 0, 0, 0, location)
+		case schedule.hours&(1<<at.Hour()) == 0:
+			at = time.Date(at.Year(), at.Month(), at.Day(), at.Hour()+1, 0, 0, 0, location)
+		case schedule.minutes&(1<<at.Minute()) == 0:
+			at = at.Add(time.Minute)
+		default:
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+/*
+Returns whether the schedule matches a time's day, by its day of the month or its day of the week.
+*/
+func (schedule cronSchedule) dayMatches(at time.Time) bool {
+	day := schedule.days&(1<<at.Day()) != 0
+	weekday := schedule.weekdays&(1<<int(at.Weekday())) != 0
+	if schedule.anyDay || schedule.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
@@ -0,0 +1,150 @@
+package main
+
+/*
+This file writes the Daily Summary sheet, which holds one row per day for each station with the high and low
+temperature, the total rainfall, the peak gust, and the average humidity, in the configured units. The statistics
+are gathered from every reading written during the day, and the day's row is written at midnight, when the station's
+first reading of the next day arrives. A day the program was only running for part of is summarized from the
+readings it saw, and the number of readings is written alongside so such days can be told apart.
+*/
+import (
+	"context"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"log/slog"
+	"math"
+	"sync"
+)
+
+const (
+	DAILYSHEET = "Daily Summary"
+)
+
+/*
+dailyStats is a struct that holds the statistics gathered from a station's readings for one day.
+*/
+type dailyStats struct {
+	day           string //YYYY-MM-DD in the configured timezone
+	readings      int
+	highTemp      float64
+	lowTemp       float64
+	hasTemp       bool
+	rain          float64
+	hasRain       bool
+	peakGust      float64
+	hasGust       bool
+	humidityTotal float64
+	humidityCount int
+}
+
+var (
+	dailyMutex  sync.Mutex
+	dailyTotals = make(map[string]*dailyStats) //Statistics of the current day for each station MAC Address
+)
+
+/*
+Adds a reading to the day's statistics. The rainfall is the station's daily rain counter, which only grows during the
+day, or the derived rain since midnight for stations without one.
+*/
+func (stats *dailyStats) add(data DeviceData) {
+	stats.readings++
+	if data.TempF != nil {
+		if !stats.hasTemp {
+			stats.highTemp, stats.lowTemp, stats.hasTemp = *data.TempF, *data.TempF, true
+		}
+		stats.highTemp = math.Max(stats.highTemp, *data.TempF)
+		stats.lowTemp = math.Min(stats.lowTemp, *data.TempF)
+	}
+	rain, ok := ambient.ToFloat(data.Fields["dailyrainin"])
+	if !ok {
+		rain, ok = ambient.ToFloat(data.Fields["rainToday"])
+	}
+	if ok {
+		stats.rain, stats.hasRain = math.Max(stats.rain, rain), true
+	}
+	if data.WindGustMPH != nil {
+		stats.peakGust, stats.hasGust = math.Max(stats.peakGust, *data.WindGustMPH), true
+	}
+	if data.Humidity != nil {
+		stats.humidityTotal += *data.Humidity
+		stats.humidityCount++
+	}
+}
+
+/*
+Returns the day's row for the Daily Summary sheet, with empty cells for statistics no reading reported.
+*/
+func (stats *dailyStats) row() []interface{} {
+	row := []interface{}{stats.day, nil, nil, nil, nil, nil, stats.readings}
+	if stats.hasTemp {
+		row[1] = convertField("tempf", stats.highTemp)
+		row[2] = convertField("tempf", stats.lowTemp)
+	}
+	if stats.hasRain {
+		row[3] = convertField("dailyrainin", stats.rain)
+	}
+	if stats.hasGust {
+		row[4] = convertField("windgustmph", stats.peakGust)
+	}
+	if stats.humidityCount > 0 {
+		row[5] = math.Round(stats.humidityTotal / float64(stats.humidityCount))
+	}
+	return row
+}
+
+/*
+Returns the header row of the Daily Summary sheet, with each unit changed to its configured unit.
+*/
+func dailyHeaders() []interface{} {
+	return []interface{}{
+		"Date",
+		headerText("tempf", "High Temperature, ºF"),
+		headerText("tempf", "Low Temperature, ºF"),
+		headerText("dailyrainin", "Total Rainfall, in"),
+		headerText("windgustmph", "Peak Gust, mph"),
+		"Average Humidity, %",
+		"Readings",
+	}
+}
+
+/*
+Adds the readings written for a station, oldest first, to the statistics of their day and writes the row of every
+day that ended to the Daily Summary sheet. Does nothing unless dailySummary is enabled.
+*/
+func trackDailySummary(ctx context.Context, station Station, readings []DeviceData) {
+	if !config.DailySummary {
+		return
+	}
+
+	var finished [][]interface{}
+	dailyMutex.Lock()
+	for _, data := range readings {
+		day := data.Time().Format(DATEFORMAT)
+		stats := dailyTotals[station.MacAddress]
+		if stats != nil && stats.day != day {
+			finished = append(finished, stats.row())
+			stats = nil
+		}
+		if stats == nil {
+			stats = &dailyStats{day: day}
+			dailyTotals[station.MacAddress] = stats
+		}
+		stats.add(data)
+	}
+	dailyMutex.Unlock()
+
+	if len(finished) == 0 {
+		return
+	}
+	name := DAILYSHEET
+	if len(config.Stations) > 1 {
+		name += " " + station.displayName()
+	}
+	forEachSpreadsheet(ctx, func(ctx context.Context) {
+		if !sheetExists(ctx, name, dailyHeaders(), 1) {
+			slog.ErrorContext(ctx, "Sheet is unavailable. Unable to write daily summary.", "sheet", name)
+			return
+		}
+		slog.InfoContext(ctx, "Writing daily summary", "station", station.displayName(), "day", finished[0][0])
+		appendValues(ctx, name, finished, 1)
+	})
+}
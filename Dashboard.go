@@ -0,0 +1,174 @@
+package main
+
+/*
+This file serves a small web dashboard at the root of apiListen, so the stations can be seen in a browser without
+setting up Grafana. The page shows every station's current conditions with today's low and high and a trend line of
+the last 24 hours for each numeric sensor, built from the readings held for the REST API, in their configured units.
+Today starts at midnight in the configured timezone. The page follows the live feed, so the current values update as
+readings arrive, and is rebuilt from the server on reload. The page, its style sheet, and its script are embedded in
+the program, from the web directory.
+*/
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TRENDWIDTH  = 100.0 //Size of the viewBox of the trend lines
+	TRENDHEIGHT = 24.0
+)
+
+var (
+	//go:embed web
+	webFiles          embed.FS
+	dashboardTemplate = template.Must(template.ParseFS(webFiles, "web/dashboard.html"))
+)
+
+/*
+dashboardStation is a struct that holds what the dashboard shows for a station.
+*/
+type dashboardStation struct {
+	MacAddress string
+	Name       string
+	Observed   string
+	Sensors    []dashboardSensor
+}
+
+/*
+dashboardSensor is a struct that holds what the dashboard shows for a sensor: its current value, today's low and
+high, and the points of its trend line, all formatted for the page.
+*/
+type dashboardSensor struct {
+	Field   string
+	Title   string
+	Unit    string
+	Current string
+	Low     string
+	High    string
+	Trend   string
+	column  int
+}
+
+/*
+Registers the dashboard page and its static files on a server's handlers.
+*/
+func registerDashboard(mux *http.ServeMux) {
+	static, err := fs.Sub(webFiles, "web/static")
+	if err != nil {
+		slog.Error("Unable to load the dashboard's static files", "err", err)
+		return
+	}
+	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(static)))
+	mux.HandleFunc("GET /{$}", serveDashboard)
+}
+
+/*
+Renders the dashboard with the readings held for every station, or for the station named by the station parameter.
+*/
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().In(location)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location).UnixMilli()
+	var stations []dashboardStation
+	for _, ring := range requestedRings(r) {
+		newest, exists := ring.newest()
+		if !exists {
+			continue
+		}
+		stations = append(stations, dashboardStation{
+			MacAddress: ring.station.MacAddress,
+			Name:       ring.station.displayName(),
+			Observed:   newest.Time().In(location).Format(time.DateTime),
+			Sensors:    dashboardSensors(newest, ring.since(now.Add(-24*time.Hour).UnixMilli()), midnight),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, stations); err != nil {
+		slog.Debug("Unable to render the dashboard", "err", err)
+	}
+}
+
+/*
+Returns the dashboard rows of every numeric sensor in a station's newest reading, in the order of the sheet's columns,
+with the low and high of the readings since midnight and the trend of the last day's readings.
+*/
+func dashboardSensors(newest DeviceData, day []DeviceData, midnight int64) []dashboardSensor {
+	var sensors []dashboardSensor
+	for name, value := range newest.Fields {
+		current, numeric := numericValue(name, value)
+		if !numeric || undiscoveredFields[name] || name == "dateutc" {
+			continue
+		}
+		sensor := dashboardSensor{Field: name, Title: sensorTitle(name), Unit: sensorUnit(name),
+			Current: formatDashboard(current), column: math.MaxInt}
+		sensorsMutex.RLock()
+		if mapped, exists := allSensors[name]; exists {
+			sensor.column = stringToNum(mapped.ID)
+		}
+		sensorsMutex.RUnlock()
+
+		low, high := math.Inf(1), math.Inf(-1)
+		var times, values []float64
+		for _, data := range day {
+			value, numeric := numericValue(name, data.Fields[name])
+			if !numeric {
+				continue
+			}
+			if data.DateUTC >= midnight {
+				low, high = min(low, value), max(high, value)
+			}
+			times = append(times, float64(data.DateUTC))
+			values = append(values, value)
+		}
+		if !math.IsInf(low, 0) {
+			sensor.Low, sensor.High = formatDashboard(low), formatDashboard(high)
+		}
+		sensor.Trend = trendPoints(times, values)
+		sensors = append(sensors, sensor)
+	}
+	sort.Slice(sensors, func(i, j int) bool {
+		if sensors[i].column != sensors[j].column {
+			return sensors[i].column < sensors[j].column
+		}
+		return sensors[i].Field < sensors[j].Field
+	})
+	return sensors
+}
+
+/*
+Returns the points of an SVG polyline tracing the values over their times, scaled to the trend line's viewBox. Fewer
+than two values have no trend.
+*/
+func trendPoints(times []float64, values []float64) string {
+	if len(values) < 2 {
+		return ""
+	}
+	low, high := slices.Min(values), slices.Max(values)
+	start, span := times[0], max(times[len(times)-1]-times[0], 1)
+	points := make([]string, len(values))
+	for i, value := range values {
+		y := TRENDHEIGHT / 2
+		if high > low {
+			y = TRENDHEIGHT - 1 - (value-low)/(high-low)*(TRENDHEIGHT-2)
+		}
+		points[i] = strconv.FormatFloat((times[i]-start)/span*TRENDWIDTH, 'f', 2, 64) + "," +
+			strconv.FormatFloat(y, 'f', 2, 64)
+	}
+	return strings.Join(points, " ")
+}
+
+/*
+Formats a value for the dashboard with at most two decimals.
+*/
+func formatDashboard(value float64) string {
+	return strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+}
@@ -0,0 +1,229 @@
+package main
+
+/*
+This file writes a statistics row at the end of each day's block of rows in the station sheets, so a day can be read
+at a glance without leaving the sheet. endOfDayStats chooses the statistic written in each sensor's column, e.g.
+{"sensor": "dailyrainin", "stat": "max"} for the day's total rain, or {"sensor": "tempf", "stat":
+"degreeMinutesAbove", "threshold": 86} for the heat stress of the day. The statistics are computed in the units
+written to the sheet from the readings written that day, and the row is appended just before the first row of the
+next day, with the date column reading e.g. "2026-03-10 end of day". The row goes to the sheet that holds the end of
+the day even when the next day starts a new sheet. A day the program was restarted during is summarized from the
+readings written since the restart. Without endOfDayStats no rows are added.
+
+The statistics are stored before the rows are appended, and a reading is only counted once however often its append
+is retried. A day that has ended stays pending until its row is in the sheet. The row's dateutc cell holds the
+negative of the next midnight's dateutc, so the row is found in the sheet's index of written rows like a reading and
+an append that is retried after it partly landed never adds the row twice.
+*/
+import (
+	"context"
+	"fmt"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DAYENDMIN   = "min"
+	DAYENDMAX   = "max"
+	DAYENDMEAN  = "mean"
+	DAYENDSUM   = "sum"
+	DAYENDLAST  = "last"
+	DAYENDABOVE = "degreeMinutesAbove" //Minutes above the threshold, weighted by how far above
+	DAYENDBELOW = "degreeMinutesBelow" //Minutes below the threshold, weighted by how far below
+
+	DAYENDGAP    = 15 * time.Minute //Longest time a single reading counts for in degree minutes
+	DAYENDSUFFIX = " end of day"
+)
+
+/*
+DayEndStat is a struct that holds a statistic written to the end of day row: the sensor whose column it is written
+in, the statistic, and the threshold of degree minutes.
+*/
+type DayEndStat struct {
+	Sensor    string  `json:"sensor"`
+	Stat      string  `json:"stat"`
+	Threshold float64 `json:"threshold"`
+}
+
+/*
+dayEndStats is a struct that holds the statistics of a station's readings written so far on one day, to one
+spreadsheet, along with the sheet the day's rows are in and the time of the last reading.
+*/
+type dayEndStats struct {
+	day      string //YYYY-MM-DD in the configured timezone
+	sheet    string
+	previous time.Time
+	values   []dayEndValue //One for each of the configured statistics, in order
+}
+
+/*
+dayEndValue is a struct that holds the running values of one statistic.
+*/
+type dayEndValue struct {
+	count         int
+	sum           float64
+	min           float64
+	max           float64
+	last          float64
+	degreeMinutes float64
+}
+
+var (
+	dayEndMutex   sync.Mutex
+	dayEndTotals  = make(map[string]dayEndStats)   //Statistics of the current day, by spreadsheet and station
+	dayEndPending = make(map[string][]dayEndStats) //Days ended whose row isn't in the sheet yet, oldest first
+)
+
+/*
+Returns the key the day's statistics of a station are kept under for the spreadsheet the context writes to.
+*/
+func dayEndKey(ctx context.Context, station Station) string {
+	return spreadsheetFor(ctx) + " " + station.MacAddress
+}
+
+/*
+Returns a copy of the day's statistics of a station, to be updated with the readings of an append and stored again
+with saveDayEnd before the append, along with the days that ended whose rows are still to be written.
+*/
+func loadDayEnd(ctx context.Context, station Station) (dayEndStats, []dayEndStats) {
+	dayEndMutex.Lock()
+	defer dayEndMutex.Unlock()
+	stats := dayEndTotals[dayEndKey(ctx, station)]
+	stats.values = append([]dayEndValue(nil), stats.values...)
+	return stats, append([]dayEndStats(nil), dayEndPending[dayEndKey(ctx, station)]...)
+}
+
+/*
+Stores the day's statistics of a station and the days that ended whose rows are still to be written.
+*/
+func saveDayEnd(ctx context.Context, station Station, stats dayEndStats, pending []dayEndStats) {
+	dayEndMutex.Lock()
+	dayEndTotals[dayEndKey(ctx, station)] = stats
+	dayEndPending[dayEndKey(ctx, station)] = pending
+	dayEndMutex.Unlock()
+}
+
+/*
+Returns the value of the dateutc cell of the day's end of day row, the negative of the next midnight's dateutc in the
+configured timezone, which no reading can have.
+*/
+func (stats *dayEndStats) marker() int64 {
+	midnight, err := time.ParseInLocation(DATEFORMAT, stats.day, ambient.Location)
+	if err != nil {
+		return 0
+	}
+	return -midnight.AddDate(0, 0, 1).UnixMilli()
+}
+
+/*
+Adds a reading to the day's statistics, starting them if they are empty. Readings count towards degree minutes for
+the time since the previous reading, at most 15 minutes, and the day's first reading for 5 minutes. A reading no newer
+than the last one added was already counted by an append being retried and is skipped.
+*/
+func (stats *dayEndStats) add(data DeviceData, sheetName string) {
+	observed := data.Time()
+	if !stats.previous.IsZero() && !observed.After(stats.previous) {
+		return
+	}
+	if stats.day == "" {
+		stats.day = observed.Format(DATEFORMAT)
+		stats.values = make([]dayEndValue, len(config.EndOfDayStats))
+	}
+	stats.sheet = sheetName
+	minutes := 5.0
+	if !stats.previous.IsZero() {
+		minutes = min(observed.Sub(stats.previous), DAYENDGAP).Minutes()
+	}
+	stats.previous = observed
+
+	for i, stat := range config.EndOfDayStats {
+		number, ok := ambient.ToFloat(convertField(stat.Sensor, data.Fields[stat.Sensor]))
+		if !ok {
+			continue
+		}
+		value := &stats.values[i]
+		if value.count == 0 {
+			value.min, value.max = number, number
+		}
+		value.count++
+		value.sum += number
+		value.min = math.Min(value.min, number)
+		value.max = math.Max(value.max, number)
+		value.last = number
+		switch stat.Stat {
+		case DAYENDABOVE:
+			value.degreeMinutes += math.Max(number-stat.Threshold, 0) * minutes
+		case DAYENDBELOW:
+			value.degreeMinutes += math.Max(stat.Threshold-number, 0) * minutes
+		}
+	}
+}
+
+/*
+Returns the end of day row of the statistics, laid out in the mapped columns, with empty cells for sensors no
+reading reported and the day's marker in the dateutc column.
+*/
+func (stats *dayEndStats) row() []interface{} {
+	row := make([]interface{}, mappedColumns(allSensors))
+	if sensor, exists := allSensors["date"]; exists && stringToNum(sensor.ID) < len(row) {
+		row[stringToNum(sensor.ID)] = stats.day + DAYENDSUFFIX
+	}
+	if sensor, exists := allSensors["dateutc"]; exists && stringToNum(sensor.ID) < len(row) {
+		row[stringToNum(sensor.ID)] = float64(stats.marker())
+	}
+	for i, stat := range config.EndOfDayStats {
+		sensor, exists := allSensors[stat.Sensor]
+		value := stats.values[i]
+		if !exists || stringToNum(sensor.ID) >= len(row) || value.count == 0 {
+			continue
+		}
+		var result float64
+		switch stat.Stat {
+		case DAYENDMIN:
+			result = value.min
+		case DAYENDMAX:
+			result = value.max
+		case DAYENDMEAN:
+			result = value.sum / float64(value.count)
+		case DAYENDSUM:
+			result = value.sum
+		case DAYENDLAST:
+			result = value.last
+		default:
+			result = value.degreeMinutes
+		}
+		row[stringToNum(sensor.ID)] = math.Round(result*100) / 100
+	}
+	return row
+}
+
+/*
+Returns the problems with the configured end of day statistics: a missing sensor, a sensor given more than once, or
+an unknown statistic.
+*/
+func dayEndProblems(stats []DayEndStat) []string {
+	var problems []string
+	seen := make(map[string]bool)
+	for i, stat := range stats {
+		prefix := "endOfDayStats[" + strconv.Itoa(i) + "]: "
+		switch {
+		case stat.Sensor == "":
+			problems = append(problems, prefix+"sensor is missing")
+		case seen[stat.Sensor]:
+			problems = append(problems, prefix+"sensor "+stat.Sensor+" already has a statistic")
+		}
+		seen[stat.Sensor] = true
+		switch stat.Stat {
+		case DAYENDMIN, DAYENDMAX, DAYENDMEAN, DAYENDSUM, DAYENDLAST, DAYENDABOVE, DAYENDBELOW:
+		default:
+			problems = append(problems, fmt.Sprintf("%sstat must be one of %s, %s, %s, %s, %s, %s, or %s", prefix,
+				DAYENDMIN, DAYENDMAX, DAYENDMEAN, DAYENDSUM, DAYENDLAST, DAYENDABOVE, DAYENDBELOW))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
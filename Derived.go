@@ -0,0 +1,120 @@
+package main
+
+/*
+This file computes the standard derived meteorological values from the raw readings of a record. The dew point and
+feels like temperature are filled in when the station doesn't report them, and the heat index and wind chill, which
+the API never reports on their own, are added as the heatIndex and windChill fields so they can be mapped to columns
+in headers.txt like any other sensor. All values are in ºF, as the API reports temperatures.
+*/
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+var (
+	derivedSensors = map[string]bool{
+		"heatIndex": true, "windChill": true,
+		"aqiPM25": true, "aqiPM25_24h": true,
+		"rainToday": true, "rain24h": true, "rainMonth": true, "rainYear": true,
+	}
+)
+
+/*
+Returns the record with the derived values added: the dew point from the temperature and humidity, the heat index,
+the wind chill, and the feels like temperature, which is the wind chill below 50ºF, the heat index above 68ºF, and the
+temperature in between, matching how the Ambient Weather server calculates it. Values the station reported itself are
+kept.
+*/
+func withDerivedMetrics(data DeviceData) DeviceData {
+	if data.TempF == nil {
+		return data
+	}
+	tempF := *data.TempF
+	if data.Fields == nil {
+		data.Fields = make(map[string]interface{})
+	}
+
+	if data.Humidity != nil {
+		heatIndex := heatIndexF(tempF, *data.Humidity)
+		setDerived(&data, "heatIndex", heatIndex, nil)
+		if *data.Humidity > 0 {
+			setDerived(&data, "dewPoint", dewPointF(tempF, *data.Humidity), &data.DewPoint)
+		}
+	}
+	if data.WindSpeedMPH != nil {
+		setDerived(&data, "windChill", windChillF(tempF, *data.WindSpeedMPH), nil)
+	}
+
+	feelsLike := tempF
+	switch {
+	case tempF < 50 && data.WindSpeedMPH != nil:
+		feelsLike = windChillF(tempF, *data.WindSpeedMPH)
+	case tempF > 68 && data.Humidity != nil:
+		feelsLike = heatIndexF(tempF, *data.Humidity)
+	}
+	setDerived(&data, "feelsLike", feelsLike, &data.FeelsLike)
+	return data
+}
+
+/*
+Stores a derived value under the given field name, rounded to one decimal place, unless the record already has the
+field. The typed field, if given, is set as well.
+*/
+func setDerived(data *DeviceData, name string, value float64, field **float64) {
+	if _, exists := data.Fields[name]; exists {
+		return
+	}
+	rounded := math.Round(value*10) / 10
+	data.Fields[name] = json.Number(strconv.FormatFloat(rounded, 'f', -1, 64))
+	if field != nil && *field == nil {
+		*field = &rounded
+	}
+}
+
+/*
+Returns the dew point in ºF for a temperature in ºF and relative humidity, using the Magnus formula.
+*/
+func dewPointF(tempF float64, humidity float64) float64 {
+	tempC := (tempF - 32) * 5 / 9
+	gamma := math.Log(humidity/100) + 17.62*tempC/(243.12+tempC)
+	return (243.12*gamma/(17.62-gamma))*9/5 + 32
+}
+
+/*
+Returns the heat index in ºF using the National Weather Service's method: Steadman's simple formula, or the Rothfusz
+regression with its low and high humidity adjustments once the simple result reaches 80ºF. Below 68ºF the temperature
+is returned.
+*/
+func heatIndexF(tempF float64, humidity float64) float64 {
+	if tempF < 68 {
+		return tempF //Heat index is not defined for cool air
+	}
+	simple := 0.5 * (tempF + 61 + (tempF-68)*1.2 + humidity*0.094)
+	if (simple+tempF)/2 < 80 {
+		return simple
+	}
+
+	index := -42.379 + 2.04901523*tempF + 10.14333127*humidity - 0.22475541*tempF*humidity -
+		0.00683783*tempF*tempF - 0.05481717*humidity*humidity + 0.00122874*tempF*tempF*humidity +
+		0.00085282*tempF*humidity*humidity - 0.00000199*tempF*tempF*humidity*humidity
+	switch {
+	case humidity < 13 && tempF >= 80 && tempF <= 112:
+		index -= (13 - humidity) / 4 * math.Sqrt((17-math.Abs(tempF-95))/17)
+	case humidity > 85 && tempF >= 80 && tempF <= 87:
+		index += (humidity - 85) / 10 * (87 - tempF) / 5
+	}
+	return index
+}
+
+/*
+Returns the wind chill in ºF using the National Weather Service formula, which is defined for temperatures at or below
+50ºF and wind speeds above 3 mph. Outside of that the temperature is returned.
+*/
+func windChillF(tempF float64, windMPH float64) float64 {
+	if tempF > 50 || windMPH <= 3 {
+		return tempF
+	}
+	factor := math.Pow(windMPH, 0.16)
+	return 35.74 + 0.6215*tempF - 35.75*factor + 0.4275*tempF*factor
+}
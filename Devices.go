@@ -0,0 +1,119 @@
+package main
+
+/*
+This file implements the devices subcommand, which lists every weather station on the account of the configured API
+Key with its name, MAC Address, location, and when it last reported, so the MAC Address to put in the config can be
+looked up instead of copied from the Ambient Weather dashboard. When the config holds only the keys, the station is
+discovered from the same list at startup.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Lists the devices on the configured account and returns the exit code for the program, 0 if the list was retrieved
+and 1 otherwise.
+*/
+func runDevices(ctx context.Context) int {
+	loaded, err := loadConfig(configFile, profile)
+	if err != nil {
+		slog.Error("Unable to load configuration", "err", err)
+		return 1
+	}
+	applyConfig(loaded)
+
+	devices, err := listDevices(ctx)
+	if err != nil {
+		slog.Error("Unable to list devices", "err", err)
+		return 1
+	}
+	if len(devices) == 0 {
+		slog.Warn("No devices found on this account")
+		return 0
+	}
+
+	for _, device := range devices {
+		lastReported := "never"
+		if device.LastData.DateUTC > 0 {
+			lastReported = device.LastData.Time().Format(time.RFC1123)
+		}
+		slog.Info("Device", "name", device.Info.Name, "macAddress", device.MacAddress,
+			"location", device.Info.Coords.Location, "lastReported", lastReported)
+	}
+	return 0
+}
+
+/*
+Retrieves the most recent reading of every device on the account with a single call to the device list, keyed by the
+lowercase MAC Address. Returns nil if the list can't be retrieved.
+*/
+func lastDataSnapshot(ctx context.Context) map[string]DeviceData {
+	devices, err := listDevices(ctx)
+	if err != nil {
+		if !ambientBreaker.isOpen() {
+			slog.ErrorContext(ctx, "Unable to retrieve the device list", "err", err)
+		}
+		return nil
+	}
+
+	snapshot := make(map[string]DeviceData, len(devices))
+	for _, device := range devices {
+		snapshot[strings.ToLower(device.MacAddress)] = device.LastData
+	}
+	return snapshot
+}
+
+/*
+Discovers the station to poll from the devices on the configured account. A single device is used automatically. With
+several devices the user is asked to choose one when running in a terminal, otherwise an error naming the devices is
+returned so the MAC Address can be added to the config.
+*/
+func discoverStation(ctx context.Context) (Station, error) {
+	slog.Info("No station configured, discovering stations on the account")
+	devices, err := listDevices(ctx)
+	if err != nil {
+		return Station{}, err
+	}
+
+	switch {
+	case len(devices) == 0:
+		return Station{}, errors.New("no devices found on this account")
+	case len(devices) == 1:
+		slog.Info("Using the only station on the account", "name", devices[0].Info.Name,
+			"macAddress", devices[0].MacAddress)
+		return Station{Name: devices[0].Info.Name, MacAddress: devices[0].MacAddress}, nil
+	case !isTerminal(os.Stdin):
+		return Station{}, fmt.Errorf("%d devices found on this account, add the macAddress of one to the config "+
+			"(run the devices command to list them)", len(devices))
+	}
+
+	for i, device := range devices {
+		fmt.Println(strconv.Itoa(i+1) + ") " + device.Info.Name + " " + device.MacAddress + " " +
+			device.Info.Coords.Location)
+	}
+	fmt.Print("Select the station to poll [1-" + strconv.Itoa(len(devices)) + "]: ")
+
+	var choice int
+	if _, err := fmt.Scan(&choice); err != nil || choice < 1 || choice > len(devices) {
+		return Station{}, errors.New("no valid station selected")
+	}
+	device := devices[choice-1]
+	slog.Info("Using selected station, add its macAddress to the config to skip this prompt",
+		"name", device.Info.Name, "macAddress", device.MacAddress)
+	return Station{Name: device.Info.Name, MacAddress: device.MacAddress}, nil
+}
+
+/*
+Reports whether the given file is an interactive terminal rather than a pipe, file, or /dev/null.
+*/
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,114 @@
+package main
+
+/*
+This file adds a column for every field the API reports that isn't mapped in headers.txt yet, such as a sensor the
+station gained after the headers file was written, instead of silently dropping its data. The new column takes the
+letter after the last mapped column, soil probe columns included, its header is written to the sheet being written
+to, and the mapping is appended to headers.txt so the column keeps its place after a restart. Fields that describe the
+station rather than a reading are never added. When the mapping is kept in the spreadsheet's mapping sheet the new
+columns are appended to it instead. Discovery is off unless discoverSensors is set to true, leaving the headers file
+alone.
+*/
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DISCOVEREDSUFFIX = " (discovered)" //Ends the description of every column added automatically
+)
+
+var (
+	undiscoveredFields = map[string]bool{"macAddress": true, "loc": true, "tz": true, "passkey": true,
+		"PASSKEY": true, "stationtype": true}
+	discoveredHeaders []string     //Sensors added whose headers haven't been written to the sheets yet
+	sensorsMutex      sync.RWMutex //Held to change allSensors, and to read it outside the write path
+)
+
+/*
+Maps every field of the readings that has no column yet to a new column and appends the new mappings to the headers
+file. Returns the names of the sensors that were added, in the order of their columns.
+*/
+func discoverSensors(ctx context.Context, readings []DeviceData) []string {
+	if !config.DiscoverSensors || len(allSensors) == 0 {
+		return nil
+	}
+
+	var added []string
+	for _, data := range readings {
+		var unknown []string
+		for name := range data.Fields {
+			if _, exists := allSensors[name]; !exists && !undiscoveredFields[name] && !strings.Contains(name, ",") {
+				unknown = append(unknown, name)
+			}
+		}
+		sort.Strings(unknown)
+		sensorsMutex.Lock()
+		for _, name := range unknown {
+			allSensors[name] = SensorInfo{ID: columnID(mappedColumns(allSensors)), Description: name + DISCOVEREDSUFFIX}
+			added = append(added, name)
+		}
+		sensorsMutex.Unlock()
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	var lines strings.Builder
+	for _, name := range added {
+		slog.InfoContext(ctx, "Adding a column for a new sensor", "sensor", name, "column", allSensors[name].ID)
+		lines.WriteString("\n" + name + "," + allSensors[name].ID + "," + allSensors[name].Description)
+	}
+	if mappingFromSheet {
+		rows := make([][]interface{}, 0, len(added))
+		for _, name := range added {
+			rows = append(rows, mappingRow(name, allSensors[name]))
+		}
+		appendValues(withSpreadsheet(ctx, spreadsheetId), config.MappingSheet, rows, 1)
+	} else if err := appendHeaders(lines.String()); err != nil {
+		slog.ErrorContext(ctx, "Unable to save the new columns to "+headersFile+", they will move after a restart",
+			"err", err)
+	}
+	return added
+}
+
+/*
+Appends lines to the headers file, each starting with a newline, making sure the file's last line is kept intact.
+*/
+func appendHeaders(lines string) error {
+	existing, err := os.ReadFile(headersFile)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 && strings.HasSuffix(string(existing), "\n") {
+		lines = strings.TrimPrefix(lines, "\n") + "\n"
+	}
+
+	file, err := os.OpenFile(headersFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(lines)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+/*
+Writes the headers of newly added sensors to the first row of a sheet, after which the sheet's header row is checked
+again.
+*/
+func writeDiscoveredHeaders(ctx context.Context, sheetName string, added []string) {
+	if len(added) > 0 {
+		forgetAlignment(ctx, sheetName)
+	}
+	for _, name := range added {
+		sensor := allSensors[name]
+		updateValues(ctx, sheetName, [][]interface{}{{headerText(name, sensor.Description)}}, "!"+sensor.ID+"1", 1)
+	}
+}
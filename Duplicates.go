@@ -0,0 +1,324 @@
+package main
+
+/*
+This file keeps readings from being written to a sheet twice. An index of the dateutc of every row in each sheet
+written to is kept in memory, read from the sheet's dateutc column the first time the sheet is written to after a
+start, and readings already in the index are dropped before rows are appended. Restarts, backfills over readings that
+are already stored, and polls that return an old reading again therefore add no duplicate rows. When an append fails
+the sheet's index is read again before retrying, since a request that timed out may still have added its rows.
+Without a dateutc column in the headers file readings are written as they come.
+
+Every append is verified by reading back the range the API reports it wrote and comparing it with the rows sent. Only
+a verified append adds its readings to the index and counts as persisted, and readings whose write failed are kept
+in the queue of the sheets output and written again, see Sinks.go.
+*/
+import (
+	"context"
+	"fmt"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"google.golang.org/api/sheets/v4"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+)
+
+var (
+	writtenTimes      = make(map[string]map[int64]bool) //dateutc of the rows in each sheet, by sheetKey
+	writtenTimesMutex sync.Mutex
+)
+
+/*
+Appends rows for the station's readings of a sheet that aren't in the sheet yet, with an end of day row before the
+first reading of each new day, verifies the rows the sheet now holds, and adds the readings to the sheet's index once
+they are verified. The day's statistics are stored before the append, and the rows of days that ended stay pending
+until they are found in their sheet's index, so a failed append loses no statistics and a retried one adds no second
+end of day row. Returns whether every reading is persisted in the sheet. Error handling is provided allowing for 3
+runs, each reading the sheet's index again first.
+*/
+func appendReadings(ctx context.Context, station Station, sheetName string, readings []DeviceData, runs int) bool {
+	readings = unwrittenReadings(ctx, sheetName, readings)
+	dayEnds := len(config.EndOfDayStats) > 0
+	dayEnd, ended := loadDayEnd(ctx, station)
+	rows := make([][]interface{}, 0, len(readings)+len(ended))
+	var markers []int64 //dateutc cells of the end of day rows appended
+	addDayEnd := func(stats dayEndStats) {
+		if stats.sheet == sheetName && !isWritten(ctx, sheetName, stats.marker()) {
+			rows = append(rows, alignRow(ctx, sheetName, stats.row()))
+			markers = append(markers, stats.marker())
+		}
+	}
+	if dayEnds {
+		for _, stats := range ended {
+			addDayEnd(stats)
+		}
+	}
+	for _, data := range readings {
+		if dayEnds && (dayEnd.previous.IsZero() || data.Time().After(dayEnd.previous)) {
+			//Readings no newer than the day's last were counted by an earlier attempt, on this day or one that ended
+			if dayEnd.day != "" && dayEnd.day != data.Time().Format(DATEFORMAT) {
+				ended = append(ended, dayEnd)
+				addDayEnd(dayEnd)
+				dayEnd = dayEndStats{}
+			}
+			dayEnd.add(data, sheetName)
+		}
+		rows = append(rows, alignRow(ctx, sheetName, buildRow(data)))
+	}
+	if dayEnds {
+		saveDayEnd(ctx, station, dayEnd, ended)
+		for _, stats := range ended {
+			if stats.sheet != sheetName { //The day ended in the previous period's sheet
+				appendDayEnd(ctx, stats)
+			}
+		}
+		defer settleDayEnds(ctx, station)
+	}
+	if len(rows) == 0 {
+		slog.InfoContext(ctx, "Every reading is already in the sheet, nothing to append", "sheet", sheetName)
+		return true
+	}
+
+	slog.InfoContext(ctx, "Appending "+strconv.Itoa(len(rows))+" rows with Google API Client.", "sheet", sheetName)
+	resp, err := service.Spreadsheets.Values.Append(spreadsheetFor(ctx), quoteSheetName(sheetName)+"!A1",
+		&sheets.ValueRange{Values: rows}).ValueInputOption(config.ValueInput).InsertDataOption("INSERT_ROWS").
+		Context(ctx).Do()
+	if err != nil {
+		forgetWritten(ctx, sheetName)
+		if errorHandler(ctx, err, runs, "Unable to append values to sheet: ") {
+			return appendReadings(ctx, station, sheetName, readings, runs+1)
+		}
+		return false
+	}
+	if resp.Updates == nil || !verifyRows(ctx, resp.Updates.UpdatedRange, rows) {
+		forgetWritten(ctx, sheetName) //Whatever did land is found by the next read of the index
+		slog.ErrorContext(ctx, "Appended rows could not be verified, the readings will be written again",
+			"sheet", sheetName)
+		return false
+	}
+
+	markWritten(ctx, sheetName, readings)
+	markTimes(ctx, sheetName, markers)
+	slog.InfoContext(ctx, "Successfully appended and verified values in sheet")
+	return true
+}
+
+/*
+Appends the end of day row of a day that ended in another sheet than the one being written, unless the row is in that
+sheet's index already, and adds it to the index once it is verified.
+*/
+func appendDayEnd(ctx context.Context, stats dayEndStats) {
+	if isWritten(ctx, stats.sheet, stats.marker()) {
+		return
+	}
+	rows := [][]interface{}{alignRow(ctx, stats.sheet, stats.row())}
+	resp, err := service.Spreadsheets.Values.Append(spreadsheetFor(ctx), quoteSheetName(stats.sheet)+"!A1",
+		&sheets.ValueRange{Values: rows}).ValueInputOption(config.ValueInput).InsertDataOption("INSERT_ROWS").
+		Context(ctx).Do()
+	if err != nil || resp.Updates == nil || !verifyRows(ctx, resp.Updates.UpdatedRange, rows) {
+		forgetWritten(ctx, stats.sheet)
+		slog.WarnContext(ctx, "Unable to append the end of day row, it stays pending", "sheet", stats.sheet,
+			"day", stats.day, "err", err)
+		return
+	}
+	markTimes(ctx, stats.sheet, []int64{stats.marker()})
+}
+
+/*
+Drops the days that ended whose end of day rows are now in their sheets from the station's pending days. Without a
+dateutc column the rows can't be found, so every day is dropped once its row was sent.
+*/
+func settleDayEnds(ctx context.Context, station Station) {
+	dayEnd, ended := loadDayEnd(ctx, station)
+	_, indexed := allSensors["dateutc"]
+	pending := ended[:0]
+	for _, stats := range ended {
+		if indexed && !isWritten(ctx, stats.sheet, stats.marker()) {
+			pending = append(pending, stats)
+		}
+	}
+	saveDayEnd(ctx, station, dayEnd, pending)
+}
+
+/*
+Reads back the range an append reports it wrote and reports whether it holds exactly the rows that were sent. Empty
+cells are read back as missing, so a missing cell matches an empty one.
+*/
+func verifyRows(ctx context.Context, updatedRange string, rows [][]interface{}) bool {
+	resp, err := service.Spreadsheets.Values.Get(spreadsheetFor(ctx), updatedRange).
+		ValueRenderOption("UNFORMATTED_VALUE").Context(ctx).Do()
+	if err != nil {
+		slog.WarnContext(ctx, "Unable to read back the appended rows", "range", updatedRange, "err", err)
+		return false
+	}
+	if len(resp.Values) != len(rows) {
+		slog.WarnContext(ctx, "Appended range holds a different number of rows", "range", updatedRange,
+			"sent", len(rows), "found", len(resp.Values))
+		return false
+	}
+
+	for i, row := range rows {
+		written := resp.Values[i]
+		for column := 0; column < max(len(row), len(written)); column++ {
+			var sent, found interface{}
+			if column < len(row) {
+				sent = row[column]
+			}
+			if column < len(written) {
+				found = written[column]
+			}
+			if !cellsMatch(sent, found) {
+				slog.WarnContext(ctx, "Appended row differs from the row sent", "range", updatedRange, "row", i,
+					"column", columnID(column), "sent", sent, "found", found)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+Reports whether a value sent to a cell matches the value read back from it. A missing value matches an empty string,
+and numbers match if they agree to the 15 significant digits Sheets keeps. With USER_ENTERED input a string Sheets
+parsed into a number, date, or boolean matches whatever it was parsed into.
+*/
+func cellsMatch(sent interface{}, found interface{}) bool {
+	if _, isString := sent.(string); isString && config.ValueInput == VALUEINPUTUSERENTERED {
+		if _, stillString := found.(string); !stillString && found != nil {
+			return true
+		}
+	}
+	if sentNumber, ok := sent.(float64); ok {
+		foundNumber, ok := found.(float64)
+		return ok && math.Abs(sentNumber-foundNumber) <= 1e-14*max(1, math.Abs(sentNumber))
+	}
+	if sent == nil {
+		sent = ""
+	}
+	if found == nil {
+		found = ""
+	}
+	return fmt.Sprint(sent) == fmt.Sprint(found)
+}
+
+/*
+Returns the readings whose dateutc isn't in the sheet yet, also dropping repeats within the readings themselves. The
+sheet's index is read from the sheet if it isn't held yet. Every reading is returned if dateutc isn't mapped to a
+column or the sheet can't be read, so a failed read never loses data.
+*/
+func unwrittenReadings(ctx context.Context, sheetName string, readings []DeviceData) []DeviceData {
+	if !loadWritten(ctx, sheetName) {
+		return readings
+	}
+
+	writtenTimesMutex.Lock()
+	written := writtenTimes[sheetKey(ctx, sheetName)]
+	seen := make(map[int64]bool, len(readings))
+	unwritten := make([]DeviceData, 0, len(readings))
+	for _, data := range readings {
+		if data.DateUTC > 0 && (written[data.DateUTC] || seen[data.DateUTC]) {
+			continue
+		}
+		seen[data.DateUTC] = true
+		unwritten = append(unwritten, data)
+	}
+	writtenTimesMutex.Unlock()
+
+	if skipped := len(readings) - len(unwritten); skipped > 0 {
+		slog.InfoContext(ctx, "Skipped "+strconv.Itoa(skipped)+" readings already in the sheet", "sheet", sheetName)
+	}
+	return unwritten
+}
+
+/*
+Reads the index of a sheet from its dateutc column if the index isn't held yet. Reports false if dateutc isn't mapped
+to a column or the column can't be read.
+*/
+func loadWritten(ctx context.Context, sheetName string) bool {
+	writtenTimesMutex.Lock()
+	_, exists := writtenTimes[sheetKey(ctx, sheetName)]
+	writtenTimesMutex.Unlock()
+	if exists {
+		return true
+	}
+
+	sensor, mapped := allSensors["dateutc"]
+	if !mapped || service == nil {
+		return false
+	}
+	resp, err := service.Spreadsheets.Values.Get(spreadsheetFor(ctx), quoteSheetName(sheetName)+"!"+sensor.ID+":"+
+		sensor.ID).ValueRenderOption("UNFORMATTED_VALUE").Context(ctx).Do()
+	if err != nil {
+		slog.WarnContext(ctx, "Unable to read the stored readings, writing without duplicate protection",
+			"sheet", sheetName, "err", err)
+		return false
+	}
+
+	written := make(map[int64]bool, len(resp.Values))
+	for _, row := range resp.Values {
+		if len(row) == 0 {
+			continue
+		}
+		if dateUTC, ok := ambient.ToFloat(row[0]); ok && dateUTC != 0 { //End of day rows hold negative markers
+			written[int64(dateUTC)] = true
+		}
+	}
+	writtenTimesMutex.Lock()
+	writtenTimes[sheetKey(ctx, sheetName)] = written
+	writtenTimesMutex.Unlock()
+	return true
+}
+
+/*
+Adds the dateutc of appended readings to the index of their sheet, if the index is held.
+*/
+func markWritten(ctx context.Context, sheetName string, readings []DeviceData) {
+	writtenTimesMutex.Lock()
+	defer writtenTimesMutex.Unlock()
+	written, exists := writtenTimes[sheetKey(ctx, sheetName)]
+	if !exists {
+		return
+	}
+	for _, data := range readings {
+		if data.DateUTC > 0 {
+			written[data.DateUTC] = true
+		}
+	}
+}
+
+/*
+Adds the dateutc cells of appended end of day rows to the index of their sheet, if the index is held.
+*/
+func markTimes(ctx context.Context, sheetName string, times []int64) {
+	writtenTimesMutex.Lock()
+	defer writtenTimesMutex.Unlock()
+	written, exists := writtenTimes[sheetKey(ctx, sheetName)]
+	if !exists {
+		return
+	}
+	for _, dateUTC := range times {
+		written[dateUTC] = true
+	}
+}
+
+/*
+Reports whether a row with the given dateutc cell is in the index of a sheet, reading the index first if it isn't
+held. Reports false if the index can't be read.
+*/
+func isWritten(ctx context.Context, sheetName string, dateUTC int64) bool {
+	if dateUTC == 0 || !loadWritten(ctx, sheetName) {
+		return false
+	}
+	writtenTimesMutex.Lock()
+	defer writtenTimesMutex.Unlock()
+	return writtenTimes[sheetKey(ctx, sheetName)][dateUTC]
+}
+
+/*
+Drops the index of a sheet so that it is read from the sheet again before the next append.
+*/
+func forgetWritten(ctx context.Context, sheetName string) {
+	writtenTimesMutex.Lock()
+	delete(writtenTimes, sheetKey(ctx, sheetName))
+	writtenTimesMutex.Unlock()
+}
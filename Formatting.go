@@ -0,0 +1,210 @@
+package main
+
+/*
+This file colors the cells of new station sheets with conditional formatting so that notable readings stand out at a
+glance. Each rule in conditionalFormats compares a sensor's column against a value and fills matching cells with a
+color, e.g. {"sensor": "tempf", "condition": "<", "value": 32, "color": "#6FA8DC"} shades freezing temperatures blue
+and {"sensor": "windgustmph", "condition": ">", "value": 40, "color": "#E06666"} shades strong gusts red. Values are
+compared in the units written to the sheet. The rules are added when a sheet is created, so existing sheets keep
+their formatting. The date columns of every station sheet are also given a date-time number format, since the times
+are written as Sheets date-times, and new sheets give each reading's column a number format: the one given after its
+column ID in headers.txt (e.g. tempf,B:0.0,...), or else the decimals its unit is rounded to, e.g. one for
+temperatures and two for rain, and whole numbers for humidity.
+*/
+import (
+	"fmt"
+	"google.golang.org/api/sheets/v4"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+FormatRule is a struct that holds a conditional formatting rule: the sensor whose column it applies to, the
+comparison and value a cell must match, and the background color of matching cells as #RRGGBB.
+*/
+type FormatRule struct {
+	Sensor    string  `json:"sensor"`
+	Condition string  `json:"condition"`
+	Value     float64 `json:"value"`
+	Color     string  `json:"color"`
+}
+
+var (
+	formatConditions = map[string]string{"<": "NUMBER_LESS", "<=": "NUMBER_LESS_THAN_EQ", ">": "NUMBER_GREATER",
+		">=": "NUMBER_GREATER_THAN_EQ", "=": "NUMBER_EQ", "!=": "NUMBER_NOT_EQ"}
+)
+
+/*
+Returns the requests that add the configured conditional formatting rules to a new sheet with the given ID. A rule is
+only added if the sheet has a column headed by its sensor, so sheets such as the Daily Summary are left alone.
+*/
+func formatRequests(sheetId int64, headers []interface{}) []*sheets.Request {
+	var requests []*sheets.Request
+	for _, rule := range config.FormatRules {
+		column, exists := sensorColumn(rule.Sensor, headers)
+		if !exists {
+			continue
+		}
+		color, _ := parseColor(rule.Color)
+
+		requests = append(requests, &sheets.Request{
+			AddConditionalFormatRule: &sheets.AddConditionalFormatRuleRequest{
+				Rule: &sheets.ConditionalFormatRule{
+					Ranges: []*sheets.GridRange{{
+						SheetId:          sheetId,
+						StartRowIndex:    1, //Below the header row
+						StartColumnIndex: int64(column),
+						EndColumnIndex:   int64(column + 1),
+					}},
+					BooleanRule: &sheets.BooleanRule{
+						Condition: &sheets.BooleanCondition{
+							Type: formatConditions[rule.Condition],
+							Values: []*sheets.ConditionValue{
+								{UserEnteredValue: strconv.FormatFloat(rule.Value, 'f', -1, 64)},
+							},
+						},
+						Format: &sheets.CellFormat{BackgroundColor: color},
+					},
+				},
+			},
+		})
+	}
+	return requests
+}
+
+/*
+Returns the requests that give the date and lightning time columns of a sheet with the given ID and header row the
+date-time number format, so the date-times written to them show as times rather than serial numbers.
+*/
+func dateFormatRequests(sheetId int64, headers []interface{}) []*sheets.Request {
+	var requests []*sheets.Request
+	for _, name := range []string{"date", "lightning_time"} {
+		column, exists := sensorColumn(name, headers)
+		if !exists {
+			continue
+		}
+		requests = append(requests, &sheets.Request{
+			RepeatCell: &sheets.RepeatCellRequest{
+				Range: &sheets.GridRange{
+					SheetId:          sheetId,
+					StartRowIndex:    1, //Below the header row
+					StartColumnIndex: int64(column),
+					EndColumnIndex:   int64(column + 1),
+				},
+				Cell: &sheets.CellData{
+					UserEnteredFormat: &sheets.CellFormat{
+						NumberFormat: &sheets.NumberFormat{Type: "DATE_TIME", Pattern: ROWTIMEPATTERN},
+					},
+				},
+				Fields: "userEnteredFormat.numberFormat",
+			},
+		})
+	}
+	return requests
+}
+
+/*
+Returns the requests that give every mapped column of a sheet with the given ID and header row its number format.
+Columns without a format are left as they are.
+*/
+func numberFormatRequests(sheetId int64, headers []interface{}) []*sheets.Request {
+	names := make([]string, 0, len(allSensors))
+	for name := range allSensors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var requests []*sheets.Request
+	for _, name := range names {
+		pattern := numberFormat(name, allSensors[name])
+		column, exists := sensorColumn(name, headers)
+		if pattern == "" || !exists {
+			continue
+		}
+		requests = append(requests, &sheets.Request{
+			RepeatCell: &sheets.RepeatCellRequest{
+				Range: &sheets.GridRange{
+					SheetId:          sheetId,
+					StartRowIndex:    1, //Below the header row
+					StartColumnIndex: int64(column),
+					EndColumnIndex:   int64(column + 1),
+				},
+				Cell: &sheets.CellData{
+					UserEnteredFormat: &sheets.CellFormat{
+						NumberFormat: &sheets.NumberFormat{Type: "NUMBER", Pattern: pattern},
+					},
+				},
+				Fields: "userEnteredFormat.numberFormat",
+			},
+		})
+	}
+	return requests
+}
+
+/*
+Returns the number format of a sensor's column: the format from the headers file if it has one, a whole number for
+humidity, or the decimals of the unit the sensor is written in. Returns an empty string for any other sensor.
+*/
+func numberFormat(name string, sensor SensorInfo) string {
+	if sensor.Format != "" {
+		return sensor.Format
+	}
+	if strings.HasPrefix(name, "humidity") || strings.HasPrefix(name, "soilhum") {
+		return "0"
+	}
+
+	chosen, converted := unitFor(name)
+	if !converted {
+		kind, exists := sensorQuantities[name]
+		if !exists {
+			return ""
+		}
+		chosen = quantities[kind].units[quantities[kind].reported]
+	}
+	if chosen.decimals == 0 {
+		return "0"
+	}
+	return "0." + strings.Repeat("0", chosen.decimals)
+}
+
+/*
+Parses a color written as #RRGGBB into the fractions of red, green, and blue used by the Sheets API.
+*/
+func parseColor(text string) (*sheets.Color, error) {
+	hex, found := strings.CutPrefix(text, "#")
+	if !found || len(hex) != 6 {
+		return nil, fmt.Errorf("color %q must be written as #RRGGBB", text)
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("color %q must be written as #RRGGBB", text)
+	}
+	return &sheets.Color{
+		Red:   float64(value>>16&0xFF) / 255,
+		Green: float64(value>>8&0xFF) / 255,
+		Blue:  float64(value&0xFF) / 255,
+	}, nil
+}
+
+/*
+Returns the problems with the configured conditional formatting rules: a missing sensor, an unknown condition, or a
+color that can't be parsed.
+*/
+func formatRuleProblems(rules []FormatRule) []string {
+	var problems []string
+	for i, rule := range rules {
+		prefix := "conditionalFormats[" + strconv.Itoa(i) + "]: "
+		if rule.Sensor == "" {
+			problems = append(problems, prefix+"sensor is missing")
+		}
+		if _, exists := formatConditions[rule.Condition]; !exists {
+			problems = append(problems, prefix+"condition must be one of <, <=, >, >=, =, or !=")
+		}
+		if _, err := parseColor(rule.Color); err != nil {
+			problems = append(problems, prefix+err.Error())
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
@@ -0,0 +1,166 @@
+package main
+
+/*
+This file serves the readings held for the REST API as a Grafana JSON datasource under /grafana on apiListen, so they
+can be graphed in Grafana without a database. Add a JSON datasource (simpod-json-datasource) in Grafana with the URL
+http://<host><apiListen>/grafana. Every numeric sensor is a metric, named after its field, e.g. tempf, and a query
+returns one series per station, named after the station and the sensor. A query's payload may name a station, by MAC
+Address or name, to return only that station's series:
+{"station": "Backyard"}
+The endpoints follow both the current and the older SimpleJSON versions of the protocol, so the Infinity datasource
+can also read /api/history directly.
+*/
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+grafanaQuery is a struct that holds the parts of a Grafana query request that are used: the time range, the most
+points a series should have, and the metrics queried.
+*/
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	MaxDataPoints int `json:"maxDataPoints"`
+	Targets       []struct {
+		Target  string `json:"target"`
+		Hide    bool   `json:"hide"`
+		Payload struct {
+			Station string `json:"station"`
+		} `json:"payload"`
+	} `json:"targets"`
+}
+
+/*
+grafanaSeries is a struct that holds a series of a Grafana query response, with every point a value and a time in
+milliseconds.
+*/
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+/*
+Registers the Grafana datasource endpoints on a server's handlers.
+*/
+func registerGrafana(mux *http.ServeMux) {
+	mux.HandleFunc("GET /grafana/{$}", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"}) //Grafana's connection test
+	})
+	mux.HandleFunc("POST /grafana/search", serveGrafanaSearch)
+	mux.HandleFunc("POST /grafana/metrics", serveGrafanaMetrics)
+	mux.HandleFunc("POST /grafana/query", serveGrafanaQuery)
+}
+
+/*
+Writes the names of the metrics that can be queried, the numeric fields of the readings held, for the SimpleJSON
+version of the protocol.
+*/
+func serveGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, grafanaMetrics(r))
+}
+
+/*
+Writes the metrics that can be queried, labelled with the sensor's description and unit, for the current version of
+the protocol.
+*/
+func serveGrafanaMetrics(w http.ResponseWriter, r *http.Request) {
+	body := []map[string]string{}
+	for _, name := range grafanaMetrics(r) {
+		label := sensorTitle(name)
+		if unit := sensorUnit(name); unit != "" {
+			label += " (" + unit + ")"
+		}
+		body = append(body, map[string]string{"label": label, "value": name})
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+/*
+Returns the sorted names of the numeric fields in the readings held for every station.
+*/
+func grafanaMetrics(r *http.Request) []string {
+	found := make(map[string]bool)
+	for _, ring := range requestedRings(r) {
+		for _, data := range ring.readings {
+			for name, value := range data.Fields {
+				if _, numeric := numericValue(name, value); numeric && !undiscoveredFields[name] {
+					found[name] = true
+				}
+			}
+		}
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Writes a series for every station and queried metric with the values held in the query's time range, thinned to at
+most the points Grafana asked for.
+*/
+func serveGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var query grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid query: " + err.Error()})
+		return
+	}
+	from, to := query.Range.From.UnixMilli(), query.Range.To.UnixMilli()
+	if query.Range.To.IsZero() {
+		to = time.Now().UnixMilli()
+	}
+
+	rings := requestedRings(r)
+	body := []grafanaSeries{}
+	for _, target := range query.Targets {
+		if target.Target == "" || target.Hide {
+			continue
+		}
+		for _, ring := range rings {
+			station := target.Payload.Station
+			if station != "" && !strings.EqualFold(ring.station.MacAddress, station) &&
+				ring.station.displayName() != station {
+				continue
+			}
+			series := grafanaSeries{Target: ring.station.displayName() + " " + sensorTitle(target.Target)}
+			for _, data := range ring.since(from - 1) {
+				if data.DateUTC > to {
+					break
+				}
+				if value, numeric := numericValue(target.Target, data.Fields[target.Target]); numeric {
+					series.Datapoints = append(series.Datapoints, [2]float64{value, float64(data.DateUTC)})
+				}
+			}
+			if len(series.Datapoints) > 0 {
+				series.Datapoints = thinPoints(series.Datapoints, query.MaxDataPoints)
+				body = append(body, series)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+/*
+Returns every nth point of a series so it has at most the given number of points, keeping the newest point. A limit of
+0 or less keeps every point.
+*/
+func thinPoints(points [][2]float64, limit int) [][2]float64 {
+	if limit <= 0 || len(points) <= limit {
+		return points
+	}
+	step := (len(points) + limit - 1) / limit
+	thinned := make([][2]float64, 0, limit)
+	for i := (len(points) - 1) % step; i < len(points); i += step {
+		thinned = append(thinned, points[i])
+	}
+	return thinned
+}
@@ -0,0 +1,179 @@
+package main
+
+/*
+This file sends the readings to Graphite, and optionally StatsD, for users with existing Graphite stacks. With
+graphiteAddress set every numeric sensor value of a reading is sent over TCP in the plaintext protocol, at the reading's
+dateutc, to a path filled in from the metricPath template, by default weather.{{.Station}}.{{.Sensor}}. The template can
+use Station, the station's name or MAC Address, MAC, the MAC Address without colons, and Sensor, the sensor's name, each
+with the characters Graphite treats specially replaced by underscores. With statsdAddress set the values of each
+station's newest reading are also sent over UDP as StatsD gauges on the same paths, since StatsD has no timestamps.
+Values are sent in their configured units.
+*/
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	GRAPHITETIMEOUT = 10 * time.Second
+	METRICPATH      = "weather.{{.Station}}.{{.Sensor}}"
+)
+
+/*
+metricPathData is a struct that holds the values a metric path template can use.
+*/
+type metricPathData struct {
+	Station string //Name of the station, or its MAC Address if unnamed
+	MAC     string //MAC Address without colons
+	Sensor  string
+}
+
+/*
+metricValue is a struct that holds a sensor value of a reading along with its metric path.
+*/
+type metricValue struct {
+	path  string
+	value float64
+}
+
+var (
+	metricPathTemplate *template.Template //Parsed from metricPath
+	metricInvalidPath  = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+/*
+Parses a metric path template and checks that it can be filled in. An empty template parses the default path.
+*/
+func parseMetricPath(text string) (*template.Template, error) {
+	if text == "" {
+		text = METRICPATH
+	}
+	parsed, err := template.New("metricPath").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := parsed.Execute(&strings.Builder{}, metricPathData{Station: "Backyard", Sensor: "tempf"}); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+/*
+Sends the readings of a station to Graphite and their newest values to StatsD. Returns an error unless the readings
+were sent to Graphite, and nil when no graphiteAddress is configured. StatsD is sent to on a best effort basis,
+as UDP gives no acknowledgement.
+*/
+func writeGraphite(ctx context.Context, station Station, readings []DeviceData) error {
+	if (config.GraphiteAddr == "" && config.StatsDAddr == "") || len(readings) == 0 || metricPathTemplate == nil {
+		return nil
+	}
+
+	if config.StatsDAddr != "" {
+		var lines strings.Builder
+		for _, metric := range metricValues(station, readings[len(readings)-1]) {
+			lines.WriteString(metric.path + ":" + strconv.FormatFloat(metric.value, 'f', -1, 64) + "|g\n")
+		}
+		if err := sendMetrics(ctx, "udp", config.StatsDAddr, lines.String()); err != nil {
+			slog.WarnContext(ctx, "Unable to send the readings to StatsD", "address", config.StatsDAddr, "err", err)
+		}
+	}
+	if config.GraphiteAddr == "" {
+		return nil
+	}
+
+	var lines strings.Builder
+	for _, data := range readings {
+		timestamp := " " + strconv.FormatInt(data.DateUTC/1000, 10) + "\n"
+		for _, metric := range metricValues(station, data) {
+			lines.WriteString(metric.path + " " + strconv.FormatFloat(metric.value, 'f', -1, 64) + timestamp)
+		}
+	}
+	if err := sendMetrics(ctx, "tcp", config.GraphiteAddr, lines.String()); err != nil {
+		return fmt.Errorf("unable to send the readings to Graphite at %s: %w", config.GraphiteAddr, err)
+	}
+	slog.InfoContext(ctx, "Sent "+strconv.Itoa(len(readings))+" readings to Graphite", "station",
+		station.displayName())
+	return nil
+}
+
+/*
+Returns the metric path and value of every numeric sensor value of a reading, in order of the paths. Booleans are sent
+as 1 or 0, and values that aren't numbers are skipped.
+*/
+func metricValues(station Station, data DeviceData) []metricValue {
+	if data.DateUTC <= 0 {
+		return nil
+	}
+	values := make([]metricValue, 0, len(data.Fields))
+	for name, value := range data.Fields {
+		if undiscoveredFields[name] {
+			continue
+		}
+		var number float64
+		switch typed := cellValue(convertField(name, value)).(type) {
+		case float64:
+			number = typed
+		case bool:
+			if typed {
+				number = 1
+			}
+		default:
+			continue
+		}
+
+		var path strings.Builder
+		err := metricPathTemplate.Execute(&path, metricPathData{
+			Station: metricInvalidPath.ReplaceAllString(station.displayName(), "_"),
+			MAC:     strings.ReplaceAll(station.MacAddress, ":", ""),
+			Sensor:  metricInvalidPath.ReplaceAllString(name, "_"),
+		})
+		if err == nil {
+			values = append(values, metricValue{path: strings.Join(strings.Fields(path.String()), "_"), value: number})
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].path < values[j].path })
+	return values
+}
+
+/*
+Opens a connection to the given address, writes the lines, and closes it again.
+*/
+func sendMetrics(ctx context.Context, network string, address string, lines string) error {
+	if lines == "" {
+		return nil
+	}
+	dialer := net.Dialer{Timeout: GRAPHITETIMEOUT}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(GRAPHITETIMEOUT)); err != nil {
+		return errors.Join(err, conn.Close())
+	}
+	if network == "udp" { //One datagram per line, so no datagram exceeds the network's packet size
+		for _, line := range strings.SplitAfter(lines, "\n") {
+			if line == "" {
+				continue
+			}
+			if _, err := conn.Write([]byte(line)); err != nil {
+				return errors.Join(err, conn.Close())
+			}
+		}
+		return conn.Close()
+	}
+	writer := bufio.NewWriter(conn)
+	if _, err := writer.WriteString(lines); err != nil {
+		return errors.Join(err, conn.Close())
+	}
+	return errors.Join(writer.Flush(), conn.Close())
+}
@@ -0,0 +1,189 @@
+package main
+
+/*
+This file keeps rows lined up with their headers when the header row of a sheet no longer matches the headers mapping,
+e.g. after a collaborator inserted a column. The first time a sheet is written to after a start, and again every hour,
+its header row is read and compared with the headers the mapping produces. Sheets created before a column's header
+was renamed, or before columns were added at the end of the mapping, match as well: the header a column was created
+with in legacyDescriptions is accepted in its place, and columns the row doesn't reach yet are written where they are
+mapped. If every expected header is still in the row, only at a different position, rows are written to the columns
+the headers moved to. If a header is missing the sheet can't be realigned, the rows are written to the mapped columns
+as before, and a header_drift event is logged and sent to the alert URL so the sheet can be fixed by hand.
+*/
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HEADERCHECKINTERVAL = time.Hour
+)
+
+/*
+columnAlignment is a struct that holds the result of the last header check of a sheet: when it was made, the column
+every mapped column's header was found in, or nil if the headers are where the mapping puts them, and whether the
+sheet has drifted beyond realigning.
+*/
+type columnAlignment struct {
+	checked time.Time
+	columns []int
+	drifted bool
+}
+
+var (
+	alignments      = make(map[string]columnAlignment) //Last header check of each sheet, by sheetKey
+	alignmentsMutex sync.Mutex
+
+	legacyDescriptions = map[string]string{ //Headers that sheets created by earlier versions have
+		"lightning_day":  "Lightning strikes per day, int",
+		"lightning_hour": "Lightning strikes per hour, int",
+		"lightning_time": "Last strike time, Datetime",
+	}
+)
+
+/*
+Compares the header row of a sheet with the expected headers if the sheet hasn't been checked within the last hour,
+and records where rows must be written. Alerts once when the sheet drifts beyond realigning.
+*/
+func checkHeaderDrift(ctx context.Context, station Station, sheetName string) {
+	key := sheetKey(ctx, sheetName)
+	alignmentsMutex.Lock()
+	previous, exists := alignments[key]
+	alignmentsMutex.Unlock()
+	if exists && time.Since(previous.checked) < HEADERCHECKINTERVAL {
+		return
+	}
+
+	resp, err := service.Spreadsheets.Values.Get(spreadsheetFor(ctx), quoteSheetName(sheetName)+"!1:1").
+		Context(ctx).Do()
+	if err != nil {
+		slog.WarnContext(ctx, "Unable to read the header row, keeping the current columns", "sheet", sheetName,
+			"err", err)
+		return
+	}
+	var actual []interface{}
+	if len(resp.Values) > 0 {
+		actual = resp.Values[0]
+	}
+
+	alignment := alignColumns(sensorHeaders(), legacyHeaders(), actual)
+	alignment.checked = time.Now()
+	switch {
+	case alignment.drifted && !previous.drifted:
+		message := "The header row of sheet " + sheetName + " no longer matches " + headersFile +
+			" and can't be realigned, rows are written to the mapped columns"
+		slog.ErrorContext(ctx, message, "event", "header_drift", "station", station.displayName())
+		sendAlert(ctx, "header_drift", station, message, alignment.checked)
+	case alignment.columns != nil && previous.columns == nil:
+		slog.WarnContext(ctx, "The header row of the sheet has moved, realigning the columns", "sheet", sheetName)
+	}
+
+	alignmentsMutex.Lock()
+	alignments[key] = alignment
+	alignmentsMutex.Unlock()
+}
+
+/*
+Returns the header row that sheets created by earlier versions have, the expected header row with the headers of
+legacyDescriptions in their columns.
+*/
+func legacyHeaders() []interface{} {
+	row := sensorHeaders()
+	for name, description := range legacyDescriptions {
+		if sensor, exists := allSensors[name]; exists {
+			row[stringToNum(sensor.ID)] = headerText(name, description)
+		}
+	}
+	return row
+}
+
+/*
+Reports whether a header of the sheet is the one expected in its column, any header matching a column no sensor is
+mapped to.
+*/
+func sameHeader(expected interface{}, header string) bool {
+	return expected == nil || fmt.Sprint(expected) == header
+}
+
+/*
+Compares the expected header row, or the legacy header row of sheets created by earlier versions, with the sheet's
+actual header row. Returns no columns if every header the sheet has is where it is expected, even if the row ends
+before the last expected column, the column each expected header was found in if they have moved, and drifted if a
+header is missing or appears more than once.
+*/
+func alignColumns(expected []interface{}, legacy []interface{}, actual []interface{}) columnAlignment {
+	matches := true
+	positions := make(map[string]int, len(actual))
+	repeated := make(map[string]bool)
+	for i, cell := range actual {
+		header := strings.TrimSpace(fmt.Sprint(cell))
+		legacyMatch := i < len(legacy) && sameHeader(legacy[i], header)
+		if i < len(expected) && !sameHeader(expected[i], header) && !legacyMatch {
+			matches = false
+		}
+		if _, exists := positions[header]; exists {
+			repeated[header] = true
+		}
+		positions[header] = i
+	}
+	if matches {
+		return columnAlignment{}
+	}
+
+	columns := make([]int, len(expected))
+	for i, header := range expected {
+		if header == nil {
+			columns[i] = -1
+			continue
+		}
+		position, exists := positions[fmt.Sprint(header)]
+		if !exists && i < len(legacy) && legacy[i] != nil {
+			header = legacy[i]
+			position, exists = positions[fmt.Sprint(header)]
+		}
+		if !exists || repeated[fmt.Sprint(header)] {
+			return columnAlignment{drifted: true}
+		}
+		columns[i] = position
+	}
+	return columnAlignment{columns: columns}
+}
+
+/*
+Moves the cells of a row built for the mapped columns to the columns their headers were found in on the sheet. The row
+is returned unchanged if the sheet's headers are where the mapping puts them.
+*/
+func alignRow(ctx context.Context, sheetName string, row []interface{}) []interface{} {
+	alignmentsMutex.Lock()
+	columns := alignments[sheetKey(ctx, sheetName)].columns
+	alignmentsMutex.Unlock()
+	if columns == nil {
+		return row
+	}
+
+	width := 0
+	for _, column := range columns {
+		width = max(width, column+1)
+	}
+	aligned := make([]interface{}, width)
+	for i, cell := range row {
+		if i < len(columns) && columns[i] >= 0 {
+			aligned[columns[i]] = cell
+		}
+	}
+	return aligned
+}
+
+/*
+Drops the last header check of a sheet so that its header row is read again before the next write, e.g. after new
+headers were written to it.
+*/
+func forgetAlignment(ctx context.Context, sheetName string) {
+	alignmentsMutex.Lock()
+	delete(alignments, sheetKey(ctx, sheetName))
+	alignmentsMutex.Unlock()
+}
@@ -0,0 +1,243 @@
+package main
+
+/*
+This file serves liveness and readiness endpoints at healthListen, so Kubernetes and uptime monitors can tell a wedged
+process from a healthy one:
+  - /healthz answers 200 while the scheduler is alive, that is it has checked in within HEALTHTIMEOUT, and 503 once it
+    has stopped checking in. The scheduler checks in every CLOCKCHECK while waiting for its next call and after every
+    station it polls. In realtime mode there is no scheduler and /healthz answers 200 while the program runs.
+  - /readyz answers 200 once the program has started, and 503 once the data is stale. With the scheduler, the data is
+    stale when a call was made more than healthMaxAgeMinutes ago and no station was polled, or an output wasn't
+    written, since that call, so a schedule that calls less often than healthMaxAgeMinutes, such as hourly, stays
+    ready between its calls. In realtime mode, it is stale once the program has run for healthMaxAgeMinutes and no
+    reading was pushed, or an output wasn't written, within that many minutes.
+
+Both answer with a JSON body holding the status, the problems found, the time the scheduler last checked in, the
+earliest call it has scheduled, its last call, the last successful poll, and the last successful write of each output,
+such as sheets for the Google Sheet.
+*/
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTHTIMEOUT = 10 * time.Minute //Longest time the scheduler may go without checking in, a poll included
+)
+
+var (
+	healthMutex sync.Mutex
+	health      = healthState{writes: make(map[string]time.Time), calls: make(map[cronSchedule]time.Time),
+		called: make(map[cronSchedule][]time.Time)}
+)
+
+/*
+healthState is a struct that holds the times the health endpoints report on.
+*/
+type healthState struct {
+	started   time.Time
+	scheduler time.Time
+	polled    time.Time
+	writes    map[string]time.Time         //Last successful write of each output, by sink name
+	calls     map[cronSchedule]time.Time   //Next call of each schedule
+	called    map[cronSchedule][]time.Time //Calls of each schedule since the last one older than healthMaxAge
+}
+
+/*
+healthReport is a struct that holds the body of a health endpoint's response.
+*/
+type healthReport struct {
+	Status    string               `json:"status"`
+	Problems  []string             `json:"problems"`
+	Started   *time.Time           `json:"started,omitempty"`
+	Scheduler *time.Time           `json:"scheduler,omitempty"`
+	NextCall  *time.Time           `json:"nextCall,omitempty"`
+	LastCall  *time.Time           `json:"lastCall,omitempty"`
+	LastPoll  *time.Time           `json:"lastPoll,omitempty"`
+	Writes    map[string]time.Time `json:"lastWrites"`
+}
+
+/*
+Records that the program has started and is ready to poll.
+*/
+func markStarted() {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	health.started = time.Now()
+}
+
+/*
+Records that the scheduler is alive.
+*/
+func markScheduler() {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	health.scheduler = time.Now()
+}
+
+/*
+Records the time of a schedule's next call.
+*/
+func markScheduled(schedule cronSchedule, next time.Time) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	health.calls[schedule] = next
+}
+
+/*
+Records that a schedule made a call, forgetting its calls before the last one older than healthMaxAge, as readiness
+only looks back to that one.
+*/
+func markCalled(schedule cronSchedule) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	now := time.Now()
+	calls := append(health.called[schedule], now)
+	for len(calls) > 1 && now.Sub(calls[1]) > time.Duration(config.HealthMaxAge)*time.Minute {
+		calls = calls[1:]
+	}
+	health.called[schedule] = calls
+}
+
+/*
+Records a successful poll of a station, or a reading pushed by the realtime API.
+*/
+func markPolled() {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	health.polled = time.Now()
+}
+
+/*
+Records a successful write to an output.
+*/
+func markSinkWritten(sink string) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	health.writes[sink] = time.Now()
+}
+
+/*
+Registers the health endpoints on a server's handlers.
+*/
+func registerHealth(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", serveLiveness)
+	mux.HandleFunc("GET /readyz", serveReadiness)
+}
+
+/*
+Answers whether the scheduler is alive.
+*/
+func serveLiveness(w http.ResponseWriter, _ *http.Request) {
+	report := newHealthReport()
+	running := report.Started != nil && time.Since(*report.Started) > HEALTHTIMEOUT
+	if !config.Realtime && running && (report.Scheduler == nil || time.Since(*report.Scheduler) > HEALTHTIMEOUT) {
+		since := "the program started"
+		if report.Scheduler != nil {
+			since = report.Scheduler.Format(time.RFC3339)
+		}
+		report.Problems = append(report.Problems, "the scheduler has not checked in since "+since)
+	}
+	writeHealth(w, report)
+}
+
+/*
+Answers whether the program has started and its data is fresh. With the scheduler, the stations must have been polled
+and every enabled output written since the last call made more than healthMaxAgeMinutes ago, as nothing is polled or
+written between calls. In realtime mode, once the program has run for healthMaxAgeMinutes, they must have been within
+that time.
+*/
+func serveReadiness(w http.ResponseWriter, _ *http.Request) {
+	report := newHealthReport()
+	maxAge := time.Duration(config.HealthMaxAge) * time.Minute
+	since := time.Now().Add(-maxAge)
+	if !config.Realtime {
+		since = dueCall(since)
+	}
+	switch {
+	case report.Started == nil:
+		report.Problems = append(report.Problems, "the program is starting")
+	case since.IsZero(), since.Before(*report.Started): //Too soon for the data to be stale
+	default:
+		if report.LastPoll == nil || report.LastPoll.Before(since) {
+			report.Problems = append(report.Problems, "no station was polled since "+since.Format(time.RFC3339))
+		}
+		for _, sink := range sinks {
+			if !sink.Enabled() {
+				continue
+			}
+			if written, exists := report.Writes[sink.Name()]; !exists || written.Before(since) {
+				report.Problems = append(report.Problems, sink.Name()+" was not written since "+
+					since.Format(time.RFC3339))
+			}
+		}
+	}
+	writeHealth(w, report)
+}
+
+/*
+Returns the time of the last call of any schedule made before the given time, or the zero time if none was.
+*/
+func dueCall(before time.Time) time.Time {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	var due time.Time
+	for _, calls := range health.called {
+		for _, call := range calls {
+			if call.Before(before) && call.After(due) {
+				due = call
+			}
+		}
+	}
+	return due
+}
+
+/*
+Returns a report of the current health state, without problems yet.
+*/
+func newHealthReport() healthReport {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	report := healthReport{Problems: []string{}, Writes: make(map[string]time.Time)}
+	if !health.started.IsZero() {
+		started := health.started
+		report.Started = &started
+	}
+	if !health.scheduler.IsZero() {
+		scheduler := health.scheduler
+		report.Scheduler = &scheduler
+	}
+	for _, next := range health.calls {
+		if report.NextCall == nil || next.Before(*report.NextCall) {
+			call := next
+			report.NextCall = &call
+		}
+	}
+	for _, calls := range health.called {
+		if last := calls[len(calls)-1]; report.LastCall == nil || last.After(*report.LastCall) {
+			report.LastCall = &last
+		}
+	}
+	if !health.polled.IsZero() {
+		polled := health.polled
+		report.LastPoll = &polled
+	}
+	for sink, written := range health.writes {
+		report.Writes[sink] = written
+	}
+	return report
+}
+
+/*
+Writes a health report, with status 200 if it found no problems and 503 otherwise.
+*/
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	status := http.StatusOK
+	report.Status = "ok"
+	if len(report.Problems) > 0 {
+		status = http.StatusServiceUnavailable
+		report.Status = "failing"
+	}
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,100 @@
+package main
+
+/*
+This file pings a heartbeat URL, such as a healthchecks.io check or another dead man's switch, after every successful
+cycle when heartbeatUrl is set in the config. A cycle is successful when every station it polled was fetched and
+none of the new readings failed to persist, and with stations polled on schedules of their own the URL is only pinged
+while the last cycle of every schedule succeeded. In realtime mode every batch of readings that is persisted counts
+as one. The service alerts when the pings stop, whether the program died, is wedged, or keeps failing, which would
+otherwise only show in the logs. Pings are sent at most once every HEARTBEATINTERVAL, and a failed ping is only
+logged, since the next cycle pings again.
+*/
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HEARTBEATINTERVAL = time.Minute //Shortest time between pings
+)
+
+var (
+	heartbeatClient = &http.Client{Transport: sharedTransport, Timeout: 10 * time.Second}
+	heartbeatMutex  sync.Mutex
+	lastHeartbeat   time.Time
+	heartbeatCycles = make(map[string]bool) //Whether the last cycle of each schedule succeeded, by its first station
+)
+
+/*
+Registers the schedules whose cycles are polled, by the MAC Address of their first station, as not yet successful.
+*/
+func registerCycles(groups []string) {
+	heartbeatMutex.Lock()
+	defer heartbeatMutex.Unlock()
+	for _, group := range groups {
+		heartbeatCycles[group] = false
+	}
+}
+
+/*
+Records whether the last cycle of a schedule succeeded, and pings the heartbeat URL if every schedule's did.
+*/
+func recordCycle(ctx context.Context, group string, succeeded bool) {
+	heartbeatMutex.Lock()
+	heartbeatCycles[group] = succeeded
+	healthy := true
+	for _, cycle := range heartbeatCycles {
+		healthy = healthy && cycle
+	}
+	heartbeatMutex.Unlock()
+	if healthy {
+		sendHeartbeat(ctx)
+	}
+}
+
+/*
+Pings the heartbeat URL, unless none is configured or it was pinged less than HEARTBEATINTERVAL ago.
+*/
+func sendHeartbeat(ctx context.Context) {
+	if config.HeartbeatURL == "" {
+		return
+	}
+	heartbeatMutex.Lock()
+	if time.Since(lastHeartbeat) < HEARTBEATINTERVAL {
+		heartbeatMutex.Unlock()
+		return
+	}
+	lastHeartbeat = time.Now()
+	heartbeatMutex.Unlock()
+
+	if err := pingHeartbeat(ctx); err != nil {
+		slog.WarnContext(ctx, "Unable to ping the heartbeat URL", "err", err)
+		return
+	}
+	slog.DebugContext(ctx, "Pinged the heartbeat URL")
+}
+
+/*
+Sends a GET request to the heartbeat URL, which every dead man's switch service accepts, and returns an error unless
+it answered with a 2xx status.
+*/
+func pingHeartbeat(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.HeartbeatURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := heartbeatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("heartbeat URL answered " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+/*
+This file pushes the newest reading of each station straight to Home Assistant's REST API when homeAssistantUrl is
+set in the config, for users who don't run an MQTT broker. Every sensor value becomes the state of an entity named
+sensor.ambient_<station>_<sensor>, where the station is its MAC Address without colons, with the same name, unit, and
+device class as the MQTT discovery config, in its configured unit. The requests are authorized with
+homeAssistantToken, a long-lived access token created on the user's Home Assistant profile page. Entities set this
+way have no unique ID, so Home Assistant keeps only their newest state across restarts and they can't be edited in
+its UI. Only the newest reading of a batch is pushed, as Home Assistant holds current states, not history, and only if
+it is newer than the last reading pushed for the station, so queued readings sent late never replace a newer state.
+*/
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	homeAssistantClient = &http.Client{Transport: sharedTransport, Timeout: 10 * time.Second}
+	homeAssistantPushed = make(map[string]int64) //dateutc of the newest reading pushed for each station, by MAC Address
+	homeAssistantMutex  sync.Mutex
+)
+
+/*
+entityState is a struct that holds the JSON body that sets the state of a Home Assistant entity.
+*/
+type entityState struct {
+	State      interface{}       `json:"state"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+/*
+Pushes the sensor values of the newest of a station's readings to Home Assistant, unless a reading at least as new was
+pushed already. Returns an error unless every state was set, and nil when no homeAssistantUrl is configured. A state
+Home Assistant rejects is skipped, and the first rejection is returned once the other states are set.
+*/
+func pushHomeAssistant(ctx context.Context, station Station, readings []DeviceData) error {
+	if config.HAURL == "" || len(readings) == 0 {
+		return nil
+	}
+	data := readings[len(readings)-1]
+	homeAssistantMutex.Lock()
+	defer homeAssistantMutex.Unlock()
+	if data.DateUTC <= homeAssistantPushed[station.MacAddress] {
+		return nil
+	}
+	stationID := strings.ToLower(strings.ReplaceAll(station.MacAddress, ":", ""))
+
+	names := make([]string, 0, len(data.Fields))
+	for name := range data.Fields {
+		if !undiscoveredFields[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var rejected error //First state Home Assistant rejected, the other states are still set
+	for _, name := range names {
+		value := cellValue(convertField(name, data.Fields[name]))
+		state := entityState{State: value, Attributes: map[string]string{
+			"friendly_name": station.displayName() + " " + sensorTitle(name),
+			"observed":      data.Time().Format(time.RFC3339),
+		}}
+		if _, numeric := value.(float64); numeric {
+			if unit := sensorUnit(name); unit != "" {
+				state.Attributes["unit_of_measurement"] = unit
+			}
+			state.Attributes["state_class"] = "measurement"
+			if class, exists := deviceClasses[sensorQuantities[name]]; exists {
+				state.Attributes["device_class"] = class
+			}
+		}
+		if strings.HasPrefix(name, "humidity") {
+			state.Attributes["device_class"] = "humidity"
+		}
+
+		entity := "sensor.ambient_" + stationID + "_" + strings.ToLower(metricInvalid.ReplaceAllString(name, "_"))
+		if err := postEntityState(ctx, entity, state); err != nil {
+			err = fmt.Errorf("unable to set the Home Assistant state of %s: %w", entity, err)
+			if !isRejected(err) {
+				return err
+			} else if rejected == nil {
+				rejected = err
+			}
+		}
+	}
+	homeAssistantPushed[station.MacAddress] = data.DateUTC
+	slog.InfoContext(ctx, "Set "+strconv.Itoa(len(names))+" Home Assistant states", "station",
+		station.displayName(), "observed", data.Time())
+	return rejected
+}
+
+/*
+POSTs the state of an entity to Home Assistant and returns an error if the request fails or isn't accepted.
+*/
+func postEntityState(ctx context.Context, entity string, state entityState) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimSuffix(config.HAURL, "/") + "/api/states/" + entity
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.HAToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+
+	resp, err := homeAssistantClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return rejectStatus(resp.StatusCode, errors.New("Home Assistant answered "+resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+/*
+This file writes the readings to an InfluxDB v2 bucket when influxUrl is set in the config, so they can be charted by
+existing Grafana dashboards. Every numeric sensor value of a reading is one point of the ambient measurement, tagged
+with the station's MAC Address and the sensor's name, with the value in its configured unit in the value field, at the
+reading's dateutc, e.g.
+ambient,station=00:11:22:33:44:55,sensor=tempf value=72.5 1700000000000
+Points are sent in line protocol to the /api/v2/write endpoint with influxOrg, influxBucket, and influxToken, in batches
+of up to 5,000 lines. Writing a point again overwrites it, so restarts and backfills add no duplicates.
+*/
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	INFLUXMEASUREMENT = "ambient"
+	INFLUXBATCH       = 5000 //Lines per write request
+)
+
+var (
+	influxClient  = &http.Client{Transport: sharedTransport, Timeout: 30 * time.Second}
+	influxEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=") //Escapes tag keys and values
+)
+
+/*
+Writes the readings of a station to the InfluxDB bucket. Returns an error unless every reading was written, and nil
+when no influxUrl is configured. A batch InfluxDB rejects is skipped, and the first rejection is returned once the
+other batches are written.
+*/
+func writeInflux(ctx context.Context, station Station, readings []DeviceData) error {
+	if config.InfluxURL == "" || len(readings) == 0 {
+		return nil
+	}
+
+	var lines []string
+	for _, data := range readings {
+		lines = append(lines, influxLines(station, data)...)
+	}
+	var rejected error //First batch InfluxDB rejected, the other batches are still written
+	for start := 0; start < len(lines); start += INFLUXBATCH {
+		end := min(start+INFLUXBATCH, len(lines))
+		if err := postInflux(ctx, strings.Join(lines[start:end], "\n")); err != nil {
+			err = fmt.Errorf("unable to write the readings to the InfluxDB bucket %s: %w", config.InfluxBucket, err)
+			if !isRejected(err) {
+				return err
+			} else if rejected == nil {
+				rejected = err
+			}
+		}
+	}
+	slog.InfoContext(ctx, "Wrote "+strconv.Itoa(len(lines))+" points to InfluxDB", "bucket", config.InfluxBucket,
+		"station", station.displayName())
+	return rejected
+}
+
+/*
+Returns the line protocol of a reading, one line per numeric sensor value in order of the sensor names. Booleans are
+written as 1 or 0, and values that aren't numbers are skipped.
+*/
+func influxLines(station Station, data DeviceData) []string {
+	if data.DateUTC <= 0 {
+		return nil
+	}
+	names := make([]string, 0, len(data.Fields))
+	for name := range data.Fields {
+		if !undiscoveredFields[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	prefix := INFLUXMEASUREMENT + ",station=" + influxEscaper.Replace(station.MacAddress) + ",sensor="
+	timestamp := " " + strconv.FormatInt(data.DateUTC, 10)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		var value float64
+		switch typed := cellValue(convertField(name, data.Fields[name])).(type) {
+		case float64:
+			value = typed
+		case bool:
+			if typed {
+				value = 1
+			}
+		default:
+			continue
+		}
+		lines = append(lines, prefix+influxEscaper.Replace(name)+" value="+strconv.FormatFloat(value, 'f', -1, 64)+
+			timestamp)
+	}
+	return lines
+}
+
+/*
+POSTs lines of line protocol to the write endpoint of the InfluxDB server, with timestamps in milliseconds, and
+returns an error if the request fails or isn't accepted.
+*/
+func postInflux(ctx context.Context, body string) error {
+	query := url.Values{"org": {config.InfluxOrg}, "bucket": {config.InfluxBucket}, "precision": {"ms"}}
+	endpoint := strings.TrimSuffix(config.InfluxURL, "/") + "/api/v2/write?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+config.InfluxToken)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", userAgent())
+
+	resp, err := influxClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return rejectStatus(resp.StatusCode,
+			errors.New("InfluxDB answered "+resp.Status+": "+strings.TrimSpace(string(message))))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+/*
+This file watches the leak detectors of a station (leak1..leak4). A detector reports 0 while dry, 1 when it detects
+water, and 2 when the station has lost contact with it. Because a row in the sheet is not how anyone wants to learn
+about a flooded basement, a leak_detected event is logged and sent as an alert the moment a detector turns wet, and a
+leak_cleared event once it is dry again. A detector that loses contact is reported as leak_offline, since a detector
+that can't report can't warn of a leak either.
+*/
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+const (
+	LEAKDRY = iota
+	LEAKWET
+	LEAKOFFLINE
+)
+
+var (
+	leakMutex  sync.Mutex
+	leakStates = make(map[string]map[string]int) //State of each leak detector for each station MAC Address
+)
+
+/*
+Checks the leak detectors of a station's readings, oldest first, and alerts on every detector that turns wet or loses
+contact, and on every detector that is dry again afterwards. A detector that is already wet the first time it is seen
+is alerted on as well.
+*/
+func trackLeaks(ctx context.Context, station Station, readings []DeviceData) {
+	leakMutex.Lock()
+	defer leakMutex.Unlock()
+
+	states, exists := leakStates[station.MacAddress]
+	if !exists {
+		states = make(map[string]int)
+		leakStates[station.MacAddress] = states
+	}
+
+	for _, data := range readings {
+		for i, value := range data.LeakN {
+			if value == nil {
+				continue
+			}
+			name := "leak" + strconv.Itoa(i+1)
+			state := int(*value)
+			previous, seen := states[name]
+			states[name] = state
+			if seen && state == previous {
+				continue
+			}
+
+			switch {
+			case state == LEAKWET:
+				message := "Leak detected by " + name + " at " + station.displayName()
+				slog.ErrorContext(ctx, message, "event", "leak_detected", "station", station.displayName(),
+					"sensor", name, "time", data.Time())
+				sendAlert(ctx, "leak_detected", station, message, data.Time())
+			case state == LEAKOFFLINE:
+				message := "Leak detector " + name + " at " + station.displayName() + " is not responding"
+				slog.WarnContext(ctx, message, "event", "leak_offline", "station", station.displayName(),
+					"sensor", name, "time", data.Time())
+				sendAlert(ctx, "leak_offline", station, message, data.Time())
+			case seen && previous != LEAKDRY:
+				message := "Leak detector " + name + " at " + station.displayName() + " is dry again"
+				slog.InfoContext(ctx, message, "event", "leak_cleared", "station", station.displayName(),
+					"sensor", name, "time", data.Time())
+				sendAlert(ctx, "leak_cleared", station, message, data.Time())
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+/*
+This file streams every new reading to browsers and other clients connected to /ws on apiListen, so local dashboards
+update the moment a reading arrives instead of polling the REST API. Each reading is sent as a JSON text message in
+the same shape as the /api/current entries, starting with the newest reading of every station when the client
+connects. A station parameter, the MAC Address or name of a station, streams only that station's readings, e.g.
+ws://localhost:8080/ws?station=Backyard
+Messages sent by clients are ignored. A client that falls too far behind is disconnected rather than holding back
+the others, and can reconnect to catch up with /api/history.
+*/
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LIVEQUEUELENGTH = 64 //Messages queued for a client before it is disconnected
+	LIVEPINGPERIOD  = 30 * time.Second
+)
+
+var (
+	liveUpgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 4096,
+		CheckOrigin:     func(*http.Request) bool { return true }, //Like the REST API, any origin may connect
+	}
+	liveMutex   sync.Mutex
+	liveClients = make(map[*liveClient]bool)
+)
+
+/*
+liveClient is a struct that holds a connected client: the station it streams, or an empty string for every station,
+and the messages queued to be sent to it.
+*/
+type liveClient struct {
+	station string
+	send    chan []byte
+}
+
+/*
+Returns whether the client streams the readings of a station.
+*/
+func (client *liveClient) wants(station Station) bool {
+	return client.station == "" || strings.EqualFold(client.station, station.MacAddress) ||
+		client.station == station.displayName()
+}
+
+/*
+Sends a station's new readings to every client that streams the station. A client whose queue is full is dropped.
+*/
+func broadcastReadings(station Station, readings []DeviceData) {
+	if len(readings) == 0 {
+		return
+	}
+	liveMutex.Lock()
+	defer liveMutex.Unlock()
+	if len(liveClients) == 0 {
+		return
+	}
+	for _, data := range readings {
+		message, err := json.Marshal(webhookBody(station, data))
+		if err != nil {
+			slog.Warn("Unable to encode the reading for the live feed", "err", err)
+			continue
+		}
+		for client := range liveClients {
+			if !client.wants(station) {
+				continue
+			}
+			select {
+			case client.send <- message:
+			default:
+				slog.Warn("Live feed client fell behind, disconnecting it")
+				delete(liveClients, client)
+				close(client.send)
+			}
+		}
+	}
+}
+
+/*
+Upgrades a request to a WebSocket connection and streams the readings to it until either side closes the connection.
+*/
+func serveLive(w http.ResponseWriter, r *http.Request) {
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Debug("Unable to upgrade the live feed connection", "err", err)
+		return
+	}
+	client := &liveClient{station: r.URL.Query().Get("station"), send: make(chan []byte, LIVEQUEUELENGTH)}
+	for _, ring := range requestedRings(r) {
+		if data, exists := ring.newest(); exists {
+			if message, err := json.Marshal(webhookBody(ring.station, data)); err == nil &&
+				len(client.send) < LIVEQUEUELENGTH {
+				client.send <- message
+			}
+		}
+	}
+	liveMutex.Lock()
+	liveClients[client] = true
+	liveMutex.Unlock()
+
+	go readLive(conn, client)
+	writeLive(conn, client)
+}
+
+/*
+Reads and discards the messages of a client so its pongs and close are handled, and stops streaming to it once the
+connection is closed or stops answering pings.
+*/
+func readLive(conn *websocket.Conn, client *liveClient) {
+	defer dropLiveClient(client)
+	conn.SetReadLimit(4096)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * LIVEPINGPERIOD))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * LIVEPINGPERIOD))
+	})
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+/*
+Writes the queued messages to a client and pings it while it is idle, closing the connection once the client is
+dropped or a write fails.
+*/
+func writeLive(conn *websocket.Conn, client *liveClient) {
+	ticker := time.NewTicker(LIVEPINGPERIOD)
+	defer ticker.Stop()
+	defer conn.Close()
+	for {
+		select {
+		case message, open := <-client.send:
+			if !open {
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure,
+					""), time.Now().Add(5*time.Second))
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				dropLiveClient(client)
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				dropLiveClient(client)
+				return
+			}
+		}
+	}
+}
+
+/*
+Stops streaming to a client, if it is still connected, which ends its writer.
+*/
+func dropLiveClient(client *liveClient) {
+	liveMutex.Lock()
+	defer liveMutex.Unlock()
+	if liveClients[client] {
+		delete(liveClients, client)
+		close(client.send)
+	}
+}
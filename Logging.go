@@ -0,0 +1,147 @@
+package main
+
+/*
+This file configures the structured logger used throughout the program. Every log record passes through a redacting
+handler before it is written, masking the Ambient Weather API Key and Application Key, OAuth tokens, and any other
+value registered as a secret so that keys never appear in stdout or in a log aggregation service. Records logged with
+a context carrying a correlation ID are tagged with it, so every log of a single poll cycle, from the Ambient request
+through parsing to the Sheets write, can be found together in aggregated logs.
+*/
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	REDACTED = "[REDACTED]"
+)
+
+/*
+correlationKey is the context key the correlation ID of a poll cycle is stored under.
+*/
+type correlationKey struct{}
+
+var (
+	secretsMutex sync.RWMutex
+	secretValues []string
+
+	// Matches secrets passed as URL query parameters or JSON fields, e.g. apiKey=... or "refresh_token":"..."
+	secretPattern = regexp.MustCompile(`(?i)((?:apiKey|applicationKey|access_token|refresh_token|client_secret)` +
+		`(?:=|"\s*:\s*"))([^&"\s]+)`)
+)
+
+/*
+Sets the default slog logger to one that redacts secrets from the message and attributes of every record before it
+is written to stderr.
+*/
+func initLogging() {
+	handler := slog.NewTextHandler(os.Stderr, nil)
+	slog.SetDefault(slog.New(&redactingHandler{handler: handler}))
+}
+
+/*
+Returns a context carrying a new random correlation ID, which every record logged with the context is tagged with as
+the cycle attribute.
+*/
+func withCorrelationID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, correlationKey{}, fmt.Sprintf("%08x", rand.Uint32()))
+}
+
+/*
+Registers a value that must never be logged. Empty values and very short values are ignored, since masking them
+would mangle unrelated log output.
+*/
+func registerSecret(secret string) {
+	secret = strings.TrimSpace(secret)
+	if len(secret) < 4 {
+		return
+	}
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	for _, existing := range secretValues {
+		if existing == secret {
+			return
+		}
+	}
+	secretValues = append(secretValues, secret)
+}
+
+/*
+Returns the given string with every registered secret and every recognizable key or token parameter replaced by
+[REDACTED].
+*/
+func redact(value string) string {
+	secretsMutex.RLock()
+	for _, secret := range secretValues {
+		value = strings.ReplaceAll(value, secret, REDACTED)
+	}
+	secretsMutex.RUnlock()
+
+	return secretPattern.ReplaceAllString(value, "${1}"+REDACTED)
+}
+
+/*
+redactingHandler is a slog.Handler that wraps another handler and redacts secrets from the message and all attributes
+of a record before passing it on.
+*/
+type redactingHandler struct {
+	handler slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(attr))
+		return true
+	})
+	if id, ok := ctx.Value(correlationKey{}).(string); ok {
+		redacted.AddAttrs(slog.String("cycle", id))
+	}
+	return h.handler.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = redactAttr(attr)
+	}
+	return &redactingHandler{handler: h.handler.WithAttrs(redacted)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{handler: h.handler.WithGroup(name)}
+}
+
+/*
+Redacts a single attribute. String values are redacted directly, groups are redacted recursively, and arbitrary values
+(errors, structs, URLs) are formatted to a string first so secrets nested inside them are caught as well.
+*/
+func redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, redact(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, len(group))
+		for i, groupAttr := range group {
+			redacted[i] = redactAttr(groupAttr)
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindAny:
+		return slog.String(attr.Key, redact(fmt.Sprint(value.Any())))
+	default:
+		return slog.Attr{Key: attr.Key, Value: value}
+	}
+}
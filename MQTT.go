@@ -0,0 +1,233 @@
+package main
+
+/*
+This file publishes every reading to an MQTT broker when mqttBroker is set in the config, using Home Assistant MQTT
+Discovery so every sensor appears in Home Assistant without any YAML. Each reading is published, retained, as a JSON
+object of its values in their configured units to <mqttTopicPrefix>/<station>/state, where the station is its MAC
+Address without colons. The first time a sensor of a station is published in a run, its discovery config is published,
+retained, to <haDiscoveryPrefix>/sensor/<station>/<sensor>/config, grouping the station's sensors under one device.
+Readings no newer than the last one published for their station, such as queued readings published after newer ones, are
+skipped so the retained state is always the newest reading. The broker is told to publish offline to
+<mqttTopicPrefix>/status if the program disconnects, and online is published on connect.
+*/
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MQTTTIMEOUT = 10 * time.Second
+)
+
+var (
+	mqttClient    mqtt.Client = nil
+	mqttMutex     sync.Mutex
+	mqttAnnounced = make(map[string]bool)  //Station and sensor pairs whose discovery config was published
+	mqttPublished = make(map[string]int64) //dateutc of the newest reading published for each station, by MAC Address
+	deviceClasses = map[string]string{"temperature": "temperature", "pressure": "atmospheric_pressure",
+		"rain": "precipitation", "rainRate": "precipitation_intensity", "wind": "wind_speed", "distance": "distance"}
+)
+
+/*
+discoveryConfig is a struct that holds the Home Assistant MQTT Discovery config of a sensor.
+*/
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	ValueTemplate     string          `json:"value_template"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	Unit              string          `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	StateClass        string          `json:"state_class,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+/*
+discoveryDevice is a struct that holds the Home Assistant device a station's sensors are grouped under.
+*/
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+}
+
+/*
+Publishes the readings of a station to the MQTT broker, connecting first if needed and announcing any sensor Home
+Assistant doesn't know about yet. Returns an error unless every reading was published, and nil when no mqttBroker is
+configured.
+*/
+func publishMQTT(ctx context.Context, station Station, readings []DeviceData) error {
+	if config.MQTTBroker == "" || len(readings) == 0 {
+		return nil
+	}
+	mqttMutex.Lock()
+	defer mqttMutex.Unlock()
+
+	if mqttClient == nil {
+		client, err := connectMQTT()
+		if err != nil {
+			return fmt.Errorf("unable to connect to the MQTT broker %s: %w", config.MQTTBroker, err)
+		}
+		mqttClient = client
+	}
+
+	stationID := strings.ToLower(strings.ReplaceAll(station.MacAddress, ":", ""))
+	stateTopic := config.MQTTPrefix + "/" + stationID + "/state"
+	published := 0
+	for _, data := range readings {
+		if data.DateUTC <= mqttPublished[station.MacAddress] {
+			continue
+		}
+		state := make(map[string]interface{}, len(data.Fields))
+		for name, value := range data.Fields {
+			if !undiscoveredFields[name] {
+				state[name] = cellValue(convertField(name, value))
+			}
+		}
+		if err := announceSensors(station, stationID, stateTopic, state, data); err != nil {
+			return fmt.Errorf("unable to publish the Home Assistant discovery config: %w", err)
+		}
+		payload, err := json.Marshal(state)
+		if err == nil {
+			err = mqttPublish(stateTopic, payload)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to publish the reading to %s: %w", stateTopic, err)
+		}
+		mqttPublished[station.MacAddress] = data.DateUTC
+		published++
+	}
+	if published > 0 {
+		slog.InfoContext(ctx, "Published "+strconv.Itoa(published)+" readings to MQTT", "topic", stateTopic)
+	}
+	return nil
+}
+
+/*
+Connects to the configured MQTT broker, with a last will that marks the program offline, and publishes that it is
+online. The client reconnects by itself after the connection drops.
+*/
+func connectMQTT() (mqtt.Client, error) {
+	statusTopic := config.MQTTPrefix + "/status"
+	options := mqtt.NewClientOptions().AddBroker(config.MQTTBroker).SetClientID("goambient-"+config.MQTTPrefix).
+		SetUsername(config.MQTTUser).SetPassword(config.MQTTPassword).SetAutoReconnect(true).
+		SetWill(statusTopic, "offline", 1, true)
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	if !token.WaitTimeout(MQTTTIMEOUT) {
+		return nil, errors.New("timed out connecting")
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+	slog.Info("Connected to the MQTT broker", "broker", config.MQTTBroker)
+
+	token = client.Publish(statusTopic, 1, true, "online")
+	if token.WaitTimeout(MQTTTIMEOUT) && token.Error() != nil {
+		slog.Warn("Unable to publish the online status", "topic", statusTopic, "err", token.Error())
+	}
+	return client, nil
+}
+
+/*
+Publishes the discovery config of every sensor in a reading's state that hasn't been announced for the station in
+this run.
+*/
+func announceSensors(station Station, stationID string, stateTopic string, state map[string]interface{},
+	data DeviceData) error {
+	names := make([]string, 0, len(state))
+	for name := range state {
+		if !mqttAnnounced[stationID+" "+name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	model, _ := data.Fields["stationtype"].(string)
+	for _, name := range names {
+		discovery := discoveryConfig{
+			Name:              sensorTitle(name),
+			UniqueID:          "goambient_" + stationID + "_" + name,
+			StateTopic:        stateTopic,
+			ValueTemplate:     "{{ value_json['" + name + "'] }}",
+			AvailabilityTopic: config.MQTTPrefix + "/status",
+			Device: discoveryDevice{Identifiers: []string{"goambient_" + stationID}, Name: station.displayName(),
+				Manufacturer: "Ambient Weather", Model: model},
+		}
+		if _, numeric := state[name].(float64); numeric {
+			discovery.Unit = sensorUnit(name)
+			discovery.DeviceClass = deviceClasses[sensorQuantities[name]]
+			discovery.StateClass = "measurement"
+		}
+		if strings.HasPrefix(name, "humidity") {
+			discovery.DeviceClass = "humidity"
+		}
+
+		payload, err := json.Marshal(discovery)
+		if err != nil {
+			return err
+		}
+		if err := mqttPublish(config.DiscoveryPrefix+"/sensor/"+stationID+"/"+name+"/config", payload); err != nil {
+			return err
+		}
+		mqttAnnounced[stationID+" "+name] = true
+	}
+	return nil
+}
+
+/*
+Publishes a retained message and waits for the broker to acknowledge it.
+*/
+func mqttPublish(topic string, payload []byte) error {
+	token := mqttClient.Publish(topic, 1, true, payload)
+	if !token.WaitTimeout(MQTTTIMEOUT) {
+		return errors.New("timed out publishing to " + topic)
+	}
+	return token.Error()
+}
+
+/*
+Returns the name of a sensor shown in Home Assistant, its description from the headers mapping without the unit, or
+the sensor's name if it isn't mapped.
+*/
+func sensorTitle(name string) string {
+	sensorsMutex.RLock()
+	sensor, exists := allSensors[name]
+	sensorsMutex.RUnlock()
+	if !exists {
+		return name
+	}
+	title, _, _ := strings.Cut(strings.TrimSuffix(sensor.Description, DISCOVEREDSUFFIX), ", ")
+	return title
+}
+
+/*
+Returns the unit a sensor's values are published in, or an empty string for sensors without a known unit.
+*/
+func sensorUnit(name string) string {
+	if kind, exists := sensorQuantities[name]; exists {
+		label := quantities[kind].units[quantities[kind].reported].label
+		if chosen, converted := unitFor(name); converted {
+			label = chosen.label
+		}
+		return strings.ReplaceAll(label, "º", "°") //Home Assistant expects the degree sign
+	}
+	switch {
+	case strings.HasPrefix(name, "humidity"):
+		return "%"
+	case name == "solarradiation":
+		return "W/m²"
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package main
+
+/*
+This file keeps the sensor column mapping in a hidden sheet of the spreadsheet, named by mappingSheet, so the owner of
+the spreadsheet can change which column a sensor is written to, or its header, by editing the sheet instead of
+deploying a new headers.txt. Each row of the sheet holds a sensor name, its column ID, its description, and optionally
+its number format, below a header row. The mapping is read from the sheet at startup. The first time the program runs
+against a spreadsheet without the sheet, it is created from headers.txt, which stays as the fallback when the sheet
+can't be read. Columns added for newly discovered sensors are appended to the sheet as well. mappingSheet is empty by
+default, keeping the mapping in headers.txt only; set it, e.g. to "Config", to use the sheet.
+*/
+import (
+	"context"
+	"fmt"
+	"google.golang.org/api/sheets/v4"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+var (
+	mappingHeaders   = []interface{}{"Sensor", "Column", "Description", "Format"}
+	mappingFromSheet = false //Whether the mapping in use is kept in the mapping sheet
+)
+
+/*
+Reads the mapping sheet and returns its rows in the format of headers.txt. Reports false if no mapping sheet is
+configured, the spreadsheet has no mapping sheet yet, or it can't be read.
+*/
+func readMappingSheet(ctx context.Context) ([]byte, bool) {
+	if config.MappingSheet == "" || service == nil || !mappingSheetExists(ctx) {
+		return nil, false
+	}
+	resp, err := service.Spreadsheets.Values.Get(spreadsheetFor(ctx), quoteSheetName(config.MappingSheet)+"!A:D").
+		Context(ctx).Do()
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to read the "+config.MappingSheet+" sheet, using "+headersFile, "err", err)
+		return nil, false
+	}
+
+	var lines strings.Builder
+	for i, row := range resp.Values {
+		if i == 0 || len(row) < 3 { //Header row and incomplete rows
+			continue
+		}
+		column := strings.TrimSpace(fmt.Sprint(row[1]))
+		if len(row) > 3 && strings.TrimSpace(fmt.Sprint(row[3])) != "" {
+			column += ":" + strings.TrimSpace(fmt.Sprint(row[3]))
+		}
+		lines.WriteString(strings.TrimSpace(fmt.Sprint(row[0])) + "," + column + "," + fmt.Sprint(row[2]) + "\n")
+	}
+	return []byte(lines.String()), true
+}
+
+/*
+Reports whether the spreadsheet has a sheet with the configured mapping sheet's name.
+*/
+func mappingSheetExists(ctx context.Context) bool {
+	response, err := service.Spreadsheets.Get(spreadsheetFor(ctx)).Context(ctx).Do()
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to list sheets", "err", err)
+		return false
+	}
+	for _, sheet := range response.Sheets {
+		if sheet.Properties.Title == config.MappingSheet {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Creates the hidden mapping sheet holding the given mapping, one row per sensor in order of its column. Reports whether
+the sheet was created and filled.
+*/
+func createMappingSheet(ctx context.Context, sensors map[string]SensorInfo) bool {
+	if config.MappingSheet == "" || service == nil {
+		return false
+	}
+	request := &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{{
+			AddSheet: &sheets.AddSheetRequest{
+				Properties: &sheets.SheetProperties{Title: config.MappingSheet, Hidden: true},
+			},
+		}},
+	}
+	if batchUpdateRequest(ctx, request, 1) == nil {
+		slog.ErrorContext(ctx, "Unable to create the "+config.MappingSheet+" sheet, keeping the mapping in "+
+			headersFile)
+		return false
+	}
+
+	names := make([]string, 0, len(sensors))
+	for name := range sensors {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return stringToNum(sensors[names[i]].ID) < stringToNum(sensors[names[j]].ID)
+	})
+	rows := [][]interface{}{mappingHeaders}
+	for _, name := range names {
+		rows = append(rows, mappingRow(name, sensors[name]))
+	}
+	updateValues(ctx, config.MappingSheet, rows, "!A1", 1)
+	slog.InfoContext(ctx, "Created the "+config.MappingSheet+" sheet from "+headersFile+", edit it to change the "+
+		"columns", "sensors", len(names))
+	return true
+}
+
+/*
+Returns the row of the mapping sheet that holds a sensor's mapping.
+*/
+func mappingRow(name string, sensor SensorInfo) []interface{} {
+	return []interface{}{name, sensor.ID, sensor.Description, sensor.Format}
+}
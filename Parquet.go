@@ -0,0 +1,153 @@
+package main
+
+/*
+This file archives the readings as Parquet files in object storage when parquetBucket is set in the config, for cheap
+long-term retention and downstream analytics. parquetBucket is a bucket URL, gs://bucket for Google Cloud Storage or
+s3://bucket?region=us-east-1 for S3, using the usual credentials of each cloud. Readings are buffered in memory and
+written every parquetFlushMinutes, and when the program stops, as one file per station and day, partitioned Hive style,
+e.g.
+<parquetPrefix>station=001122334455/date=2026-07-04/1783180800000.parquet
+Each row of a file is one sensor value of a reading in its configured unit, so files written before and after a sensor
+is added share a schema. A partition that couldn't be written stays in the buffer for the next flush, rather than in the
+output's queue, so its rows are written once. The output's cursor in the state file only moves past a reading once it is
+in the bucket, so buffered readings lost when the program is killed before they are flushed are sent again from the
+history API on the next start.
+*/
+import (
+	"context"
+	"github.com/parquet-go/parquet-go"
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/gcsblob"
+	_ "gocloud.dev/blob/s3blob"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+parquetRow is a struct that holds one sensor value of a reading, a row of the Parquet files.
+*/
+type parquetRow struct {
+	Station     string  `parquet:"station,dict"`
+	StationName string  `parquet:"station_name,dict"`
+	DateUTC     int64   `parquet:"dateutc,timestamp(millisecond)"`
+	Sensor      string  `parquet:"sensor,dict"`
+	Value       float64 `parquet:"value"`
+}
+
+var (
+	parquetMutex     sync.Mutex
+	parquetBuffer    = make(map[string][]parquetRow) //Rows waiting to be written, by object key prefix
+	parquetLastFlush = time.Now()
+)
+
+/*
+Adds the readings of a station to the buffer, and writes the buffer to the bucket once parquetFlushMinutes have passed
+since it was last written. Always returns nil, as the buffer keeps whatever couldn't be written for the next flush.
+*/
+func writeParquet(ctx context.Context, station Station, readings []DeviceData) error {
+	if config.ParquetURL == "" || len(readings) == 0 {
+		return nil
+	}
+	parquetMutex.Lock()
+	stationID := strings.ToLower(strings.ReplaceAll(station.MacAddress, ":", ""))
+	for _, data := range readings {
+		if data.DateUTC <= 0 {
+			continue
+		}
+		partition := config.ParquetPrefix + "station=" + stationID + "/date=" + data.Time().Format(DATEFORMAT) + "/"
+		for name, value := range data.Fields {
+			if undiscoveredFields[name] || name == "dateutc" {
+				continue
+			}
+			if number, ok := cellValue(convertField(name, value)).(float64); ok {
+				parquetBuffer[partition] = append(parquetBuffer[partition], parquetRow{Station: station.MacAddress,
+					StationName: station.displayName(), DateUTC: data.DateUTC, Sensor: name, Value: number})
+			}
+		}
+	}
+	due := time.Since(parquetLastFlush) >= time.Duration(config.ParquetInterval)*time.Minute
+	parquetMutex.Unlock()
+
+	if due && !flushParquet(ctx) {
+		slog.WarnContext(ctx, "Parquet partitions left in the buffer for the next flush")
+	}
+	return nil
+}
+
+/*
+Writes every buffered partition to its own Parquet file in the bucket and empties the buffer, moving the output's
+cursor for each station up to its oldest reading still buffered. Partitions that couldn't be written stay in the
+buffer for the next flush. Returns whether the whole buffer was written.
+*/
+func flushParquet(ctx context.Context) bool {
+	parquetMutex.Lock()
+	defer parquetMutex.Unlock()
+	parquetLastFlush = time.Now()
+	if len(parquetBuffer) == 0 {
+		return true
+	}
+
+	bucket, err := blob.OpenBucket(ctx, config.ParquetURL)
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to open the Parquet bucket", "bucket", config.ParquetURL, "err", err)
+		return false
+	}
+	defer bucket.Close()
+
+	partitions := make([]string, 0, len(parquetBuffer))
+	for partition := range parquetBuffer {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+	flushed := true
+	written := make(map[string]int64) //dateutc of the newest row written for each station, by MAC Address
+	for _, partition := range partitions {
+		rows := parquetBuffer[partition]
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].DateUTC < rows[j].DateUTC })
+		key := partition + strconv.FormatInt(time.Now().UnixMilli(), 10) + ".parquet"
+		if err := writeParquetFile(ctx, bucket, key, rows); err != nil {
+			slog.ErrorContext(ctx, "Unable to write the Parquet file", "key", key, "err", err)
+			flushed = false
+			continue
+		}
+		slog.InfoContext(ctx, "Wrote "+strconv.Itoa(len(rows))+" rows to a Parquet file", "key", key)
+		delete(parquetBuffer, partition)
+		for _, row := range rows {
+			written[row.Station] = max(written[row.Station], row.DateUTC)
+		}
+	}
+
+	for _, rows := range parquetBuffer { //Readings still buffered hold the cursor back
+		for _, row := range rows {
+			if newest, exists := written[row.Station]; exists && row.DateUTC <= newest {
+				written[row.Station] = row.DateUTC - 1
+			}
+		}
+	}
+	for macAddress, newest := range written {
+		recordSinkCursor("parquet", macAddress, []DeviceData{{DateUTC: newest}})
+	}
+	return flushed
+}
+
+/*
+Writes rows to a new Parquet file in the bucket under the given key.
+*/
+func writeParquetFile(ctx context.Context, bucket *blob.Bucket, key string, rows []parquetRow) error {
+	object, err := bucket.NewWriter(ctx, key, &blob.WriterOptions{ContentType: "application/vnd.apache.parquet"})
+	if err != nil {
+		return err
+	}
+	writer := parquet.NewGenericWriter[parquetRow](object)
+	if _, err = writer.Write(rows); err == nil {
+		err = writer.Close()
+	}
+	if closeErr := object.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
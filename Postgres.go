@@ -0,0 +1,180 @@
+package main
+
+/*
+This file stores the readings in a PostgreSQL database when postgresUrl is set in the config. Each reading is one row of
+the ambient_readings table, keyed on the station's MAC Address and dateutc, with every field the station reported, in
+its configured unit, in the data JSONB column. The table is created if it doesn't exist, and with timescaleDb enabled it
+is made a TimescaleDB hypertable partitioned on dateutc. Readings are inserted in batches of up to 500 rows per
+statement, and a reading that is already stored is replaced, so restarts and backfills add no duplicate rows. The
+database is written without a spreadsheetId too.
+*/
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	POSTGRESTABLE = "ambient_readings"
+	POSTGRESBATCH = 500 //Rows per INSERT statement
+)
+
+var (
+	postgresDB    *sql.DB = nil
+	postgresMutex sync.Mutex
+)
+
+/*
+Writes the readings of a station to the PostgreSQL database, connecting and creating the table first if needed.
+Returns an error unless every reading is in the database, and nil when no postgresUrl is configured. A batch the
+database refuses for its data is skipped, and the first refusal is returned once the other batches are written.
+*/
+func writePostgres(ctx context.Context, station Station, readings []DeviceData) error {
+	if config.PostgresURL == "" || len(readings) == 0 {
+		return nil
+	}
+	postgresMutex.Lock()
+	defer postgresMutex.Unlock()
+	if err := connectPostgres(ctx); err != nil {
+		return err
+	}
+
+	readings = afterWatermark(ctx, "postgres", postgresWatermark, readings)
+	var rejected error //First batch the database refused, the other batches are still written
+	for start := 0; start < len(readings); start += POSTGRESBATCH {
+		end := min(start+POSTGRESBATCH, len(readings))
+		if err := rejectSQL(upsertPostgres(ctx, station, readings[start:end])); err != nil {
+			err = fmt.Errorf("unable to write the readings to the PostgreSQL database: %w", err)
+			if !isRejected(err) {
+				return err
+			} else if rejected == nil {
+				rejected = err
+			}
+		}
+	}
+	slog.InfoContext(ctx, "Wrote "+strconv.Itoa(len(readings))+" readings to the PostgreSQL database",
+		"station", station.displayName())
+	return rejected
+}
+
+/*
+Connects to the configured PostgreSQL database if it isn't connected yet, returning an error if it can't connect. The
+caller must hold postgresMutex.
+*/
+func connectPostgres(ctx context.Context) error {
+	if postgresDB != nil {
+		return nil
+	}
+	db, err := openPostgres(ctx, config.PostgresURL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to the PostgreSQL database: %w", err)
+	}
+	watermark, err := loadWatermark(ctx, db, "SELECT (extract(epoch FROM watermark) * 1000)::bigint FROM "+
+		POSTGRESTABLE+"_compaction WHERE source = $1", POSTGRESTABLE)
+	if err != nil {
+		_ = db.Close()
+		return fmt.Errorf("unable to read the compaction watermark: %w", err)
+	}
+	postgresDB, postgresWatermark = db, watermark
+	return nil
+}
+
+/*
+Connects to the PostgreSQL database at the given URL and creates the readings table if it doesn't exist, turning it
+into a hypertable when timescaleDb is enabled.
+*/
+func openPostgres(ctx context.Context, databaseURL string) (*sql.DB, error) {
+	db, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	statements := []string{`CREATE TABLE IF NOT EXISTS ` + POSTGRESTABLE + ` (
+		station TEXT NOT NULL,
+		station_name TEXT NOT NULL DEFAULT '',
+		dateutc TIMESTAMPTZ NOT NULL,
+		data JSONB NOT NULL,
+		PRIMARY KEY (station, dateutc)
+	)`, `CREATE TABLE IF NOT EXISTS ` + POSTGRESTABLE + `_compaction (
+		source TEXT PRIMARY KEY,
+		watermark TIMESTAMPTZ NOT NULL
+	)`}
+	if config.Timescale {
+		statements = append(statements, `CREATE EXTENSION IF NOT EXISTS timescaledb`,
+			`SELECT create_hypertable('`+POSTGRESTABLE+`', 'dateutc', if_not_exists => TRUE, migrate_data => TRUE)`)
+	} else {
+		statements = append(statements, `CREATE INDEX IF NOT EXISTS `+POSTGRESTABLE+`_dateutc ON `+POSTGRESTABLE+
+			` (dateutc)`)
+	}
+	for _, statement := range statements {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	slog.InfoContext(ctx, "Connected to the PostgreSQL database", "table", POSTGRESTABLE,
+		"hypertable", config.Timescale)
+	return db, nil
+}
+
+/*
+Inserts the readings in a single statement, replacing the data of readings that are already stored. Only the last of
+readings with the same dateutc is inserted, as a statement can't update the same row twice.
+*/
+func upsertPostgres(ctx context.Context, station Station, readings []DeviceData) error {
+	var query strings.Builder
+	query.WriteString("INSERT INTO " + POSTGRESTABLE + " (station, station_name, dateutc, data) VALUES ")
+	args := make([]interface{}, 0, 4*len(readings))
+	last := make(map[int64]int, len(readings)) //Index of the last reading with each dateutc
+	for i, data := range readings {
+		last[data.DateUTC] = i
+	}
+	for i, data := range readings {
+		if data.DateUTC <= 0 || last[data.DateUTC] != i {
+			continue
+		}
+		fields := make(map[string]interface{}, len(data.Fields))
+		for name, value := range data.Fields {
+			if !undiscoveredFields[name] {
+				fields[name] = cellValue(convertField(name, value))
+			}
+		}
+		encoded, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+
+		if len(args) > 0 {
+			query.WriteString(", ")
+		}
+		n := len(args)
+		query.WriteString("($" + strconv.Itoa(n+1) + ", $" + strconv.Itoa(n+2) + ", $" + strconv.Itoa(n+3) + ", $" +
+			strconv.Itoa(n+4) + ")")
+		args = append(args, station.MacAddress, station.Name, time.UnixMilli(data.DateUTC).UTC(), string(encoded))
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	query.WriteString(" ON CONFLICT (station, dateutc) DO UPDATE SET station_name = excluded.station_name, " +
+		"data = excluded.data")
+	_, err := postgresDB.ExecContext(ctx, query.String(), args...)
+	return err
+}
+
+/*
+Registers the password of a URL, such as a PostgreSQL or NATS URL, as a secret so it never appears in the logs.
+*/
+func registerURLSecret(rawURL string) {
+	if parsed, err := url.Parse(rawURL); err == nil && parsed.User != nil {
+		if password, set := parsed.User.Password(); set {
+			registerSecret(password)
+		}
+	}
+}
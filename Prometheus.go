@@ -0,0 +1,107 @@
+package main
+
+/*
+This file serves the newest reading of every station as Prometheus gauges when metricsListen is set in the config, so
+Prometheus can scrape the station data directly. Each numeric sensor value is a gauge named after the sensor with the
+ambient_ prefix, in its configured unit, labelled with the station's MAC Address and name, e.g.
+ambient_tempf{station="00:11:22:33:44:55",name="Backyard"} 72.5
+The gauges are served at /metrics on the configured address by the embedded server, and hold the newest reading passed
+to writeRows, whether or not it was written to the outputs.
+*/
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	METRICSPREFIX = "ambient_"
+)
+
+var (
+	latestMutex    sync.Mutex
+	latestReadings = make(map[string]latestReading) //Newest reading of each station, by MAC Address
+	metricInvalid  = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	labelEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+/*
+latestReading is a struct that holds the newest reading of a station along with the station it came from.
+*/
+type latestReading struct {
+	station Station
+	data    DeviceData
+}
+
+/*
+Records the newest of a station's readings, if it is newer than the one held, for the metrics endpoint.
+*/
+func trackLatest(station Station, readings []DeviceData) {
+	latestMutex.Lock()
+	defer latestMutex.Unlock()
+	for _, data := range readings {
+		if held, exists := latestReadings[station.MacAddress]; !exists || data.DateUTC > held.data.DateUTC {
+			latestReadings[station.MacAddress] = latestReading{station: station, data: data}
+		}
+	}
+}
+
+/*
+Writes the gauges of the newest reading of every station in the Prometheus text format, grouped by metric.
+*/
+func serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	samples := make(map[string][]string) //Samples of each metric
+	latestMutex.Lock()
+	for _, latest := range latestReadings {
+		labels := `{station="` + labelEscaper.Replace(latest.station.MacAddress) + `",name="` +
+			labelEscaper.Replace(latest.station.displayName()) + `"}`
+		for name, value := range latest.data.Fields {
+			if undiscoveredFields[name] {
+				continue
+			}
+			number, numeric := numericValue(name, value)
+			if !numeric {
+				continue
+			}
+			metric := METRICSPREFIX + metricInvalid.ReplaceAllString(name, "_")
+			samples[metric] = append(samples[metric], metric+labels+" "+strconv.FormatFloat(number, 'g', -1, 64))
+		}
+	}
+	latestMutex.Unlock()
+
+	metrics := make([]string, 0, len(samples))
+	for metric := range samples {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	var body strings.Builder
+	for _, metric := range metrics {
+		sort.Strings(samples[metric])
+		body.WriteString("# TYPE " + metric + " gauge\n")
+		body.WriteString(strings.Join(samples[metric], "\n") + "\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(body.String()))
+}
+
+/*
+Returns a field's value converted to its configured unit as a number, with true as 1 and false as 0. Reports false for
+values that are not numbers, such as text.
+*/
+func numericValue(name string, value interface{}) (float64, bool) {
+	switch typed := cellValue(convertField(name, value)).(type) {
+	case float64:
+		return typed, true
+	case bool:
+		if typed {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+/*
+This file configures the HTTP proxy used for every outbound connection: the Ambient Weather REST and realtime APIs and
+the Google OAuth and Sheets APIs. A proxy set in the config file is used for all of them, otherwise the standard
+HTTPS_PROXY, HTTP_PROXY, and NO_PROXY environment variables are honored so users behind corporate proxies can run the
+program either way.
+*/
+import (
+	"context"
+	"errors"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/url"
+)
+
+/*
+Returns the function choosing the proxy for each request. An empty proxy URL means the environment variables are used,
+otherwise every request goes through the given http, https, or socks5 proxy.
+*/
+func proxyFunc(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.New("proxy " + redact(proxyURL) + " must be an http, https, or socks5 URL")
+	}
+	if parsed.Host == "" {
+		return nil, errors.New("proxy " + redact(proxyURL) + " is missing a host")
+	}
+	if password, exists := parsed.User.Password(); exists {
+		registerSecret(password)
+	}
+	return http.ProxyURL(parsed), nil
+}
+
+/*
+Points the shared transport, used by the Ambient Weather and Google clients, and the realtime dialer at the given
+proxy. If the proxy URL is invalid the environment variables are used instead and the error is returned.
+*/
+func applyProxy(proxyURL string) error {
+	proxy, err := proxyFunc(proxyURL)
+	if err != nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	sharedTransport.Proxy = proxy
+	realtimeDialer.Proxy = proxy
+	return err
+}
+
+/*
+Returns a context that makes the oauth2 and Google API libraries send their requests, including token refreshes,
+through googleClient and so through the configured proxy.
+*/
+func googleContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, googleClient)
+}
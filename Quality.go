@@ -0,0 +1,117 @@
+package main
+
+/*
+This file implements the data quality filters that catch sensor glitches the fixed ranges in Schema.go can't: a
+reading that is plausible on its own but jumps impossibly far from the station's previous reading, like a temperature
+spike of 30ºF in 5 minutes, a sudden pressure jump, or a daily rain total that goes backwards during the day. The
+largest change allowed per 5 minutes is set for each sensor with spikeLimits in the config, and qualityAction chooses
+whether a reading that fails is dropped (the default), only flagged in the logs, or not checked at all.
+*/
+import (
+	"context"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	QUALITYDROP = "drop"
+	QUALITYFLAG = "flag"
+	QUALITYOFF  = "off"
+)
+
+var (
+	defaultSpikeLimits = map[string]float64{
+		"tempf":      10,  //ºF per 5 minutes
+		"tempinf":    10,  //ºF per 5 minutes
+		"humidity":   30,  //% per 5 minutes
+		"baromrelin": 0.1, //inHg per 5 minutes
+		"baromabsin": 0.1, //inHg per 5 minutes
+	}
+
+	qualityMutex    sync.Mutex
+	previousReading = make(map[string]DeviceData) //Last reading that passed the filters for each station MAC Address
+)
+
+/*
+Returns the largest change allowed per 5 minutes for every checked sensor, the defaults with the configured limits
+applied on top. A limit of 0 turns the check off for that sensor.
+*/
+func spikeLimits() map[string]float64 {
+	limits := make(map[string]float64, len(defaultSpikeLimits)+len(config.SpikeLimits))
+	for name, limit := range defaultSpikeLimits {
+		limits[name] = limit
+	}
+	for name, limit := range config.SpikeLimits {
+		limits[name] = limit
+	}
+	return limits
+}
+
+/*
+Compares a reading with the station's previous reading and returns it with the fields that failed the filters dropped
+or, when qualityAction is flag, unchanged. Each failure is logged as a quality_outlier event. A dropped reading is not
+used as the baseline, so the next reading is compared with the last good one and the allowed change grows with the
+time between them. Readings more than 30 minutes after the baseline start a new baseline instead, since a long gap
+allows any change, and readings older than the baseline are returned unchecked.
+*/
+func filterOutliers(ctx context.Context, station Station, data DeviceData) DeviceData {
+	if config.QualityAction == QUALITYOFF {
+		return data
+	}
+
+	qualityMutex.Lock()
+	defer qualityMutex.Unlock()
+
+	previous, exists := previousReading[station.MacAddress]
+	if exists && data.DateUTC <= previous.DateUTC {
+		return data
+	}
+	elapsed := data.Time().Sub(previous.Time())
+	if !exists || elapsed > 30*time.Minute {
+		previousReading[station.MacAddress] = data
+		return data
+	}
+
+	var outliers []string
+	intervals := max(float64(elapsed)/float64(5*time.Minute), 1)
+	for name, limit := range spikeLimits() {
+		current, ok := ambient.ToFloat(data.Fields[name])
+		last, hasLast := ambient.ToFloat(previous.Fields[name])
+		if limit <= 0 || !ok || !hasLast {
+			continue
+		}
+		if change := current - last; change > limit*intervals || -change > limit*intervals {
+			outliers = append(outliers, name)
+		}
+	}
+
+	current, ok := ambient.ToFloat(data.Fields["dailyrainin"])
+	last, hasLast := ambient.ToFloat(previous.Fields["dailyrainin"])
+	sameDay := data.Time().YearDay() == previous.Time().YearDay() && data.Time().Year() == previous.Time().Year()
+	if ok && hasLast && sameDay && current < last {
+		outliers = append(outliers, "dailyrainin")
+	}
+
+	if len(outliers) == 0 {
+		previousReading[station.MacAddress] = data
+		return data
+	}
+	sort.Strings(outliers)
+	slog.WarnContext(ctx, "Reading changed implausibly since the previous reading", "event", "quality_outlier",
+		"station", station.displayName(), "time", data.Time(), "fields", strings.Join(outliers, ","),
+		"action", config.QualityAction)
+
+	if config.QualityAction == QUALITYFLAG {
+		previousReading[station.MacAddress] = data
+		return data
+	}
+	cleaned, err := withoutFields(data, outliers)
+	if err != nil {
+		return data
+	}
+	return cleaned
+}
@@ -0,0 +1,191 @@
+package main
+
+/*
+This file computes rain totals over the periods the Ambient Weather API doesn't report, written as extra columns: rain
+since midnight, in the last 24 hours, month to date, and rain year to date, where the rain year starts in the month set
+as rainYearStartMonth in the config (e.g. 10 for a water year starting in October). The largest daily rain total seen
+for each day is kept in a ledger file so the month and rain year totals survive restarts, and a backfill fills the
+ledger for days the program wasn't running. Where the API's own monthly or yearly total is larger, e.g. for the days
+before the ledger started, it is used instead.
+*/
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	rainFile   = "rain.json"
+	rainMutex  sync.Mutex
+	rainLedger map[string]map[string]float64  //Daily rain total in inches by day for each station MAC Address
+	rainPoints = make(map[string][]rainPoint) //Daily rain readings of the last 24 hours for each station MAC Address
+	rainDirty  = false
+)
+
+/*
+rainPoint is a struct that holds the daily rain total a station reported at a point in time, used to add up the rain
+of the last 24 hours when the station doesn't report it.
+*/
+type rainPoint struct {
+	observed time.Time
+	daily    float64
+}
+
+/*
+Returns the record with the rainToday, rain24h, rainMonth, and rainYear fields added from its daily rain total and the
+ledger, and records the daily total in the ledger. Records without a daily rain total are returned unchanged.
+*/
+func withRainTotals(station Station, data DeviceData) DeviceData {
+	daily, ok := ambient.ToFloat(data.Fields["dailyrainin"])
+	if !ok {
+		return data
+	}
+
+	rainMutex.Lock()
+	defer rainMutex.Unlock()
+	loadRainLedger()
+
+	observed := data.Time()
+	days, exists := rainLedger[station.MacAddress]
+	if !exists {
+		days = make(map[string]float64)
+		rainLedger[station.MacAddress] = days
+	}
+	day := observed.Format(DATEFORMAT)
+	if daily > days[day] {
+		days[day] = daily
+		rainDirty = true
+	}
+
+	setDerived(&data, "rainToday", daily, nil)
+	if last24h, ok := ambient.ToFloat(data.Fields["24hourrainin"]); ok {
+		setDerived(&data, "rain24h", last24h, nil)
+	} else {
+		setDerived(&data, "rain24h", rainSince(station, observed, daily), nil)
+	}
+
+	month := ledgerTotal(days, time.Date(observed.Year(), observed.Month(), 1, 0, 0, 0, 0, location), observed)
+	if monthly, ok := ambient.ToFloat(data.Fields["monthlyrainin"]); ok {
+		month = math.Max(month, monthly)
+	}
+	setDerived(&data, "rainMonth", month, nil)
+
+	yearStart := rainYearStart(observed)
+	year := ledgerTotal(days, yearStart, observed)
+	if yearly, ok := ambient.ToFloat(data.Fields["yearlyrainin"]); ok && yearStart.Month() == time.January {
+		year = math.Max(year, yearly)
+	}
+	setDerived(&data, "rainYear", math.Max(year, month), nil)
+	return data
+}
+
+/*
+Returns the start of the rain year the given time falls in, midnight on the first day of the configured start month.
+*/
+func rainYearStart(observed time.Time) time.Time {
+	startMonth := time.Month(max(config.RainYearStart, 1))
+	year := observed.Year()
+	if observed.Month() < startMonth {
+		year--
+	}
+	return time.Date(year, startMonth, 1, 0, 0, 0, 0, location)
+}
+
+/*
+Adds up the daily totals in the ledger from the start day up to and including the day of the end time.
+*/
+func ledgerTotal(days map[string]float64, start time.Time, end time.Time) float64 {
+	total := 0.0
+	first := start.Format(DATEFORMAT)
+	last := end.Format(DATEFORMAT)
+	for day, rain := range days {
+		if day >= first && day <= last {
+			total += rain
+		}
+	}
+	return total
+}
+
+/*
+Records the daily rain total reported at the given time and returns the rain of the 24 hours before it, adding up the
+increases of the daily total and starting over from the new total wherever it reset at midnight. Only readings seen
+since the program started are counted.
+*/
+func rainSince(station Station, observed time.Time, daily float64) float64 {
+	points := rainPoints[station.MacAddress]
+	if len(points) == 0 || observed.After(points[len(points)-1].observed) {
+		points = append(points, rainPoint{observed: observed, daily: daily})
+	}
+	for len(points) > 0 && observed.Sub(points[0].observed) > 24*time.Hour {
+		points = points[1:]
+	}
+	rainPoints[station.MacAddress] = points
+
+	total := 0.0
+	for i := 1; i < len(points) && !points[i].observed.After(observed); i++ {
+		if change := points[i].daily - points[i-1].daily; change >= 0 {
+			total += change
+		} else {
+			total += points[i].daily //The daily total reset at midnight
+		}
+	}
+	return total
+}
+
+/*
+Reads the rain ledger from the rain file the first time it is needed. A missing file starts an empty ledger.
+*/
+func loadRainLedger() {
+	if rainLedger != nil {
+		return
+	}
+	rainLedger = make(map[string]map[string]float64)
+
+	data, err := os.ReadFile(rainFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &rainLedger)
+	}
+	if err != nil {
+		slog.Warn("Unable to read the rain ledger, rain totals start over", "file", rainFile, "err", err)
+		rainLedger = make(map[string]map[string]float64)
+	}
+}
+
+/*
+Writes the rain ledger to the rain file if it changed, dropping days more than two years old.
+*/
+func saveRainLedger() {
+	rainMutex.Lock()
+	defer rainMutex.Unlock()
+	if !rainDirty {
+		return
+	}
+
+	cutoff := time.Now().In(location).AddDate(-2, 0, 0).Format(DATEFORMAT)
+	for _, days := range rainLedger {
+		for day := range days {
+			if day < cutoff {
+				delete(days, day)
+			}
+		}
+	}
+
+	data, err := json.Marshal(rainLedger)
+	if err == nil {
+		err = os.WriteFile(rainFile, data, 0o644)
+	}
+	if err != nil {
+		slog.Warn("Unable to save the rain ledger", "file", rainFile, "err", err)
+		return
+	}
+	rainDirty = false
+	slog.Debug("Saved the rain ledger", "file", rainFile, "stations", len(rainLedger))
+}
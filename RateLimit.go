@@ -0,0 +1,72 @@
+package main
+
+/*
+This file provides the client-side rate limiting for the Ambient Weather API, which allows 1 request per second for
+each API Key and 3 requests per second for each Application Key. Every request made through executeRequest waits for
+its turn here, so polling several stations, retries, and backfill jobs running at the same time never burst past the
+limit and trigger 429 responses.
+*/
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	apiKeyLimiter = newRateLimiter(time.Second)
+	appKeyLimiter = newRateLimiter(time.Second / 3)
+)
+
+/*
+rateLimiter is a struct that spaces out requests sharing a key so that at most one request starts per interval. Each
+caller reserves the next free slot for its key and then sleeps until that slot, so concurrent callers are served in
+the order they arrived.
+*/
+type rateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time
+}
+
+/*
+Returns a rateLimiter allowing one request per interval for each key.
+*/
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	return &rateLimiter{interval: interval, next: make(map[string]time.Time)}
+}
+
+/*
+Blocks until a request for the given key may start, returning false if the context is cancelled first.
+*/
+func (limiter *rateLimiter) wait(ctx context.Context, key string) bool {
+	limiter.mutex.Lock()
+	now := time.Now()
+	start := limiter.next[key]
+	if start.Before(now) {
+		start = now
+	}
+	limiter.next[key] = start.Add(limiter.interval)
+	limiter.mutex.Unlock()
+
+	return sleepContext(ctx, time.Until(start))
+}
+
+/*
+Blocks until a request to the given Ambient Weather API URL may start without exceeding the limit of either the API Key
+or the Application Key in its query. Returns false if the context is cancelled while waiting.
+*/
+func waitForRateLimit(ctx context.Context, completeURL string) bool {
+	parsed, err := url.Parse(completeURL)
+	if err != nil {
+		return true
+	}
+	query := parsed.Query()
+	if apiKey := query.Get("apiKey"); apiKey != "" && !apiKeyLimiter.wait(ctx, apiKey) {
+		return false
+	}
+	if appKey := query.Get("applicationKey"); appKey != "" && !appKeyLimiter.wait(ctx, appKey) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package main
+
+/*
+This file implements the realtime mode, which subscribes to the Ambient Weather realtime API instead of polling every 5
+minutes. The subscription itself is handled by the ambient package; every record it pushes is written through the same
+writeRows function used by the scheduled calls. The connection is re-established with a growing wait whenever it
+drops.
+*/
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+realtimeReading is a struct that holds a DeviceData record pushed by the realtime API along with the station it was
+reported by, queued for the writer goroutine.
+*/
+type realtimeReading struct {
+	station Station
+	data    DeviceData
+}
+
+/*
+Subscribes to the realtime API for every station on the configured API Key and writes each pushed record to the sheet.
+Records are queued to a separate goroutine so a slow sheet write never delays a pong and drops the connection, and
+records that queue up during a write are written together in one batch. The function reconnects until the context is
+cancelled, waiting 10 seconds longer after each consecutive failure up to 5 minutes, and the records still queued when
+it returns are handed to the outputs' queues before the program exits.
+*/
+func subscribeRealtime(ctx context.Context) {
+	readings := make(chan realtimeReading, 100)
+	defer close(readings) //Ends the writer once the records still queued are written
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		for reading := range readings {
+			batch := []realtimeReading{reading}
+		queued:
+			for len(batch) < cap(readings) { //Records that arrived during the last write are written together
+				select {
+				case next := <-readings:
+					batch = append(batch, next)
+				default:
+					break queued
+				}
+			}
+			writeRealtime(withCorrelationID(ctx), batch)
+		}
+	}()
+
+	failures := 0
+	for {
+		started := time.Now()
+		slog.Info("Connecting to the Ambient Weather realtime API")
+		client := ambientClientFor(config.APIKey)
+		err := client.Subscribe(ctx, func(data DeviceData) { handleRealtimeData(data, readings) })
+		if ctx.Err() != nil {
+			slog.Info("Realtime subscription stopped")
+			return
+		}
+		if time.Since(started) > 5*time.Minute {
+			failures = 0
+		}
+		failures++
+
+		wait := min(10*failures, 300)
+		slog.Warn("Realtime connection lost: " + err.Error() + " reconnecting after " + strconv.Itoa(wait) +
+			" second wait.")
+		if !sleepContext(ctx, time.Duration(wait)*time.Second) {
+			return
+		}
+	}
+}
+
+/*
+Validates and writes a batch of records pushed by the realtime API, with one write for each station's new records.
+*/
+func writeRealtime(ctx context.Context, batch []realtimeReading) {
+	var stations []Station
+	byStation := make(map[string][]DeviceData)
+	for _, reading := range batch {
+		if _, exists := byStation[reading.station.MacAddress]; !exists {
+			stations = append(stations, reading.station)
+		}
+		byStation[reading.station.MacAddress] = append(byStation[reading.station.MacAddress], reading.data)
+	}
+
+	persisted := true
+	for _, station := range stations {
+		valid := validReadings(ctx, station, byStation[station.MacAddress])
+		if len(valid) == 0 {
+			continue
+		}
+		valid = newReadings(ctx, station, valid)
+		if len(valid) == 0 {
+			continue
+		}
+		trackBatteries(ctx, station, valid)
+		trackLeaks(ctx, station, valid)
+		if !writeRows(ctx, station, valid) {
+			slog.ErrorContext(ctx, "Realtime readings were not persisted", "station", station.displayName())
+			persisted = false
+			continue
+		}
+		markPersisted(station, valid)
+		trackDailySummary(ctx, station, valid)
+	}
+	saveState()
+	if persisted {
+		sendHeartbeat(ctx)
+	}
+}
+
+/*
+Handles a record pushed by the realtime API, queueing it for the station that reported it. Data from stations that
+aren't configured is ignored.
+*/
+func handleRealtimeData(data DeviceData, readings chan<- realtimeReading) {
+	macAddress, _ := data.Fields["macAddress"].(string)
+	station, exists := findStation(macAddress)
+	if !exists {
+		slog.Debug("Ignoring realtime data from an unconfigured station", "macAddress", macAddress)
+		return
+	}
+	slog.Info("Received realtime data", "station", station.displayName())
+	markPolled()
+	if body, err := json.Marshal(data.Fields); err == nil {
+		recordRealtime(station.MacAddress, body)
+	}
+	readings <- realtimeReading{station: station, data: data}
+}
+
+/*
+Returns the configured station with the given MAC Address, compared case-insensitively.
+*/
+func findStation(macAddress string) (Station, bool) {
+	for _, station := range config.Stations {
+		if strings.EqualFold(station.MacAddress, macAddress) {
+			return station, true
+		}
+	}
+	return Station{}, false
+}
@@ -0,0 +1,155 @@
+package main
+
+/*
+This file records every raw response from the Ambient Weather API to a local archive when recordDir is set in the
+config, so the data can be replayed, parsed again after a schema change, or used to rebuild a damaged spreadsheet.
+Each response is a line of JSON in a gzip compressed file per day, responses-YYYY-MM-DD.jsonl.gz. Every line is
+written as its own gzip member, which readers decompress as one stream, so a crash never leaves a file that can't be
+read. Files older than the configured number of days are deleted when a new day's file is started.
+*/
+import (
+	"compress/gzip"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RECORDPREFIX = "responses-"
+	RECORDSUFFIX = ".jsonl.gz"
+)
+
+var (
+	recordMutex sync.Mutex
+	recordDay   = "" //Day of the file last written, old files are removed when it changes
+)
+
+/*
+recordedResponse is a struct that holds a single raw response in the archive: when it was received, whether it came
+from the REST or realtime API, the station it belongs to if known, the request it answered without the keys, and the
+response body exactly as received.
+*/
+type recordedResponse struct {
+	Received   time.Time       `json:"received"`
+	Source     string          `json:"source"`
+	MacAddress string          `json:"macAddress,omitempty"`
+	Request    string          `json:"request,omitempty"`
+	Body       json.RawMessage `json:"body"`
+}
+
+/*
+Records a raw REST API response for the given request URL. The API Key and App Key are removed from the recorded
+request and the station's MAC Address is taken from its path.
+*/
+func recordResponse(completeURL string, body string) {
+	if config.RecordDir == "" {
+		return
+	}
+	request := ""
+	macAddress := ""
+	if parsed, err := url.Parse(completeURL); err == nil {
+		query := parsed.Query()
+		query.Del("apiKey")
+		query.Del("applicationKey")
+		parsed.RawQuery = query.Encode()
+		request = parsed.String()
+		if dir, last := path.Split(parsed.Path); strings.HasSuffix(dir, "/devices/") {
+			macAddress = last
+		}
+	}
+	appendRecord(recordedResponse{Source: "rest", MacAddress: macAddress, Request: request,
+		Body: json.RawMessage(body)})
+}
+
+/*
+Records a raw realtime data event for the station with the given MAC Address.
+*/
+func recordRealtime(macAddress string, body []byte) {
+	if config.RecordDir == "" {
+		return
+	}
+	appendRecord(recordedResponse{Source: "realtime", MacAddress: macAddress, Body: json.RawMessage(body)})
+}
+
+/*
+Appends a record to today's archive file as its own gzip member, starting a new file and removing expired ones when
+the day changes. Failures are logged and otherwise ignored so recording never stops data from being written.
+*/
+func appendRecord(record recordedResponse) {
+	record.Received = time.Now()
+	if !json.Valid(record.Body) {
+		slog.Warn("Not recording response that is not valid JSON", "source", record.Source)
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Warn("Unable to encode recorded response", "err", err)
+		return
+	}
+
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
+
+	day := record.Received.Format(DATEFORMAT)
+	if day != recordDay {
+		if err := os.MkdirAll(config.RecordDir, 0o755); err != nil {
+			slog.Warn("Unable to create recording directory", "dir", config.RecordDir, "err", err)
+			return
+		}
+		removeExpiredRecordings(record.Received)
+		recordDay = day
+	}
+
+	file, err := os.OpenFile(filepath.Join(config.RecordDir, RECORDPREFIX+day+RECORDSUFFIX),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		slog.Warn("Unable to open recording file", "err", err)
+		return
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			return
+		}
+	}(file)
+
+	writer := gzip.NewWriter(file)
+	if _, err := writer.Write(append(line, '\n')); err != nil {
+		slog.Warn("Unable to record response", "err", err)
+		return
+	}
+	if err := writer.Close(); err != nil {
+		slog.Warn("Unable to record response", "err", err)
+	}
+}
+
+/*
+Deletes archive files for days more than the configured number of days before now. A retention of 0 keeps every file.
+*/
+func removeExpiredRecordings(now time.Time) {
+	if config.RecordDays <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(config.RecordDir, RECORDPREFIX+"*"+RECORDSUFFIX))
+	if err != nil {
+		return
+	}
+
+	cutoff := now.AddDate(0, 0, -config.RecordDays).Format(DATEFORMAT)
+	for _, file := range files {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), RECORDPREFIX), RECORDSUFFIX)
+		if day < cutoff {
+			if err := os.Remove(file); err != nil {
+				slog.Warn("Unable to remove expired recording", "file", file, "err", err)
+				continue
+			}
+			slog.Info("Removed expired recording", "file", file)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+/*
+This file implements the replay subcommand, which reads the archive of raw responses written when recordDir is set and
+pushes every recorded record through the same parse, validate, and write steps as a live poll. This rebuilds a damaged
+sheet, fills a new spreadsheet or backend, or applies a change to the parsing to data that was already collected.
+Records that appear in several responses are written once, and records are written per station in timestamp order.
+*/
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Replays the recorded responses between the given dates into the sheets and returns the exit code for the program, 0 if
+every archive file was read and 1 otherwise. Both dates are inclusive, an empty start date replays the whole archive.
+*/
+func runReplay(ctx context.Context, fromDate string, toDate string) int {
+	if !initialize(ctx) {
+		return 1
+	}
+	if config.RecordDir == "" {
+		slog.Error("recordDir is not set in the config, there is no archive to replay")
+		return 1
+	}
+
+	from := time.Time{}
+	to := time.Now().AddDate(1, 0, 0)
+	if fromDate != "" {
+		var err error
+		from, to, err = parseDateRange(fromDate, toDate)
+		if err != nil {
+			slog.Error("Invalid replay range", "err", err)
+			return 1
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(config.RecordDir, RECORDPREFIX+"*"+RECORDSUFFIX))
+	if err != nil || len(files) == 0 {
+		slog.Error("No recorded responses found", "dir", config.RecordDir)
+		return 1
+	}
+	sort.Strings(files)
+
+	exitCode := 0
+	byStation := make(map[string][]DeviceData)
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return 1
+		}
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), RECORDPREFIX), RECORDSUFFIX)
+		if day < from.AddDate(0, 0, -1).Format(DATEFORMAT) || day > to.Format(DATEFORMAT) {
+			continue //Responses are filed by the day they were received, which may be a day after the record
+		}
+
+		records, err := readRecording(file)
+		if err != nil {
+			slog.Error("Unable to read the whole recording, replaying the records read so far", "file", file,
+				"err", err)
+			exitCode = 1
+		}
+		for _, record := range records {
+			station, exists := findStation(record.MacAddress)
+			if !exists {
+				continue
+			}
+			for _, data := range recordedReadings(record) {
+				key := station.MacAddress + "/" + strconv.FormatInt(data.DateUTC, 10)
+				observed := data.Time()
+				if seen[key] || observed.Before(from) || !observed.Before(to) {
+					continue
+				}
+				seen[key] = true
+				byStation[station.MacAddress] = append(byStation[station.MacAddress], data)
+			}
+		}
+		slog.Info("Read recording", "file", file, "responses", len(records))
+	}
+
+	for _, station := range config.Stations {
+		ctx := withCorrelationID(ctx)
+		readings := validReadings(ctx, station, sortByTime(byStation[station.MacAddress]))
+		if len(readings) == 0 {
+			slog.WarnContext(ctx, "No recorded records to replay", "station", station.displayName())
+			continue
+		}
+		if !writeRows(ctx, station, readings) {
+			slog.ErrorContext(ctx, "Replayed records were not all persisted", "station", station.displayName())
+			exitCode = 1
+			continue
+		}
+		slog.InfoContext(ctx, "Replayed "+strconv.Itoa(len(readings))+" records", "station", station.displayName())
+	}
+	if !flushSinks(context.WithoutCancel(ctx)) {
+		exitCode = 1
+	}
+	return exitCode
+}
+
+/*
+Reads every recorded response in an archive file. A file cut short by a crash returns the responses before the damage
+along with the error.
+*/
+func readRecording(file string) ([]recordedResponse, error) {
+	opened, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func(opened *os.File) {
+		err := opened.Close()
+		if err != nil {
+			return
+		}
+	}(opened)
+
+	reader, err := gzip.NewReader(opened)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []recordedResponse
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var record recordedResponse
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return records, fmt.Errorf("unable to parse recorded response: %w", err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return records, err
+	}
+	return records, nil
+}
+
+/*
+Decodes the records held in a recorded response: the array returned by a REST device query or the single record of a
+realtime data event. Responses that hold no records, such as the device list, return nothing.
+*/
+func recordedReadings(record recordedResponse) []DeviceData {
+	switch record.Source {
+	case "rest":
+		readings, err := ambient.ParseDeviceData(string(record.Body))
+		if err != nil {
+			slog.Warn("Unable to parse recorded response", "received", record.Received, "err", err)
+			return nil
+		}
+		return readings
+	case "realtime":
+		var data DeviceData
+		if err := json.Unmarshal(record.Body, &data); err != nil {
+			slog.Warn("Unable to parse recorded realtime data", "received", record.Received, "err", err)
+			return nil
+		}
+		return []DeviceData{data}
+	default:
+		return nil
+	}
+}
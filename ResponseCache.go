@@ -0,0 +1,94 @@
+package main
+
+/*
+This file caches responses from the Ambient Weather API. When a response carries an ETag or Last-Modified header, the
+next request for the same endpoint is made conditional with If-None-Match / If-Modified-Since, and a 304 Not Modified
+response is answered from the cache instead of downloading the same records again. Responses are cached by endpoint,
+e.g. a device's records by its MAC Address, whatever the limit asked for, so the cache holds one response per station
+and endpoint. History pages requested with end_date only ever change the past, so they are never cached.
+*/
+import (
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+/*
+cachedResponse is a struct that holds the validators and body of the last successful response for a URL.
+*/
+type cachedResponse struct {
+	etag         string
+	lastModified string
+	body         string
+}
+
+var (
+	cacheMutex    sync.Mutex
+	responseCache = make(map[string]cachedResponse)
+)
+
+/*
+Returns the key a URL's response is cached under, its host and path, reporting false for URLs whose responses aren't
+cached: history pages that end at end_date.
+*/
+func cacheKey(completeURL string) (string, bool) {
+	parsed, err := url.Parse(completeURL)
+	if err != nil || parsed.Query().Has("end_date") {
+		return "", false
+	}
+	return parsed.Host + parsed.Path, true
+}
+
+/*
+Adds the conditional request headers for the cached response of the given URL, if there is one.
+*/
+func applyCacheHeaders(req *http.Request, completeURL string) {
+	key, cacheable := cacheKey(completeURL)
+	if !cacheable {
+		return
+	}
+	cacheMutex.Lock()
+	cached, exists := responseCache[key]
+	cacheMutex.Unlock()
+	if !exists {
+		return
+	}
+
+	if cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	if cached.lastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.lastModified)
+	}
+}
+
+/*
+Returns the cached body for the given URL, used when the server answers 304 Not Modified.
+*/
+func cachedBody(completeURL string) (string, bool) {
+	key, cacheable := cacheKey(completeURL)
+	if !cacheable {
+		return "", false
+	}
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	cached, exists := responseCache[key]
+	return cached.body, exists
+}
+
+/*
+Stores the body of a successful response for the given URL, replacing the one cached for its endpoint, if the URL is
+cached and the server sent validators that allow a conditional request next time.
+*/
+func storeResponse(completeURL string, header http.Header, body string) {
+	etag := header.Get("ETag")
+	lastModified := header.Get("Last-Modified")
+	key, cacheable := cacheKey(completeURL)
+	if !cacheable || (etag == "" && lastModified == "") {
+		return
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	responseCache[key] = cachedResponse{etag: etag, lastModified: lastModified, body: body}
+}
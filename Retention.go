@@ -0,0 +1,177 @@
+package main
+
+/*
+This file keeps the spreadsheet under Google's limit of 10 million cells by retiring station sheets once their newest
+reading is more than retentionYears old. Every retired sheet is first exported to a CSV file in archiveDir, named after
+the sheet, and is then hidden or deleted as chosen by retentionAction. Hidden sheets still count towards the cell
+limit, only deleting them frees their cells. A sheet is never retired unless its export succeeded. Sheets without a
+dateutc column, such as the Daily Summary, are kept. Old sheets are checked at startup and whenever a new sheet is
+created, and a retentionYears of 0 keeps every sheet.
+*/
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"google.golang.org/api/sheets/v4"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RETENTIONHIDE   = "hide"
+	RETENTIONDELETE = "delete"
+	RETENTIONTAIL   = 500 //Last rows of a sheet read to find its newest reading
+)
+
+/*
+Exports and retires every visible sheet whose newest reading is older than the retention period. Only the header row
+and the end of the dateutc column of each sheet are read to find its newest reading, the whole sheet is only read to
+export it.
+*/
+func applyRetention(ctx context.Context) {
+	if config.RetentionYears <= 0 || service == nil {
+		return
+	}
+	response, err := service.Spreadsheets.Get(spreadsheetFor(ctx)).Context(ctx).Do()
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to list sheets for retention", "err", err)
+		return
+	}
+
+	cutoff := time.Now().AddDate(-config.RetentionYears, 0, 0).UnixMilli()
+	for _, sheet := range response.Sheets {
+		name := sheet.Properties.Title
+		if sheet.Properties.Hidden {
+			continue
+		}
+		var rows int64
+		if sheet.Properties.GridProperties != nil {
+			rows = sheet.Properties.GridProperties.RowCount
+		}
+		newest, exists, err := newestReading(ctx, name, rows)
+		if err != nil {
+			slog.WarnContext(ctx, "Unable to read sheet for retention", "sheet", name, "err", err)
+			continue
+		}
+		if !exists || newest >= cutoff {
+			continue
+		}
+
+		values, err := service.Spreadsheets.Values.Get(spreadsheetFor(ctx), quoteSheetName(name)).
+			ValueRenderOption("UNFORMATTED_VALUE").Context(ctx).Do()
+		if err != nil {
+			slog.ErrorContext(ctx, "Unable to read sheet to archive it, keeping it", "sheet", name, "err", err)
+			continue
+		}
+		file, err := exportSheet(name, values.Values)
+		if err != nil {
+			slog.ErrorContext(ctx, "Unable to archive sheet, keeping it", "sheet", name, "err", err)
+			continue
+		}
+		slog.InfoContext(ctx, "Archived sheet", "sheet", name, "file", file, "rows", len(values.Values))
+		retireSheet(ctx, name, sheet.Properties.SheetId)
+	}
+}
+
+/*
+Returns the dateutc of the newest reading in a sheet with the given number of rows, reading the header row to find the
+dateutc column and then only its last RETENTIONTAIL rows, since readings are appended in order. The rest of the column
+is only read when its last rows are empty. Reports false if the sheet has no dateutc column or no readings.
+*/
+func newestReading(ctx context.Context, name string, rows int64) (int64, bool, error) {
+	header, err := service.Spreadsheets.Values.Get(spreadsheetFor(ctx), quoteSheetName(name)+"!1:1").
+		Context(ctx).Do()
+	if err != nil || len(header.Values) == 0 {
+		return 0, false, err
+	}
+	column, exists := sensorColumn("dateutc", header.Values[0])
+	if !exists {
+		return 0, false, nil
+	}
+	id := columnID(column)
+	start := max(2, rows-RETENTIONTAIL+1)
+	ranges := []string{id + strconv.FormatInt(start, 10) + ":" + id}
+	if start > 2 {
+		ranges = append(ranges, id+"2:"+id+strconv.FormatInt(start-1, 10))
+	}
+
+	for _, cells := range ranges {
+		dates, err := service.Spreadsheets.Values.Get(spreadsheetFor(ctx), quoteSheetName(name)+"!"+cells).
+			ValueRenderOption("UNFORMATTED_VALUE").Context(ctx).Do()
+		if err != nil {
+			return 0, false, err
+		}
+		var newest int64
+		for _, row := range dates.Values {
+			if len(row) == 0 {
+				continue
+			}
+			if dateUTC, ok := ambient.ToFloat(row[0]); ok && int64(dateUTC) > newest {
+				newest = int64(dateUTC)
+			}
+		}
+		if newest > 0 {
+			return newest, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+/*
+Writes a sheet's values, header row included, to a CSV file in the archive directory and returns the file's path.
+An existing archive of the sheet is replaced, since it holds the same rows or fewer.
+*/
+func exportSheet(name string, values [][]interface{}) (string, error) {
+	if err := os.MkdirAll(config.ArchiveDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(config.ArchiveDir, strings.NewReplacer("/", "-", "\\", "-").Replace(name)+".csv")
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+
+	writer := csv.NewWriter(file)
+	for _, row := range values {
+		record := make([]string, len(row))
+		for i, cell := range row {
+			record[i] = fmt.Sprint(cell)
+		}
+		if err := writer.Write(record); err != nil {
+			_ = file.Close()
+			return "", err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		_ = file.Close()
+		return "", err
+	}
+	return path, file.Close()
+}
+
+/*
+Hides or deletes an archived sheet as chosen by retentionAction.
+*/
+func retireSheet(ctx context.Context, name string, sheetId int64) {
+	request := &sheets.Request{
+		UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+			Properties: &sheets.SheetProperties{SheetId: sheetId, Hidden: true},
+			Fields:     "hidden",
+		},
+	}
+	if config.RetentionAction == RETENTIONDELETE {
+		request = &sheets.Request{DeleteSheet: &sheets.DeleteSheetRequest{SheetId: sheetId}}
+	}
+
+	if batchUpdateRequest(ctx, &sheets.BatchUpdateSpreadsheetRequest{Requests: []*sheets.Request{request}}, 1) == nil {
+		slog.ErrorContext(ctx, "Unable to retire archived sheet", "sheet", name, "action", config.RetentionAction)
+		return
+	}
+	slog.InfoContext(ctx, "Retired archived sheet", "sheet", name, "action", config.RetentionAction)
+}
@@ -0,0 +1,49 @@
+package main
+
+/*
+This file implements the sheet rotation policy, which decides how much time each sheet covers. Yearly sheets (the
+default) are named for the year, e.g. 2026, monthly sheets for the year and month, e.g. 2026-03, and weekly sheets for
+the ISO year and week, e.g. 2026-W11. A station reporting every minute fills over half a million rows a year, so
+monthly or weekly rotation keeps each sheet well within the Sheets row and cell limits. A new sheet is created with
+its frozen header row the first time a reading falls into its period, the same as a new year's sheet.
+*/
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	ROTATIONYEARLY  = "yearly"
+	ROTATIONMONTHLY = "monthly"
+	ROTATIONWEEKLY  = "weekly"
+)
+
+/*
+Returns the name of the period the given time falls in under the configured rotation policy.
+*/
+func sheetPeriod(observed time.Time) string {
+	switch config.SheetRotation {
+	case ROTATIONMONTHLY:
+		return fmt.Sprintf("%d-%02d", observed.Year(), int(observed.Month()))
+	case ROTATIONWEEKLY:
+		year, week := observed.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	default:
+		return strconv.Itoa(observed.Year())
+	}
+}
+
+/*
+Returns a time in the period before the one the given time falls in under the configured rotation policy.
+*/
+func previousPeriod(observed time.Time) time.Time {
+	switch config.SheetRotation {
+	case ROTATIONMONTHLY:
+		return time.Date(observed.Year(), observed.Month(), 1, 0, 0, 0, 0, observed.Location()).AddDate(0, 0, -1)
+	case ROTATIONWEEKLY:
+		return observed.AddDate(0, 0, -7)
+	default:
+		return observed.AddDate(-1, 0, 0)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+/*
+This file routes subsets of the sensors to specific outputs. Each entry of sinkRoutes names a sink and the sensors it
+receives, as sensor names or patterns such as temp* or *rainin, and the sensors it doesn't, e.g.
+{"sink": "sheets", "sensors": ["tempf", "humidity", "wind*", "*rainin"]} to keep the indoor sensors out of a public
+sheet while every other output still gets everything. A sensor reaches the sink if it matches one of sensors, or
+sensors is empty, and matches none of exclude. dateutc, date, and the fields describing the station always reach
+every sink. Routes are applied by the dispatcher before a batch is queued for or written to its sink.
+*/
+import (
+	"path"
+)
+
+/*
+SinkRoute is a struct that holds the sensors routed to a sink.
+*/
+type SinkRoute struct {
+	Sink    string   `json:"sink"`
+	Sensors []string `json:"sensors"` //Sensor names or patterns the sink receives, all if empty
+	Exclude []string `json:"exclude"` //Sensor names or patterns the sink never receives
+}
+
+/*
+Returns the readings with only the fields the route of the named sink lets through. Readings are returned as they are
+if the sink has no route.
+*/
+func routeReadings(sinkName string, readings []DeviceData) []DeviceData {
+	var route *SinkRoute
+	for i := range config.SinkRoutes {
+		if config.SinkRoutes[i].Sink == sinkName {
+			route = &config.SinkRoutes[i]
+			break
+		}
+	}
+	if route == nil {
+		return readings
+	}
+
+	routed := make([]DeviceData, len(readings))
+	for i, data := range readings {
+		fields := make(map[string]interface{}, len(data.Fields))
+		for name, value := range data.Fields {
+			if route.allows(name) {
+				fields[name] = value
+			}
+		}
+		data.Fields = fields
+		routed[i] = data
+	}
+	return routed
+}
+
+/*
+Reports whether the route lets a sensor through.
+*/
+func (route SinkRoute) allows(name string) bool {
+	if name == "dateutc" || name == "date" || undiscoveredFields[name] {
+		return true
+	}
+	if len(route.Sensors) > 0 && !matchesAny(route.Sensors, name) {
+		return false
+	}
+	return !matchesAny(route.Exclude, name)
+}
+
+/*
+Reports whether a sensor name matches any of the names or patterns.
+*/
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns the problems with the routes: a route for an unknown sink, a sink with more than one route, or an invalid
+pattern.
+*/
+func routeProblems(loaded Config) []string {
+	var problems []string
+	seen := make(map[string]bool)
+	for _, route := range loaded.SinkRoutes {
+		known := false
+		for _, sink := range sinks {
+			known = known || sink.Name() == route.Sink
+		}
+		if !known {
+			problems = append(problems, "sinkRoutes names an unknown output "+route.Sink)
+		}
+		if seen[route.Sink] {
+			problems = append(problems, "sinkRoutes has more than one route for "+route.Sink)
+		}
+		seen[route.Sink] = true
+		for _, pattern := range append(route.Sensors, route.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				problems = append(problems, "sinkRoutes has an invalid pattern "+pattern+" for "+route.Sink)
+			}
+		}
+	}
+	return problems
+}
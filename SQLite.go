@@ -0,0 +1,269 @@
+package main
+
+/*
+This file stores the readings in a local SQLite database when sqliteFile is set in the config, so the history can be
+queried with SQL. The database holds these tables:
+  - stations: one row per station, by MAC Address, with its name.
+  - sensors: one row per field the stations report, with its description and unit from the headers mapping.
+  - readings: one row per sensor value of each reading, keyed by station, dateutc, and sensor, with the value in its
+    configured unit in value, or in text for values that aren't numbers. observed holds the observation time in the
+    configured timezone as text, and an index on dateutc keeps queries over a time range fast.
+  - readings_hourly and readings_daily: the averages of old readings when compaction is enabled, see Compaction.go.
+  - compaction: the watermark of the readings compacted so far, by the table they came from.
+
+The schema is created and migrated automatically when the database is opened, its version kept in PRAGMA
+user_version, so new migrations are only ever appended to sqliteMigrations. Readings already in the database are
+skipped, so restarts and backfills add no duplicate rows. The database is written without a spreadsheetId too.
+*/
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	_ "modernc.org/sqlite"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	sqliteDB      *sql.DB = nil
+	sqliteMutex   sync.Mutex
+	sqliteSensors = make(map[string]int64) //ID of each sensor in the sensors table
+)
+
+/*
+The migrations that build the schema, in order. Migration n brings the database from user_version n to n+1.
+*/
+var sqliteMigrations = []string{
+	`CREATE TABLE stations (
+		id INTEGER PRIMARY KEY,
+		mac_address TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE sensors (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		description TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE readings (
+		station_id INTEGER NOT NULL REFERENCES stations(id),
+		dateutc INTEGER NOT NULL,
+		observed TEXT NOT NULL,
+		sensor_id INTEGER NOT NULL REFERENCES sensors(id),
+		value REAL,
+		text TEXT,
+		PRIMARY KEY (station_id, dateutc, sensor_id)
+	) WITHOUT ROWID;
+	CREATE INDEX readings_dateutc ON readings (dateutc);
+	CREATE INDEX readings_sensor_dateutc ON readings (sensor_id, dateutc);`,
+	`CREATE TABLE readings_hourly (
+		station_id INTEGER NOT NULL REFERENCES stations(id),
+		dateutc INTEGER NOT NULL,
+		sensor_id INTEGER NOT NULL REFERENCES sensors(id),
+		value REAL NOT NULL,
+		min_value REAL NOT NULL,
+		max_value REAL NOT NULL,
+		samples INTEGER NOT NULL,
+		PRIMARY KEY (station_id, dateutc, sensor_id)
+	) WITHOUT ROWID;
+	CREATE TABLE readings_daily (
+		station_id INTEGER NOT NULL REFERENCES stations(id),
+		dateutc INTEGER NOT NULL,
+		sensor_id INTEGER NOT NULL REFERENCES sensors(id),
+		value REAL NOT NULL,
+		min_value REAL NOT NULL,
+		max_value REAL NOT NULL,
+		samples INTEGER NOT NULL,
+		PRIMARY KEY (station_id, dateutc, sensor_id)
+	) WITHOUT ROWID;`,
+	`CREATE TABLE compaction (
+		source TEXT PRIMARY KEY,
+		watermark INTEGER NOT NULL
+	) WITHOUT ROWID;`,
+}
+
+/*
+Writes the readings of a station to the SQLite database, opening and migrating it first if needed. Returns an error
+unless every reading is in the database, and nil when no sqliteFile is configured.
+*/
+func writeSQLite(ctx context.Context, station Station, readings []DeviceData) error {
+	if config.SQLiteFile == "" || len(readings) == 0 {
+		return nil
+	}
+	sqliteMutex.Lock()
+	defer sqliteMutex.Unlock()
+	if err := connectSQLite(ctx); err != nil {
+		return err
+	}
+
+	written, err := insertSQLite(ctx, station, afterWatermark(ctx, "sqlite", sqliteWatermark, readings))
+	if err != nil {
+		return fmt.Errorf("unable to write the readings to the SQLite database %s: %w", config.SQLiteFile,
+			rejectSQL(err))
+	}
+	slog.InfoContext(ctx, "Wrote "+strconv.Itoa(written)+" readings to the SQLite database", "file",
+		config.SQLiteFile, "station", station.displayName())
+	return nil
+}
+
+/*
+Opens and migrates the configured SQLite database if it isn't open yet, returning an error if it can't be opened. The
+caller must hold sqliteMutex.
+*/
+func connectSQLite(ctx context.Context) error {
+	if sqliteDB != nil {
+		return nil
+	}
+	db, err := openSQLite(ctx, config.SQLiteFile)
+	if err != nil {
+		return fmt.Errorf("unable to open the SQLite database %s: %w", config.SQLiteFile, err)
+	}
+	watermark, err := loadWatermark(ctx, db, "SELECT watermark FROM compaction WHERE source = ?", "readings")
+	if err != nil {
+		_ = db.Close()
+		return fmt.Errorf("unable to read the compaction watermark of %s: %w", config.SQLiteFile, err)
+	}
+	sqliteDB, sqliteWatermark = db, watermark
+	return nil
+}
+
+/*
+Opens the SQLite database at the given path, creating it if it doesn't exist, and applies the migrations it hasn't
+had yet, each in its own transaction.
+*/
+func openSQLite(ctx context.Context, path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) //SQLite allows a single writer
+
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		slog.InfoContext(ctx, "Migrating the SQLite database", "file", path, "version", version+1)
+		tx, err := db.BeginTx(ctx, nil)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, sqliteMigrations[version])
+			if err == nil {
+				_, err = tx.ExecContext(ctx, "PRAGMA user_version = "+strconv.Itoa(version+1))
+			}
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				_ = tx.Rollback()
+			}
+		}
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+/*
+Inserts the sensor values of the readings in a single transaction, adding the station and any new sensors first.
+Returns the number of readings that weren't in the database yet.
+*/
+func insertSQLite(ctx context.Context, station Station, readings []DeviceData) (int, error) {
+	tx, err := sqliteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() //Does nothing once committed
+
+	var stationID int64
+	err = tx.QueryRowContext(ctx, `INSERT INTO stations (mac_address, name) VALUES (?, ?)
+		ON CONFLICT (mac_address) DO UPDATE SET name = excluded.name RETURNING id`,
+		station.MacAddress, station.Name).Scan(&stationID)
+	if err != nil {
+		return 0, err
+	}
+	insert, err := tx.PrepareContext(ctx, `INSERT INTO readings (station_id, dateutc, observed, sensor_id, value, text)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+
+	added := make(map[string]int64) //Sensors added in this transaction, cached once it commits
+	written := 0
+	for _, data := range readings {
+		names := make([]string, 0, len(data.Fields))
+		for name := range data.Fields {
+			if !undiscoveredFields[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		inserted := false
+		observed := data.Time().Format(CSVTIMEFORMAT)
+		for _, name := range names {
+			sensorID, err := sqliteSensor(ctx, tx, name, added)
+			if err != nil {
+				return 0, err
+			}
+			var value, text interface{}
+			switch typed := cellValue(convertField(name, data.Fields[name])).(type) {
+			case float64:
+				value = typed
+			case bool:
+				value = 0.0
+				if typed {
+					value = 1.0
+				}
+			case string:
+				text = typed
+			}
+			result, err := insert.ExecContext(ctx, stationID, data.DateUTC, observed, sensorID, value, text)
+			if err != nil {
+				return 0, err
+			}
+			if rows, err := result.RowsAffected(); err == nil && rows > 0 {
+				inserted = true
+			}
+		}
+		if inserted {
+			written++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for name, id := range added {
+		sqliteSensors[name] = id
+	}
+	return written, nil
+}
+
+/*
+Returns the ID of a sensor in the sensors table, adding the sensor with its description from the headers mapping if
+it isn't there yet.
+*/
+func sqliteSensor(ctx context.Context, tx *sql.Tx, name string, added map[string]int64) (int64, error) {
+	if id, exists := sqliteSensors[name]; exists {
+		return id, nil
+	}
+	if id, exists := added[name]; exists {
+		return id, nil
+	}
+	description := name
+	if sensor, exists := allSensors[name]; exists {
+		description = headerText(name, sensor.Description)
+	}
+	var id int64
+	err := tx.QueryRowContext(ctx, `INSERT INTO sensors (name, description) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET description = excluded.description RETURNING id`, name, description).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	added[name] = id
+	return id, nil
+}
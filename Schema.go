@@ -0,0 +1,225 @@
+package main
+
+/*
+This file validates the records decoded from the Ambient Weather API before anything is written to the sheet. Every
+record must carry a plausible dateutc and at least one sensor reading, every known sensor must fall within the range
+it can physically report in the API's imperial units, and related sensors must agree with each other. A record that
+fails only some checks is partial data: the offending fields are dropped and the rest is written. A record with no
+usable timestamp or no usable readings is garbage and is not written at all.
+*/
+import (
+	"context"
+	"encoding/json"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DATAVALID = iota
+	DATAPARTIAL
+	DATAGARBAGE
+)
+
+/*
+sensorRange is a struct that holds the lowest and highest value a sensor can plausibly report in the units the Ambient
+Weather API uses.
+*/
+type sensorRange struct {
+	min float64
+	max float64
+}
+
+var (
+	temperatureRange = sensorRange{-80, 160} //°F
+	percentRange     = sensorRange{0, 100}   //%
+	windRange        = sensorRange{0, 250}   //mph
+	directionRange   = sensorRange{0, 360}   //degrees
+	pressureRange    = sensorRange{15, 35}   //inHg
+	rainRateRange    = sensorRange{0, 30}    //in/hr
+	rainTotalRange   = sensorRange{0, 1000}  //in
+	particleRange    = sensorRange{0, 1000}  //µg/m³
+	aqiRange         = sensorRange{0, 500}   //US EPA index
+	batteryRange     = sensorRange{0, 1}     //1 is OK, 0 is low
+	sensorRanges     = buildSensorRanges()
+)
+
+/*
+Builds the plausible range of every sensor that has one, including each sensor of the numbered series.
+*/
+func buildSensorRanges() map[string]sensorRange {
+	ranges := map[string]sensorRange{
+		"tempf": temperatureRange, "tempinf": temperatureRange, "feelsLike": temperatureRange,
+		"feelsLikein": temperatureRange, "dewPoint": temperatureRange, "dewPointin": temperatureRange,
+		"pm_in_temp_aqin": temperatureRange, "heatIndex": temperatureRange, "windChill": temperatureRange,
+
+		"humidity": percentRange, "humidityin": percentRange, "pm_in_humidity_aqin": percentRange,
+
+		"windspeedmph": windRange, "windgustmph": windRange, "maxdailygust": windRange,
+		"windspdmph_avg2m": windRange, "windspdmph_avg10m": windRange,
+		"winddir": directionRange, "windgustdir": directionRange, "winddir_avg2m": directionRange,
+		"winddir_avg10m": directionRange,
+
+		"baromrelin": pressureRange, "baromabsin": pressureRange,
+		"solarradiation": {0, 2000}, "uv": {0, 20},
+
+		"hourlyrainin": rainRateRange, "eventrainin": rainTotalRange, "dailyrainin": rainTotalRange,
+		"weeklyrainin": rainTotalRange, "monthlyrainin": rainTotalRange, "yearlyrainin": rainTotalRange,
+		"totalrainin": rainTotalRange, "24hourrainin": rainTotalRange,
+
+		"pm25": particleRange, "pm25_24h": particleRange, "pm25_in": particleRange, "pm25_in_24h": particleRange,
+		"pm25_in_aqin": particleRange, "pm25_in_24h_aqin": particleRange, "pm10_in_aqin": particleRange,
+		"pm10_in_24h_aqin": particleRange, "co2_in_aqin": {0, 10000}, "co2_in_24h_aqin": {0, 10000},
+		"aqi_pm25_aqin": aqiRange, "aqi_pm25_24h_aqin": aqiRange, "aqi_pm10_aqin": aqiRange,
+		"aqi_pm10_24h_aqin": aqiRange, "aqi_pm25_in": aqiRange, "aqi_pm25_in_24h": aqiRange, "aqiPM25": aqiRange,
+		"aqiPM25_24h": aqiRange,
+
+		"battout": batteryRange, "battin": batteryRange, "batt_co2": batteryRange, "batt_25": batteryRange,
+		"batt_lightning": batteryRange, "batt_cellgateway": batteryRange,
+
+		"rainToday": rainTotalRange, "rain24h": rainTotalRange, "rainMonth": rainTotalRange, "rainYear": rainTotalRange,
+
+		"lightning_day": {0, 100000}, "lightning_hour": {0, 100000}, "lightning_distance": {0, 100},
+	}
+
+	seriesRanges := map[string]sensorRange{
+		"temp": temperatureRange, "feelsLike": temperatureRange, "dewPoint": temperatureRange,
+		"soiltemp": temperatureRange, "humidity": percentRange, "soilhum": percentRange,
+		"leafwetness": percentRange, "batt": batteryRange, "battsm": batteryRange, "batleak": batteryRange,
+		"leak": {0, 2}, "relay": {0, 1},
+	}
+	var data DeviceData
+	for _, series := range ambient.NumberedSensors {
+		if valueRange, exists := seriesRanges[series.Prefix]; exists {
+			for i := range series.Values(&data) {
+				ranges[series.Name(i+1)] = valueRange
+			}
+		}
+	}
+	return ranges
+}
+
+/*
+Checks a record and classifies it as DATAVALID, DATAPARTIAL, or DATAGARBAGE. Partial records are returned with the
+fields that failed a check removed, along with the names of the removed fields.
+*/
+func checkReading(data DeviceData) (DeviceData, int, []string) {
+	observed := data.Time()
+	if data.DateUTC <= 0 || observed.Year() < 2000 || observed.After(time.Now().Add(24*time.Hour)) {
+		return data, DATAGARBAGE, []string{"dateutc"}
+	}
+
+	var dropped []string
+	for name, value := range data.Fields {
+		valueRange, exists := sensorRanges[name]
+		if !exists {
+			continue
+		}
+		number, ok := ambient.ToFloat(value)
+		if !ok || number < valueRange.min || number > valueRange.max {
+			dropped = append(dropped, name)
+		}
+	}
+	dropped = append(dropped, inconsistentSensors(data)...)
+
+	if len(dropped) > 0 {
+		cleaned, err := withoutFields(data, dropped)
+		if err != nil {
+			return data, DATAGARBAGE, dropped
+		}
+		data = cleaned
+	}
+
+	if !hasReadings(data) {
+		return data, DATAGARBAGE, dropped
+	}
+	if len(dropped) > 0 {
+		sort.Strings(dropped)
+		return data, DATAPARTIAL, dropped
+	}
+	return data, DATAVALID, nil
+}
+
+/*
+Returns the names of sensors whose readings contradict a related sensor, which usually means the station reported
+them in a different unit. A dew point or feels like temperature far from the temperature it was derived from, or a
+relative pressure in hPa instead of inHg, is dropped.
+*/
+func inconsistentSensors(data DeviceData) []string {
+	var inconsistent []string
+	if data.TempF != nil && data.DewPoint != nil && *data.DewPoint > *data.TempF+2 {
+		inconsistent = append(inconsistent, "dewPoint")
+	}
+	if data.TempF != nil && data.FeelsLike != nil &&
+		(*data.FeelsLike-*data.TempF > 40 || *data.TempF-*data.FeelsLike > 60) {
+		inconsistent = append(inconsistent, "feelsLike")
+	}
+	if data.TempInF != nil && data.DewPointIn != nil && *data.DewPointIn > *data.TempInF+2 {
+		inconsistent = append(inconsistent, "dewPointin")
+	}
+	if data.WindSpeedMPH != nil && data.WindGustMPH != nil && *data.WindGustMPH+1 < *data.WindSpeedMPH {
+		inconsistent = append(inconsistent, "windgustmph")
+	}
+	return inconsistent
+}
+
+/*
+Returns a copy of the record with the given fields removed, from both the Fields map and the typed fields.
+*/
+func withoutFields(data DeviceData, names []string) (DeviceData, error) {
+	fields := make(map[string]interface{}, len(data.Fields))
+	for name, value := range data.Fields {
+		fields[name] = value
+	}
+	for _, name := range names {
+		delete(fields, name)
+	}
+
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return data, err
+	}
+	var cleaned DeviceData
+	err = json.Unmarshal(encoded, &cleaned)
+	return cleaned, err
+}
+
+/*
+Reports whether the record holds at least one reading from a known sensor.
+*/
+func hasReadings(data DeviceData) bool {
+	for name := range data.Fields {
+		if _, exists := sensorRanges[name]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Checks every record retrieved for a station, oldest first, and returns the ones that can be written after the data
+quality filters, with the derived metrics, air quality indexes, and rain totals added. Partial records are kept
+without the fields that failed a check and logged as a warning, garbage records are dropped and logged as an error.
+*/
+func validReadings(ctx context.Context, station Station, readings []DeviceData) []DeviceData {
+	var valid []DeviceData
+	for _, data := range sortByTime(readings) {
+		checked, result, problems := checkReading(data)
+		switch result {
+		case DATAGARBAGE:
+			slog.ErrorContext(ctx, "Discarding unusable reading", "station", station.displayName(),
+				"dateutc", data.DateUTC, "problems", strings.Join(problems, ","))
+			continue
+		case DATAPARTIAL:
+			slog.WarnContext(ctx, "Reading is partial, dropping implausible fields", "station", station.displayName(),
+				"time", checked.Time(), "dropped", strings.Join(problems, ","))
+		}
+
+		checked = withAirQuality(withDerivedMetrics(filterOutliers(ctx, station, checked)))
+		valid = append(valid, withRainTotals(station, checked))
+	}
+	saveRainLedger()
+	return valid
+}
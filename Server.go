@@ -0,0 +1,58 @@
+package main
+
+/*
+This file runs the embedded HTTP servers the program serves its endpoints from: the Prometheus metrics at metricsListen,
+the health endpoints at healthListen, and the REST API, live feed, Grafana datasource, and dashboard at apiListen.
+Endpoints configured on the same address share one server.
+*/
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+/*
+Starts serving every configured endpoint in the background. The servers are shut down when the context is cancelled.
+*/
+func startServers(ctx context.Context) {
+	muxes := make(map[string]*http.ServeMux) //Handlers of each address
+	muxFor := func(address string) *http.ServeMux {
+		if muxes[address] == nil {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+	if config.MetricsListen != "" {
+		muxFor(config.MetricsListen).HandleFunc("/metrics", serveMetrics)
+		slog.Info("Serving Prometheus metrics", "address", config.MetricsListen, "path", "/metrics")
+	}
+	if config.HealthListen != "" {
+		registerHealth(muxFor(config.HealthListen))
+		slog.Info("Serving the health endpoints", "address", config.HealthListen, "paths", "/healthz /readyz")
+	}
+	if config.APIListen != "" {
+		registerAPI(muxFor(config.APIListen))
+		registerGrafana(muxFor(config.APIListen))
+		registerDashboard(muxFor(config.APIListen))
+		slog.Info("Serving the REST API", "address", config.APIListen, "path", "/api/")
+	}
+
+	for address, mux := range muxes {
+		server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP server stopped", "address", address, "err", err)
+			}
+		}()
+		backgroundTasks.Add(1)
+		go func() {
+			defer backgroundTasks.Done()
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer cancel()
+			_ = server.Shutdown(shutdownCtx)
+		}()
+	}
+}
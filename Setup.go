@@ -0,0 +1,60 @@
+package main
+
+/*
+This file implements the setup subcommand, which authorizes the program to use Google Sheets with an OAuth client
+secret in credentials.json and saves the token to token.json. It is the only place the program asks for anything
+interactively: the user is shown a verification URL and a code to enter through the device code flow, or a link to
+open and the authorization code to paste back when the OAuth client does not support device codes. The run command
+never prompts, so a headless daemon whose token is missing or revoked logs the problem and keeps its readings queued
+until setup has been run again.
+*/
+import (
+	"encoding/json"
+	"golang.org/x/oauth2/google"
+	"log/slog"
+	"os"
+)
+
+/*
+Authorizes the program with the OAuth client secret in credentials.json and saves the token, returning the exit code
+for the program, 0 if a token was saved and 1 otherwise.
+*/
+func runSetup() int {
+	loaded, err := loadConfig(configFile, profile)
+	if err != nil {
+		slog.Error("Unable to load configuration", "err", err)
+		return 1
+	}
+	applyConfig(loaded)
+
+	credential, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		slog.Error("Unable to read the OAuth client secret", "file", credentialsFile, "err", err)
+		return 1
+	}
+	var keyFile struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(credential, &keyFile) == nil && keyFile.Type == "service_account" {
+		slog.Info("Service accounts need no authorization, " + credentialsFile + " is used as is")
+		return 0
+	}
+	clientConfig, err := google.ConfigFromJSON(credential, googleScopes()...)
+	if err != nil {
+		slog.Error("Unable to parse the OAuth client secret", "file", credentialsFile, "err", err)
+		return 1
+	}
+
+	tok, err := getTokenFromDevice(clientConfig)
+	if err != nil {
+		slog.Warn("Device code flow unavailable, falling back to browser authorization", "err", err)
+		tok = getTokenFromWeb(clientConfig)
+	}
+	if tok == nil {
+		slog.Error("Authorization failed, no token was saved")
+		return 1
+	}
+	saveToken(tokenFile, tok)
+	slog.Info("Authorized Google Sheets access", "token", tokenFile)
+	return 0
+}
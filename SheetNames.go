@@ -0,0 +1,85 @@
+package main
+
+/*
+This file implements the sheet naming template, which lets the sheetName setting choose how sheets are named instead
+of the default of the rotation period followed by the station name when several stations are configured. The setting
+is a Go template, e.g. "{{.Year}}-{{.Month}} {{.Station}}" or "Wetter {{.ISOYear}} KW{{.Week}}", filled in with the
+time of the reading and the station it came from. Every reading of a sheet's period must give the same name, so a
+template should include the fields of the rotation period. Week is the ISO week, so it goes with ISOYear, the year the
+week belongs to: 30 December 2024 is in week 01 of 2025.
+*/
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+sheetNameData is a struct that holds the values a sheet naming template can use.
+*/
+type sheetNameData struct {
+	Year      int
+	ISOYear   int    //Year of the ISO week, which differs from Year around New Year
+	Month     string //01-12
+	MonthName string //January-December
+	Week      string //ISO week, 01-53
+	Day       string //01-31
+	Period    string //The default name of the rotation period, e.g. 2026-03
+	Station   string //Name of the station, or its MAC Address if unnamed
+}
+
+var (
+	sheetNameTemplate *template.Template //Parsed from sheetName, nil uses the default names
+)
+
+/*
+Parses a sheet naming template and checks that it can be filled in and gives a name the Sheets API accepts. An empty
+template returns nil.
+*/
+func parseSheetName(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	parsed, err := template.New("sheetName").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := executeSheetName(parsed, Station{Name: "Backyard"}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(name) == "" {
+		return nil, fmt.Errorf("template %q gives an empty name", text)
+	}
+	return parsed, nil
+}
+
+/*
+Fills in a sheet naming template for a reading observed at the given time by the given station. Sheet names can't be
+longer than 100 characters, so longer names are cut short.
+*/
+func executeSheetName(parsed *template.Template, station Station, observed time.Time) (string, error) {
+	isoYear, week := observed.ISOWeek()
+	data := sheetNameData{
+		Year:      observed.Year(),
+		ISOYear:   isoYear,
+		Month:     fmt.Sprintf("%02d", int(observed.Month())),
+		MonthName: observed.Month().String(),
+		Week:      fmt.Sprintf("%02d", week),
+		Day:       fmt.Sprintf("%02d", observed.Day()),
+		Period:    sheetPeriod(observed),
+		Station:   station.displayName(),
+	}
+
+	var name strings.Builder
+	if err := parsed.Execute(&name, data); err != nil {
+		return "", err
+	}
+	title := strings.TrimSpace(name.String())
+	if len([]rune(title)) > 100 {
+		title = string([]rune(title)[:100])
+	}
+	return title, nil
+}
@@ -3,15 +3,18 @@ package main
 /*
 This file provides functionality for interacting with the Google Sheets API, through reading data, writing data,
 handling errors, and managing the uploading of weather station information. This program authenticates and initializes
-the Google Sheets API service using OAuth2 credentials. There is functionality to write weather station data provided
-through a comma seperated string. It ensures that data is inputted into a sheet for the current year.
+the Google Sheets API service using OAuth2 credentials, a service account key, or Application Default Credentials.
+There is functionality to write weather station data parsed into a DeviceData struct. It ensures that data is
+inputted into a sheet for the current year.
 */
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
 	"google.golang.org/api/sheets/v4"
 	"log/slog"
@@ -19,6 +22,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,73 +30,214 @@ import (
 SensorInfo is a struct that allows for the storage of information regarding a certain sensor, including an ID which
 stores the position of the sensor in the Sheet. The SensorInfo struct also provides a simple description for the sheet
 and can be accessed by a map that stores the struct by the  named the sensor name is provided by the Ambient Weather
-API so data can be categorized with its respective sensor.
+API so data can be categorized with its respective sensor. Format holds the Sheets number format of the column, e.g.
+0.0, if the headers file gives one.
 */
 type SensorInfo struct {
 	ID          string
 	Description string
+	Format      string
 }
 
+const (
+	SHEETSSCOPE    = "https://www.googleapis.com/auth/spreadsheets"
+	ROWTIMEPATTERN = "yyyy-mm-dd hh:mm:ss" //Sheets number format of the date columns
+	DEVICEAUTHURL  = "https://oauth2.googleapis.com/device/code"
+
+	APPENDCHUNKROWS = 10000 //Most rows sent in a single append
+
+	VALUEINPUTRAW         = "RAW"          //Values are stored exactly as sent
+	VALUEINPUTUSERENTERED = "USER_ENTERED" //Values are parsed as if typed in, e.g. "12" becomes a number
+)
+
 var (
-	service       *sheets.Service = nil
-	spreadsheetId                 = "1XfM5AjJzs8rEJ9PDDi9N0DEPOqw-P1RYdM4ST8Ga4uM"
-	allSensors                    = make(map[string]SensorInfo)
+	credentialsFile                 = "credentials.json"
+	tokenFile                       = "token.json"
+	headersFile                     = "headers.txt"
+	oauthConfig     *oauth2.Config  = nil
+	service         *sheets.Service = nil
+	spreadsheetId                   = "1XfM5AjJzs8rEJ9PDDi9N0DEPOqw-P1RYdM4ST8Ga4uM"
+	allSensors                      = make(map[string]SensorInfo)
+	sheetsEpoch                     = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC) //Day 0 of Sheets date-times
+	datesFormatted                  = make(map[string]bool)                         //Formatted sheets, by sheetKey
 )
 
 /*
-Function that Initializes the Sheet service through the provided credentials.json file and then retries a token. The
-service is then provided in the service variable
+Function that Initializes the Sheet service through the credentials found by getSheetsClient and then retries a token.
+The service is then provided in the service variable
 */
 func initializeSheet(runs int) {
-	ctx := context.Background()
+	ctx := googleContext(context.Background())
 
-	credential, credErr := os.ReadFile("credentials.json")
-	if credErr != nil {
-		if errorHandler(credErr, runs, "Unable to read client secret file: ") {
+	client, clientErr := getSheetsClient(ctx)
+	if clientErr != nil {
+		if errorHandler(ctx, clientErr, runs, "Unable to authenticate with Google: ") {
 			initializeSheet(runs + 1)
-		} else {
-			return
-		}
-	}
-
-	// If modifying these scopes, delete your previously saved token.json.
-	config, configErr := google.ConfigFromJSON(credential, "https://www.googleapis.com/auth/spreadsheets")
-	if configErr != nil {
-		if errorHandler(configErr, runs, "Unable to parse client secret file to config: ") {
-			initializeSheet(runs + 1)
-		} else {
-			return
 		}
+		return
 	}
-	client := getClient(config)
 
 	var serviceErr error
-	service, serviceErr = sheets.NewService(ctx, option.WithHTTPClient(client))
+	service, serviceErr = sheets.NewService(ctx, option.WithHTTPClient(withSheetsQuota(client)))
 	if serviceErr != nil {
-		if errorHandler(serviceErr, runs, "Unable to retrieve Sheets client: ") {
+		if errorHandler(ctx, serviceErr, runs, "Unable to retrieve Sheets client: ") {
 			initializeSheet(runs + 1)
-		} else {
-			return
 		}
+		return
+	}
 
+	if config.YearlySheets {
+		var driveErr error
+		driveService, driveErr = drive.NewService(ctx, option.WithHTTPClient(client))
+		if driveErr != nil {
+			slog.Error("Unable to retrieve Drive client, yearly spreadsheets can't be created", "err", driveErr)
+		}
 	}
 
 	slog.Info("Successfully initialized Sheets client")
 }
 
 /*
-Program that retrieves an OAuth2 client. First attempts to retrieve a token from a local file token.json, if
-unavailable then it fetches a new token from the web and saves it to the file. An HTTP client is returned using the
-token retrieved
+Returns an HTTP client authorized for the Sheets API, choosing the authentication method from the credentials
+available so the program can run non-interactively on headless servers and in Kubernetes:
+  - A service account key in credentials.json ("type": "service_account") is used directly through a JWT config.
+  - An OAuth client secret in credentials.json uses the token.json written by the setup subcommand in getClient.
+  - If credentials.json does not exist, Application Default Credentials are used, which covers a key file referenced
+    by GOOGLE_APPLICATION_CREDENTIALS as well as GKE Workload Identity and the GCE metadata server.
 */
-func getClient(config *oauth2.Config) *http.Client {
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
+func getSheetsClient(ctx context.Context) (*http.Client, error) {
+	credential, err := os.ReadFile(credentialsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("No " + credentialsFile + " found, using Application Default Credentials")
+		return google.DefaultClient(ctx, googleScopes()...)
+	}
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
+		return nil, fmt.Errorf("unable to read client secret file: %w", err)
+	}
+
+	var keyFile struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(credential, &keyFile); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", credentialsFile, err)
 	}
-	return config.Client(context.Background(), tok)
+
+	if keyFile.Type == "service_account" {
+		jwtConfig, err := google.JWTConfigFromJSON(credential, googleScopes()...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse service account key: %w", err)
+		}
+		slog.Info("Authenticating with service account", "email", jwtConfig.Email)
+		return jwtConfig.Client(ctx), nil
+	}
+
+	// If modifying these scopes, delete your previously saved token.json.
+	config, err := google.ConfigFromJSON(credential, googleScopes()...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file to config: %w", err)
+	}
+	return getClient(config)
+}
+
+/*
+Program that retrieves an OAuth2 client with the token from a local file token.json, which the setup subcommand
+writes. Returns an error if there is no token, since the program never prompts for one while it runs. The client
+refreshes the access token automatically and every refreshed token is written back to token.json so a restart never
+begins with a stale token.
+*/
+func getClient(config *oauth2.Config) (*http.Client, error) {
+	oauthConfig = config
+	tok, err := tokenFromFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("no OAuth token in %s, run the setup command to authorize: %w", tokenFile, err)
+	}
+	registerSecret(tok.AccessToken)
+	registerSecret(tok.RefreshToken)
+
+	ctx := googleContext(context.Background())
+	source := &savingTokenSource{source: config.TokenSource(ctx, tok), last: tok}
+	return oauth2.NewClient(ctx, source), nil
+}
+
+/*
+savingTokenSource wraps a refreshing token source and persists the token to token.json whenever Google issues a new
+access token, so refreshed (and occasionally rotated refresh) tokens survive restarts.
+*/
+type savingTokenSource struct {
+	source oauth2.TokenSource
+	mutex  sync.Mutex
+	last   *oauth2.Token
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.last == nil || tok.AccessToken != s.last.AccessToken {
+		slog.Info("OAuth access token refreshed")
+		registerSecret(tok.AccessToken)
+		registerSecret(tok.RefreshToken)
+		saveToken(tokenFile, tok)
+		s.last = tok
+	}
+	return tok, nil
+}
+
+/*
+Reports whether an error was caused by Google rejecting the refresh token with invalid_grant, which happens when the
+token has expired, been revoked, or the OAuth consent screen is still in testing mode (7-day token lifetime). Retrying
+such a request can never succeed, so it must be handled by re-authorizing instead.
+*/
+func isInvalidGrant(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return retrieveErr.ErrorCode == "invalid_grant"
+	}
+	return err != nil && strings.Contains(err.Error(), "invalid_grant")
+}
+
+/*
+Called when Google rejects the stored refresh token. The stale token.json is removed and the problem logged, always
+returning false so the caller gives up and the readings stay queued: a new token can only be requested interactively
+by the setup subcommand, which must never block a running program waiting for input while it writes.
+*/
+func reauthenticate() bool {
+	if oauthConfig == nil {
+		slog.Error("Google rejected the service account credentials. Check that the key in " + credentialsFile +
+			" has not been deleted or disabled")
+		return false
+	}
+
+	slog.Error("Stored OAuth token is no longer valid (invalid_grant). Run the setup command to authorize again")
+	if err := os.Remove(tokenFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Unable to remove stale token file", "path", tokenFile, "err", err)
+	}
+	return false
+}
+
+/*
+Retrieves a new OAuth2 token through the device code flow. The user is shown a verification URL and a code to enter,
+and the function polls Google until the user has approved the request or the code expires.
+*/
+func getTokenFromDevice(config *oauth2.Config) (*oauth2.Token, error) {
+	ctx := googleContext(context.Background())
+	deviceConfig := *config
+	if deviceConfig.Endpoint.DeviceAuthURL == "" {
+		deviceConfig.Endpoint.DeviceAuthURL = DEVICEAUTHURL
+	}
+
+	response, err := deviceConfig.DeviceAuth(ctx, oauth2.AccessTypeOffline)
+	if err != nil {
+		return nil, err
+	}
+	slog.Warn("To re-authorize Google Sheets access, visit the verification URL and enter the code",
+		"url", response.VerificationURI, "code", response.UserCode, "expires", response.Expiry)
+
+	return deviceConfig.DeviceAccessToken(ctx, response)
 }
 
 /*
@@ -101,17 +246,16 @@ Account associated with the credential
 */
 func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	slog.Info("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
+	slog.Info("Go to the following link in your browser then type the authorization code", "url", authURL)
 
 	var authCode string
 	if _, err := fmt.Scan(&authCode); err != nil {
-		slog.Error("Unable to read authorization code: %v", err)
+		slog.Error("Unable to read authorization code", "err", err)
 	}
 
-	tok, err := config.Exchange(context.TODO(), authCode)
+	tok, err := config.Exchange(googleContext(context.TODO()), authCode)
 	if err != nil {
-		slog.Error("Unable to retrieve token from web: %v", err)
+		slog.Error("Unable to retrieve token from web", "err", err)
 	}
 	return tok
 }
@@ -140,114 +284,253 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 OAuth2 token retrieved from the web is stored as a token.json file in the program path  .
 */
 func saveToken(path string, token *oauth2.Token) {
-	slog.Info("Saving credential file to: %s\n", path)
+	slog.Info("Saving credential file", "path", path)
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		slog.Error("Unable to cache oauth token: %v", err)
+		slog.Error("Unable to cache oauth token", "err", err)
 	}
 	defer func(f *os.File) {
 		err := f.Close()
 		if err != nil {
-			slog.Error("Unable to cache oauth token: %v", err)
+			slog.Error("Unable to cache oauth token", "err", err)
 			return
 		}
 	}(f)
 	jsonErr := json.NewEncoder(f).Encode(token)
 	if jsonErr != nil {
-		slog.Error("Unable to cache oauth token: %v", jsonErr)
+		slog.Error("Unable to cache oauth token", "err", jsonErr)
 		return
 	}
 }
 
 /*
-Function that writes data provided by a comma seperated string. The function gets the next empty row in the sheet,
-writes the data to an interface and places the data in its respective column with its sensor. The function then calls
-the function to update the values in the sheet with the provided interface.
+Function that writes DeviceData records for the given station to the Google Sheet, as the sheets output of writeRows.
+The function writes each record to an interface and places each field in its respective column with its sensor,
+writing the header of any column discoverSensors added since the last write. The records are grouped by the sheet their
+observation time falls in, readings already in the sheet are dropped, and each group is appended in chunks of up to
+10,000 rows, so thousands of records take one API call per chunk instead of one per record. Records are written to
+every configured spreadsheet. Returns an error for the first sheet of the primary spreadsheet that wasn't written, the
+other spreadsheets catch up through their duplicate protection when the records are written again.
 */
-func writeData(data string) {
-	slog.Info("Data writing function...")
+func writeSheets(ctx context.Context, station Station, readings []DeviceData) error {
+	added := discoveredHeaders
+	groups := make(map[string][]DeviceData)
+	years := make(map[string]int)
+	var names []string
+	for _, data := range readings {
+		name := sheetTitle(station, data.Time())
+		if _, exists := groups[name]; !exists {
+			names = append(names, name)
+			years[name] = data.Time().Year()
+		}
+		groups[name] = append(groups[name], data)
+	}
 
-	year := time.Now().Year()
-	writeRange := strconv.Itoa(time.Now().Year()) + "!A:A"
+	var failure error //First sheet of the primary spreadsheet that wasn't written
+	forEachSpreadsheet(ctx, func(ctx context.Context) {
+		primary := spreadsheetFor(ctx) == spreadsheetId
+		for _, name := range names {
+			var err error
+			ctx, available := yearlyContext(ctx, years[name], true)
+			if !available {
+				err = errors.New("spreadsheet is unavailable, unable to write rows to " + name)
+			} else if !sheetExists(ctx, name, sensorHeaders(), 1) {
+				err = errors.New("sheet " + name + " is unavailable, unable to write rows")
+			} else {
+				writeDiscoveredHeaders(ctx, name, added)
+				checkHeaderDrift(ctx, station, name)
 
-	response := getResponse(writeRange, strconv.Itoa(year), 1) //Retrieves data from the sheet
-	if response == nil {
-		slog.Error("Response from sheet is nil. Unable to write data.")
-		return
+				slog.InfoContext(ctx, "Writing "+strconv.Itoa(len(groups[name]))+" rows", "sheet", name)
+				err = appendChunks(ctx, station, name, groups[name])
+			}
+			if err == nil {
+				continue
+			}
+			slog.ErrorContext(ctx, "Unable to write rows", "sheet", name, "err", err)
+			if primary && failure == nil {
+				failure = err
+			}
+		}
+	})
+	if failure == nil {
+		discoveredHeaders = discoveredHeaders[len(added):]
+	}
+	return failure
+}
+
+/*
+Appends the readings of a sheet in chunks of at most 10,000 rows, oldest first, keeping each request well within the
+Sheets API's request size limit, and logs the progress of writes that take more than one chunk. Stops at the first
+chunk that fails so the rows stay in order, and returns an error saying how many rows were written before it.
+*/
+func appendChunks(ctx context.Context, station Station, sheetName string, readings []DeviceData) error {
+	for start := 0; start < len(readings); start += APPENDCHUNKROWS {
+		end := min(start+APPENDCHUNKROWS, len(readings))
+		if !appendReadings(ctx, station, sheetName, readings[start:end], 1) {
+			return errors.New("stopped writing after " + strconv.Itoa(start) + " of " + strconv.Itoa(len(readings)) +
+				" rows")
+		}
+		if len(readings) > APPENDCHUNKROWS {
+			slog.InfoContext(ctx, "Wrote "+strconv.Itoa(end)+" of "+strconv.Itoa(len(readings))+" rows",
+				"sheet", sheetName, "percent", end*100/len(readings))
+		}
+	}
+	return nil
+}
+
+/*
+Builds the row written to the sheet for a DeviceData record, placing each field in its sensor's column. Fields that
+are not mapped in the headers file are skipped, and readings are converted to their configured units. The date column
+holds the time the station observed the record, from dateutc in the configured timezone, so rows stay correct however
+late they are polled or backfilled. It and the lightning time are written as Sheets date-times so they sort, filter,
+and chart as times.
+*/
+func buildRow(data DeviceData) []interface{} {
+	dataRow := make([]interface{}, mappedColumns(allSensors)) //Row that stores the new data
+	for name, value := range data.Fields {                    //Placing each field of the record in its sensor's column
+		sensor, exists := allSensors[name]
+		if !exists {
+			slog.Debug("Sensor is not mapped in "+headersFile+", skipping", "sensor", name)
+			continue
+		}
+		position := stringToNum(sensor.ID)
+		if position < 0 || position >= len(dataRow) {
+			slog.Warn("Column "+sensor.ID+" is outside of the mapped columns, skipping", "sensor", name)
+			continue
+		}
+		dataRow[position] = cellValue(convertField(name, value))
 	}
-	sheetData := response.Values
 
-	splitData := strings.Split(data, ",")
-	emptyRow := len(sheetData) + 1
+	if sensor, exists := allSensors["date"]; exists && data.DateUTC > 0 { //Observation time in the configured timezone
+		if position := stringToNum(sensor.ID); position >= 0 && position < len(dataRow) {
+			dataRow[position] = serialTime(data.Time())
+		}
+	}
+	if sensor, exists := allSensors["lightning_time"]; exists { //Last strike in the same format as the date
+		if strike, ok := data.LightningStrike(); ok {
+			if position := stringToNum(sensor.ID); position >= 0 && position < len(dataRow) {
+				dataRow[position] = serialTime(strike)
+			}
+		}
+	}
+	return dataRow
+}
+
+/*
+Converts a time into a Sheets date-time serial number, the days since 30 December 1899 with the time of day as the
+fraction, taken from the wall clock of the time's location since Sheets date-times have no timezone.
+*/
+func serialTime(t time.Time) float64 {
+	wallClock := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return float64(wallClock.Sub(sheetsEpoch).Milliseconds()) / float64(24*time.Hour/time.Millisecond)
+}
 
-	slog.Info("Parsing through data...")
-	var dataSheet [][]interface{}                   //Interface to upload to the sheet
-	dataRow := make([]interface{}, len(allSensors)) //Row that stores the new data
-	for _, item := range splitData {                //Parsing through data provided by the comma-seperated string
-		dataParts := strings.Split(item, ":")
-		position := allSensors[strings.Trim(dataParts[0], "\"")].ID
-		dataRow[stringToNum(position)] = dataParts[1]
+/*
+Converts a field of a DeviceData record into the value written to its cell. Numbers are written as numbers, strings as
+they are, and any nested value as its JSON text.
+*/
+func cellValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case json.Number:
+		if number, err := typed.Float64(); err == nil {
+			return number
+		}
+		return typed.String()
+	case string, bool, nil:
+		return typed
+	default:
+		encoded, err := json.Marshal(typed)
+		if err != nil {
+			return fmt.Sprint(typed)
+		}
+		return string(encoded)
 	}
+}
 
-	dataSheet = append(dataSheet, dataRow) //Appends row to the interface
+/*
+Returns the name of the sheet that data observed at the given time for the given station is written to, from the
+sheetName template if one is configured. By default, with a single station the sheet is named for the period of the
+rotation policy, e.g. the year, when several stations are configured each station gets its own sheet for the period
+suffixed with the station name.
+*/
+func sheetTitle(station Station, observed time.Time) string {
+	if sheetNameTemplate != nil {
+		if title, err := executeSheetName(sheetNameTemplate, station, observed); err == nil {
+			return title
+		}
+	}
+	title := sheetPeriod(observed)
+	if len(config.Stations) > 1 {
+		title += " " + station.displayName()
+	}
+	return title
+}
 
-	updateValues(strconv.Itoa(year), dataSheet, "!A"+strconv.Itoa(emptyRow), 0)
+/*
+Quotes a sheet name for use in A1 notation so names containing spaces or apostrophes form a valid range.
+*/
+func quoteSheetName(name string) string {
+	return "'" + strings.ReplaceAll(name, "'", "''") + "'"
 }
 
 /*
 Function to write values to the sheet, given a provided interface of data, sheet name, and range to write to. The
 function provides error handling allowing for 3 retries before logging an error and returning back to the main program.
 */
-func updateValues(sheetName string, writeValues [][]interface{}, valuesRange string, runs int) {
-	fullRange := sheetName + valuesRange
+func updateValues(ctx context.Context, sheetName string, writeValues [][]interface{}, valuesRange string, runs int) {
+	fullRange := quoteSheetName(sheetName) + valuesRange
 	body := &sheets.ValueRange{Values: writeValues}
 
-	slog.Info("Updating values function. Writing to Range: " + valuesRange)
+	slog.InfoContext(ctx, "Updating values function. Writing to Range: "+valuesRange)
 
-	slog.Info("Updating with Google API Client.")
-	_, err := service.Spreadsheets.Values.Update(spreadsheetId, fullRange, body).
-		ValueInputOption("RAW").Do()
+	slog.InfoContext(ctx, "Updating with Google API Client.")
+	_, err := service.Spreadsheets.Values.Update(spreadsheetFor(ctx), fullRange, body).
+		ValueInputOption(config.ValueInput).Context(ctx).Do()
 	if err != nil {
-		if errorHandler(err, runs, "Unable to update values in sheet: ") {
-			updateValues(sheetName, writeValues, valuesRange, runs+1)
+		if errorHandler(ctx, err, runs, "Unable to update values in sheet: ") {
+			updateValues(ctx, sheetName, writeValues, valuesRange, runs+1)
 		} else {
 			return
 		}
 	}
 
-	slog.Info("Successfully updated values in sheet")
+	slog.InfoContext(ctx, "Successfully updated values in sheet")
 }
 
 /*
-Retries data from a given sheet at a given range and name of sheet. Ensures that the sheet exists before trying to
-retrieve the data. If the sheet doesn't exist then the sheetExists function will create one and if that fails then
-the function returns nil. Error handling is provided allowing for 3 runs before returning nil.
+Function to append rows to the end of a sheet with the Sheets Append API. The API finds the last row of the table
+starting at A1 and inserts the rows after it in the same call, so no read is needed to find the next empty row and
+concurrent writers can't overwrite each other's rows. Error handling is provided allowing for 3 runs before logging an
+error and returning the last error to the caller.
 */
-func getResponse(responseRange string, name string, runs int) *sheets.ValueRange {
-	if !sheetExists(name, 1) {
-		return nil
-	}
+func appendValues(ctx context.Context, sheetName string, writeValues [][]interface{}, runs int) error {
+	body := &sheets.ValueRange{Values: writeValues}
 
-	slog.Info("Getting Response from Sheet")
-	resp, err := service.Spreadsheets.Values.Get(spreadsheetId, responseRange).Do()
+	slog.InfoContext(ctx, "Appending "+strconv.Itoa(len(writeValues))+" rows with Google API Client.",
+		"sheet", sheetName)
+	_, err := service.Spreadsheets.Values.Append(spreadsheetFor(ctx), quoteSheetName(sheetName)+"!A1", body).
+		ValueInputOption(config.ValueInput).InsertDataOption("INSERT_ROWS").Context(ctx).Do()
 	if err != nil {
-		if errorHandler(err, runs, "Unable to retrieve data from sheet: ") {
-			return getResponse(responseRange, name, runs+1)
-		} else {
-			return nil
+		if errorHandler(ctx, err, runs, "Unable to append values to sheet: ") {
+			return appendValues(ctx, sheetName, writeValues, runs+1)
 		}
+		return err
 	}
 
-	return resp
+	slog.InfoContext(ctx, "Successfully appended values to sheet")
+	return nil
 }
 
 /*
- */
-func sheetExists(sheetName string, runs int) bool {
-	response, err := service.Spreadsheets.Get(spreadsheetId).Do()
+Checks whether a sheet with the given name exists in the spreadsheet and creates it with the given header row if it
+doesn't, then retires sheets past the retention period. Returns false if the spreadsheet can't be read or the sheet
+can't be created. Error handling is provided allowing for 3 runs before returning false.
+*/
+func sheetExists(ctx context.Context, sheetName string, headers []interface{}, runs int) bool {
+	response, err := service.Spreadsheets.Get(spreadsheetFor(ctx)).Context(ctx).Do()
 	if err != nil {
-		if errorHandler(err, runs, "Unable to retrieve data from sheet: ") {
-			sheetExists(sheetName, runs+1)
+		if errorHandler(ctx, err, runs, "Unable to retrieve data from sheet: ") {
+			return sheetExists(ctx, sheetName, headers, runs+1)
 		} else {
 			return false
 		}
@@ -255,11 +538,20 @@ func sheetExists(sheetName string, runs int) bool {
 
 	for _, sheet := range response.Sheets {
 		if sheet.Properties.Title == sheetName {
+			//Sheets created before the date columns held date-times, templates format their own
+			if !datesFormatted[sheetKey(ctx, sheetName)] && config.TemplateSheet == "" {
+				requests := dateFormatRequests(sheet.Properties.SheetId, headers)
+				if len(requests) == 0 || batchUpdateRequest(ctx,
+					&sheets.BatchUpdateSpreadsheetRequest{Requests: requests}, 1) != nil {
+					datesFormatted[sheetKey(ctx, sheetName)] = true
+				}
+			}
 			return true
 		}
 	}
-	slog.Info("Creating Sheet for Current Year")
-	if createSheet(sheetName) {
+	slog.InfoContext(ctx, "Creating Sheet", "sheet", sheetName)
+	if createSheet(ctx, sheetName, headers) {
+		applyRetention(ctx)
 		return true
 	} else {
 		return false
@@ -267,12 +559,19 @@ func sheetExists(sheetName string, runs int) bool {
 }
 
 /*
-Function to create a separate sheet for a given name. The function creates the sheet through a batchUpdateRequest
-and then freezes the first row through a batchUpdateRequest. If the batchUpdateRequest response results in nil the
-program will return false and thus return false meaning the sheet wasn't properly created. Otherwise, the function
-will return true.
+Function to create a separate sheet for a given name. The function creates the sheet through a batchUpdateRequest,
+freezes and protects the first row, formats the date and reading columns, and adds the configured conditional
+formatting and the charts through a batchUpdateRequest, and writes the given header row to it. Only the program's own
+account can edit the protected header row, so collaborators can't rename or shift the headers that the column mapping
+depends on. If the batchUpdateRequest response results in nil the program will return false and thus return false
+meaning the sheet wasn't properly created. Otherwise, the function will return true. Station sheets are copied from the
+template sheet instead when one is configured.
 */
-func createSheet(sheetName string) bool {
+func createSheet(ctx context.Context, sheetName string, headers []interface{}) bool {
+	if created, templated := createFromTemplate(ctx, sheetName, headers); templated {
+		return created
+	}
+
 	createRequest := &sheets.BatchUpdateSpreadsheetRequest{
 		Requests: []*sheets.Request{
 			{
@@ -285,16 +584,16 @@ func createSheet(sheetName string) bool {
 		},
 	}
 
-	response := batchUpdateRequest(createRequest, 1)
+	response := batchUpdateRequest(ctx, createRequest, 1)
 	if response == nil {
-		slog.Error("Unable to complete batch update request. Returning to previous function")
+		slog.ErrorContext(ctx, "Unable to complete batch update request. Returning to previous function")
 		return false
 	}
 
 	if len(response.Replies) > 0 && response.Replies[0].AddSheet != nil {
-		slog.Info("Sheet created successfully", "sheetName", sheetName)
+		slog.InfoContext(ctx, "Sheet created successfully", "sheetName", sheetName)
 
-		slog.Info("Batch update request to freeze first row")
+		slog.InfoContext(ctx, "Batch update request to freeze and protect first row")
 
 		freezeProperties := &sheets.SheetProperties{
 			SheetId: response.Replies[0].AddSheet.Properties.SheetId,
@@ -311,40 +610,86 @@ func createSheet(sheetName string) bool {
 						Fields:     "gridProperties.frozenRowCount",
 					},
 				},
+				headerProtection(response.Replies[0].AddSheet.Properties.SheetId),
 			},
 		}
-
-		batchUpdateRequest(freezeRequest, 1)
-
-		var sheetHeaders [][]interface{}
-
-		headerRow := make([]interface{}, len(allSensors))
-		for _, sensor := range allSensors {
-			headerRow[stringToNum(sensor.ID)] = sensor.Description
+		sheetId := freezeProperties.SheetId
+		freezeRequest.Requests = append(freezeRequest.Requests, dateFormatRequests(sheetId, headers)...)
+		freezeRequest.Requests = append(freezeRequest.Requests, numberFormatRequests(sheetId, headers)...)
+		freezeRequest.Requests = append(freezeRequest.Requests, formatRequests(sheetId, headers)...)
+		freezeRequest.Requests = append(freezeRequest.Requests, chartRequests(sheetId, headers)...)
+
+		if batchUpdateRequest(ctx, freezeRequest, 1) != nil {
+			datesFormatted[sheetKey(ctx, sheetName)] = true
 		}
 
-		sheetHeaders = append(sheetHeaders, headerRow)
-
-		updateValues(sheetName, sheetHeaders, "!A1", 1)
+		updateValues(ctx, sheetName, [][]interface{}{headers}, "!A1", 1)
 
 		return true
 	}
-	slog.Error("Unable to complete batch update request. Returning to previous function")
+	slog.ErrorContext(ctx, "Unable to complete batch update request. Returning to previous function")
 	return false
 }
 
+/*
+Returns the request that protects the header row of the sheet with the given ID. Columns are found by their position,
+so only the program's own account may edit the headers.
+*/
+func headerProtection(sheetId int64) *sheets.Request {
+	return &sheets.Request{
+		AddProtectedRange: &sheets.AddProtectedRangeRequest{
+			ProtectedRange: &sheets.ProtectedRange{
+				Range: &sheets.GridRange{
+					SheetId:       sheetId,
+					StartRowIndex: 0,
+					EndRowIndex:   1,
+				},
+				Description: "Header row written by GoAmbient",
+			},
+		},
+	}
+}
+
+/*
+Returns the header row of a station sheet, the description of every mapped sensor in its column with the unit changed
+to its configured unit.
+*/
+func sensorHeaders() []interface{} {
+	headerRow := make([]interface{}, mappedColumns(allSensors))
+	for name, sensor := range allSensors {
+		headerRow[stringToNum(sensor.ID)] = headerText(name, sensor.Description)
+	}
+	return headerRow
+}
+
+/*
+Returns the position of a sensor's column in a sheet with the given header row. Reports false if the sensor isn't
+mapped or the sheet's column isn't headed by it, as in sheets such as the Daily Summary.
+*/
+func sensorColumn(name string, headers []interface{}) (int, bool) {
+	sensor, exists := allSensors[name]
+	if !exists {
+		return 0, false
+	}
+	column := stringToNum(sensor.ID)
+	if column >= len(headers) || headers[column] != headerText(name, sensor.Description) {
+		return 0, false
+	}
+	return column, true
+}
+
 /*
 Function that takes a batch update request and processes the request. The response from the request is then returned
 to the user. Provides error handling allowing for 3 runs before returning a nil response.
 */
-func batchUpdateRequest(batchRequest *sheets.BatchUpdateSpreadsheetRequest,
+func batchUpdateRequest(ctx context.Context, batchRequest *sheets.BatchUpdateSpreadsheetRequest,
 	runs int) *sheets.BatchUpdateSpreadsheetResponse {
 	var response *sheets.BatchUpdateSpreadsheetResponse = nil
-	slog.Info("Requesting new batch update")
-	response, err := service.Spreadsheets.BatchUpdate(spreadsheetId, batchRequest).Do()
+	slog.InfoContext(ctx, "Requesting new batch update")
+	response, err := service.Spreadsheets.BatchUpdate(spreadsheetFor(ctx), batchRequest).Context(ctx).Do()
 	if err != nil {
-		if errorHandler(err, runs, "Unable to complete batch update request: ") {
-			return batchUpdateRequest(batchRequest, runs+1)
+		if errorHandler(ctx, err, runs, "Unable to complete batch update request: ") {
+			return batchUpdateRequest(ctx, batchRequest, runs+1)
 		} else {
 			return nil
 		}
@@ -364,57 +709,140 @@ func stringToNum(letters string) int {
 	return result - 1
 }
 
+/*
+Returns the letters of the column at the given position in the sheet, the inverse of stringToNum, e.g. 0 is A and 26
+is AA.
+*/
+func columnID(position int) string {
+	letters := ""
+	for position++; position > 0; position = (position - 1) / 26 {
+		letters = string(rune('A'+(position-1)%26)) + letters
+	}
+	return letters
+}
+
+/*
+Returns the number of columns a sensor mapping spans, one past its last column, which is more than the number of
+sensors when the mapping leaves columns empty.
+*/
+func mappedColumns(sensors map[string]SensorInfo) int {
+	columns := 0
+	for _, sensor := range sensors {
+		columns = max(columns, stringToNum(sensor.ID)+1)
+	}
+	return columns
+}
+
+/*
+Returns the position of the first column no sensor of a mapping is in.
+*/
+func freeColumn(sensors map[string]SensorInfo) int {
+	used := make(map[int]bool, len(sensors))
+	for _, sensor := range sensors {
+		used[stringToNum(sensor.ID)] = true
+	}
+	position := 0
+	for used[position] {
+		position++
+	}
+	return position
+}
+
 /*
 Parses through the txt file of all the sensors called headers.txt. Each line contains the sensor name, sensor ID, and
 a description for the sensor. The ID and the description are stored in a struct which is mapped to the sensor name
-in the allSensors map
+in the allSensors map. The mapping sheet of the spreadsheet is read instead when it exists, and is created from
+headers.txt when it doesn't.
 */
 func readSensors(runs int) {
-	data, err := os.ReadFile("headers.txt")
+	ctx := context.Background()
+	if data, exists := readMappingSheet(ctx); exists {
+		sensors, err := parseSensors(data)
+		if err == nil {
+			slog.Info("Read the sensor mapping from the "+config.MappingSheet+" sheet", "sensors", len(sensors))
+			mappingFromSheet = true
+			sensorsMutex.Lock()
+			allSensors = withSoilProbes(sensors, config.SoilProbes)
+			sensorsMutex.Unlock()
+			return
+		}
+		slog.Error("Invalid sensor mapping in the "+config.MappingSheet+" sheet, using "+headersFile, "err", err)
+	}
+
+	data, err := os.ReadFile(headersFile)
 	if err != nil {
-		if errorHandler(err, runs, "Unable to read headers.txt") {
+		if errorHandler(context.Background(), err, runs, "Unable to read "+headersFile+": ") {
 			readSensors(runs + 1)
-		} else {
-			return
 		}
+		return
+	}
+
+	sensors, err := parseSensors(data)
+	if err != nil {
+		slog.Error("Invalid sensor mapping in "+headersFile, "err", err)
+		return
 	}
-	for _, line := range strings.Split(string(data), "\n") {
-		if line == "" {
+	if runs == 1 && !mappingFromSheet {
+		mappingFromSheet = createMappingSheet(ctx, sensors)
+	}
+	sensorsMutex.Lock()
+	allSensors = withSoilProbes(sensors, config.SoilProbes)
+	sensorsMutex.Unlock()
+}
+
+/*
+Parses the contents of a headers file into a map of sensor name to SensorInfo. Blank lines are skipped, and an error
+is returned for a line without a name, ID, and description or for a sensor name that appears more than once. The ID
+may be followed by a colon and the column's number format, e.g. tempf,B:0.0,Outdoor Temperature, ºF. The format can't
+contain a comma.
+*/
+func parseSensors(data []byte) (map[string]SensorInfo, error) {
+	sensors := make(map[string]SensorInfo)
+	for number, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
 			continue
 		}
 
 		splitLine := strings.SplitN(line, ",", 3)
 		if len(splitLine) < 3 {
-			if errorHandler(err, runs, "Invalid line in headers.txt: "+line) {
-				readSensors(runs + 1)
-			} else {
-				return
-			}
+			return nil, fmt.Errorf("line %d: expected name,ID,description but got %q", number+1, line)
+		}
+
+		name := strings.TrimSpace(splitLine[0])
+		if _, exists := sensors[name]; exists {
+			return nil, fmt.Errorf("line %d: sensor %q is listed more than once", number+1, name)
 		}
-		sensor := SensorInfo{
-			ID:          strings.TrimSpace(splitLine[1]),
+		id, format, _ := strings.Cut(strings.TrimSpace(splitLine[1]), ":")
+		sensors[name] = SensorInfo{
+			ID:          id,
 			Description: strings.TrimSpace(splitLine[2]),
+			Format:      format,
 		}
-		allSensors[splitLine[0]] = sensor
-
 	}
+	return sensors, nil
 }
 
 /*
 Handles Errors from various functions throughout the program, takes the error, number of runs performed, and a message.
 If runs of the function reach or exceed 3 runs, then an error is logged, otherwise a warning is logged. Both the
 warning and error log the error message and a message about the function. The program will wait based on the number of
-runs starting from a 10-second wait to a 30-second wait
+runs starting from a 10-second wait to a 30-second wait. An invalid_grant error is not retried at all; reauthenticate
+logs that the setup command must be run again. Rows a write gives up on are not lost, they stay in the
+sheets output's queue and buffer file until the Google Sheet can be reached again, see Sinks.go and Buffer.go.
 */
-func errorHandler(err error, runs int, message string) bool {
+func errorHandler(ctx context.Context, err error, runs int, message string) bool {
 	if runs > 3 {
-		slog.Error("Error after 3 attempts: " + message + err.Error() + " returning back to caller method")
+		slog.ErrorContext(ctx, "Error after 3 attempts: "+message+err.Error()+" returning back to caller method")
+		return false
+	} else if ctx.Err() != nil {
+		slog.WarnContext(ctx, "Shutting down, not retrying: "+message+err.Error())
 		return false
+	} else if isInvalidGrant(err) {
+		return reauthenticate()
 	} else {
 		wait := 10 * runs
-		slog.Warn("Warning #" + strconv.Itoa(runs) + ". Error: " + message + err.Error() + " retrying after " +
-			strconv.Itoa(wait) + " second wait.")
-		time.Sleep(time.Duration(wait) * time.Second)
-		return true
+		slog.WarnContext(ctx, "Warning #"+strconv.Itoa(runs)+". Error: "+message+err.Error()+" retrying after "+
+			strconv.Itoa(wait)+" second wait.")
+		return sleepContext(ctx, time.Duration(wait)*time.Second)
 	}
 }
@@ -0,0 +1,87 @@
+package main
+
+/*
+This file keeps the program within the Sheets API's per minute quotas, 60 requests a minute for each user by default.
+Every Sheets request waits for its turn in a client-side limiter set by sheetsRequestsPerMinute, so bursts such as
+creating a sheet, backfilling, and writing to several spreadsheets are spread out instead of running into the quota.
+A request the API still rejects with 429 RESOURCE_EXHAUSTED is retried by the transport itself with exponential
+backoff, or after the Retry-After the API asks for, before the caller's own error handling sees the failure. The
+quota refills every minute, so these waits are longer than the generic retries of errorHandler.
+*/
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	SHEETSQUOTABACKOFF = 5 * time.Second //First wait after a 429 from the Sheets API
+	SHEETSQUOTARETRIES = 5               //Retries of a request rejected for quota
+)
+
+var (
+	sheetsLimiter = newRateLimiter(time.Second)
+)
+
+/*
+quotaTransport is an http.RoundTripper that sends Sheets API requests through the Sheets rate limiter and retries
+requests rejected for quota.
+*/
+type quotaTransport struct {
+	base http.RoundTripper
+}
+
+/*
+Returns a copy of the given client whose requests are limited to the configured Sheets quota and retried on 429.
+*/
+func withSheetsQuota(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	limited := *client
+	limited.Transport = &quotaTransport{base: base}
+	return &limited
+}
+
+/*
+Waits for the request's turn under the Sheets quota and sends it, waiting and sending it again each time the API
+answers 429, up to 5 retries. A request whose body can't be sent again isn't retried.
+*/
+func (transport *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for runs := 0; ; runs++ {
+		if !sheetsLimiter.wait(ctx, "sheets") {
+			return nil, ctx.Err()
+		}
+		resp, err := transport.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || runs >= SHEETSQUOTARETRIES ||
+			(req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+
+		wait := max(parseRetryAfter(resp.Header.Get("Retry-After")), backoff(SHEETSQUOTABACKOFF, runs))
+		_ = resp.Body.Close()
+		slog.WarnContext(ctx, "Sheets API quota exhausted, retrying after "+wait.Round(time.Second).String(),
+			"retry", runs+1)
+		if !sleepContext(ctx, wait) {
+			return nil, ctx.Err()
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+/*
+Sets the Sheets rate limiter to the given number of requests per minute.
+*/
+func applySheetsQuota(requestsPerMinute int) {
+	sheetsLimiter = newRateLimiter(time.Minute / time.Duration(max(requestsPerMinute, 1)))
+}
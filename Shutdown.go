@@ -0,0 +1,94 @@
+package main
+
+/*
+This file shuts the program down cleanly once it is asked to stop with SIGINT or SIGTERM, as Kubernetes does when it
+terminates a pod. The signal cancels the context every scheduled call, subscription, and request runs under, so calls
+in flight are aborted and nothing new is started. The program then waits for its background work to end, writes the
+readings still queued or buffered for the outputs, saves the state file, and closes its connections, all within
+SHUTDOWNTIMEOUT so it exits inside the pod's grace period. A second signal stops the program at once.
+*/
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	SHUTDOWNTIMEOUT = 25 * time.Second //Within the 30 second grace period Kubernetes gives a pod by default
+)
+
+var (
+	backgroundTasks sync.WaitGroup //Goroutines that finish their work once the context is cancelled
+)
+
+/*
+Waits for the background work to end, writes every output's queued and buffered readings, and closes the connections
+to the outputs, giving up on whatever is left once SHUTDOWNTIMEOUT has passed.
+*/
+func shutdown(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), SHUTDOWNTIMEOUT)
+	defer cancel()
+	slog.Info("Shutting down, writing the readings still queued", "timeout", SHUTDOWNTIMEOUT)
+
+	finished := make(chan struct{})
+	go func() {
+		backgroundTasks.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		slog.Warn("Background work didn't end in time, shutting down without it")
+	}
+
+	flushed := flushSinks(ctx)
+	saveState()
+	closeConnections()
+	if !flushed {
+		slog.Error("Shut down with readings that were not written")
+		return
+	}
+	slog.Info("Shut down cleanly")
+}
+
+/*
+Closes the connections to the outputs that hold one open: the databases, the MQTT broker, Kafka, and NATS.
+*/
+func closeConnections() {
+	sqliteMutex.Lock()
+	if sqliteDB != nil {
+		_ = sqliteDB.Close()
+		sqliteDB = nil
+	}
+	sqliteMutex.Unlock()
+
+	postgresMutex.Lock()
+	if postgresDB != nil {
+		_ = postgresDB.Close()
+		postgresDB = nil
+	}
+	postgresMutex.Unlock()
+
+	mqttMutex.Lock()
+	if mqttClient != nil {
+		mqttClient.Disconnect(250) //Milliseconds to finish publishing
+		mqttClient = nil
+	}
+	mqttMutex.Unlock()
+
+	streamMutex.Lock()
+	if kafkaWriter != nil {
+		_ = kafkaWriter.Close()
+		kafkaWriter = nil
+	}
+	if natsConn != nil {
+		natsConn.Close()
+		natsConn = nil
+	}
+	streamMutex.Unlock()
+
+	xlsxMutex.Lock()
+	closeXLSX()
+	xlsxMutex.Unlock()
+}
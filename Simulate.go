@@ -0,0 +1,125 @@
+package main
+
+/*
+This file implements the simulation mode enabled with -simulate, which generates synthetic weather data in place of
+the Ambient Weather API so the sheet setup and alerting can be tested without a station or API keys. Temperature and
+humidity follow a daily curve, the sun rises and sets, the wind and pressure drift, and rain falls in random showers.
+Every value is derived from the station and the 5 minute slot it is reported in, so asking for the same slot twice
+gives the same record, just like the real API.
+*/
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+var (
+	simulate         = false
+	simulatedStation = Station{Name: "Simulated", MacAddress: "00:00:00:00:00:00"}
+)
+
+/*
+Returns a synthetic API response for the station holding the given number of most recent records, newest first, in
+the same JSON format as the Ambient Weather device query.
+*/
+func simulatedResponse(station Station, limit int) string {
+	newest := time.Now().Truncate(5 * time.Minute)
+	records := make([]map[string]interface{}, 0, limit)
+	for i := 0; i < limit; i++ {
+		records = append(records, simulatedRecord(station, newest.Add(-time.Duration(i)*5*time.Minute)))
+	}
+
+	encoded, err := json.Marshal(records)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+/*
+Generates the record the station reports at the given time. Temperature peaks at 3pm and bottoms out at 3am with the
+humidity moving the opposite way, solar radiation follows the sun between 6am and 6pm, and the dew point is derived
+from the temperature and humidity so the record passes the same checks as real data.
+*/
+func simulatedRecord(station Station, observed time.Time) map[string]interface{} {
+	random := simulatedRandom(station, observed.Unix()/300)
+	hour := float64(observed.Hour()) + float64(observed.Minute())/60
+	daily := math.Cos(2 * math.Pi * (hour - 15) / 24) //1 at 3pm, -1 at 3am
+
+	tempF := 60 + 15*daily + random.NormFloat64()*0.5
+	humidity := math.Max(15, math.Min(100, 60-25*daily+random.NormFloat64()*2))
+	solar := math.Max(0, 900*math.Sin(math.Pi*(hour-6)/12)*(0.8+0.2*random.Float64()))
+	wind := math.Abs(5 + 4*daily + random.NormFloat64()*2)
+	pressure := 29.92 + 0.15*math.Sin(2*math.Pi*float64(observed.Unix())/(5*86400))
+
+	rainRate := simulatedRainRate(station, observed)
+	if rainRate > 0 {
+		humidity = math.Max(humidity, 90)
+		solar /= 4
+	}
+
+	return map[string]interface{}{
+		"dateutc":        observed.UnixMilli(),
+		"date":           observed.UTC().Format(time.RFC3339),
+		"tempf":          round(tempF, 1),
+		"humidity":       math.Round(humidity),
+		"dewPoint":       round(dewPointF(tempF, humidity), 1),
+		"feelsLike":      round(tempF, 1),
+		"tempinf":        round(70+random.NormFloat64()*0.3, 1),
+		"humidityin":     math.Round(40 + random.NormFloat64()),
+		"windspeedmph":   round(wind, 1),
+		"windgustmph":    round(wind*(1.3+0.3*random.Float64()), 1),
+		"winddir":        math.Round(math.Mod(225+40*random.NormFloat64()+360, 360)),
+		"baromrelin":     round(pressure, 2),
+		"baromabsin":     round(pressure-0.5, 2),
+		"solarradiation": round(solar, 1),
+		"uv":             math.Round(solar / 100),
+		"hourlyrainin":   round(rainRate, 2),
+		"dailyrainin":    round(simulatedDailyRain(station, observed), 2),
+		"battout":        1,
+	}
+}
+
+/*
+Returns the rain rate in inches per hour at the given time. Each hour has a small chance of a shower, with the rate
+chosen at random for the whole hour.
+*/
+func simulatedRainRate(station Station, observed time.Time) float64 {
+	random := simulatedRandom(station, -observed.Unix()/3600)
+	if random.Float64() > 0.06 {
+		return 0
+	}
+	return 0.02 + random.Float64()*0.5
+}
+
+/*
+Returns the rain that fell from local midnight up to the given time by adding up the rain in every 5 minute slot.
+*/
+func simulatedDailyRain(station Station, observed time.Time) float64 {
+	total := 0.0
+	midnight := time.Date(observed.Year(), observed.Month(), observed.Day(), 0, 0, 0, 0, observed.Location())
+	for slot := midnight; !slot.After(observed); slot = slot.Add(5 * time.Minute) {
+		total += simulatedRainRate(station, slot) / 12
+	}
+	return total
+}
+
+/*
+Returns a random number generator seeded from the station's MAC Address and the given slot number, so every slot of
+every station gets its own repeatable values.
+*/
+func simulatedRandom(station Station, slot int64) *rand.Rand {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(station.MacAddress))
+	return rand.New(rand.NewPCG(hash.Sum64(), uint64(slot)))
+}
+
+/*
+Rounds a value to the given number of decimal places.
+*/
+func round(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
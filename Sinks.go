@@ -0,0 +1,384 @@
+package main
+
+/*
+This file writes the readings to every enabled output, the Google Sheet being just one of them, so any output can be
+used as well as, or instead of, the sheet. Each output is a Sink, enabled by its own settings, e.g. spreadsheetId for
+the sheets or sqliteFile for SQLite, and sinks limits the outputs to the ones it names, e.g. ["sheets", "sqlite"].
+writeRows hands each batch of readings to every enabled sink at once, so a slow output doesn't hold up the others. A
+sink that fails keeps a station's readings in its own queue, in memory and, with bufferDir set, on disk so they survive
+a restart, see Buffer.go, and the queue is written first the next time the station's readings arrive, after a wait that
+doubles with every failure for that station from 30 seconds up to 30 minutes, so one unavailable output neither blocks
+nor repeats the writes to the others. Readings an output rejects for good, with an HTTP 4xx status or a database
+constraint, are dropped rather than queued, as sending them again can't succeed. A queue holds at most 10,000 readings
+per station, once it is full the batch is refused and writeRows reports the readings as not persisted, so they are
+fetched again.
+*/
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SINKQUEUELIMIT = 10000 //Readings queued per sink and station
+	SINKBACKOFF    = 30 * time.Second
+	SINKMAXBACKOFF = 30 * time.Minute
+)
+
+/*
+Sink is the interface of an output the readings are written to. EnabledIn reports whether a config enables the
+output, and Enabled whether the running config does. Write is given a batch of a station's readings, sorted oldest
+first, and returns an error unless every reading was persisted.
+*/
+type Sink interface {
+	Name() string
+	Enabled() bool
+	EnabledIn(loaded Config) bool
+	Write(ctx context.Context, station Station, readings []DeviceData) error
+}
+
+/*
+funcSink is a struct that adapts an output's enabled check and write function to the Sink interface.
+*/
+type funcSink struct {
+	name    string
+	enabled func(loaded Config) bool
+	write   func(ctx context.Context, station Station, readings []DeviceData) error
+}
+
+/*
+bufferedSink is a struct that adapts the write function of an output that only buffers the readings it is given, and
+moves its cursor itself once they are really written, such as Parquet's.
+*/
+type bufferedSink struct {
+	funcSink
+}
+
+/*
+sinkQueue is a struct that holds the readings a sink failed to write and their stations, and how often the sink
+failed in a row and when it is next tried, all by station MAC Address.
+*/
+type sinkQueue struct {
+	mutex       sync.Mutex
+	pending     map[string][]DeviceData
+	stations    map[string]Station
+	failures    map[string]int
+	nextAttempt map[string]time.Time
+}
+
+/*
+rejectedError is a struct that holds an error an output answered with when it refused readings for good, so sending
+them again can't succeed.
+*/
+type rejectedError struct {
+	err error
+}
+
+var (
+	sinks = []Sink{
+		funcSink{"sheets", func(loaded Config) bool { return loaded.SpreadsheetID != "" }, writeSheets},
+		funcSink{"xlsx", func(loaded Config) bool { return loaded.XLSXFile != "" }, writeXLSX},
+		funcSink{"csv", func(loaded Config) bool { return loaded.CSVDir != "" }, writeCSV},
+		funcSink{"sqlite", func(loaded Config) bool { return loaded.SQLiteFile != "" }, writeSQLite},
+		funcSink{"postgres", func(loaded Config) bool { return loaded.PostgresURL != "" }, writePostgres},
+		funcSink{"influxdb", func(loaded Config) bool { return loaded.InfluxURL != "" }, writeInflux},
+		funcSink{"mqtt", func(loaded Config) bool { return loaded.MQTTBroker != "" }, publishMQTT},
+		funcSink{"bigquery", func(loaded Config) bool { return loaded.BigQueryDataset != "" }, writeBigQuery},
+		bufferedSink{funcSink{"parquet", func(loaded Config) bool { return loaded.ParquetURL != "" }, writeParquet}},
+		funcSink{"graphite", func(loaded Config) bool { return loaded.GraphiteAddr+loaded.StatsDAddr != "" },
+			writeGraphite},
+		funcSink{"webhook", func(loaded Config) bool { return len(loaded.Webhooks) > 0 }, postWebhooks},
+		funcSink{"kafka", func(loaded Config) bool { return len(loaded.KafkaBrokers) > 0 }, publishKafka},
+		funcSink{"nats", func(loaded Config) bool { return loaded.NATSURL != "" }, publishNATS},
+		funcSink{"remotewrite", func(loaded Config) bool { return loaded.RemoteWriteURL != "" }, pushRemoteWrite},
+		funcSink{"homeassistant", func(loaded Config) bool { return loaded.HAURL != "" }, pushHomeAssistant},
+		funcSink{"wunderground", func(loaded Config) bool { return anyStation(loaded.Stations, wunderground.enabled) },
+			uploadWunderground},
+		funcSink{"pwsweather", func(loaded Config) bool { return anyStation(loaded.Stations, pwsweather.enabled) },
+			uploadPWSWeather},
+		funcSink{"windy", func(loaded Config) bool { return anyStation(loaded.Stations, windy.enabled) },
+			uploadWindy},
+	}
+	sinkQueues = make(map[string]*sinkQueue)
+	sinkMutex  sync.Mutex
+)
+
+/*
+Returns the name of the output in logs and in the sinks setting.
+*/
+func (sink funcSink) Name() string {
+	return sink.name
+}
+
+/*
+Reports whether the output is configured and, if sinks is set, named in it.
+*/
+func (sink funcSink) Enabled() bool {
+	return sink.EnabledIn(config)
+}
+
+/*
+Reports whether the output is configured in a config and, if its sinks is set, named in it.
+*/
+func (sink funcSink) EnabledIn(loaded Config) bool {
+	if !sink.enabled(loaded) {
+		return false
+	}
+	if len(loaded.Sinks) == 0 {
+		return true
+	}
+	for _, name := range loaded.Sinks {
+		if name == sink.name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Writes the readings to the output.
+*/
+func (sink funcSink) Write(ctx context.Context, station Station, readings []DeviceData) error {
+	return sink.write(ctx, station, readings)
+}
+
+/*
+Function that writes DeviceData records for the given station, whether a backfill, a poll that caught up on several
+readings, or a burst of realtime updates, to every enabled output. The records are sorted by time, and a column is
+added for any field that is not mapped in the headers file yet before any output is written. Returns whether every
+enabled output persisted the records or queued them to try again.
+*/
+func writeRows(ctx context.Context, station Station, readings []DeviceData) bool {
+	readings = sortByTime(readings)
+	trackLatest(station, readings)
+	broadcastReadings(station, trackRecent(station, readings))
+	if added := discoverSensors(ctx, readings); len(added) > 0 {
+		discoveredHeaders = append(discoveredHeaders, added...)
+	}
+
+	var wait sync.WaitGroup
+	refused := make(chan string, len(sinks))
+	for _, sink := range sinks {
+		if !sink.Enabled() {
+			continue
+		}
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if !dispatch(ctx, sink, station, readings) {
+				refused <- sink.Name()
+			}
+		}()
+	}
+	wait.Wait()
+	return len(refused) == 0
+}
+
+/*
+Writes the readings, with the fields the sink's route lets through, after any the sink has queued for the station, to a
+sink, queueing them if the write fails or the sink is waiting out a failure for the station. A reading that is both
+queued and given again, such as one buffered before a restart and then sent by healSinks, is written once. Reports
+false if the sink's queue is full and the readings were refused.
+*/
+func dispatch(ctx context.Context, sink Sink, station Station, readings []DeviceData) bool {
+	readings = routeReadings(sink.Name(), readings)
+	queue := queueFor(sink.Name())
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	pending := queue.pending[station.MacAddress]
+	if len(pending)+len(readings) > SINKQUEUELIMIT {
+		slog.ErrorContext(ctx, "Output queue is full, refusing readings", "sink", sink.Name(),
+			"station", station.displayName(), "queued", len(pending))
+		return false
+	}
+	batch := uniqueByTime(append(pending, readings...))
+	queue.stations[station.MacAddress] = station
+	if nextAttempt := queue.nextAttempt[station.MacAddress]; time.Now().Before(nextAttempt) {
+		queue.pending[station.MacAddress] = batch
+		saveBuffer(sink.Name(), queue)
+		slog.DebugContext(ctx, "Output is waiting out a failure, queueing readings", "sink", sink.Name(),
+			"station", station.displayName(), "queued", len(batch), "retry", nextAttempt)
+		return true
+	}
+
+	if err := sink.Write(ctx, station, batch); err != nil && !dropRejected(ctx, sink.Name(), station, err) {
+		failures := queue.failures[station.MacAddress] + 1
+		queue.failures[station.MacAddress] = failures
+		queue.nextAttempt[station.MacAddress] = time.Now().Add(min(SINKBACKOFF<<min(failures-1, 10), SINKMAXBACKOFF))
+		queue.pending[station.MacAddress] = batch
+		saveBuffer(sink.Name(), queue)
+		slog.WarnContext(ctx, "Unable to write to output, queued "+strconv.Itoa(len(batch))+" readings",
+			"sink", sink.Name(), "station", station.displayName(), "retry", queue.nextAttempt[station.MacAddress],
+			"err", err)
+		return true
+	}
+	if len(pending) > 0 {
+		slog.InfoContext(ctx, "Output caught up on "+strconv.Itoa(len(pending))+" queued readings",
+			"sink", sink.Name(), "station", station.displayName())
+	}
+	delete(queue.failures, station.MacAddress)
+	delete(queue.nextAttempt, station.MacAddress)
+	delete(queue.pending, station.MacAddress)
+	if len(pending) > 0 {
+		saveBuffer(sink.Name(), queue)
+	}
+	markSinkWritten(sink.Name())
+	if _, buffered := sink.(bufferedSink); !buffered {
+		recordSinkCursor(sink.Name(), station.MacAddress, batch)
+	}
+	return true
+}
+
+/*
+Writes the readings every sink has queued, without waiting out earlier failures, before the program exits. Returns
+whether every queue was emptied, the readings left in a queue are lost unless bufferDir keeps them for the next run.
+*/
+func flushSinks(ctx context.Context) bool {
+	flushed := true
+	for _, sink := range sinks {
+		queue := queueFor(sink.Name())
+		queue.mutex.Lock()
+		queued := len(queue.pending)
+		for mac, pending := range queue.pending {
+			station := queue.stations[mac]
+			if err := sink.Write(ctx, station, pending); err != nil && !dropRejected(ctx, sink.Name(), station, err) {
+				slog.ErrorContext(ctx, "Unable to write queued readings to output", "sink", sink.Name(),
+					"station", station.displayName(), "readings", len(pending), "buffered", config.BufferDir != "",
+					"err", err)
+				flushed = false
+				continue
+			}
+			delete(queue.pending, mac)
+			delete(queue.failures, mac)
+			delete(queue.nextAttempt, mac)
+			if _, buffered := sink.(bufferedSink); !buffered {
+				recordSinkCursor(sink.Name(), mac, pending)
+			}
+		}
+		if len(queue.pending) != queued {
+			saveBuffer(sink.Name(), queue)
+		}
+		queue.mutex.Unlock()
+	}
+	return flushed && flushParquet(ctx)
+}
+
+/*
+Returns the queue of a sink, creating it the first time the sink is written to.
+*/
+func queueFor(name string) *sinkQueue {
+	sinkMutex.Lock()
+	defer sinkMutex.Unlock()
+	queue, exists := sinkQueues[name]
+	if !exists {
+		queue = &sinkQueue{pending: make(map[string][]DeviceData), stations: make(map[string]Station),
+			failures: make(map[string]int), nextAttempt: make(map[string]time.Time)}
+		sinkQueues[name] = queue
+	}
+	return queue
+}
+
+/*
+Returns the problems with the sinks setting: names that aren't an output.
+*/
+func sinkProblems(loaded Config) []string {
+	var problems []string
+	for _, name := range loaded.Sinks {
+		known := false
+		for _, sink := range sinks {
+			known = known || sink.Name() == name
+		}
+		if !known {
+			problems = append(problems, "sinks names an unknown output "+name)
+		}
+	}
+	return problems
+}
+
+/*
+Returns the names of the outputs a config enables.
+*/
+func enabledSinks(loaded Config) []string {
+	var names []string
+	for _, sink := range sinks {
+		if sink.EnabledIn(loaded) {
+			names = append(names, sink.Name())
+		}
+	}
+	return names
+}
+
+/*
+Returns the message of the error.
+*/
+func (rejected rejectedError) Error() string {
+	return rejected.err.Error()
+}
+
+/*
+Returns the error the output answered with.
+*/
+func (rejected rejectedError) Unwrap() error {
+	return rejected.err
+}
+
+/*
+Returns err, marked as a rejection if an output answered with an HTTP status that means the request can never succeed:
+a 4xx status other than those for authorization, timeouts, and rate limits, which may pass once they are resolved.
+*/
+func rejectStatus(status int, err error) error {
+	switch {
+	case status < 400 || status > 499:
+		return err
+	case status == http.StatusUnauthorized, status == http.StatusForbidden, status == http.StatusRequestTimeout,
+		status == http.StatusTooManyRequests:
+		return err
+	}
+	return rejectedError{err: err}
+}
+
+/*
+Returns err, marked as a rejection if a database refused the statement for its data: a PostgreSQL data exception or
+integrity constraint violation, SQLSTATE class 22 or 23, or an SQLite constraint or type mismatch.
+*/
+func rejectSQL(err error) error {
+	var postgresErr interface{ SQLState() string }
+	if errors.As(err, &postgresErr) {
+		if state := postgresErr.SQLState(); len(state) == 5 && (state[:2] == "22" || state[:2] == "23") {
+			return rejectedError{err: err}
+		}
+	}
+	var sqliteErr interface{ Code() int }
+	if errors.As(err, &sqliteErr) {
+		if code := sqliteErr.Code() & 0xff; code == 19 || code == 20 { //SQLITE_CONSTRAINT and SQLITE_MISMATCH
+			return rejectedError{err: err}
+		}
+	}
+	return err
+}
+
+/*
+Reports whether an output rejected readings for good, in which case they are logged as dropped instead of being
+queued, and the readings it didn't reject count as written.
+*/
+func dropRejected(ctx context.Context, sink string, station Station, err error) bool {
+	if !isRejected(err) {
+		return false
+	}
+	slog.ErrorContext(ctx, "Output rejected the readings, dropping them", "sink", sink, "station",
+		station.displayName(), "err", err)
+	return true
+}
+
+/*
+Reports whether err is, or wraps, an output's refusal of readings for good.
+*/
+func isRejected(err error) bool {
+	var rejected rejectedError
+	return errors.As(err, &rejected)
+}
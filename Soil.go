@@ -0,0 +1,70 @@
+package main
+
+/*
+This file names the soil probes of a station. Each probe reports a soil temperature (soiltemp1f..soiltemp10f) and a
+soil humidity (soilhum1..soilhum10), and the soilProbes setting maps probe numbers to names in one line, e.g.
+{"1": "Garden bed", "2": "Lawn"}, instead of a headers.txt line per sensor. Both readings of a named probe are written
+to columns headed with its name, reusing the probe's columns in headers.txt when it has them and adding columns after
+the last mapped one when it doesn't.
+*/
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	SOILPROBES = 10
+)
+
+/*
+Returns the sensor mapping with a named column for the soil temperature and soil humidity of every configured probe.
+Probes are added in order of their number, in the first free columns. The probe columns aren't saved to the headers
+mapping, so the columns a discovered sensor left free for them are taken again after a restart.
+*/
+func withSoilProbes(sensors map[string]SensorInfo, probes map[string]string) map[string]SensorInfo {
+	numbers := make([]int, 0, len(probes))
+	for number := range probes {
+		if probe, err := strconv.Atoi(number); err == nil && probe >= 1 && probe <= SOILPROBES {
+			numbers = append(numbers, probe)
+		}
+	}
+	sort.Ints(numbers)
+
+	for _, probe := range numbers {
+		name := probes[strconv.Itoa(probe)]
+		columns := []struct {
+			sensor      string
+			description string
+		}{
+			{"soiltemp" + strconv.Itoa(probe) + "f", name + " Soil Temperature, ºF"},
+			{"soilhum" + strconv.Itoa(probe), name + " Soil Humidity, %"},
+		}
+		for _, column := range columns {
+			sensor, exists := sensors[column.sensor]
+			if !exists {
+				sensor.ID = columnID(freeColumn(sensors))
+			}
+			sensor.Description = column.description
+			sensors[column.sensor] = sensor
+		}
+	}
+	return sensors
+}
+
+/*
+Returns the problems with the configured soil probes: a probe number outside 1-10 or a probe without a name.
+*/
+func soilProbeProblems(probes map[string]string) []string {
+	var problems []string
+	for number, name := range probes {
+		if probe, err := strconv.Atoi(number); err != nil || probe < 1 || probe > SOILPROBES {
+			problems = append(problems, fmt.Sprintf("soilProbes: probe %q must be a number from 1 to %d", number,
+				SOILPROBES))
+		} else if name == "" {
+			problems = append(problems, "soilProbes: probe "+number+" has no name")
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
@@ -0,0 +1,60 @@
+package main
+
+/*
+This file writes the same readings to several spreadsheets, e.g. a personal spreadsheet and a shared club spreadsheet.
+The spreadsheets in extraSpreadsheetIds are written to after the one in spreadsheetId, each in turn with its own
+retries, so a spreadsheet that is unavailable or out of quota doesn't keep the others from being written. The sheets
+of every spreadsheet are created, formatted, and checked for duplicate readings independently. The spreadsheet a
+write goes to travels in its context, and Sheets calls without one go to spreadsheetId.
+*/
+import (
+	"context"
+	"log/slog"
+)
+
+/*
+spreadsheetKey is the context key the ID of the spreadsheet being written to is stored under.
+*/
+type spreadsheetKey struct{}
+
+/*
+Returns a context whose Sheets calls go to the spreadsheet with the given ID.
+*/
+func withSpreadsheet(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, spreadsheetKey{}, id)
+}
+
+/*
+Returns the ID of the spreadsheet the Sheets calls made with the context go to, spreadsheetId unless the context
+names another.
+*/
+func spreadsheetFor(ctx context.Context) string {
+	if id, ok := ctx.Value(spreadsheetKey{}).(string); ok {
+		return id
+	}
+	return spreadsheetId
+}
+
+/*
+Returns the key of a sheet in the spreadsheet the context's Sheets calls go to, for state kept for each sheet.
+*/
+func sheetKey(ctx context.Context, sheetName string) string {
+	return spreadsheetFor(ctx) + "!" + sheetName
+}
+
+/*
+Calls write once for every configured spreadsheet, with a context whose Sheets calls go to that spreadsheet. Nothing
+is called without a spreadsheetId, when only the workbook is written.
+*/
+func forEachSpreadsheet(ctx context.Context, write func(ctx context.Context)) {
+	if spreadsheetId == "" {
+		return
+	}
+	ids := append([]string{spreadsheetId}, config.ExtraSheetIDs...)
+	for _, id := range ids {
+		if len(ids) > 1 {
+			slog.DebugContext(ctx, "Writing to spreadsheet", "spreadsheet", id)
+		}
+		write(withSpreadsheet(ctx, id))
+	}
+}
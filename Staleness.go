@@ -0,0 +1,52 @@
+package main
+
+/*
+This file detects stations that have stopped reporting. When the API answers but the station's newest reading hasn't
+advanced for the configured number of consecutive polls, the station itself is offline (power, WiFi, or hardware) even
+though nothing is wrong with the API. A single station_stale event is logged when that happens, separate from API
+errors, and a station_recovered event once the station reports again.
+*/
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	staleMutex sync.Mutex
+	stalePolls = make(map[string]int) //Consecutive polls without a new reading for each station MAC Address
+)
+
+/*
+Records the outcome of a successful poll of a station, whether it returned a reading newer than the last one written.
+Logs a station_stale event when the configured number of consecutive polls return nothing new, and a
+station_recovered event on the first new reading after that.
+*/
+func trackStaleness(ctx context.Context, station Station, advanced bool) {
+	staleMutex.Lock()
+	defer staleMutex.Unlock()
+
+	polls := stalePolls[station.MacAddress]
+	if advanced {
+		if config.StalePolls > 0 && polls >= config.StalePolls {
+			slog.InfoContext(ctx, "Station is reporting again", "event", "station_recovered",
+				"station", station.displayName(), "stalePolls", polls)
+		}
+		stalePolls[station.MacAddress] = 0
+		return
+	}
+
+	polls++
+	stalePolls[station.MacAddress] = polls
+	if config.StalePolls > 0 && polls == config.StalePolls {
+		lastObservedMutex.Lock()
+		last := lastObserved[station.MacAddress]
+		lastObservedMutex.Unlock()
+
+		slog.ErrorContext(ctx, "Station is stale, it has not reported a new reading in "+strconv.Itoa(polls)+
+			" polls. Check the station's power and WiFi", "event", "station_stale", "station", station.displayName(),
+			"lastReported", time.UnixMilli(last))
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+/*
+This file keeps a small state file, set with stateFile in the config, recording the dateutc of the last reading
+written for every station and the last reading each output wrote for every station, its cursor. The file is read when
+the program starts, so a restart resumes exactly where the last run left off without reading the sheet: the first
+poll fetches everything since the last reading written, and the gap is backfilled even when no Google Sheet is
+written. An output whose cursor is behind the station's last reading, because its queue was lost when the program
+stopped, is sent the readings it missed from the history API. The file is written after every cycle that persisted
+readings and when the program stops, through a temporary file so a crash never leaves it half written. An empty
+stateFile keeps no state.
+*/
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	stateMutex sync.Mutex
+	state      = persistedState{Stations: make(map[string]int64), Sinks: make(map[string]map[string]int64)}
+	stateDirty = false
+)
+
+/*
+persistedState is a struct that holds the contents of the state file: the dateutc of the last reading written for
+each station MAC Address, and of the last reading each output wrote for each station MAC Address.
+*/
+type persistedState struct {
+	Stations map[string]int64            `json:"lastWritten"`
+	Sinks    map[string]map[string]int64 `json:"sinkCursors"`
+}
+
+/*
+Reads the state file and seeds the last reading written for every station from it. A missing file starts an empty
+state.
+*/
+func loadState() {
+	if config.StateFile == "" {
+		return
+	}
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	data, err := os.ReadFile(config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	loaded := persistedState{}
+	if err == nil {
+		err = json.Unmarshal(data, &loaded)
+	}
+	if err != nil {
+		slog.Warn("Unable to read the state file, starting without it", "file", config.StateFile, "err", err)
+		return
+	}
+	if loaded.Stations != nil {
+		state.Stations = loaded.Stations
+	}
+	if loaded.Sinks != nil {
+		state.Sinks = loaded.Sinks
+	}
+
+	lastObservedMutex.Lock()
+	for macAddress, last := range state.Stations {
+		lastObserved[macAddress] = max(lastObserved[macAddress], last)
+	}
+	lastObservedMutex.Unlock()
+	slog.Info("Resuming from the state file", "file", config.StateFile, "stations", len(state.Stations))
+}
+
+/*
+Records the dateutc of the last reading written for a station.
+*/
+func recordStation(macAddress string, dateUTC int64) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if dateUTC > state.Stations[macAddress] {
+		state.Stations[macAddress] = dateUTC
+		stateDirty = true
+	}
+}
+
+/*
+Moves an output's cursor for a station to the newest of the readings it wrote, which must be sorted oldest first. The
+summary, which has no MAC Address, has no cursor.
+*/
+func recordSinkCursor(sink string, macAddress string, readings []DeviceData) {
+	if len(readings) == 0 || macAddress == "" {
+		return
+	}
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if state.Sinks[sink] == nil {
+		state.Sinks[sink] = make(map[string]int64)
+	}
+	if dateUTC := readings[len(readings)-1].DateUTC; dateUTC > state.Sinks[sink][macAddress] {
+		state.Sinks[sink][macAddress] = dateUTC
+		stateDirty = true
+	}
+}
+
+/*
+Returns the dateutc of the last reading written for a station according to the state file, reporting false if the
+station has none.
+*/
+func stateLastWritten(macAddress string) (int64, bool) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	last, exists := state.Stations[macAddress]
+	return last, exists && last > 0
+}
+
+/*
+Writes the state file if the state changed, replacing the old file only once the new one is completely written.
+*/
+func saveState() {
+	if config.StateFile == "" {
+		return
+	}
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if !stateDirty {
+		return
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	temporary := config.StateFile + ".tmp"
+	if err == nil {
+		err = os.WriteFile(temporary, data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(temporary, config.StateFile)
+	}
+	if err != nil {
+		slog.Warn("Unable to save the state file", "file", config.StateFile, "err", err)
+		return
+	}
+	stateDirty = false
+}
+
+/*
+Sends every enabled output whose cursor for a station is behind the station's last reading written the readings it
+missed, fetched from the history API. Outputs without a cursor for the station, such as one just enabled, start from
+the next reading instead.
+*/
+func healSinks(ctx context.Context, stations []Station) {
+	for _, station := range stations {
+		last, exists := stateLastWritten(station.MacAddress)
+		if !exists {
+			continue
+		}
+		behind := make(map[string]int64) //Cursor of each output that missed readings
+		oldest := last
+		stateMutex.Lock()
+		for _, sink := range sinks {
+			cursor, tracked := state.Sinks[sink.Name()][station.MacAddress]
+			if sink.Enabled() && tracked && cursor < last {
+				behind[sink.Name()] = cursor
+				oldest = min(oldest, cursor)
+			}
+		}
+		stateMutex.Unlock()
+		if len(behind) == 0 {
+			continue
+		}
+
+		ctx := withCorrelationID(ctx)
+		slog.WarnContext(ctx, "Outputs missed readings when the program stopped, sending them now",
+			"station", station.displayName(), "outputs", len(behind), "since", time.UnixMilli(oldest))
+		readings, err := fetchHistory(ctx, station, time.UnixMilli(oldest+1), time.UnixMilli(last+1))
+		if err != nil {
+			slog.ErrorContext(ctx, "Unable to fetch every missed reading, sending those fetched", "err", err)
+		}
+		readings = validReadings(ctx, station, readings)
+		for _, sink := range sinks {
+			cursor, missed := behind[sink.Name()]
+			if !missed {
+				continue
+			}
+			var pending []DeviceData
+			for _, data := range readings {
+				if data.DateUTC > cursor {
+					pending = append(pending, data)
+				}
+			}
+			if len(pending) > 0 && dispatch(ctx, sink, station, pending) {
+				slog.InfoContext(ctx, "Sent "+strconv.Itoa(len(pending))+" missed readings", "sink", sink.Name(),
+					"station", station.displayName())
+			}
+		}
+	}
+	saveState()
+}
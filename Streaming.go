@@ -0,0 +1,101 @@
+package main
+
+/*
+This file publishes the readings to Kafka and NATS for users building streaming pipelines on top of their station data.
+Each reading is one message with the same JSON body as the webhooks: the station's MAC Address and name, dateutc, the
+observation time, and every field in its configured unit. With kafkaBrokers set the messages go to kafkaTopic, keyed by
+the station's MAC Address so a station's readings stay in order within one partition, and are only counted as written
+once every in-sync replica has them. With natsUrl set they are published to natsSubject followed by the MAC Address
+without colons, e.g. ambient.readings.001122334455, so subscribers can pick stations with wildcards. Messages are
+encoded as JSON only.
+*/
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	STREAMTIMEOUT = 10 * time.Second
+)
+
+var (
+	kafkaWriter *kafka.Writer = nil
+	natsConn    *nats.Conn    = nil
+	streamMutex sync.Mutex
+)
+
+/*
+Publishes the readings of a station to the Kafka topic. Returns an error unless every reading was acknowledged, and
+nil when no kafkaBrokers are configured.
+*/
+func publishKafka(ctx context.Context, station Station, readings []DeviceData) error {
+	if len(config.KafkaBrokers) == 0 || len(readings) == 0 {
+		return nil
+	}
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+
+	if kafkaWriter == nil {
+		kafkaWriter = &kafka.Writer{Addr: kafka.TCP(config.KafkaBrokers...), Topic: config.KafkaTopic,
+			Balancer: &kafka.Hash{}, RequiredAcks: kafka.RequireAll, WriteTimeout: STREAMTIMEOUT}
+	}
+	messages := make([]kafka.Message, 0, len(readings))
+	for _, data := range readings {
+		body, err := json.Marshal(webhookBody(station, data))
+		if err != nil {
+			return fmt.Errorf("unable to encode the reading for Kafka: %w", err)
+		}
+		messages = append(messages, kafka.Message{Key: []byte(station.MacAddress), Value: body, Time: data.Time()})
+	}
+
+	if err := kafkaWriter.WriteMessages(ctx, messages...); err != nil {
+		return fmt.Errorf("unable to publish the readings to the Kafka topic %s: %w", config.KafkaTopic, err)
+	}
+	slog.InfoContext(ctx, "Published "+strconv.Itoa(len(messages))+" readings to Kafka", "topic", config.KafkaTopic,
+		"station", station.displayName())
+	return nil
+}
+
+/*
+Publishes the readings of a station to the station's NATS subject, connecting first if needed. Returns an error unless
+the server received every reading, and nil when no natsUrl is configured.
+*/
+func publishNATS(ctx context.Context, station Station, readings []DeviceData) error {
+	if config.NATSURL == "" || len(readings) == 0 {
+		return nil
+	}
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+
+	if natsConn == nil {
+		conn, err := nats.Connect(config.NATSURL, nats.Name("GoAmbient"), nats.MaxReconnects(-1))
+		if err != nil {
+			return fmt.Errorf("unable to connect to NATS: %w", err)
+		}
+		natsConn = conn
+	}
+
+	subject := config.NATSSubject + "." + strings.ToLower(strings.ReplaceAll(station.MacAddress, ":", ""))
+	for _, data := range readings {
+		body, err := json.Marshal(webhookBody(station, data))
+		if err == nil {
+			err = natsConn.Publish(subject, body)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to publish the reading to %s: %w", subject, err)
+		}
+	}
+	if err := natsConn.FlushTimeout(STREAMTIMEOUT); err != nil { //Waits for the server to have every message
+		return fmt.Errorf("unable to flush the readings to %s: %w", subject, err)
+	}
+	slog.InfoContext(ctx, "Published "+strconv.Itoa(len(readings))+" readings to NATS", "subject", subject)
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+/*
+This file aggregates the readings of every station polled in a cycle into a row on a combined Summary sheet, written
+in addition to each station's own sheet when summary is enabled and more than one station is configured. Readings
+where the average across stations is meaningful (temperature, humidity, pressure, wind speed) are averaged, and
+readings where the extreme matters (gusts, rain) take the largest value of any station. The row uses the same columns
+and units as the station sheets, dated at the newest of the aggregated readings. The summary is only written to the
+sheets and the workbook, the other outputs hold the readings of real stations, by MAC Address.
+*/
+import (
+	"context"
+	"encoding/json"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"log/slog"
+	"strconv"
+)
+
+var (
+	summaryStation  = Station{Name: "Summary"}
+	summarySinks    = map[string]bool{"sheets": true, "xlsx": true} //Outputs the summary is written to
+	averagedSensors = []string{
+		"tempf", "humidity", "dewPoint", "feelsLike", "heatIndex", "windChill", "baromrelin", "baromabsin",
+		"windspeedmph", "windspdmph_avg2m", "windspdmph_avg10m", "solarradiation", "uv", "pm25", "aqiPM25",
+	}
+	maximumSensors = []string{
+		"windgustmph", "maxdailygust", "hourlyrainin", "eventrainin", "dailyrainin", "rainToday", "rain24h",
+		"lightning_hour", "lightning_day",
+	}
+)
+
+/*
+Returns the summary of the given readings, one per station: the average of every averaged sensor and the largest
+value of every maximum sensor reported by at least one station. Reports false if fewer than two readings are given.
+*/
+func summarize(readings []DeviceData) (DeviceData, bool) {
+	if len(readings) < 2 {
+		return DeviceData{}, false
+	}
+
+	var newest int64
+	for _, data := range readings {
+		newest = max(newest, data.DateUTC)
+	}
+	fields := map[string]interface{}{"dateutc": newest}
+
+	for _, name := range averagedSensors {
+		total, count := 0.0, 0
+		for _, data := range readings {
+			if value, ok := ambient.ToFloat(data.Fields[name]); ok {
+				total += value
+				count++
+			}
+		}
+		if count > 0 {
+			fields[name] = json.Number(strconv.FormatFloat(round(total/float64(count), 2), 'f', -1, 64))
+		}
+	}
+	for _, name := range maximumSensors {
+		largest, found := 0.0, false
+		for _, data := range readings {
+			if value, ok := ambient.ToFloat(data.Fields[name]); ok && (!found || value > largest) {
+				largest, found = value, true
+			}
+		}
+		if found {
+			fields[name] = json.Number(strconv.FormatFloat(largest, 'f', -1, 64))
+		}
+	}
+
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return DeviceData{}, false
+	}
+	var summary DeviceData
+	if err := json.Unmarshal(encoded, &summary); err != nil {
+		return DeviceData{}, false
+	}
+	return summary, true
+}
+
+/*
+Writes the summary of the newest reading of every station polled in a cycle to the Summary sheet.
+*/
+func writeSummary(ctx context.Context, readings []DeviceData) {
+	summary, ok := summarize(readings)
+	if !ok {
+		return
+	}
+	slog.InfoContext(ctx, "Writing summary of "+strconv.Itoa(len(readings))+" stations")
+	for _, sink := range sinks {
+		if sink.Enabled() && summarySinks[sink.Name()] {
+			dispatch(ctx, sink, summaryStation, []DeviceData{summary})
+		}
+	}
+}
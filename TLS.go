@@ -0,0 +1,62 @@
+package main
+
+/*
+This file configures TLS for every outbound connection, to the Ambient Weather REST and realtime APIs and to the Google
+APIs. Networks that intercept TLS re-sign traffic with their own certificate authority, so a PEM bundle of extra CA
+certificates can be set as caFile in the config and is trusted alongside the system roots. The minimum TLS version
+defaults to 1.2 and can be raised to 1.3 with tlsMinVersion.
+*/
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+Builds the TLS configuration for the given CA bundle and minimum version. An empty CA file trusts only the system
+roots and an empty version means TLS 1.2.
+*/
+func tlsConfig(caFile string, minVersion string) (*tls.Config, error) {
+	settings := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	switch minVersion {
+	case "", "1.2":
+	case "1.3":
+		settings.MinVersion = tls.VersionTLS13
+	default:
+		return settings, errors.New("tlsMinVersion must be 1.2 or 1.3, not " + minVersion)
+	}
+
+	if caFile == "" {
+		return settings, nil
+	}
+	bundle, err := os.ReadFile(caFile)
+	if err != nil {
+		return settings, fmt.Errorf("unable to read CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(bundle) {
+		return settings, errors.New("no PEM certificates found in " + caFile)
+	}
+	settings.RootCAs = pool
+	return settings, nil
+}
+
+/*
+Applies the TLS configuration to the shared transport and the realtime dialer. If the configuration is invalid the
+system roots and TLS 1.2 are used instead and the error is returned.
+*/
+func applyTLS(caFile string, minVersion string) error {
+	settings, err := tlsConfig(caFile, minVersion)
+	if err != nil {
+		settings = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	sharedTransport.TLSClientConfig = settings
+	realtimeDialer.TLSClientConfig = settings.Clone()
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+/*
+This file creates new station sheets as copies of a template sheet, so the colors, column widths, fonts, formulas,
+and charts set up once in the template carry over to every new period's sheet. The sheet named by templateSheet is
+duplicated under the new sheet's name, shown if the template is hidden, and given the header row the mapping
+produces, which is protected as on any new sheet. The template's own formatting is kept, so the conditional
+formatting, number formats, and charts the program adds to bare sheets are left out. A spreadsheet without the
+template gets a bare sheet instead.
+*/
+import (
+	"context"
+	"google.golang.org/api/sheets/v4"
+	"log/slog"
+	"slices"
+)
+
+/*
+Creates a station sheet with the given name and header row by duplicating the template sheet. Reports whether the
+sheet was created, and whether the template was used at all, which it isn't when no template is configured, the
+headers aren't those of a station sheet, or the spreadsheet has no template sheet.
+*/
+func createFromTemplate(ctx context.Context, sheetName string, headers []interface{}) (bool, bool) {
+	if config.TemplateSheet == "" || !slices.Equal(headers, sensorHeaders()) {
+		return false, false
+	}
+	response, err := service.Spreadsheets.Get(spreadsheetFor(ctx)).Context(ctx).Do()
+	if err != nil {
+		slog.WarnContext(ctx, "Unable to find the template sheet, creating a bare sheet", "err", err)
+		return false, false
+	}
+	var template *sheets.SheetProperties
+	for _, sheet := range response.Sheets {
+		if sheet.Properties.Title == config.TemplateSheet {
+			template = sheet.Properties
+		}
+	}
+	if template == nil {
+		slog.WarnContext(ctx, "Template sheet not found, creating a bare sheet", "template", config.TemplateSheet)
+		return false, false
+	}
+
+	duplicate := batchUpdateRequest(ctx, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{{
+			DuplicateSheet: &sheets.DuplicateSheetRequest{
+				SourceSheetId:    template.SheetId,
+				NewSheetName:     sheetName,
+				InsertSheetIndex: int64(len(response.Sheets)),
+			},
+		}},
+	}, 1)
+	if duplicate == nil || len(duplicate.Replies) == 0 || duplicate.Replies[0].DuplicateSheet == nil {
+		slog.ErrorContext(ctx, "Unable to duplicate the template sheet", "template", config.TemplateSheet)
+		return false, true
+	}
+	slog.InfoContext(ctx, "Sheet created from template", "sheetName", sheetName, "template", config.TemplateSheet)
+
+	sheetId := duplicate.Replies[0].DuplicateSheet.Properties.SheetId
+	batchUpdateRequest(ctx, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{
+			{
+				UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+					Properties: &sheets.SheetProperties{SheetId: sheetId, ForceSendFields: []string{"Hidden"}},
+					Fields:     "hidden", //Shows the copy of a hidden template
+				},
+			},
+			headerProtection(sheetId),
+		},
+	}, 1)
+	datesFormatted[sheetKey(ctx, sheetName)] = true //The template formats its own date columns
+
+	updateValues(ctx, sheetName, [][]interface{}{headers}, "!A1", 1)
+	return true, true
+}
@@ -0,0 +1,44 @@
+package main
+
+/*
+This file defines the HTTP transport shared by every client in the program. Connections are kept alive and reused
+between the 5 minute polls and the Google API calls that follow them, instead of dialing and negotiating TLS again for
+every request, and every stage of a connection has a timeout so a dead network fails fast instead of hanging a poll.
+*/
+import (
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	sharedDialer    = &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	sharedTransport = newSharedTransport()
+	ambientClient   = &http.Client{Transport: sharedTransport, Timeout: 30 * time.Second} //Timeout set from the config
+	googleClient    = &http.Client{Transport: sharedTransport}                            //Used by the Google APIs
+	realtimeDialer  = &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		NetDialContext:   sharedDialer.DialContext,
+		HandshakeTimeout: 15 * time.Second,
+	}
+)
+
+/*
+Returns the transport used by every HTTP client. Idle connections are kept for 6 minutes so the connection from one
+poll is still open for the next, and a few idle connections are kept per host for the bursts of Sheets requests made
+while writing.
+*/
+func newSharedTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           sharedDialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          20,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       6 * time.Minute,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
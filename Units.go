@@ -0,0 +1,200 @@
+package main
+
+/*
+This file converts readings from the units the Ambient Weather API reports in, imperial except for the lightning
+distance in km, to the units chosen in the config. Setting units to metric converts every temperature to ºC, pressure
+to hPa, rain to mm, wind speed to km/h, and distance to km, while imperial writes distance in miles. sensorUnits
+chooses the unit of individual sensors, e.g. {"baromrelin": "mmHg", "windspeedmph": "m/s"}, on top of or instead of
+the global choice. Converted values are written to the sheet and the unit in each column's header is changed to match.
+*/
+import (
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	UNITSIMPERIAL = "imperial"
+	UNITSMETRIC   = "metric"
+)
+
+/*
+unit is a struct that holds a unit a quantity can be written in: its label in headers, the conversion from the unit
+the API reports, and the number of decimal places converted values are rounded to.
+*/
+type unit struct {
+	label    string
+	convert  func(float64) float64
+	decimals int
+}
+
+/*
+quantity is a struct that holds the units a kind of reading can be written in, keyed by name, along with the unit the
+API reports it in and the units used for imperial and metric.
+*/
+type quantity struct {
+	reported string
+	imperial string
+	metric   string
+	units    map[string]unit
+}
+
+var (
+	quantities = map[string]quantity{
+		"temperature": {reported: "F", imperial: "F", metric: "C", units: map[string]unit{
+			"F": {"ºF", func(f float64) float64 { return f }, 1},
+			"C": {"ºC", func(f float64) float64 { return (f - 32) * 5 / 9 }, 1},
+			"K": {"K", func(f float64) float64 { return (f-32)*5/9 + 273.15 }, 1},
+		}},
+		"pressure": {reported: "inHg", imperial: "inHg", metric: "hPa", units: map[string]unit{
+			"inHg": {"inHg", func(in float64) float64 { return in }, 2},
+			"hPa":  {"hPa", func(in float64) float64 { return in * 33.8639 }, 1},
+			"mbar": {"mbar", func(in float64) float64 { return in * 33.8639 }, 1},
+			"kPa":  {"kPa", func(in float64) float64 { return in * 3.38639 }, 2},
+			"mmHg": {"mmHg", func(in float64) float64 { return in * 25.4 }, 1},
+		}},
+		"rain": {reported: "in", imperial: "in", metric: "mm", units: map[string]unit{
+			"in": {"in", func(in float64) float64 { return in }, 2},
+			"mm": {"mm", func(in float64) float64 { return in * 25.4 }, 1},
+			"cm": {"cm", func(in float64) float64 { return in * 2.54 }, 2},
+		}},
+		"rainRate": {reported: "in/hr", imperial: "in/hr", metric: "mm/hr", units: map[string]unit{
+			"in/hr": {"in/hr", func(in float64) float64 { return in }, 2},
+			"mm/hr": {"mm/hr", func(in float64) float64 { return in * 25.4 }, 1},
+		}},
+		"wind": {reported: "mph", imperial: "mph", metric: "km/h", units: map[string]unit{
+			"mph":   {"mph", func(mph float64) float64 { return mph }, 1},
+			"km/h":  {"km/h", func(mph float64) float64 { return mph * 1.609344 }, 1},
+			"m/s":   {"m/s", func(mph float64) float64 { return mph * 0.44704 }, 1},
+			"knots": {"knots", func(mph float64) float64 { return mph * 0.868976 }, 1},
+		}},
+		"distance": {reported: "km", imperial: "mi", metric: "km", units: map[string]unit{
+			"km": {"km", func(km float64) float64 { return km }, 1},
+			"mi": {"mi", func(km float64) float64 { return km / 1.609344 }, 1},
+		}},
+	}
+	sensorQuantities = buildSensorQuantities()
+)
+
+/*
+Builds the kind of quantity every convertible sensor reports, including each sensor of the numbered temperature
+series.
+*/
+func buildSensorQuantities() map[string]string {
+	kinds := map[string]string{
+		"tempf": "temperature", "tempinf": "temperature", "feelsLike": "temperature", "feelsLikein": "temperature",
+		"dewPoint": "temperature", "dewPointin": "temperature", "pm_in_temp_aqin": "temperature",
+		"heatIndex": "temperature", "windChill": "temperature",
+
+		"baromrelin": "pressure", "baromabsin": "pressure",
+
+		"eventrainin": "rain", "dailyrainin": "rain", "weeklyrainin": "rain", "monthlyrainin": "rain",
+		"yearlyrainin": "rain", "totalrainin": "rain", "24hourrainin": "rain", "hourlyrainin": "rainRate",
+		"rainToday": "rain", "rain24h": "rain", "rainMonth": "rain", "rainYear": "rain",
+
+		"windspeedmph": "wind", "windgustmph": "wind", "maxdailygust": "wind", "windspdmph_avg2m": "wind",
+		"windspdmph_avg10m": "wind",
+
+		"lightning_distance": "distance",
+	}
+
+	var data DeviceData
+	for _, series := range ambient.NumberedSensors {
+		switch series.Prefix {
+		case "temp", "feelsLike", "dewPoint", "soiltemp":
+			for i := range series.Values(&data) {
+				kinds[series.Name(i+1)] = "temperature"
+			}
+		}
+	}
+	return kinds
+}
+
+/*
+Returns the unit a sensor is written in, from sensorUnits if the sensor has an entry and otherwise the metric unit of
+its quantity when units is metric. Reports false if the sensor is written as the API reports it.
+*/
+func unitFor(sensor string) (unit, bool) {
+	kind, exists := sensorQuantities[sensor]
+	if !exists {
+		return unit{}, false
+	}
+	units := quantities[kind]
+
+	name := units.imperial
+	if config.Units == UNITSMETRIC {
+		name = units.metric
+	}
+	if override, exists := config.SensorUnits[sensor]; exists {
+		name = override
+	}
+	if name == units.reported {
+		return unit{}, false
+	}
+	chosen, exists := units.units[name]
+	return chosen, exists
+}
+
+/*
+Converts a reading of the given sensor to its configured unit. Values of sensors written in the API's units, and
+values that aren't numeric, are returned unchanged.
+*/
+func convertField(sensor string, value interface{}) interface{} {
+	chosen, converted := unitFor(sensor)
+	if !converted {
+		return value
+	}
+	number, ok := ambient.ToFloat(value)
+	if !ok {
+		return value
+	}
+	scale := math.Pow(10, float64(chosen.decimals))
+	return math.Round(chosen.convert(number)*scale) / scale
+}
+
+/*
+Returns the header of a sensor's column with the unit changed to its configured unit. The reported unit following a
+comma in the description is replaced, otherwise the unit is appended in parentheses.
+*/
+func headerText(sensor string, description string) string {
+	chosen, converted := unitFor(sensor)
+	if !converted {
+		return description
+	}
+	units := quantities[sensorQuantities[sensor]]
+	reported := units.units[units.reported].label
+	if strings.Contains(description, ", "+reported) {
+		return strings.Replace(description, ", "+reported, ", "+chosen.label, 1)
+	}
+	return description + " (" + chosen.label + ")"
+}
+
+/*
+Returns the problems with the configured units: an unknown global choice, a sensor that can't be converted, or a unit
+that doesn't exist for the sensor's quantity.
+*/
+func unitProblems(loaded Config) []string {
+	var problems []string
+	if loaded.Units != "" && loaded.Units != UNITSIMPERIAL && loaded.Units != UNITSMETRIC {
+		problems = append(problems, "units must be "+UNITSIMPERIAL+" or "+UNITSMETRIC)
+	}
+	for sensor, name := range loaded.SensorUnits {
+		kind, exists := sensorQuantities[sensor]
+		if !exists {
+			problems = append(problems, "sensorUnits: sensor "+sensor+" has no unit to convert")
+			continue
+		}
+		if _, exists := quantities[kind].units[name]; !exists {
+			var names []string
+			for known := range quantities[kind].units {
+				names = append(names, known)
+			}
+			sort.Strings(names)
+			problems = append(problems, "sensorUnits: "+sensor+" can't be written in "+name+", expected one of "+
+				strings.Join(names, ", "))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
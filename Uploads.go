@@ -0,0 +1,197 @@
+package main
+
+/*
+This file forwards every reading to the personal weather station networks a station is registered with, so the
+program can replace the separate bridges for each. A station uploads to every network whose keys are set in its entry
+of stations:
+  - Weather Underground, with wundergroundId and wundergroundKey from the PWS registered on wunderground.com.
+  - PWSWeather, with pwsweatherId and pwsweatherKey, the station ID and API key from pwsweather.com.
+  - Windy, with windyKey, the API key from stations.windy.com, and windyStation, the station's index on that account.
+
+Each network is a sink of its own, so one network being down doesn't hold back the others, and its uploads are retried
+through the sink's queue. Readings are uploaded in the imperial units the networks expect, whatever units are
+configured, dated with their dateutc so late readings and backfills land at the right time. A network that accepts an
+update at most every few minutes is sent only the readings at least that far apart. Readings no newer than the last
+one uploaded to a network, such as queued readings sent after newer ones, are skipped.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+uploadTarget is a struct that describes a personal weather station network: whether a station uploads to it, the URL
+a reading is sent to, whether the network accepted it, and the shortest time it accepts between updates.
+*/
+type uploadTarget struct {
+	name        string
+	enabled     func(station Station) bool
+	request     func(station Station, data DeviceData) string
+	accepted    func(status int, body string) bool
+	minInterval time.Duration
+}
+
+var (
+	uploadClient = &http.Client{Transport: sharedTransport, Timeout: 15 * time.Second}
+	uploadFields = map[string]string{ //Ambient Weather field to the parameter of the Weather Underground protocol
+		"tempf": "tempf", "humidity": "humidity", "dewPoint": "dewptf", "windspeedmph": "windspeedmph",
+		"windgustmph": "windgustmph", "winddir": "winddir", "baromrelin": "baromin", "hourlyrainin": "rainin",
+		"dailyrainin": "dailyrainin", "weeklyrainin": "weeklyrainin", "monthlyrainin": "monthlyrainin",
+		"solarradiation": "solarradiation", "uv": "UV", "tempinf": "indoortempf", "humidityin": "indoorhumidity",
+		"pm25": "AqPM2.5", "soiltemp1f": "soiltempf", "soilhum1": "soilmoisture",
+	}
+	uploadedMutex sync.Mutex
+	lastUploaded  = make(map[string]int64) //dateutc of the last reading uploaded, by target and station MAC Address
+
+	wunderground = uploadTarget{
+		name:    "Weather Underground",
+		enabled: func(station Station) bool { return station.WUID != "" },
+		request: func(station Station, data DeviceData) string {
+			query := uploadQuery(data)
+			query.Set("ID", station.WUID)
+			query.Set("PASSWORD", station.WUKey)
+			query.Set("action", "updateraw")
+			return "https://weatherstation.wunderground.com/weatherstation/updateweatherstation.php?" + query.Encode()
+		},
+		accepted: func(status int, body string) bool {
+			return status == http.StatusOK && strings.HasPrefix(body, "success")
+		},
+	}
+	pwsweather = uploadTarget{
+		name:    "PWSWeather",
+		enabled: func(station Station) bool { return station.PWSID != "" },
+		request: func(station Station, data DeviceData) string {
+			query := uploadQuery(data)
+			query.Set("ID", station.PWSID)
+			query.Set("PASSWORD", station.PWSKey)
+			return "https://pwsupdate.pwsweather.com/api/v1/submitwx?" + query.Encode()
+		},
+		accepted: func(status int, body string) bool {
+			return status == http.StatusOK && !strings.Contains(strings.ToLower(body), "error")
+		},
+	}
+	windy = uploadTarget{
+		name:    "Windy",
+		enabled: func(station Station) bool { return station.WindyKey != "" },
+		request: func(station Station, data DeviceData) string {
+			query := uploadQuery(data)
+			query.Set("station", strconv.Itoa(station.WindyStation))
+			return "https://stations.windy.com/pws/update/" + url.PathEscape(station.WindyKey) + "?" + query.Encode()
+		},
+		accepted: func(status int, _ string) bool {
+			return status == http.StatusOK
+		},
+		minInterval: 5 * time.Minute,
+	}
+)
+
+/*
+Uploads each of a station's readings to Weather Underground, oldest first.
+*/
+func uploadWunderground(ctx context.Context, station Station, readings []DeviceData) error {
+	return uploadReadings(ctx, wunderground, station, readings)
+}
+
+/*
+Uploads each of a station's readings to PWSWeather, oldest first.
+*/
+func uploadPWSWeather(ctx context.Context, station Station, readings []DeviceData) error {
+	return uploadReadings(ctx, pwsweather, station, readings)
+}
+
+/*
+Uploads each of a station's readings to Windy, oldest first.
+*/
+func uploadWindy(ctx context.Context, station Station, readings []DeviceData) error {
+	return uploadReadings(ctx, windy, station, readings)
+}
+
+/*
+Uploads each of a station's readings to a network, oldest first, skipping readings at or before the last one uploaded
+and those closer to it than the network accepts. Returns an error unless every reading was accepted, and nil for
+stations that don't upload to the network. A reading the network rejects is skipped, and the first rejection is
+returned once the other readings are uploaded.
+*/
+func uploadReadings(ctx context.Context, target uploadTarget, station Station, readings []DeviceData) error {
+	if !target.enabled(station) || len(readings) == 0 {
+		return nil
+	}
+	key := target.name + " " + station.MacAddress
+
+	uploaded := 0
+	var rejected error //First reading the network rejected, the other readings are still uploaded
+	for _, data := range readings {
+		uploadedMutex.Lock()
+		last := lastUploaded[key]
+		uploadedMutex.Unlock()
+		if data.DateUTC <= last || data.DateUTC-last < target.minInterval.Milliseconds() {
+			continue
+		}
+
+		if err := postUpload(ctx, target, target.request(station, data)); err != nil {
+			err = fmt.Errorf("unable to upload the reading to %s: %w", target.name, err)
+			if !isRejected(err) {
+				return err
+			} else if rejected == nil {
+				rejected = err
+			}
+			continue
+		}
+		uploadedMutex.Lock()
+		lastUploaded[key] = max(last, data.DateUTC)
+		uploadedMutex.Unlock()
+		uploaded++
+	}
+	slog.InfoContext(ctx, "Uploaded "+strconv.Itoa(uploaded)+" readings to "+target.name, "station",
+		station.displayName())
+	return rejected
+}
+
+/*
+Returns the query parameters of the Weather Underground protocol for a reading, which PWSWeather and Windy share: the
+time and every field the protocol knows, in the units the API reports.
+*/
+func uploadQuery(data DeviceData) url.Values {
+	query := url.Values{
+		"dateutc":      {time.UnixMilli(data.DateUTC).UTC().Format("2006-01-02 15:04:05")},
+		"softwaretype": {"GoAmbient " + version},
+	}
+	for field, parameter := range uploadFields {
+		if value, ok := ambient.ToFloat(data.Fields[field]); ok {
+			query.Set(parameter, strconv.FormatFloat(value, 'f', -1, 64))
+		}
+	}
+	return query
+}
+
+/*
+Sends a reading to a network's upload URL and returns an error unless the network accepted it.
+*/
+func postUpload(ctx context.Context, target uploadTarget, uploadURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uploadURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	message := strings.TrimSpace(string(body))
+	if !target.accepted(resp.StatusCode, message) {
+		return rejectStatus(resp.StatusCode, errors.New(target.name+" answered "+resp.Status+": "+message))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+/*
+This file sets the headers sent with every request to the Ambient Weather API. Each request identifies the program and
+its version with a User-Agent so the traffic can be told apart from other clients of the API, and any extra headers
+set as requestHeaders in the config are added, for requirements the API may introduce later. The version is set when
+building with -ldflags "-X main.version=1.2.3".
+*/
+import (
+	"net/http"
+	"runtime"
+)
+
+var (
+	version = "dev"
+)
+
+/*
+Returns the User-Agent sent to the Ambient Weather API, e.g. GoAmbient/1.2.3 (linux; go1.23.0).
+*/
+func userAgent() string {
+	return "GoAmbient/" + version + " (" + runtime.GOOS + "; " + runtime.Version() + ")"
+}
+
+/*
+Returns the headers sent with every request to the Ambient Weather API: the User-Agent followed by the configured
+extra headers, which may replace the User-Agent.
+*/
+func requestHeaders() http.Header {
+	header := http.Header{}
+	header.Set("User-Agent", userAgent())
+	for name, value := range config.RequestHeaders {
+		header.Set(name, value)
+	}
+	return header
+}
+
+/*
+Adds the headers from requestHeaders to a request.
+*/
+func applyRequestHeaders(req *http.Request) {
+	for name, values := range requestHeaders() {
+		req.Header[name] = values
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+/*
+This file implements the validate subcommand, which checks the config file, the headers mapping, and the Google
+credentials before the program is started as a daemon. Every problem found is logged, so a broken deployment can be
+fixed in one pass instead of one crash at a time.
+*/
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ryanwlin/GoAmbient/ambient"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Runs every validation check and returns the exit code for the program, 0 if the configuration is valid and 1 if any
+problem was found.
+*/
+func runValidate(path string, profileName string) int {
+	var problems []error
+
+	loaded, err := loadConfig(path, profileName)
+	if err != nil {
+		problems = append(problems, err)
+	} else {
+		applyConfig(loaded)
+		problems = append(problems, validateConfig(loaded)...)
+		problems = append(problems, validateHeaders(loaded.HeadersFile)...)
+		if loaded.SpreadsheetID != "" || loaded.BigQueryDataset != "" { //Both use the Google credentials
+			problems = append(problems, validateCredentials(loaded.CredentialsFile, loaded.TokenFile)...)
+		}
+	}
+
+	for _, problem := range problems {
+		slog.Error("Validation failed: " + problem.Error())
+	}
+	if len(problems) > 0 {
+		slog.Error(fmt.Sprintf("Found %d configuration problem(s)", len(problems)))
+		return 1
+	}
+
+	slog.Info("Configuration is valid")
+	return 0
+}
+
+/*
+Checks that the keys and spreadsheet are set, that at least one station is configured, and that every station has a
+unique name and a well formed 6 byte MAC Address.
+*/
+func validateConfig(loaded Config) []error {
+	var problems []error
+
+	if loaded.APIKey == "" {
+		problems = append(problems, errors.New("apiKey is missing"))
+	}
+	if loaded.ApplicationKey == "" {
+		problems = append(problems, errors.New("applicationKey is missing"))
+	}
+	if loaded.SecondaryAPIKey != "" && loaded.SecondaryAPIKey == loaded.APIKey {
+		problems = append(problems, errors.New("secondaryApiKey must differ from apiKey"))
+	}
+	if len(enabledSinks(loaded)) == 0 {
+		problems = append(problems, errors.New("spreadsheetId is missing and no other output is set"))
+	}
+	if loaded.InfluxURL != "" && (loaded.InfluxOrg == "" || loaded.InfluxBucket == "" || loaded.InfluxToken == "") {
+		problems = append(problems, errors.New("influxUrl needs influxOrg, influxBucket, and influxToken"))
+	}
+	if loaded.MQTTBroker != "" && (loaded.MQTTPrefix == "" || loaded.DiscoveryPrefix == "") {
+		problems = append(problems, errors.New("mqttTopicPrefix and haDiscoveryPrefix must not be empty"))
+	}
+	if loaded.BigQueryDataset != "" && (loaded.BigQueryProject == "" || loaded.BigQueryTable == "") {
+		problems = append(problems, errors.New("bigqueryDataset needs bigqueryProject and bigqueryTable"))
+	}
+	if loaded.ParquetURL != "" && loaded.ParquetInterval < 1 {
+		problems = append(problems, errors.New("parquetFlushMinutes must be at least 1"))
+	}
+	if loaded.HealthListen != "" && loaded.HealthMaxAge < 1 {
+		problems = append(problems, errors.New("healthMaxAgeMinutes must be at least 1"))
+	}
+	if loaded.APIListen != "" && loaded.HistorySize < 1 {
+		problems = append(problems, errors.New("apiHistorySize must be at least 1"))
+	}
+	if _, err := parseMetricPath(loaded.MetricPath); err != nil {
+		problems = append(problems, fmt.Errorf("metricPath is invalid: %w", err))
+	}
+	if parsed, err := url.Parse(loaded.HeartbeatURL); loaded.HeartbeatURL != "" && (err != nil ||
+		(parsed.Scheme != "http" && parsed.Scheme != "https")) {
+		problems = append(problems, errors.New("heartbeatUrl must be an http or https URL"))
+	}
+	for _, webhookURL := range loaded.Webhooks {
+		if parsed, err := url.Parse(webhookURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			problems = append(problems, errors.New("webhookUrls must only hold http or https URLs, found "+webhookURL))
+		}
+	}
+	if len(loaded.KafkaBrokers) > 0 && loaded.KafkaTopic == "" {
+		problems = append(problems, errors.New("kafkaTopic must not be empty"))
+	}
+	if loaded.NATSURL != "" && loaded.NATSSubject == "" {
+		problems = append(problems, errors.New("natsSubject must not be empty"))
+	}
+	if loaded.HAURL != "" && loaded.HAToken == "" {
+		problems = append(problems, errors.New("homeAssistantUrl needs homeAssistantToken"))
+	}
+	if loaded.Timescale && loaded.PostgresURL == "" {
+		problems = append(problems, errors.New("timescaleDb needs postgresUrl"))
+	}
+	if loaded.SheetsPerMinute < 1 {
+		problems = append(problems, errors.New("sheetsRequestsPerMinute must be at least 1"))
+	}
+	if loaded.ValueInput != VALUEINPUTRAW && loaded.ValueInput != VALUEINPUTUSERENTERED {
+		problems = append(problems, errors.New("valueInputOption must be "+VALUEINPUTRAW+" or "+VALUEINPUTUSERENTERED))
+	}
+	for _, id := range loaded.ExtraSheetIDs {
+		if id == "" || id == loaded.SpreadsheetID {
+			problems = append(problems, errors.New("extraSpreadsheetIds must not be empty or repeat spreadsheetId"))
+			break
+		}
+	}
+	for _, email := range loaded.ShareWith {
+		if !strings.Contains(email, "@") {
+			problems = append(problems, errors.New("shareWith must only hold email addresses, found "+email))
+		}
+	}
+	if (loaded.DriveFolder != "" || len(loaded.ShareWith) > 0) && !loaded.YearlySheets {
+		problems = append(problems, errors.New("driveFolderId and shareWith need yearlySpreadsheets"))
+	}
+	if loaded.RequestTimeout <= 0 {
+		problems = append(problems, errors.New("requestTimeoutSeconds must be greater than 0"))
+	}
+	if loaded.MaxRetryTime < loaded.RequestTimeout {
+		problems = append(problems, errors.New("maxRetrySeconds must be at least requestTimeoutSeconds"))
+	}
+	if loaded.ReadingsPerPoll < 1 || loaded.ReadingsPerPoll > ambient.MAXLIMIT {
+		problems = append(problems, fmt.Errorf("readingsPerPoll must be between 1 and %d", ambient.MAXLIMIT))
+	}
+	if _, err := proxyFunc(loaded.Proxy); err != nil {
+		problems = append(problems, fmt.Errorf("proxy is invalid: %w", err))
+	}
+	if loaded.RecordDays < 0 {
+		problems = append(problems, errors.New("recordDays must not be negative"))
+	}
+	for name := range loaded.RequestHeaders {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			problems = append(problems, fmt.Errorf("requestHeaders has an invalid header name %q", name))
+		}
+	}
+	if _, err := tlsConfig(loaded.CAFile, loaded.TLSMinVersion); err != nil {
+		problems = append(problems, fmt.Errorf("TLS settings are invalid: %w", err))
+	}
+	if loaded.AlertURL != "" {
+		parsed, err := url.Parse(loaded.AlertURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			problems = append(problems, errors.New("alertUrl must be an http or https URL"))
+		}
+	}
+	if loaded.StalePolls < 0 {
+		problems = append(problems, errors.New("stalePolls must not be negative, 0 disables stale station alerts"))
+	}
+	if _, err := time.LoadLocation(loaded.Timezone); err != nil {
+		problems = append(problems, fmt.Errorf("timezone is invalid: %w", err))
+	}
+	if schedule, err := parseCron(loaded.Schedule); err != nil {
+		problems = append(problems, fmt.Errorf("schedule is invalid: %w", err))
+	} else if _, matches := schedule.next(time.Now()); !matches {
+		problems = append(problems, errors.New("schedule never matches a day"))
+	}
+	if loaded.Jitter < 0 || loaded.Jitter >= 300 {
+		problems = append(problems, errors.New("jitterSeconds must be from 0 to 299, within the 5 minute reports"))
+	}
+	if loaded.QueryMode != QUERYHISTORY && loaded.QueryMode != QUERYLASTDATA {
+		problems = append(problems, errors.New("queryMode must be "+QUERYHISTORY+" or "+QUERYLASTDATA))
+	}
+	for _, problem := range routeProblems(loaded) {
+		problems = append(problems, errors.New(problem))
+	}
+	for _, problem := range sinkProblems(loaded) {
+		problems = append(problems, errors.New(problem))
+	}
+	for _, problem := range unitProblems(loaded) {
+		problems = append(problems, errors.New(problem))
+	}
+	switch loaded.SheetRotation {
+	case ROTATIONYEARLY, ROTATIONMONTHLY, ROTATIONWEEKLY:
+	default:
+		problems = append(problems,
+			errors.New("sheetRotation must be "+ROTATIONYEARLY+", "+ROTATIONMONTHLY+", or "+ROTATIONWEEKLY))
+	}
+	if _, err := parseSheetName(loaded.SheetName); err != nil {
+		problems = append(problems, fmt.Errorf("sheetName is invalid: %w", err))
+	}
+	if loaded.CompactHourly < 0 || loaded.CompactDaily < 0 {
+		problems = append(problems, errors.New("compactHourlyDays and compactDailyDays must not be negative"))
+	}
+	if loaded.CompactDaily > 0 && loaded.CompactDaily <= loaded.CompactHourly || loaded.CompactDaily > 0 &&
+		loaded.CompactHourly == 0 {
+		problems = append(problems, errors.New("compactDailyDays needs compactHourlyDays, and must be greater"))
+	}
+	if loaded.CompactHourly > 0 && loaded.SQLiteFile == "" && loaded.PostgresURL == "" {
+		problems = append(problems, errors.New("compactHourlyDays needs sqliteFile or postgresUrl"))
+	}
+	if loaded.RetentionYears < 0 {
+		problems = append(problems, errors.New("retentionYears must not be negative, 0 keeps every sheet"))
+	}
+	if loaded.RetentionAction != RETENTIONHIDE && loaded.RetentionAction != RETENTIONDELETE {
+		problems = append(problems, errors.New("retentionAction must be "+RETENTIONHIDE+" or "+RETENTIONDELETE))
+	}
+	for _, problem := range dayEndProblems(loaded.EndOfDayStats) {
+		problems = append(problems, errors.New(problem))
+	}
+	for _, problem := range formatRuleProblems(loaded.FormatRules) {
+		problems = append(problems, errors.New(problem))
+	}
+	for _, problem := range soilProbeProblems(loaded.SoilProbes) {
+		problems = append(problems, errors.New(problem))
+	}
+	switch loaded.QualityAction {
+	case QUALITYDROP, QUALITYFLAG, QUALITYOFF:
+	default:
+		problems = append(problems,
+			errors.New("qualityAction must be "+QUALITYDROP+", "+QUALITYFLAG+", or "+QUALITYOFF))
+	}
+	for name, limit := range loaded.SpikeLimits {
+		if limit < 0 {
+			problems = append(problems, fmt.Errorf("spikeLimits: limit for %s must not be negative", name))
+		}
+	}
+	if loaded.RainYearStart < 1 || loaded.RainYearStart > 12 {
+		problems = append(problems, errors.New("rainYearStartMonth must be between 1 and 12"))
+	}
+	if loaded.BreakerFailures < 1 {
+		problems = append(problems, errors.New("circuitBreakerFailures must be at least 1"))
+	}
+	if len(loaded.Stations) == 0 {
+		slog.Warn("No station configured, the station will be discovered from the account at startup")
+	}
+
+	names := make(map[string]bool)
+	for _, station := range loaded.Stations {
+		if err := validateMacAddress(station.MacAddress); err != nil {
+			problems = append(problems, err)
+		}
+		if names[station.displayName()] {
+			problems = append(problems, fmt.Errorf("station %q is configured more than once", station.displayName()))
+		}
+		names[station.displayName()] = true
+		if (station.WUID == "") != (station.WUKey == "") {
+			problems = append(problems, fmt.Errorf("station %q needs both wundergroundId and wundergroundKey",
+				station.displayName()))
+		}
+		if (station.PWSID == "") != (station.PWSKey == "") {
+			problems = append(problems, fmt.Errorf("station %q needs both pwsweatherId and pwsweatherKey",
+				station.displayName()))
+		}
+		if _, err := parseCron(station.Schedule); station.Schedule != "" && err != nil {
+			problems = append(problems, fmt.Errorf("station %q has an invalid schedule: %w", station.displayName(),
+				err))
+		}
+		if station.WindyStation < 0 {
+			problems = append(problems, fmt.Errorf("station %q has a negative windyStation", station.displayName()))
+		}
+	}
+
+	return problems
+}
+
+/*
+Returns an error if the given string is not a MAC Address in the colon separated form used by Ambient Weather, e.g.
+00:0E:C6:20:0F:7B.
+*/
+func validateMacAddress(macAddress string) error {
+	hardwareAddr, err := net.ParseMAC(macAddress)
+	if err != nil || len(hardwareAddr) != 6 {
+		return fmt.Errorf("macAddress %q is not a valid MAC Address (expected the form 00:0E:C6:20:0F:7B)",
+			macAddress)
+	}
+	return nil
+}
+
+/*
+Parses the headers mapping and checks that every column ID is made of capital letters, that no two sensors share a
+column, that the columns leave no gaps (buildRow sizes each row by the mapped columns), and that every sensor name
+is documented by the Ambient Weather API.
+*/
+func validateHeaders(path string) []error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("unable to read %s: %w", path, err)}
+	}
+
+	sensors, err := parseSensors(data)
+	if err != nil {
+		return []error{fmt.Errorf("%s: %w", path, err)}
+	}
+
+	return checkSensors(sensors, path)
+}
+
+/*
+Checks a parsed sensor mapping for invalid, duplicated, or out of range column IDs and for sensor names that are
+neither documented by the API, derived by the program, nor discovered in a reading.
+*/
+func checkSensors(sensors map[string]SensorInfo, path string) []error {
+	var problems []error
+
+	names := make([]string, 0, len(sensors))
+	for name := range sensors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	columns := make(map[string]string)
+	for _, name := range names {
+		sensor := sensors[name]
+		if !isColumnID(sensor.ID) {
+			problems = append(problems, fmt.Errorf("%s: sensor %q has invalid column ID %q", path, name, sensor.ID))
+			continue
+		}
+		if other, exists := columns[sensor.ID]; exists {
+			problems = append(problems, fmt.Errorf("%s: sensors %q and %q both map to column %s",
+				path, other, name, sensor.ID))
+		}
+		columns[sensor.ID] = name
+
+		if stringToNum(sensor.ID) >= len(sensors) {
+			problems = append(problems, fmt.Errorf("%s: column %s for sensor %q is beyond the %d mapped columns, "+
+				"column IDs must be contiguous starting at A", path, sensor.ID, name, len(sensors)))
+		}
+		discovered := strings.HasSuffix(sensor.Description, DISCOVEREDSUFFIX)
+		if !ambient.DocumentedSensors[name] && !derivedSensors[name] && !discovered {
+			problems = append(problems, fmt.Errorf("%s: unknown sensor %q is not reported by the Ambient Weather API",
+				path, name))
+		}
+	}
+
+	return problems
+}
+
+/*
+Reports whether the given string is a spreadsheet column ID made only of capital letters, e.g. A or BQ.
+*/
+func isColumnID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, letter := range id {
+		if letter < 'A' || letter > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Checks that the credentials file is either a service account key or an OAuth client secret, and that an existing token
+file can be parsed. A missing credentials file is not an error since Application Default Credentials are used instead.
+*/
+func validateCredentials(credentialsPath string, tokenPath string) []error {
+	var problems []error
+
+	credential, err := os.ReadFile(credentialsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Warn("No " + credentialsPath + " found, Application Default Credentials will be used")
+		return nil
+	}
+	if err != nil {
+		return []error{fmt.Errorf("unable to read %s: %w", credentialsPath, err)}
+	}
+
+	var keyFile struct {
+		Type      string          `json:"type"`
+		Installed json.RawMessage `json:"installed"`
+		Web       json.RawMessage `json:"web"`
+	}
+	if err := json.Unmarshal(credential, &keyFile); err != nil {
+		return []error{fmt.Errorf("unable to parse %s: %w", credentialsPath, err)}
+	}
+
+	switch {
+	case keyFile.Type == "service_account":
+	case keyFile.Installed != nil || keyFile.Web != nil:
+		if _, err := tokenFromFile(tokenPath); errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, fmt.Errorf("%s not found, run the setup command to authorize", tokenPath))
+		} else if err != nil {
+			problems = append(problems, fmt.Errorf("unable to parse %s: %w", tokenPath, err))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("%s is neither a service account key nor an OAuth client secret",
+			credentialsPath))
+	}
+
+	return problems
+}
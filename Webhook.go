@@ -0,0 +1,150 @@
+package main
+
+/*
+This file POSTs every reading as JSON to each URL in webhookUrls, so any downstream service can receive the readings
+without changes to the program. The body holds the station's MAC Address and name, dateutc, the observation time, and
+every field of the reading in its configured unit. With webhookSecret set each request is signed: X-GoAmbient-Timestamp
+holds the Unix time the request was sent, and X-GoAmbient-Signature holds sha256= followed by the hex HMAC-SHA256 of the
+timestamp, a dot, and the body, keyed with the secret, so a receiver can check the request came from the program and
+reject replays. A request that fails or isn't answered with a 2xx status is retried twice, after 5 and 10 seconds.
+*/
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	WEBHOOKATTEMPTS = 3
+)
+
+var (
+	webhookClient = &http.Client{Transport: sharedTransport, Timeout: 15 * time.Second}
+)
+
+/*
+webhookReading is a struct that holds the JSON body POSTed to the webhooks for a reading.
+*/
+type webhookReading struct {
+	Station  string                 `json:"station"`
+	Name     string                 `json:"name"`
+	DateUTC  int64                  `json:"dateutc"`
+	Observed time.Time              `json:"observed"`
+	Fields   map[string]interface{} `json:"fields"`
+}
+
+/*
+POSTs each of a station's readings to every configured webhook, oldest first. Returns an error unless every webhook
+accepted every reading, and nil when no webhooks are configured. A reading a webhook rejects is skipped, and the first
+rejection is returned once the other readings are posted.
+*/
+func postWebhooks(ctx context.Context, station Station, readings []DeviceData) error {
+	if len(config.Webhooks) == 0 || len(readings) == 0 {
+		return nil
+	}
+
+	var rejected error //First reading a webhook rejected, the other readings are still posted
+	for _, data := range readings {
+		body, err := json.Marshal(webhookBody(station, data))
+		if err != nil {
+			return fmt.Errorf("unable to encode the reading for the webhooks: %w", err)
+		}
+		for _, webhookURL := range config.Webhooks {
+			if err := postWebhookWithRetry(ctx, webhookURL, body); err != nil {
+				if !isRejected(err) {
+					return err
+				} else if rejected == nil {
+					rejected = err
+				}
+			}
+		}
+	}
+	slog.InfoContext(ctx, "Posted "+strconv.Itoa(len(readings))+" readings to the webhooks", "station",
+		station.displayName(), "webhooks", len(config.Webhooks))
+	return rejected
+}
+
+/*
+Returns the webhook body of a reading, with every field converted to its configured unit.
+*/
+func webhookBody(station Station, data DeviceData) webhookReading {
+	fields := make(map[string]interface{}, len(data.Fields))
+	for name, value := range data.Fields {
+		if !undiscoveredFields[name] {
+			fields[name] = cellValue(convertField(name, value))
+		}
+	}
+	return webhookReading{Station: station.MacAddress, Name: station.displayName(), DateUTC: data.DateUTC,
+		Observed: data.Time(), Fields: fields}
+}
+
+/*
+POSTs a body to a webhook, retrying a failed request with a growing wait unless the webhook rejected it for good.
+Returns the last error once every attempt failed or the context is cancelled.
+*/
+func postWebhookWithRetry(ctx context.Context, webhookURL string, body []byte) error {
+	var err error
+	for attempt := 1; attempt <= WEBHOOKATTEMPTS; attempt++ {
+		err = postWebhook(ctx, webhookURL, body)
+		var rejected rejectedError
+		if err == nil || errors.As(err, &rejected) {
+			return err
+		}
+		slog.WarnContext(ctx, "Unable to post to the webhook, attempt "+strconv.Itoa(attempt), "url", webhookURL,
+			"err", err)
+		if attempt < WEBHOOKATTEMPTS && !sleepContext(ctx, time.Duration(attempt)*5*time.Second) {
+			break
+		}
+	}
+	slog.ErrorContext(ctx, "Giving up on posting to the webhook", "url", webhookURL)
+	return err
+}
+
+/*
+POSTs a body to a webhook, signed if a secret is configured, and returns an error if the request fails or isn't
+accepted.
+*/
+func postWebhook(ctx context.Context, webhookURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+	if config.WebhookSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-GoAmbient-Timestamp", timestamp)
+		req.Header.Set("X-GoAmbient-Signature", "sha256="+webhookSignature(config.WebhookSecret, timestamp, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) //Lets the connection be reused
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return rejectStatus(resp.StatusCode, errors.New("webhook answered "+resp.Status))
+	}
+	return nil
+}
+
+/*
+Returns the hex HMAC-SHA256 of a timestamp, a dot, and a body, keyed with the secret.
+*/
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
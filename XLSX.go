@@ -0,0 +1,236 @@
+package main
+
+/*
+This file writes the readings to a local Excel workbook when xlsxFile is set in the config. The workbook holds one sheet
+per year, named after the year and, with several stations, the station, with the same header row and columns as the
+Google Sheet. Readings whose dateutc is already in a sheet are skipped, so restarts and backfills add no duplicate rows.
+The workbook is read once, the first time it is written, and kept in memory with the dateutc of every row of each sheet,
+so later writes only add the new rows. It is saved to a temporary file that then replaces the workbook, so a crash while
+saving never leaves a corrupt workbook. Set spreadsheetId to an empty string to write only the workbook, in which case
+no Google credentials are needed.
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xuri/excelize/v2"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	XLSXSHEETLENGTH = 31 //Longest sheet name Excel allows
+)
+
+var (
+	xlsxMutex        sync.Mutex
+	xlsxInvalidChars = strings.NewReplacer("[", "(", "]", ")", ":", "-", "*", "-", "?", "", "/", "-", "\\", "-")
+	xlsxBook         *excelize.File
+	xlsxSheets       = make(map[string]*xlsxSheet) //Rows of each sheet of the open workbook, by name
+)
+
+/*
+xlsxSheet is a struct that holds the dateutc of every row of a sheet of the workbook and the row the next reading is
+written to.
+*/
+type xlsxSheet struct {
+	written map[string]bool
+	next    int
+}
+
+/*
+Writes the readings of a station to their year's sheet of the workbook, opening or creating the workbook and the
+sheet if needed, and saves the workbook. Returns an error unless every reading is in the workbook, and nil when no
+workbook is configured.
+*/
+func writeXLSX(ctx context.Context, station Station, readings []DeviceData) error {
+	if config.XLSXFile == "" || len(readings) == 0 {
+		return nil
+	}
+	xlsxMutex.Lock()
+	defer xlsxMutex.Unlock()
+
+	created := false
+	if xlsxBook == nil {
+		book, err := excelize.OpenFile(config.XLSXFile)
+		created = errors.Is(err, os.ErrNotExist)
+		if created {
+			book, err = excelize.NewFile(), nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to open the workbook %s: %w", config.XLSXFile, err)
+		}
+		xlsxBook = book
+		xlsxSheets = make(map[string]*xlsxSheet)
+	}
+	defaultSheets := xlsxBook.GetSheetList()
+
+	groups := make(map[string][]DeviceData)
+	var names []string
+	for _, data := range readings {
+		name := xlsxSheetName(station, data.Time().Year())
+		if _, exists := groups[name]; !exists {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], data)
+	}
+	written := 0
+	for _, name := range names {
+		added, err := appendXLSXRows(xlsxBook, name, groups[name])
+		if err != nil {
+			closeXLSX() //Read the workbook again on the next write
+			return fmt.Errorf("unable to write the readings to the %s sheet of the workbook: %w", name, err)
+		}
+		written += added
+	}
+	if created {
+		for _, name := range defaultSheets { //The empty sheet every new workbook starts with
+			if err := xlsxBook.DeleteSheet(name); err != nil {
+				slog.WarnContext(ctx, "Unable to remove the default sheet from the workbook", "sheet", name, "err", err)
+			}
+		}
+	}
+
+	if err := saveXLSX(xlsxBook); err != nil {
+		return fmt.Errorf("unable to save the workbook %s: %w", config.XLSXFile, err)
+	}
+	slog.InfoContext(ctx, "Wrote "+strconv.Itoa(written)+" rows to the workbook", "file", config.XLSXFile,
+		"station", station.displayName())
+	return nil
+}
+
+/*
+Saves the workbook to a temporary file next to it and then replaces the workbook with it.
+*/
+func saveXLSX(book *excelize.File) error {
+	temporary := config.XLSXFile + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	err = book.Write(file)
+	if syncErr := file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temporary, config.XLSXFile)
+	}
+	if err != nil {
+		_ = os.Remove(temporary)
+	}
+	return err
+}
+
+/*
+Closes the open workbook, so it is read again from the file the next time it is written.
+*/
+func closeXLSX() {
+	if xlsxBook != nil {
+		_ = xlsxBook.Close()
+		xlsxBook = nil
+	}
+	xlsxSheets = make(map[string]*xlsxSheet)
+}
+
+/*
+Appends the rows of readings to a sheet of the workbook, creating the sheet if it doesn't exist and bringing its header
+row up to date with the mapped sensors. The sheet's rows are only read the first time it is written. Readings whose
+dateutc is already in the sheet are skipped. Returns the number of rows appended.
+*/
+func appendXLSXRows(book *excelize.File, name string, readings []DeviceData) (int, error) {
+	if index, err := book.GetSheetIndex(name); err != nil || index < 0 {
+		if _, err := book.NewSheet(name); err != nil {
+			return 0, err
+		}
+		if err := formatXLSXSheet(book, name); err != nil {
+			return 0, err
+		}
+	}
+	headers := sensorHeaders()
+	if err := book.SetSheetRow(name, "A1", &headers); err != nil {
+		return 0, err
+	}
+
+	sheet, loaded := xlsxSheets[name]
+	if !loaded {
+		rows, err := book.GetRows(name, excelize.Options{RawCellValue: true})
+		if err != nil {
+			return 0, err
+		}
+		sheet = &xlsxSheet{written: make(map[string]bool, len(rows)), next: max(len(rows), 1) + 1}
+		if sensor, indexed := allSensors["dateutc"]; indexed {
+			column := stringToNum(sensor.ID)
+			for _, row := range rows {
+				if column < len(row) {
+					sheet.written[row[column]] = true
+				}
+			}
+		}
+		xlsxSheets[name] = sheet
+	}
+
+	_, indexed := allSensors["dateutc"]
+	first := sheet.next //Below the header row and any rows already written
+	for _, data := range readings {
+		dateUTC := strconv.FormatInt(data.DateUTC, 10)
+		if indexed && data.DateUTC > 0 && sheet.written[dateUTC] {
+			continue
+		}
+		cell, err := excelize.CoordinatesToCellName(1, sheet.next)
+		if err != nil {
+			return 0, err
+		}
+		row := buildRow(data)
+		if err := book.SetSheetRow(name, cell, &row); err != nil {
+			return 0, err
+		}
+		sheet.written[dateUTC] = true
+		sheet.next++
+	}
+	return sheet.next - first, nil
+}
+
+/*
+Freezes the header row of a new sheet and shows its date columns as date-times, which buildRow writes as the same
+serial numbers Excel uses.
+*/
+func formatXLSXSheet(book *excelize.File, name string) error {
+	if err := book.SetPanes(name, &excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2",
+		ActivePane: "bottomLeft"}); err != nil {
+		return err
+	}
+	pattern := ROWTIMEPATTERN
+	style, err := book.NewStyle(&excelize.Style{CustomNumFmt: &pattern})
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{"date", "lightning_time"} {
+		if sensor, exists := allSensors[field]; exists {
+			if err := book.SetColStyle(name, sensor.ID, style); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Returns the name of a station's sheet for a year, replacing the characters Excel doesn't allow in sheet names and
+cutting it to the longest name Excel allows.
+*/
+func xlsxSheetName(station Station, year int) string {
+	name := strconv.Itoa(year)
+	if len(config.Stations) > 1 {
+		name += " " + xlsxInvalidChars.Replace(station.displayName())
+	}
+	if runes := []rune(name); len(runes) > XLSXSHEETLENGTH {
+		name = string(runes[:XLSXSHEETLENGTH])
+	}
+	return name
+}
@@ -0,0 +1,150 @@
+package main
+
+/*
+This file gives every year its own spreadsheet instead of a new tab in one ever growing spreadsheet, when
+yearlySpreadsheets is enabled. The first reading of a year creates a spreadsheet named e.g. "Weather 2026" through the
+Drive API, in the Drive folder given by driveFolderId or else in the root of the account's Drive, shares it with the
+accounts in shareWith, and adds a row linking to it on the Spreadsheets sheet of the spreadsheet in spreadsheetId,
+which acts as the index of the years. The index is read back at startup, so each year's spreadsheet is only created
+once. The station sheets of a year go to its spreadsheet, while the Daily Summary and the other sheets stay in
+spreadsheetId. Creating files needs the drive.file scope, so an OAuth token saved before the option was enabled must
+be deleted to grant it.
+*/
+import (
+	"context"
+	"fmt"
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/drive/v3"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+const (
+	INDEXSHEET      = "Spreadsheets"
+	SPREADSHEETMIME = "application/vnd.google-apps.spreadsheet"
+	SHAREROLE       = "writer"
+)
+
+var (
+	driveService       *drive.Service = nil
+	yearlySpreadsheets                = make(map[int]string) //Spreadsheet ID of each year
+	yearlyIndexRead                   = false
+	yearlyMutex        sync.Mutex
+	indexHeaders       = []interface{}{"Year", "Spreadsheet ID", "Link"}
+)
+
+/*
+Returns the scopes the program asks Google for, adding the drive.file scope when yearly spreadsheets are created and
+the BigQuery scope when readings are inserted into BigQuery.
+*/
+func googleScopes() []string {
+	scopes := []string{SHEETSSCOPE}
+	if config.YearlySheets {
+		scopes = append(scopes, drive.DriveFileScope)
+	}
+	if config.BigQueryDataset != "" {
+		scopes = append(scopes, bigquery.BigqueryScope)
+	}
+	return scopes
+}
+
+/*
+Returns a context whose Sheets calls go to the spreadsheet of the given year, creating it if create is set and it
+doesn't exist yet. Contexts for any spreadsheet but spreadsheetId, and every context when yearly spreadsheets are off,
+are returned unchanged. Reports false if the year's spreadsheet doesn't exist and can't be created.
+*/
+func yearlyContext(ctx context.Context, year int, create bool) (context.Context, bool) {
+	if !config.YearlySheets || spreadsheetFor(ctx) != spreadsheetId {
+		return ctx, true
+	}
+	yearlyMutex.Lock()
+	defer yearlyMutex.Unlock()
+
+	if !yearlyIndexRead {
+		yearlyIndexRead = readSpreadsheetIndex(ctx)
+	}
+	if id, exists := yearlySpreadsheets[year]; exists {
+		return withSpreadsheet(ctx, id), true
+	}
+	if !create {
+		return ctx, false
+	}
+
+	id, err := createYearlySpreadsheet(ctx, year)
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to create the spreadsheet for "+strconv.Itoa(year), "err", err)
+		return ctx, false
+	}
+	yearlySpreadsheets[year] = id
+	return withSpreadsheet(ctx, id), true
+}
+
+/*
+Reads the year and spreadsheet ID of every row of the index sheet. Reports false if the index can't be read, an index
+that doesn't exist yet is read as empty.
+*/
+func readSpreadsheetIndex(ctx context.Context) bool {
+	if !sheetExists(ctx, INDEXSHEET, indexHeaders, 1) {
+		return false
+	}
+	resp, err := service.Spreadsheets.Values.Get(spreadsheetFor(ctx), quoteSheetName(INDEXSHEET)+"!A:B").
+		ValueRenderOption("UNFORMATTED_VALUE").Context(ctx).Do()
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to read the "+INDEXSHEET+" sheet", "err", err)
+		return false
+	}
+	for _, row := range resp.Values {
+		if len(row) < 2 {
+			continue
+		}
+		year, err := strconv.Atoi(fmt.Sprint(row[0]))
+		if err == nil && fmt.Sprint(row[1]) != "" {
+			yearlySpreadsheets[year] = fmt.Sprint(row[1])
+		}
+	}
+	slog.InfoContext(ctx, "Read the yearly spreadsheets", "years", len(yearlySpreadsheets))
+	return true
+}
+
+/*
+Creates the spreadsheet of a year in the configured Drive folder, shares it with the configured accounts, and adds it
+to the index sheet. Returns the new spreadsheet's ID. If it can't be added to the index the new spreadsheet is deleted
+again and an error returned, so the next start doesn't create a second spreadsheet for the same year.
+*/
+func createYearlySpreadsheet(ctx context.Context, year int) (string, error) {
+	if driveService == nil {
+		return "", fmt.Errorf("the Drive API is not initialized")
+	}
+	file := &drive.File{Name: "Weather " + strconv.Itoa(year), MimeType: SPREADSHEETMIME}
+	if config.DriveFolder != "" {
+		file.Parents = []string{config.DriveFolder}
+	}
+	created, err := driveService.Files.Create(file).Fields("id", "webViewLink").SupportsAllDrives(true).
+		Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	slog.InfoContext(ctx, "Created the spreadsheet for "+strconv.Itoa(year), "spreadsheet", created.Id,
+		"link", created.WebViewLink)
+
+	for _, email := range config.ShareWith {
+		_, err := driveService.Permissions.Create(created.Id,
+			&drive.Permission{Type: "user", Role: SHAREROLE, EmailAddress: email}).
+			SendNotificationEmail(false).SupportsAllDrives(true).Context(ctx).Do()
+		if err != nil {
+			slog.ErrorContext(ctx, "Unable to share the spreadsheet", "spreadsheet", created.Id, "email", email,
+				"err", err)
+		}
+	}
+
+	if err := appendValues(ctx, INDEXSHEET, [][]interface{}{{year, created.Id, created.WebViewLink}}, 1); err != nil {
+		deleteErr := driveService.Files.Delete(created.Id).SupportsAllDrives(true).Context(ctx).Do()
+		if deleteErr != nil {
+			slog.ErrorContext(ctx, "Unable to delete the spreadsheet missing from the "+INDEXSHEET+" sheet, delete it "+
+				"by hand", "spreadsheet", created.Id, "err", deleteErr)
+		}
+		return "", fmt.Errorf("unable to add the spreadsheet to the %s sheet: %w", INDEXSHEET, err)
+	}
+	return created.Id, nil
+}
@@ -0,0 +1,137 @@
+/*
+Package ambient is a client for the Ambient Weather API that can be used by any Go program. A Client lists the devices
+on an account, queries the history of a device, iterates over its records for any period, and subscribes to the
+realtime API, decoding every record into a DeviceData struct. By default requests are sent once with
+http.DefaultClient; programs that need retries, rate limiting, or caching set Fetch to route every request through
+their own code.
+*/
+package ambient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	URLBASE  = "https://api.ambientweather.net/v1/devices"
+	MAXLIMIT = 288 //Maximum number of records the API returns per request
+)
+
+/*
+Client is a struct that holds the keys used to call the Ambient Weather API and how requests are sent. Only the keys
+are required, every other field falls back to a default when left empty.
+*/
+type Client struct {
+	APIKey         string
+	ApplicationKey string
+	HTTPClient     *http.Client                                          //http.DefaultClient if nil
+	Dialer         *websocket.Dialer                                     //websocket.DefaultDialer if nil
+	Header         http.Header                                           //Extra headers sent with every request
+	PageInterval   time.Duration                                         //Wait between pages of History, 1s if 0
+	Fetch          func(ctx context.Context, url string) (string, error) //Replaces the single GET of every request
+}
+
+/*
+Returns a Client for the account of the given API Key using the default HTTP client.
+*/
+func NewClient(apiKey string, applicationKey string) *Client {
+	return &Client{APIKey: apiKey, ApplicationKey: applicationKey}
+}
+
+/*
+Returns the URL that lists every device on the account along with its most recent data.
+*/
+func (client *Client) DevicesURL() string {
+	return URLBASE + "?apiKey=" + client.APIKey + "&applicationKey=" + client.ApplicationKey
+}
+
+/*
+Returns the URL that queries up to limit records of a device, newest first. The records end before endDate, or at the
+device's newest record if endDate is zero.
+*/
+func (client *Client) HistoryURL(macAddress string, limit int, endDate time.Time) string {
+	url := URLBASE + "/" + macAddress + "?apiKey=" + client.APIKey + "&applicationKey=" + client.ApplicationKey +
+		"&limit=" + strconv.Itoa(limit)
+	if !endDate.IsZero() {
+		url += "&end_date=" + strconv.FormatInt(endDate.UnixMilli(), 10)
+	}
+	return url
+}
+
+/*
+Retrieves the devices on the account, including each device's name, MAC Address, location, and last reported data.
+*/
+func (client *Client) ListDevices(ctx context.Context) ([]Device, error) {
+	body, err := client.get(ctx, client.DevicesURL())
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve the device list: %w", err)
+	}
+
+	var devices []Device
+	if err := json.Unmarshal([]byte(body), &devices); err != nil {
+		return nil, fmt.Errorf("unable to parse the device list: %w", err)
+	}
+	return devices, nil
+}
+
+/*
+Retrieves up to limit records of a device reported before endDate, or its most recent records if endDate is zero. The
+API returns at most MAXLIMIT records per call, newest first.
+*/
+func (client *Client) QueryHistory(ctx context.Context, macAddress string, limit int,
+	endDate time.Time) ([]DeviceData, error) {
+	body, err := client.get(ctx, client.HistoryURL(macAddress, limit, endDate))
+	if err != nil {
+		return nil, err
+	}
+	return ParseDeviceData(body)
+}
+
+/*
+Sends a GET request for the given URL, through Fetch if it is set, and returns the body of the response. Any status
+other than 200 is returned as an error.
+*/
+func (client *Client) get(ctx context.Context, url string) (string, error) {
+	if client.Fetch != nil {
+		return client.Fetch(ctx, url)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for name, values := range client.Header {
+		req.Header[name] = values
+	}
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			return
+		}
+	}(resp.Body)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("received status " + resp.Status)
+	}
+	return string(body), nil
+}
@@ -0,0 +1,288 @@
+package ambient
+
+/*
+This file defines the DeviceData struct that a record returned by the Ambient Weather API is decoded into. Every
+sensor documented by the API has a typed field, numbered sensors (temp1f..temp10f, soilhum1..soilhum10, leak1..leak4,
+etc.) are collected into arrays, and every field of the record is also kept by name so fields the struct doesn't know
+about are never lost.
+*/
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+DeviceData is a struct that holds a single record reported by a weather station. Numeric sensors are pointers so a
+sensor the station doesn't have (nil) can be told apart from a reading of 0. For the numbered sensor arrays index 0
+holds sensor 1. Fields holds every field of the record by its API name, including any the struct doesn't know about.
+*/
+type DeviceData struct {
+	DateUTC  int64  `json:"dateutc"`
+	Date     string `json:"date"`
+	TZ       string `json:"tz"`
+	LastRain string `json:"lastRain"`
+
+	TempF       *float64 `json:"tempf"`
+	Humidity    *float64 `json:"humidity"`
+	FeelsLike   *float64 `json:"feelsLike"`
+	DewPoint    *float64 `json:"dewPoint"`
+	TempInF     *float64 `json:"tempinf"`
+	HumidityIn  *float64 `json:"humidityin"`
+	FeelsLikeIn *float64 `json:"feelsLikein"`
+	DewPointIn  *float64 `json:"dewPointin"`
+
+	WindSpeedMPH     *float64 `json:"windspeedmph"`
+	WindGustMPH      *float64 `json:"windgustmph"`
+	MaxDailyGust     *float64 `json:"maxdailygust"`
+	WindDir          *float64 `json:"winddir"`
+	WindGustDir      *float64 `json:"windgustdir"`
+	WindSpdMPHAvg2m  *float64 `json:"windspdmph_avg2m"`
+	WindDirAvg2m     *float64 `json:"winddir_avg2m"`
+	WindSpdMPHAvg10m *float64 `json:"windspdmph_avg10m"`
+	WindDirAvg10m    *float64 `json:"winddir_avg10m"`
+
+	BaromRelIn     *float64 `json:"baromrelin"`
+	BaromAbsIn     *float64 `json:"baromabsin"`
+	SolarRadiation *float64 `json:"solarradiation"`
+	UV             *float64 `json:"uv"`
+
+	HourlyRainIn  *float64 `json:"hourlyrainin"`
+	EventRainIn   *float64 `json:"eventrainin"`
+	DailyRainIn   *float64 `json:"dailyrainin"`
+	WeeklyRainIn  *float64 `json:"weeklyrainin"`
+	MonthlyRainIn *float64 `json:"monthlyrainin"`
+	YearlyRainIn  *float64 `json:"yearlyrainin"`
+	TotalRainIn   *float64 `json:"totalrainin"`
+	Rain24HourIn  *float64 `json:"24hourrainin"`
+
+	GDD  *float64 `json:"gdd"`
+	ETOS *float64 `json:"etos"`
+	ETRS *float64 `json:"etrs"`
+
+	BattOut         *float64 `json:"battout"`
+	BattIn          *float64 `json:"battin"`
+	BattCO2         *float64 `json:"batt_co2"`
+	Batt25          *float64 `json:"batt_25"`
+	BattLightning   *float64 `json:"batt_lightning"`
+	BattCellGateway *float64 `json:"batt_cellgateway"`
+
+	PM25             *float64 `json:"pm25"`
+	PM25_24h         *float64 `json:"pm25_24h"`
+	PM25In           *float64 `json:"pm25_in"`
+	PM25In24h        *float64 `json:"pm25_in_24h"`
+	PM25InAQIN       *float64 `json:"pm25_in_aqin"`
+	PM25In24hAQIN    *float64 `json:"pm25_in_24h_aqin"`
+	PM10InAQIN       *float64 `json:"pm10_in_aqin"`
+	PM10In24hAQIN    *float64 `json:"pm10_in_24h_aqin"`
+	CO2InAQIN        *float64 `json:"co2_in_aqin"`
+	CO2In24hAQIN     *float64 `json:"co2_in_24h_aqin"`
+	PMInTempAQIN     *float64 `json:"pm_in_temp_aqin"`
+	PMInHumidityAQIN *float64 `json:"pm_in_humidity_aqin"`
+	AQIPM25AQIN      *float64 `json:"aqi_pm25_aqin"`
+	AQIPM25_24hAQIN  *float64 `json:"aqi_pm25_24h_aqin"`
+	AQIPM10AQIN      *float64 `json:"aqi_pm10_aqin"`
+	AQIPM10_24hAQIN  *float64 `json:"aqi_pm10_24h_aqin"`
+	AQIPM25In        *float64 `json:"aqi_pm25_in"`
+	AQIPM25In24h     *float64 `json:"aqi_pm25_in_24h"`
+
+	LightningDay      *float64 `json:"lightning_day"`
+	LightningHour     *float64 `json:"lightning_hour"`
+	LightningTime     *int64   `json:"lightning_time"`
+	LightningDistance *float64 `json:"lightning_distance"`
+
+	TempNF      [10]*float64 `json:"-"` // temp1f..temp10f
+	HumidityN   [10]*float64 `json:"-"` // humidity1..humidity10
+	FeelsLikeN  [10]*float64 `json:"-"` // feelsLike1..feelsLike10
+	DewPointN   [10]*float64 `json:"-"` // dewPoint1..dewPoint10
+	BattN       [10]*float64 `json:"-"` // batt1..batt10
+	SoilTempNF  [10]*float64 `json:"-"` // soiltemp1f..soiltemp10f
+	SoilHumN    [10]*float64 `json:"-"` // soilhum1..soilhum10
+	SoilTensN   [4]*float64  `json:"-"` // soiltens1..soiltens4
+	BattSMN     [4]*float64  `json:"-"` // battsm1..battsm4
+	LeafWetness [8]*float64  `json:"-"` // leafwetness1..leafwetness8
+	LeakN       [4]*float64  `json:"-"` // leak1..leak4
+	BattLeakN   [4]*float64  `json:"-"` // batleak1..batleak4
+	RelayN      [10]*float64 `json:"-"` // relay1..relay10
+
+	Fields map[string]interface{} `json:"-"`
+}
+
+/*
+Device is a struct that holds a device on an Ambient Weather account as returned by the /v1/devices endpoint, with
+its descriptive info and the most recent record it reported.
+*/
+type Device struct {
+	MacAddress string     `json:"macAddress"`
+	Info       DeviceInfo `json:"info"`
+	LastData   DeviceData `json:"lastData"`
+}
+
+/*
+DeviceInfo is a struct that holds the name and location the owner gave a device on the Ambient Weather dashboard.
+*/
+type DeviceInfo struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	Coords   struct {
+		Address   string  `json:"address"`
+		Location  string  `json:"location"`
+		Elevation float64 `json:"elevation"`
+		Coords    struct {
+			Lat float64 `json:"lat"`
+			Lon float64 `json:"lon"`
+		} `json:"coords"`
+	} `json:"coords"`
+}
+
+/*
+NumberedSensor describes a series of numbered sensors by the API name of each sensor, e.g. "soiltemp" and "f" for
+soiltemp1f..soiltemp10f, and the DeviceData array the readings are stored in.
+*/
+type NumberedSensor struct {
+	Prefix string
+	Suffix string
+	Values func(data *DeviceData) []*float64
+}
+
+var (
+	Location = time.Local //Timezone the times of a record are returned in
+)
+
+/*
+Every series of numbered sensors reported by the API.
+*/
+var NumberedSensors = []NumberedSensor{
+	{"temp", "f", func(data *DeviceData) []*float64 { return data.TempNF[:] }},
+	{"humidity", "", func(data *DeviceData) []*float64 { return data.HumidityN[:] }},
+	{"feelsLike", "", func(data *DeviceData) []*float64 { return data.FeelsLikeN[:] }},
+	{"dewPoint", "", func(data *DeviceData) []*float64 { return data.DewPointN[:] }},
+	{"batt", "", func(data *DeviceData) []*float64 { return data.BattN[:] }},
+	{"soiltemp", "f", func(data *DeviceData) []*float64 { return data.SoilTempNF[:] }},
+	{"soilhum", "", func(data *DeviceData) []*float64 { return data.SoilHumN[:] }},
+	{"soiltens", "", func(data *DeviceData) []*float64 { return data.SoilTensN[:] }},
+	{"battsm", "", func(data *DeviceData) []*float64 { return data.BattSMN[:] }},
+	{"leafwetness", "", func(data *DeviceData) []*float64 { return data.LeafWetness[:] }},
+	{"leak", "", func(data *DeviceData) []*float64 { return data.LeakN[:] }},
+	{"batleak", "", func(data *DeviceData) []*float64 { return data.BattLeakN[:] }},
+	{"relay", "", func(data *DeviceData) []*float64 { return data.RelayN[:] }},
+}
+
+/*
+Every sensor name documented by the Ambient Weather API, built from the json tags of DeviceData and the numbered
+sensor series.
+*/
+var DocumentedSensors = documentedSensorNames()
+
+/*
+Parses the body of an Ambient Weather API device query, a JSON array of records, into DeviceData structs.
+*/
+func ParseDeviceData(body string) ([]DeviceData, error) {
+	var records []DeviceData
+	if err := json.Unmarshal([]byte(body), &records); err != nil {
+		return nil, fmt.Errorf("unable to parse API response: %w", err)
+	}
+	return records, nil
+}
+
+/*
+Decodes a single record into the typed fields of DeviceData, then fills the numbered sensor arrays and the Fields map
+from the same record. Numbers in Fields are kept as json.Number so no precision is lost before they are written.
+*/
+func (data *DeviceData) UnmarshalJSON(body []byte) error {
+	type plainDeviceData DeviceData
+	if err := json.Unmarshal(body, (*plainDeviceData)(data)); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data.Fields); err != nil {
+		return err
+	}
+
+	for _, series := range NumberedSensors {
+		values := series.Values(data)
+		for i := range values {
+			if value, ok := ToFloat(data.Fields[series.Name(i+1)]); ok {
+				values[i] = &value
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Returns the time the record was observed, from the dateutc field in milliseconds since 01-01-1970, in Location.
+*/
+func (data DeviceData) Time() time.Time {
+	return time.UnixMilli(data.DateUTC).In(Location)
+}
+
+/*
+Returns the time of the last lightning strike the detector heard, in Location. lightning_time is
+reported in milliseconds since 01-01-1970 like dateutc, though older firmware reports seconds. Reports false if the
+record has no strike time.
+*/
+func (data DeviceData) LightningStrike() (time.Time, bool) {
+	if data.LightningTime == nil || *data.LightningTime <= 0 {
+		return time.Time{}, false
+	}
+	if *data.LightningTime < 100000000000 { //Before 1973 in milliseconds, so the value is in seconds
+		return time.Unix(*data.LightningTime, 0).In(Location), true
+	}
+	return time.UnixMilli(*data.LightningTime).In(Location), true
+}
+
+/*
+Returns the API name of sensor number n in the series, e.g. soiltemp3f.
+*/
+func (series NumberedSensor) Name(n int) string {
+	return series.Prefix + strconv.Itoa(n) + series.Suffix
+}
+
+/*
+Converts a value from the Fields map to a float64, reporting false for values that are missing or not numeric.
+*/
+func ToFloat(value interface{}) (float64, bool) {
+	switch typed := value.(type) {
+	case json.Number:
+		number, err := typed.Float64()
+		return number, err == nil
+	case float64:
+		return typed, true
+	case string:
+		number, err := strconv.ParseFloat(typed, 64)
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
+
+/*
+Builds the set of documented sensor names from the json tags of DeviceData and every name in the numbered sensor
+series.
+*/
+func documentedSensorNames() map[string]bool {
+	names := make(map[string]bool)
+
+	dataType := reflect.TypeOf(DeviceData{})
+	for i := 0; i < dataType.NumField(); i++ {
+		tag := strings.Split(dataType.Field(i).Tag.Get("json"), ",")[0]
+		if tag != "" && tag != "-" {
+			names[tag] = true
+		}
+	}
+
+	var data DeviceData
+	for _, series := range NumberedSensors {
+		for i := range series.Values(&data) {
+			names[series.Name(i+1)] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,86 @@
+package ambient
+
+/*
+This file implements the History iterator, which retrieves every record a device reported over a period of time. The
+API returns at most 288 records per call, so pages are requested backwards from the end of the period, each page
+ending at the oldest record of the previous one, with a pause between pages to stay within the API's limit of one
+request per second per key.
+*/
+import (
+	"context"
+	"fmt"
+	"iter"
+	"time"
+)
+
+const (
+	PAGEINTERVAL = time.Second //Default wait between the pages of History
+)
+
+/*
+Returns an iterator over every record the device reported from the start time up to (but not including) the end
+time, newest first. Pages are only requested as the loop consumes them, so stopping the loop early stops the requests.
+If a page can't be retrieved the error is yielded once and the iteration ends, after the records retrieved so far.
+*/
+func (client *Client) History(ctx context.Context, macAddress string, from time.Time,
+	to time.Time) iter.Seq2[DeviceData, error] {
+	return func(yield func(DeviceData, error) bool) {
+		seen := make(map[int64]bool)
+		var requested time.Time
+
+		for endDate := to; endDate.After(from); {
+			if !requested.IsZero() {
+				if err := client.throttle(ctx, requested); err != nil {
+					yield(DeviceData{}, err)
+					return
+				}
+			}
+			requested = time.Now()
+
+			page, err := client.QueryHistory(ctx, macAddress, MAXLIMIT, endDate)
+			if err != nil {
+				yield(DeviceData{}, fmt.Errorf("unable to retrieve records before %s: %w", endDate, err))
+				return
+			}
+
+			oldest := endDate
+			for _, data := range page {
+				observed := time.UnixMilli(data.DateUTC)
+				if observed.Before(oldest) {
+					oldest = observed
+				}
+				if observed.Before(from) || !observed.Before(to) || seen[data.DateUTC] {
+					continue
+				}
+				seen[data.DateUTC] = true
+				if !yield(data, nil) {
+					return
+				}
+			}
+
+			if !oldest.Before(endDate) {
+				return //The API returned nothing older, the start of the device's history was reached
+			}
+			endDate = oldest
+		}
+	}
+}
+
+/*
+Waits until the page interval has passed since the previous page was requested, returning the context's error if it
+is cancelled first.
+*/
+func (client *Client) throttle(ctx context.Context, previous time.Time) error {
+	interval := client.PageInterval
+	if interval <= 0 {
+		interval = PAGEINTERVAL
+	}
+	timer := time.NewTimer(time.Until(previous.Add(interval)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,146 @@
+package ambient
+
+/*
+This file implements the subscription to the Ambient Weather realtime API. The realtime API is a socket.io server, so
+a minimal socket.io client is implemented here on top of a WebSocket: the Engine.IO handshake, ping/pong keep-alives,
+and the subscribe, subscribed, and data events. Every data event is decoded into a DeviceData struct and passed to
+the caller.
+*/
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	REALTIMEURL = "wss://rt2.ambientweather.net/socket.io/?api=1&EIO=4&transport=websocket&applicationKey="
+)
+
+/*
+realtimeOpen is the Engine.IO open packet sent by the server once the WebSocket is connected, holding the interval the
+server pings at and how long it waits for a pong.
+*/
+type realtimeOpen struct {
+	PingInterval int `json:"pingInterval"`
+	PingTimeout  int `json:"pingTimeout"`
+}
+
+/*
+Subscribes to the realtime API for every device on the account and calls handle with each record pushed, which holds
+the reporting device's MAC Address in its macAddress field. handle is called from the connection's goroutine, so it
+should return quickly or the connection misses its pings. Returns the reason the connection ended once it fails or
+the context is cancelled; reconnecting is left to the caller.
+*/
+func (client *Client) Subscribe(ctx context.Context, handle func(data DeviceData)) error {
+	dialer := client.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, _, err := dialer.DialContext(ctx, REALTIMEURL+client.ApplicationKey, client.Header)
+	if err != nil {
+		return err
+	}
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() { //Closing the connection unblocks ReadMessage when the context is cancelled
+		select {
+		case <-ctx.Done():
+		case <-closed:
+		}
+		err := conn.Close()
+		if err != nil {
+			return
+		}
+	}()
+
+	timeout := 90 * time.Second
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		packet := string(message)
+		switch {
+		case strings.HasPrefix(packet, "0"): //Engine.IO open, connect to the default namespace
+			var open realtimeOpen
+			if err := json.Unmarshal(message[1:], &open); err == nil && open.PingInterval > 0 {
+				timeout = time.Duration(open.PingInterval+open.PingTimeout) * time.Millisecond
+			}
+			err = conn.WriteMessage(websocket.TextMessage, []byte("40"))
+		case packet == "1":
+			return errors.New("server closed the connection")
+		case packet == "2": //Engine.IO ping
+			err = conn.WriteMessage(websocket.TextMessage, []byte("3"))
+		case strings.HasPrefix(packet, "40"): //Connected to the namespace, subscribe to the API Key's devices
+			err = emitRealtime(conn, "subscribe", map[string][]string{"apiKeys": {client.APIKey}})
+		case strings.HasPrefix(packet, "41"):
+			return errors.New("server disconnected the socket")
+		case strings.HasPrefix(packet, "44"):
+			return errors.New("server refused the connection: " + packet[2:])
+		case strings.HasPrefix(packet, "42"):
+			handleRealtimeEvent(message[2:], handle)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Sends a socket.io event with the given name and JSON encoded payload.
+*/
+func emitRealtime(conn *websocket.Conn, event string, payload interface{}) error {
+	encoded, err := json.Marshal([]interface{}{event, payload})
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, append([]byte("42"), encoded...))
+}
+
+/*
+Handles a socket.io event. A subscribed event logs the devices the API Key gives access to, and a data event is decoded
+into a DeviceData record and passed to handle.
+*/
+func handleRealtimeEvent(message []byte, handle func(data DeviceData)) {
+	var event []json.RawMessage
+	if err := json.Unmarshal(message, &event); err != nil || len(event) < 2 {
+		slog.Warn("Unable to parse realtime event", "event", string(message))
+		return
+	}
+
+	var name string
+	if err := json.Unmarshal(event[0], &name); err != nil {
+		slog.Warn("Unable to parse realtime event name", "event", string(message))
+		return
+	}
+
+	switch name {
+	case "subscribed":
+		var subscribed struct {
+			Devices []struct {
+				MacAddress string `json:"macAddress"`
+			} `json:"devices"`
+		}
+		if err := json.Unmarshal(event[1], &subscribed); err == nil {
+			slog.Info("Subscribed to realtime updates", "devices", len(subscribed.Devices))
+		}
+	case "data":
+		var data DeviceData
+		if err := json.Unmarshal(event[1], &data); err != nil {
+			slog.Warn("Unable to parse realtime data", "err", err)
+			return
+		}
+		handle(data)
+	}
+}
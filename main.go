@@ -7,57 +7,472 @@ API is then written to a Google Sheet through the Sheets.go program. The main pr
 AmbientWeather API every 5 minutes.
 */
 import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/ryanwlin/GoAmbient/ambient"
 	"log/slog"
+	"math/rand/v2"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+const (
+	POLLINTERVAL = 5 * time.Minute //The interval the stations report at and are called at
+)
+
+var (
+	pollMutex         sync.Mutex //Held while fetched readings are processed and written
+	lastObservedMutex sync.Mutex
+	lastObserved      = make(map[string]int64) //dateutc of the newest reading written for each station MAC Address
+)
+
 /*
 Main function that initializes all necessary functions like the Google Sheets Service and the Ambient Weather API
 by providing secrets like the API Key, APP Key, and MAC Address to build the HTTP to retrieve data from API calls.
+The first argument may name a subcommand:
+  - run (default): start the program and poll the Ambient Weather API on a schedule, or with -simulate write synthetic
+    data without a station or API keys.
+  - validate: check the config, headers mapping, and credentials, then exit.
+  - backfill: write the history between -from and -to into the sheets, then exit.
+  - devices: list the weather stations on the account of the API Key, then exit.
+  - replay: write the responses recorded in recordDir between -from and -to into the sheets, then exit.
+  - setup: authorize Google Sheets access with the OAuth client secret in credentials.json, then exit.
 */
 func main() {
-	slog.Info("Start program at", "time", time.Now())
+	initLogging() //Redacts API keys and tokens from all log output
 
-	slog.Info("Initializing Sheets")
-	initializeSheet(1) //Initialize the Google Sheet Service
-	readSensors(1)     //Reads all sensor descriptions from headers.txt and stores them in a map
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	flag.StringVar(&configFile, "config", configFile, "path to the JSON config file")
+	flag.StringVar(&profile, "profile", os.Getenv("GOAMBIENT_PROFILE"), "named profile from the config file to run")
+	flag.StringVar(&backfillFrom, "from", "", "first day to backfill or replay, as YYYY-MM-DD")
+	flag.StringVar(&backfillTo, "to", "", "last day to backfill or replay, as YYYY-MM-DD (default today)")
+	flag.BoolVar(&simulate, "simulate", false, "write synthetic weather data instead of calling the Ambient API")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		os.Exit(2)
+	}
 
-	//Retries secrets from secrets.txt file, will restive from K8s after setup
-	secretFile, err := os.ReadFile("secrets.txt")
-	if err != nil {
-		slog.Warn("Unable to read headers.txt: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop() //A second signal stops the program at once
+		slog.Info("Received a termination signal, shutting down. Signal again to stop at once")
+	}()
+
+	switch command {
+	case "run":
+		run(ctx)
+	case "validate":
+		os.Exit(runValidate(configFile, profile))
+	case "backfill":
+		os.Exit(runBackfill(ctx, backfillFrom, backfillTo))
+	case "devices":
+		os.Exit(runDevices(ctx))
+	case "replay":
+		os.Exit(runReplay(ctx, backfillFrom, backfillTo))
+	case "setup":
+		os.Exit(runSetup())
+	default:
+		slog.Error("Unknown command " + command + ", expected run, validate, backfill, devices, replay, or setup")
+		os.Exit(2)
+	}
+}
+
+/*
+Starts the program: initializes the config, Sheets, and sensor mapping, fills any gap left since the program last ran,
+and begins the scheduled API calls, or the realtime subscription if it is enabled in the config.
+*/
+func run(ctx context.Context) {
+	slog.Info("Start program at", "time", time.Now(), "version", version)
+
+	if !initialize(ctx) {
+		os.Exit(1)
+	}
+	startServers(ctx)
+	startCompaction(ctx)
+	defer shutdown(ctx) //Writes the readings still queued or buffered when the program stops
+	if simulate {
+		slog.Warn("Simulation mode, writing synthetic weather data instead of calling the Ambient Weather API")
+	} else {
+		healGaps(ctx, config.Stations)
+		healSinks(ctx, config.Stations)
+		forEachSpreadsheet(ctx, applyRetention)
 	}
-	secret := strings.Split(string(secretFile), ",")
 
-	createURL(secret[0], secret[1], secret[2]) //Creates URL to call Ambient Weather API, with all the provided secrets
+	markStarted()
+	if config.Realtime && !simulate {
+		subscribeRealtime(ctx)
+		return
+	}
 
 	slog.Info("Starting scheduled API calls")
-	scheduleAPI()
+	scheduleAPI(ctx)
 
 }
 
 /*
-Function that schedules calls to retrieve data from the Ambient Weather API every 5 minutes. Once data is retrieved
-a function in Sheets.go is called to write the data to a Google Sheet.
+Loads the config for the selected profile, discovers the station if the config only holds the keys, initializes the
+Google Sheet Service, and reads the sensor mapping. Returns false if the config could not be loaded or no station
+could be chosen.
 */
-func scheduleAPI() {
-	currentTime := time.Now()
+func initialize(ctx context.Context) bool {
+	loaded, err := loadConfig(configFile, profile) //Reads keys and file locations from config.json or secrets.txt
+	if err != nil && !simulate {
+		slog.Error("Unable to load configuration", "err", err)
+		return false
+	} else if err != nil {
+		slog.Warn("Unable to load configuration, simulating with the defaults", "err", err)
+	}
+	applyConfig(loaded)
+	loadState()
 
-	nextRun := currentTime.Truncate(time.Minute).Add(5 * time.Minute)
-	nextRun = nextRun.Truncate(5 * time.Minute)
-	waitDuration := time.Until(nextRun)
-	slog.Info("Next API call scheduled at:", "time", nextRun)
+	if len(config.Stations) == 0 && simulate {
+		config.Stations = []Station{simulatedStation}
+	}
+	if len(config.Stations) == 0 {
+		station, err := discoverStation(ctx)
+		if err != nil {
+			slog.Error("No station configured and none could be discovered", "err", err)
+			return false
+		}
+		config.Stations = []Station{station}
+	}
+	loadBuffers()
 
-	time.Sleep(waitDuration)
+	if spreadsheetId != "" {
+		slog.Info("Initializing Sheets")
+		initializeSheet(1) //Initialize the Google Sheet Service
+	}
+	readSensors(1) //Reads all sensor descriptions from headers.txt and stores them in a map
+	return true
+}
 
-	slog.Info("API Function called at: ", "time", time.Now())
-	data := executeRequest(0)
-	if data == "" {
-		slog.Error("API request resulted in empty values")
+/*
+Function that schedules calls to retrieve data from the Ambient Weather API until the context is cancelled. Stations
+with a schedule of their own are called on it by a goroutine for each schedule, and the rest on the configured
+schedule, by default every 5 minutes on the 5 minute marks of the clock. The goroutines share the rate limiter of the
+API, so stations whose calls fall on the same second are spaced out rather than bursting past the limit.
+*/
+func scheduleAPI(ctx context.Context) {
+	var specs []string
+	groups := make(map[string][]Station) //Stations polled on each schedule
+	for _, station := range config.Stations {
+		spec := station.Schedule
+		if spec == "" {
+			spec = config.Schedule
+		}
+		if _, exists := groups[spec]; !exists {
+			specs = append(specs, spec)
+		}
+		groups[spec] = append(groups[spec], station)
+	}
+
+	firstStations := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		firstStations = append(firstStations, groups[spec][0].MacAddress)
 	}
+	registerCycles(firstStations)
+
+	var running sync.WaitGroup
+	for _, spec := range specs {
+		schedule, err := parseCron(spec)
+		if err != nil {
+			slog.Error("Invalid station schedule, polling on the configured schedule instead", "schedule", spec,
+				"err", err)
+			schedule = pollSchedule
+		}
+		if len(specs) > 1 {
+			slog.Info("Scheduling stations", "schedule", spec, "stations", len(groups[spec]))
+		}
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			scheduleStations(ctx, schedule, groups[spec])
+		}()
+	}
+	running.Wait()
+	slog.Info("Scheduled API calls stopped")
+}
 
-	writeData(data)
-	scheduleAPI() //Recalls function to schedule and run API calls
+/*
+Calls the given stations on a schedule until the context is cancelled. The next call is scheduled once a call ends,
+so a call that runs past the next scheduled minute skips it rather than calling twice in a row. When the host wakes
+from suspend or its clock jumps, the gap since the stations' last stored readings is filled and the stations are
+called at once, before the next call is scheduled from the new time.
+*/
+func scheduleStations(ctx context.Context, schedule cronSchedule, stations []Station) {
+	watch := newClockWatch()
+	check := time.NewTicker(CLOCKCHECK)
+	defer check.Stop()
+	for {
+		markScheduler()
+		nextRun, scheduled := schedule.next(time.Now())
+		if !scheduled {
+			slog.Error("The schedule never matches, no API calls are scheduled", "stations", len(stations))
+			return
+		}
+		slog.Info("Next API call scheduled at:", "time", nextRun)
+		markScheduled(schedule, nextRun)
+		timer := time.NewTimer(time.Until(nextRun))
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				slog.Info("API Function called at: ", "time", time.Now())
+				break wait
+			case <-check.C:
+				markScheduler()
+				if drift, jumped := watch.jumped(); jumped {
+					timer.Stop()
+					slog.Warn("The host slept or its clock jumped, catching up now", "drift", drift.Round(time.Second))
+					pollMutex.Lock()
+					healGaps(ctx, stations)
+					pollMutex.Unlock()
+					break wait
+				}
+			}
+		}
+		markCalled(schedule)
+		pollStations(ctx, stations)
+	}
+}
+
+/*
+Polls the given stations once. Each station is called in turn for every reading since the last one written, or in
+lastData mode the device list is called once for every station's most recent reading, and once the data is retrieved
+a function in Sheets.go is called to write each new reading as its own row in a Google Sheet. The readings are
+processed and written under pollMutex, so stations polled on other schedules at the same time take turns. With
+summary enabled, whenever any of these stations wrote a new reading, the newest readings of these stations, and of any
+polled on other schedules, are then aggregated into a row on the Summary sheet. The heartbeat URL is pinged if every
+station was fetched and persisted, and the last cycle of every other schedule succeeded too. With jitterSeconds set,
+each call waits its random delay from jitterDelays first.
+*/
+func pollStations(ctx context.Context, stations []Station) {
+	started := time.Now()
+	var snapshot map[string]DeviceData
+	delays := jitterDelays(len(stations))
+	if config.QueryMode == QUERYLASTDATA && !simulate {
+		if !sleepContext(ctx, delays[0]) {
+			return
+		}
+		snapshot = lastDataSnapshot(ctx) //One call covers every station
+		delays = make([]time.Duration, len(stations))
+	}
+	var latest []DeviceData //Newest reading of each station, for the summary
+	succeeded := true       //Whether every station was fetched and persisted, for the heartbeat
+	polled := make(map[string]bool)
+	for _, station := range stations {
+		polled[station.MacAddress] = true
+	}
+	for i, station := range stations {
+		if !sleepContext(ctx, time.Until(started.Add(delays[i]))) {
+			return
+		}
+		ctx := withCorrelationID(ctx) //Tags every log of this station's cycle
+		readings, err := fetchReadings(ctx, station, snapshot)
+		if err != nil {
+			if !ambientBreaker.isOpen() {
+				slog.ErrorContext(ctx, "Unable to retrieve readings", "station", station.displayName(), "err", err)
+			}
+			markScheduler()
+			succeeded = false
+			continue
+		}
+		markPolled()
+		markScheduler()
+		newest, written, persisted := processReadings(ctx, station, readings)
+		if written {
+			latest = append(latest, newest)
+		}
+		succeeded = succeeded && persisted
+	}
+	if config.Summary && len(latest) > 0 {
+		latestMutex.Lock()
+		for _, station := range config.Stations {
+			if held, exists := latestReadings[station.MacAddress]; exists && !polled[station.MacAddress] {
+				latest = append(latest, held.data) //Stations polled on their own schedules
+			}
+		}
+		latestMutex.Unlock()
+		pollMutex.Lock()
+		writeSummary(withCorrelationID(ctx), latest)
+		pollMutex.Unlock()
+	}
+	saveState()
+	recordCycle(ctx, stations[0].MacAddress, succeeded)
+}
+
+/*
+Validates and writes the readings fetched for a station, skipping those already written. Returns the newest reading
+written, reporting false if none was, and whether the write succeeded, which it does when nothing was new.
+*/
+func processReadings(ctx context.Context, station Station, readings []DeviceData) (DeviceData, bool, bool) {
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	readings = validReadings(ctx, station, readings)
+	if len(readings) == 0 {
+		return DeviceData{}, false, true
+	}
+	readings = newReadings(ctx, station, readings)
+	trackStaleness(ctx, station, len(readings) > 0)
+	trackBatteries(ctx, station, readings)
+	trackLeaks(ctx, station, readings)
+	if len(readings) == 0 {
+		return DeviceData{}, false, true
+	}
+	if !writeRows(ctx, station, readings) {
+		slog.ErrorContext(ctx, "Readings were not persisted, retrying them on the next poll",
+			"station", station.displayName())
+		return DeviceData{}, false, false
+	}
+	markPersisted(station, readings)
+	trackDailySummary(ctx, station, readings)
+	return readings[len(readings)-1], true, true
+}
+
+/*
+Returns a random delay of up to the configured jitter for each of the given number of calls, sorted so the calls keep
+their order, to spread the calls of many deployments and stations over the jitter instead of all hitting the API on
+the same second. Without jitter every delay is 0. At least one delay is returned.
+*/
+func jitterDelays(calls int) []time.Duration {
+	delays := make([]time.Duration, max(calls, 1))
+	if config.Jitter <= 0 {
+		return delays
+	}
+	for i := range delays {
+		delays[i] = rand.N(time.Duration(config.Jitter) * time.Second)
+	}
+	slices.Sort(delays)
+	return delays
+}
+
+/*
+Retrieves the latest readings for a station. In the default history query mode the station's device endpoint is
+called for every reading since the last one written, paging back through the history when more readings were missed
+than one call returns, in lastData mode the station's most recent reading is taken from the snapshot of the device
+list, and in simulation mode the readings are generated.
+*/
+func fetchReadings(ctx context.Context, station Station, snapshot map[string]DeviceData) ([]DeviceData, error) {
+	var readings []DeviceData
+	var err error
+	switch {
+	case simulate:
+		readings, err = ambient.ParseDeviceData(simulatedResponse(station, min(pollLimit(station), ambient.MAXLIMIT)))
+	case config.QueryMode == QUERYLASTDATA:
+		data, exists := snapshot[strings.ToLower(station.MacAddress)]
+		if !exists {
+			return nil, errors.New("station is missing from the device list")
+		}
+		return []DeviceData{data}, nil
+	case pollLimit(station) > ambient.MAXLIMIT:
+		lastObservedMutex.Lock()
+		since := time.UnixMilli(lastObserved[station.MacAddress] + 1)
+		lastObservedMutex.Unlock()
+		slog.WarnContext(ctx, "More readings missed than one call returns, paging through the history",
+			"station", station.displayName(), "since", since)
+		readings, err = fetchHistory(ctx, station, since, time.Now())
+		if err != nil && len(readings) > 0 {
+			slog.WarnContext(ctx, "History incomplete, writing the readings retrieved so far",
+				"station", station.displayName(), "err", err)
+			err = nil
+		}
+	default:
+		client := ambientClientFor(activeAPIKey())
+		readings, err = client.QueryHistory(ctx, station.MacAddress, pollLimit(station), time.Time{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(readings) == 0 {
+		return nil, errors.New("API response contained no readings")
+	}
+	return readings, nil
+}
+
+/*
+Returns the number of records to request for a station so the request covers everything since the last reading
+written. The station reports every 5 minutes, so this is the number of 5 minute intervals since that reading, at least
+the configured readings per poll. It may exceed the API's limit of 288 a call returns, fetchReadings then pages
+through the history instead. Before anything has been written the configured readings per poll is requested.
+*/
+func pollLimit(station Station) int {
+	lastObservedMutex.Lock()
+	last := lastObserved[station.MacAddress]
+	lastObservedMutex.Unlock()
+
+	if last == 0 {
+		return config.ReadingsPerPoll
+	}
+	missed := int(time.Since(time.UnixMilli(last))/POLLINTERVAL) + 1
+	return max(config.ReadingsPerPoll, missed)
+}
+
+/*
+Returns the readings that are newer than the last reading written for the station, sorted oldest first. Consecutive
+calls that fetch several readings overlap, and a station that hasn't reported since the previous call returns the
+same dateutc again, so this keeps a reading from being written twice. The readings are only recorded as written by
+markPersisted once their rows are verified, so readings whose write failed are returned again.
+*/
+func newReadings(ctx context.Context, station Station, readings []DeviceData) []DeviceData {
+	lastObservedMutex.Lock()
+	defer lastObservedMutex.Unlock()
+
+	last := lastObserved[station.MacAddress]
+	var fresh []DeviceData
+	for _, data := range sortByTime(readings) {
+		if data.DateUTC > last {
+			fresh = append(fresh, data)
+		}
+	}
+
+	if len(fresh) == 0 {
+		slog.InfoContext(ctx, "Station has not reported since the last stored reading, skipping write",
+			"station", station.displayName(), "lastReported", time.UnixMilli(last))
+		return nil
+	}
+	return fresh
+}
+
+/*
+Records the newest of the given readings, which must be sorted oldest first, as the last reading written for the
+station once their rows have been persisted, in memory and in the state file.
+*/
+func markPersisted(station Station, readings []DeviceData) {
+	if len(readings) == 0 {
+		return
+	}
+	lastObservedMutex.Lock()
+	lastObserved[station.MacAddress] = max(lastObserved[station.MacAddress], readings[len(readings)-1].DateUTC)
+	lastObservedMutex.Unlock()
+	recordStation(station.MacAddress, readings[len(readings)-1].DateUTC)
+}
+
+/*
+Waits for the given duration, returning early with false if the context is cancelled first, e.g. on SIGTERM.
+*/
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
 }
@@ -0,0 +1,30 @@
+// Follows the live feed and updates the current values on the page as readings arrive, reconnecting when the
+// connection drops. Today's lows and highs and the trend lines are refreshed when the page is reloaded.
+(function () {
+	function connect() {
+		const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+		const socket = new WebSocket(scheme + "//" + location.host + "/ws" + location.search);
+		socket.onmessage = function (event) {
+			const reading = JSON.parse(event.data);
+			const station = document.querySelector('[data-station="' + CSS.escape(reading.station) + '"]');
+			if (!station) {
+				return;
+			}
+			station.querySelector(".time").textContent = new Date(reading.dateutc).toLocaleString();
+			for (const [field, value] of Object.entries(reading.fields)) {
+				const row = station.querySelector('[data-field="' + CSS.escape(field) + '"]');
+				if (!row || typeof value !== "number") {
+					continue;
+				}
+				const cell = row.querySelector(".current");
+				cell.querySelector(".value").textContent = String(Math.round(value * 100) / 100);
+				cell.classList.add("updated");
+				setTimeout(function () { cell.classList.remove("updated"); }, 2000);
+			}
+		};
+		socket.onclose = function () {
+			setTimeout(connect, 5000);
+		};
+	}
+	connect();
+})();